@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"s7_plc_read/utils"
+)
+
+// command is one subcommand of the CLI. setup registers the command's own
+// flags on fs and returns the function that runs it with the positional
+// arguments left after flag parsing.
+type command struct {
+	name           string
+	args           string
+	summary        string
+	requiresConfig bool // Fail when the config file is missing or invalid
+	// reportsConfigErrors commands run with an invalid config and report the
+	// problems in configProblems themselves.
+	reportsConfigErrors bool
+	ignoresConfig       bool // Runs without reading the config file at all
+	setup               func(fs *flag.FlagSet) func(args []string) error
+}
+
+var commands = []command{
+	{name: "run", summary: "poll the PLC and write to the configured outputs (default)", requiresConfig: true, setup: setupRun},
+	{name: "read", args: "<address>...", summary: "read addresses such as DB1.DBD3:DINT from the PLC", setup: setupRead},
+	{name: "write", args: "<address|tag> <value>", summary: "write one value, e.g. DB1.DBB0 42, to the PLC", setup: setupWrite},
+	{name: "info", summary: "print CPU type, firmware, run state, protection and clock drift", setup: setupInfo},
+	{name: "blocks", summary: "list OB/FB/FC/DB blocks with DB sizes and check tags against them", setup: setupBlocks},
+	{name: "import", args: "<file>...", summary: "convert TIA Portal tag tables, DB sources and STEP 7 symbol tables to config tags", setup: setupImport},
+	{name: "validate-config", summary: "check the config file, list every problem and exit", requiresConfig: true, reportsConfigErrors: true, setup: setupValidateConfig},
+	{name: "secrets", args: "list | set <name> | delete <name>", summary: "manage the encrypted keystore, set reads the value from stdin", reportsConfigErrors: true, setup: setupSecrets},
+	{name: "hash-password", summary: "print the bcrypt hash of the password on stdin for WebUsers", ignoresConfig: true, setup: setupHashPassword},
+	{name: "new-api-key", args: "<name>", summary: "create a random API key and print its WebAPIKeys entry", ignoresConfig: true, setup: setupNewAPIKey},
+	{name: "healthcheck", summary: "ask the running collector whether it is ready, for Docker HEALTHCHECK", reportsConfigErrors: true, setup: setupHealthcheck},
+	{name: "simulate", summary: "run the collector against a simulated PLC", requiresConfig: true, setup: setupSimulate},
+}
+
+// errUsage is returned by commands called with the wrong arguments.
+var errUsage = errors.New("invalid arguments")
+
+// errShutdownIncomplete is returned when the collector stopped without
+// finishing requests, flushing outputs or closing connections in time.
+var errShutdownIncomplete = errors.New("shutdown incomplete")
+
+// Exit codes besides 0 for success, 1 for errors and 2 for usage errors.
+const exitShutdownIncomplete = 3
+
+// Global flags, shared by all commands.
+var (
+	configFile string
+	logLevel   string
+	overrides  utils.ConfigOverrides
+
+	configProblems utils.ConfigErrors // Set by loadConfig
+)
+
+func registerGlobalFlags(fs *flag.FlagSet) {
+	fs.StringVar(&configFile, "config", utils.DefaultConfigPath(), "path of the config file (env CONFIG_FILE)")
+	fs.StringVar(&logLevel, "log-level", "", "log level: debug, info, warn or error (overrides LogLevel)")
+	overrides = utils.RegisterConfigFlags(fs)
+}
+
+// runCLI runs the command named in args and returns the process exit code.
+// Without a command name the collector is started, as before the CLI existed.
+func runCLI(args []string) int {
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		printUsage()
+		return 0
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == name {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage()
+		return 2
+	}
+
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: s7_plc_read %s [flags] %s\n\n%s\n\nFlags:\n", cmd.name, cmd.args, cmd.summary)
+		fs.PrintDefaults()
+	}
+	registerGlobalFlags(fs)
+	run := cmd.setup(fs)
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if !cmd.ignoresConfig {
+		if configProblems, err = loadConfig(cmd.requiresConfig); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if len(configProblems) > 0 && !cmd.reportsConfigErrors {
+		fmt.Fprintf(os.Stderr, "%s is invalid:\n", configFile)
+		for _, problem := range configProblems {
+			fmt.Fprintf(os.Stderr, "  %v\n", problem)
+		}
+		return 1
+	}
+
+	if err := run(positional); err != nil {
+		if errors.Is(err, errUsage) {
+			fs.Usage()
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.name, err)
+		if errors.Is(err, errShutdownIncomplete) {
+			return exitShutdownIncomplete
+		}
+		return 1
+	}
+	return 0
+}
+
+// parseArgs parses flags that may appear before, between or after the
+// positional arguments. Everything after "--" is positional, which allows
+// negative values such as "write DB1.DBW0 -- -5".
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var tail []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, tail = args[:i], args[i+1:]
+			break
+		}
+	}
+
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	return append(positional, tail...), nil
+}
+
+// loadConfig reads the config file into the current config and applies the
+// command line overrides. When the file is optional and missing, the
+// defaults are used so one-shot commands work with flags alone. Problems
+// with the content of the config are returned separately from errors that
+// prevent reading it; the values are only validated when the config is
+// required.
+func loadConfig(required bool) (utils.ConfigErrors, error) {
+	cfg, problems, err := buildConfig(required)
+	var parseErrs utils.ConfigParseErrors
+	if errors.As(err, &parseErrs) {
+		return parseErrs.ConfigErrors, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.SetLogLevel(cfg.LogLevel); err != nil && !required {
+		return nil, err
+	}
+	utils.SetCurrentConfig(cfg)
+	return problems, nil
+}
+
+// buildConfig reads the config file, applies the command line overrides and
+// then fills in the defaults, like loadConfig but without making the result
+// the current config. The collector uses it to reload the config. A file
+// that cannot be decoded is reported as utils.ConfigParseErrors.
+func buildConfig(required bool) (utils.Config, utils.ConfigErrors, error) {
+	cfg := utils.DefaultConfig()
+	var problems utils.ConfigErrors
+	if required || utils.FileExists(configFile) {
+		var err error
+		var parseErrs utils.ConfigParseErrors
+		cfg, err = utils.ReadConfig(configFile)
+		switch {
+		case errors.As(err, &parseErrs):
+			return cfg, nil, parseErrs
+		case err != nil && !errors.As(err, &problems):
+			return cfg, nil, fmt.Errorf("%s: %w", configFile, err)
+		}
+	}
+
+	if err := overrides.Apply(&cfg); err != nil {
+		return cfg, nil, err
+	}
+	if logLevel != "" {
+		cfg.LogLevel = logLevel
+	}
+	cfg.ApplyDefaults()
+	problems = append(problems, cfg.ResolveSecrets()...)
+	if required {
+		problems = append(problems, cfg.Validate()...)
+	}
+	return cfg, problems, nil
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: s7_plc_read <command> [flags] [arguments]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nGlobal flags:\n")
+	fs := flag.NewFlagSet("global", flag.ContinueOnError)
+	registerGlobalFlags(fs)
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nRun \"s7_plc_read <command> -h\" for the flags of a command.\n")
+}
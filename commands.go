@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"s7_plc_read/utils"
+)
+
+func setupRun(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		return runCollector(nil)
+	}
+}
+
+func setupSimulate(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		sim := utils.NewSimulatedPLC()
+		stop := make(chan struct{})
+		defer close(stop)
+		go sim.Run(100*time.Millisecond, stop)
+		return runCollector(sim)
+	}
+}
+
+func setupInfo(fs *flag.FlagSet) func(args []string) error {
+	registerPLCFlags(fs)
+	format := fs.String("format", "human", "output format: human or json")
+	return func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		client, closeFn, err := connectOnce()
+		if err != nil {
+			return err
+		}
+		defer closeFn()
+
+		info := utils.ReadPLCInfo(client)
+		cfg := utils.CurrentConfig()
+		info.Name, info.Address = cfg.PlcName, cfg.PlcIP
+		switch *format {
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(info)
+		case "human", "text":
+		default:
+			return fmt.Errorf("unknown format %q (use human or json)", *format)
+		}
+
+		fmt.Printf("PLC:             %s (%s)\n", info.Name, info.Address)
+		fmt.Printf("Module type:     %s\n", info.ModuleType)
+		fmt.Printf("Module name:     %s\n", info.ModuleName)
+		fmt.Printf("AS name:         %s\n", info.ASName)
+		fmt.Printf("Serial number:   %s\n", info.SerialNumber)
+		fmt.Printf("Order code:      %s\n", info.OrderCode)
+		fmt.Printf("Firmware:        %s\n", info.Firmware)
+		fmt.Printf("Status:          %s\n", info.Status)
+		if p := info.Protection; p != nil {
+			fmt.Printf("Protection:      level %d (selector %d, parameters %d), mode selector %s\n",
+				p.Level, p.SelectorLevel, p.ParameterLevel, p.ModeSelector)
+		}
+		if info.MaxPDULength > 0 {
+			fmt.Printf("Max PDU length:  %d\n", info.MaxPDULength)
+			fmt.Printf("Max connections: %d\n", info.MaxConnections)
+		}
+		if info.PLCClock != nil {
+			fmt.Printf("PLC clock:       %s (drift %s)\n", info.PLCClock.Format("2006-01-02 15:04:05.000"), info.ClockDrift)
+		}
+		parts := make([]string, 0, len(info.Errors))
+		for part := range info.Errors {
+			parts = append(parts, part)
+		}
+		sort.Strings(parts)
+		for _, part := range parts {
+			fmt.Printf("Not available:   %s: %s\n", part, info.Errors[part])
+		}
+		return nil
+	}
+}
+
+func setupBlocks(fs *flag.FlagSet) func(args []string) error {
+	registerPLCFlags(fs)
+	format := fs.String("format", "human", "output format: human or json")
+	sizes := fs.Bool("sizes", true, "read size and timestamps of every DB")
+	return func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		if *format != "human" && *format != "text" && *format != "json" {
+			return fmt.Errorf("unknown format %q (use human or json)", *format)
+		}
+		tags, err := utils.ParseTags(*utils.CurrentConfig())
+		if err != nil {
+			return err
+		}
+		client, closeFn, err := connectOnce()
+		if err != nil {
+			return err
+		}
+		defer closeFn()
+
+		inv, err := utils.ListBlocks(client)
+		if err != nil {
+			return fmt.Errorf("list blocks: %w", err)
+		}
+		if *sizes {
+			for _, n := range inv.DB {
+				info, _ := utils.ReadDBInfo(client, n)
+				inv.DBs = append(inv.DBs, info)
+			}
+		}
+		_, problems := utils.CheckTagBounds(client, tags)
+
+		if *format == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(struct {
+				utils.BlockInventory
+				TagProblems []utils.TagProblem `json:"tagProblems"`
+			}{inv, problems})
+		}
+
+		list := func(name string, numbers []int) {
+			fmt.Printf("%-4s (%d) %s\n", name, len(numbers), strings.Trim(fmt.Sprint(numbers), "[]"))
+		}
+		list("OB", inv.OB)
+		list("FB", inv.FB)
+		list("FC", inv.FC)
+		list("DB", inv.DB)
+		list("SFB", inv.SFB)
+		list("SFC", inv.SFC)
+		list("SDB", inv.SDB)
+		if len(inv.DBs) > 0 {
+			fmt.Printf("\n%-6s %8s %8s  %-12s %-12s %s\n", "DB", "Size", "Load", "Code date", "Interface", "Name")
+			for _, db := range inv.DBs {
+				if db.Error != "" {
+					fmt.Printf("DB%-4d %s\n", db.Number, db.Error)
+					continue
+				}
+				fmt.Printf("DB%-4d %8d %8d  %-12s %-12s %s\n", db.Number, db.Size, db.LoadSize, db.CodeDate, db.InterfaceDate, db.Name)
+			}
+		}
+		if len(problems) > 0 {
+			fmt.Printf("\nTags that do not fit the PLC:\n")
+			for _, p := range problems {
+				fmt.Printf("  %-20s %-24s %s\n", p.Tag, p.Address, p.Problem)
+			}
+		}
+		return nil
+	}
+}
+
+func setupImport(fs *flag.FlagSet) func(args []string) error {
+	var opts utils.ImportOptions
+	fs.StringVar(&opts.Format, "format", "", "input format: csv, xml, db, sdf or asc (default from the file extension)")
+	fs.IntVar(&opts.DB, "db", 0, "DB number for a DB source that only has the symbolic name")
+	fs.StringVar(&opts.Measurement, "measurement", "", "InfluxDB measurement of the imported tags")
+	output := fs.String("o", "", "write the tags to this file instead of stdout")
+	return func(args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		var tags []utils.TagConfig
+		for _, path := range args {
+			result, err := utils.ImportTags(path, opts)
+			if err != nil {
+				return err
+			}
+			for _, skipped := range result.Skipped {
+				utils.Warnf("%s: skipped %s", path, skipped)
+			}
+			utils.Infof("%s: imported %d tags", path, len(result.Tags))
+			tags = append(tags, result.Tags...)
+		}
+
+		out := os.Stdout
+		if *output != "" {
+			f, err := os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Tags []utils.TagConfig `json:"Tags"`
+		}{tags})
+	}
+}
+
+func setupValidateConfig(fs *flag.FlagSet) func(args []string) error {
+	registerPLCFlags(fs)
+	online := fs.Bool("online", false, "also connect to the PLC and check tag addresses against the DB sizes")
+	format := fs.String("format", "human", "output format: human or json")
+	schema := fs.Bool("schema", false, "print the JSON Schema of the config file and exit")
+	return func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		if *schema {
+			_, err := os.Stdout.Write(configSchema)
+			return err
+		}
+		if *format != "human" && *format != "text" && *format != "json" {
+			return fmt.Errorf("unknown format %q (use human or json)", *format)
+		}
+
+		// loadConfig has already parsed and validated the file.
+		problems := configProblems
+		if *online && len(problems) == 0 {
+			tags, err := utils.ParseTags(*utils.CurrentConfig())
+			if err != nil {
+				return err
+			}
+			client, closeFn, err := connectOnce()
+			if err != nil {
+				return err
+			}
+			defer closeFn()
+			_, bad := utils.CheckTagBounds(client, tags)
+			for _, p := range bad {
+				problems = append(problems, utils.ConfigError{Path: "Tags",
+					Message: fmt.Sprintf("tag %s (%s): %s", p.Tag, p.Address, p.Problem)})
+			}
+		}
+
+		if *format == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if problems == nil {
+				problems = utils.ConfigErrors{}
+			}
+			if err := enc.Encode(struct {
+				File   string             `json:"file"`
+				Valid  bool               `json:"valid"`
+				Errors utils.ConfigErrors `json:"errors"`
+			}{configFile, len(problems) == 0, problems}); err != nil {
+				return err
+			}
+		} else {
+			for _, p := range problems {
+				fmt.Printf("%s: %v\n", configFile, p)
+			}
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%d problem(s) found", len(problems))
+		}
+		if *format != "json" {
+			fmt.Printf("%s: OK\n", configFile)
+		}
+		return nil
+	}
+}
+
+func setupSecrets(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		action, args := args[0], args[1:]
+		if (action == "list") != (len(args) == 0) || len(args) > 1 {
+			return errUsage
+		}
+		path := utils.CurrentConfig().Keystore
+		if path == "" {
+			return fmt.Errorf("no keystore, set Keystore in the config or pass --Keystore")
+		}
+		key, err := utils.MasterKey()
+		if err != nil {
+			return err
+		}
+		keystore, err := utils.OpenKeystore(path, key, action == "set")
+		if err != nil {
+			return err
+		}
+
+		switch action {
+		case "list":
+			for _, name := range keystore.Names() {
+				fmt.Println(name)
+			}
+			return nil
+		case "set":
+			// The value is read from stdin so it stays out of the shell history.
+			value, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+			if err := keystore.Set(args[0], strings.TrimRight(string(value), "\r\n")); err != nil {
+				return err
+			}
+		case "delete":
+			if !keystore.Delete(args[0]) {
+				return fmt.Errorf("keystore %s has no secret %s", path, args[0])
+			}
+		default:
+			return errUsage
+		}
+		if err := keystore.Save(); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s %s\n", path, action, args[0])
+		return nil
+	}
+}
+
+func setupHashPassword(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		// The password is read from stdin so it stays out of the shell history.
+		password, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		text := strings.TrimRight(string(password), "\r\n")
+		if text == "" {
+			return fmt.Errorf("no password on stdin")
+		}
+		hash, err := utils.HashPassword(text)
+		if err != nil {
+			return err
+		}
+		fmt.Println(hash)
+		return nil
+	}
+}
+
+func setupNewAPIKey(fs *flag.FlagSet) func(args []string) error {
+	role := fs.String("role", utils.RoleViewer, "role of the key: viewer, operator or admin")
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		if !utils.RoleAllows(*role, utils.RoleViewer) {
+			return fmt.Errorf("unknown role %q (use viewer, operator or admin)", *role)
+		}
+		key, hash, err := utils.NewAPIKey()
+		if err != nil {
+			return err
+		}
+		entry, err := json.Marshal(utils.WebAPIKey{Name: args[0], Key: hash, Role: *role})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("API key (shown only once): %s\n", key)
+		fmt.Printf("Add to WebAPIKeys in the config: %s\n", entry)
+		return nil
+	}
+}
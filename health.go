@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"s7_plc_read/utils"
+)
+
+// pollInterval is the time between two polls of the tags.
+const pollInterval = time.Second
+
+// health records the outcome of polls for /readyz. The outcome of writes
+// is kept by dispatcher.
+var health struct {
+	sync.Mutex
+	started  time.Time
+	lastPoll time.Time // Last poll that read at least one value
+	pollErr  string
+}
+
+func init() {
+	health.started = time.Now()
+}
+
+func recordPoll(err error) {
+	health.Lock()
+	defer health.Unlock()
+	if err != nil {
+		health.pollErr = err.Error()
+		return
+	}
+	health.pollErr = ""
+	health.lastPoll = time.Now()
+}
+
+// healthCheck is one entry of the /readyz response.
+type healthCheck struct {
+	OK       bool   `json:"ok"`
+	Critical bool   `json:"critical"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// readiness evaluates the readiness checks. The collector is ready when
+// every critical check is OK.
+func readiness(cfg utils.Config) (bool, map[string]healthCheck) {
+	health.Lock()
+	defer health.Unlock()
+	now := time.Now()
+
+	checks := map[string]healthCheck{}
+	switch {
+	case activeClient() == nil:
+		checks[utils.CheckPLC] = healthCheck{Detail: "not connected"}
+	case health.pollErr != "":
+		checks[utils.CheckPLC] = healthCheck{Detail: health.pollErr}
+	default:
+		checks[utils.CheckPLC] = healthCheck{OK: true, Detail: fmt.Sprintf("connected to %s:%s", cfg.PlcIP, cfg.PlcPort)}
+	}
+
+	maxAge := time.Duration(cfg.ReadinessPolls) * pollInterval
+	switch {
+	case health.lastPoll.IsZero():
+		checks[utils.CheckPoll] = healthCheck{Detail: "no successful poll yet"}
+	case now.Sub(health.lastPoll) > maxAge:
+		checks[utils.CheckPoll] = healthCheck{Detail: fmt.Sprintf("last successful poll %s ago", now.Sub(health.lastPoll).Round(time.Second))}
+	default:
+		checks[utils.CheckPoll] = healthCheck{OK: true, Detail: "last successful poll at " + health.lastPoll.Format(time.RFC3339)}
+	}
+
+	sinks := dispatcher.Status()
+	if cfg.WriteToInfluxDB {
+		checks[utils.CheckInfluxDB] = healthCheck{Detail: "nothing written yet"}
+		for _, s := range sinks {
+			switch {
+			case s.Kind != "influxdb":
+			case s.Error != "":
+				checks[utils.CheckInfluxDB] = healthCheck{Detail: s.Error}
+			case s.Written > 0:
+				checks[utils.CheckInfluxDB] = healthCheck{OK: true, Detail: "last write at " + s.LastWrite.Format(time.RFC3339)}
+			}
+		}
+	}
+
+	others := 0
+	var failing []string
+	for _, s := range sinks {
+		if s.Kind == "influxdb" {
+			continue
+		}
+		others++
+		if !s.Healthy {
+			failing = append(failing, s.Name+": "+s.Error)
+		}
+	}
+	switch {
+	case len(failing) > 0:
+		checks[utils.CheckSinks] = healthCheck{Detail: strings.Join(failing, "; ")}
+	case others > 0:
+		checks[utils.CheckSinks] = healthCheck{OK: true, Detail: fmt.Sprintf("%d sink(s) writable", others)}
+	}
+
+	ready := true
+	for _, name := range cfg.ReadinessCritical {
+		check, ok := checks[name]
+		if !ok {
+			continue
+		}
+		check.Critical = true
+		checks[name] = check
+		ready = ready && check.OK
+	}
+	return ready, checks
+}
+
+// registerHealthHandlers adds /healthz and /readyz. They need no
+// credentials, so orchestrators can probe them.
+func registerHealthHandlers() {
+	http.HandleFunc("GET /healthz", healthzHandler)
+	http.HandleFunc("GET /readyz", readyzHandler)
+}
+
+// healthzHandler reports that the process is alive.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "ok",
+		"uptime": time.Since(health.started).Round(time.Second).String(),
+	})
+}
+
+// readyzHandler reports whether the collector polls the PLC and writes its
+// outputs, with 503 when a critical check fails.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ready, checks := readiness(*utils.CurrentConfig())
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not ready", http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]interface{}{"status": status, "checks": checks})
+}
+
+func setupHealthcheck(fs *flag.FlagSet) func(args []string) error {
+	live := fs.Bool("live", false, "check /healthz, that the process is alive, instead of /readyz")
+	url := fs.String("url", "", "base URL of the web server, defaults to localhost and WebPort")
+	timeout := fs.Duration("timeout", 5*time.Second, "time to wait for the answer")
+	return func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+		cfg := utils.CurrentConfig()
+		base := *url
+		if base == "" {
+			if !cfg.WebServer {
+				return fmt.Errorf("the web server is disabled, set WebServer to use health checks")
+			}
+			scheme := "http"
+			if cfg.WebTLSCert != "" || cfg.WebTLSSelfSigned {
+				scheme = "https"
+			}
+			base = fmt.Sprintf("%s://localhost:%s", scheme, cfg.WebPort)
+		}
+		path := "/readyz"
+		if *live {
+			path = "/healthz"
+		}
+
+		// The certificate is issued for the public name of the server, not
+		// for localhost, so it is not verified.
+		client := &http.Client{
+			Timeout:   *timeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		}
+		resp, err := client.Get(base + path)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err == nil {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(body)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: %s", path, resp.Status)
+		}
+		return nil
+	}
+}
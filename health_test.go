@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"s7_plc_read/utils"
+
+	"github.com/robinson/gos7"
+)
+
+// healthSink is a sink whose Health returns err.
+type healthSink struct {
+	name string
+	err  error
+}
+
+func (s *healthSink) Name() string                    { return s.name }
+func (s *healthSink) Start(ctx context.Context) error { return nil }
+func (s *healthSink) Write(batch utils.Batch) error   { return nil }
+func (s *healthSink) Flush(ctx context.Context) error { return nil }
+func (s *healthSink) Close() error                    { return nil }
+func (s *healthSink) Health() error                   { return s.err }
+
+func TestReadiness(t *testing.T) {
+	defer func(d *utils.Dispatcher) { dispatcher = d }(dispatcher)
+	defer setActiveClient(nil)
+	client := gos7.NewClient(gos7.NewTCPClientHandler("127.0.0.1:102", 0, 1))
+	down := errors.New("connection refused")
+
+	tests := []struct {
+		name      string
+		offline   bool          // No PLC client
+		pollErr   string        // Error of the last poll
+		pollAge   time.Duration // Age of the last successful poll, 0 for none
+		influxErr error         // Health of the InfluxDB sink, nil without one
+		sinkErr   error         // Health of the other sink
+		critical  []string      // nil for all checks
+		ready     bool
+		failing   []string // Checks that are not OK
+	}{
+		{name: "ready", pollAge: time.Second, ready: true},
+		{name: "no PLC", offline: true, pollAge: time.Second, failing: []string{utils.CheckPLC}},
+		{name: "poll error", pollErr: "read DB1: timeout", pollAge: time.Second, failing: []string{utils.CheckPLC}},
+		{name: "no poll yet", failing: []string{utils.CheckPoll}},
+		{name: "stale poll", pollAge: time.Minute, failing: []string{utils.CheckPoll}},
+		{name: "stale poll not critical", pollAge: time.Minute, critical: []string{utils.CheckPLC, utils.CheckSinks},
+			ready: true, failing: []string{utils.CheckPoll}},
+		{name: "InfluxDB down", pollAge: time.Second, influxErr: down, failing: []string{utils.CheckInfluxDB}},
+		{name: "sink down", pollAge: time.Second, sinkErr: down, failing: []string{utils.CheckSinks}},
+		{name: "sink down not critical", pollAge: time.Second, sinkErr: down, critical: []string{utils.CheckPLC, utils.CheckPoll},
+			ready: true, failing: []string{utils.CheckSinks}},
+		{name: "nothing critical", offline: true, critical: []string{}, ready: true,
+			failing: []string{utils.CheckPLC, utils.CheckPoll}},
+	}
+	for _, tt := range tests {
+		cfg := utils.DefaultConfig()
+		if tt.critical != nil {
+			cfg.ReadinessCritical = tt.critical
+		}
+
+		var sinks []utils.ConfiguredSink
+		if tt.influxErr != nil {
+			cfg.WriteToInfluxDB = true
+			sinks = append(sinks, utils.ConfiguredSink{Sink: &healthSink{"influxdb", tt.influxErr}, Kind: "influxdb"})
+		}
+		sinks = append(sinks, utils.ConfiguredSink{Sink: &healthSink{"file", tt.sinkErr}, Kind: "file"})
+		dispatcher = utils.NewDispatcher()
+		dispatcher.SetSinks(sinks)
+
+		if tt.offline {
+			setActiveClient(nil)
+		} else {
+			setActiveClient(client)
+		}
+		health.Lock()
+		health.pollErr, health.lastPoll = tt.pollErr, time.Time{}
+		if tt.pollAge > 0 {
+			health.lastPoll = time.Now().Add(-tt.pollAge)
+		}
+		health.Unlock()
+
+		ready, checks := readiness(cfg)
+		dispatcher.Close(context.Background())
+		if ready != tt.ready {
+			t.Errorf("%s: ready %v, want %v: %+v", tt.name, ready, tt.ready, checks)
+		}
+		var failing []string
+		for _, name := range utils.ReadinessChecks {
+			check, ok := checks[name]
+			if ok && !check.OK {
+				failing = append(failing, name)
+			}
+			if want := tt.critical == nil || slices.Contains(tt.critical, name); ok && check.Critical != want {
+				t.Errorf("%s: %s critical %v, want %v", tt.name, name, check.Critical, want)
+			}
+		}
+		if !slices.Equal(failing, tt.failing) {
+			t.Errorf("%s: failing checks %v, want %v: %+v", tt.name, failing, tt.failing, checks)
+		}
+		if _, ok := checks[utils.CheckInfluxDB]; ok != (tt.influxErr != nil) {
+			t.Errorf("%s: InfluxDB check present %v, want %v", tt.name, ok, !ok)
+		}
+	}
+}
@@ -3,12 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"flag"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -19,171 +19,542 @@ import (
 	"github.com/robinson/gos7"
 )
 
-var plcData utils.PLCData
-var writeAPI api.WriteAPIBlocking
-var influxClient influxdb2.Client
+var values = utils.NewValueCache()
 
-func main() {
-	// Load config
-	utils.LoadConfig("config.json")
+// dispatcher hands the poll results to the sinks of the running config.
+var dispatcher = utils.NewDispatcher()
+
+// contexts follows the shift, order and batch recorded with every sample.
+var contexts = utils.NewContextTracker()
+
+// snapshots takes the snapshots of the Snapshots config from the polls.
+var snapshots = utils.NewSnapshotRecorder()
 
-	// Define a flag for enabling/disabling InfluxDB
-	useInfluxDB := utils.ConfigData.WriteToInfluxDB
-	// Define a flag for enabling/disabling Webserver
-	useWebserver := utils.ConfigData.WebServer
+// accumulators keeps the totals of the accumulator tags, opened by
+// runCollector.
+var accumulators *utils.Accumulators
 
-	flag.Parse()
+func main() {
+	os.Exit(runCLI(os.Args[1:]))
+}
 
-	if useWebserver {
+// runtime is the config and the connections the collector polls with. A
+// reload builds a new runtime next to the running one and only swaps them
+// when it is complete, so a failed reload leaves the collector untouched.
+type runtime struct {
+	cfg     utils.Config
+	tags    []utils.Tag
+	sim     *utils.SimulatedPLC    // Polled instead of a PLC when not nil
+	handler *gos7.TCPClientHandler // nil when simulating
+	client  gos7.Client
+	sinks   []utils.ConfiguredSink   // Owned by dispatcher once handed to it
+	modbus  *utils.ModbusMap         // nil without a Modbus config
+	opcua   *utils.OPCUAAddressSpace // nil without an OPCUA config
+}
+
+// runCollector polls the configured tags every second, serves the latest
+// values on the web server and hands them to the sinks (InfluxDB, the
+// historian, the file sinks and the stream sinks) until the process is
+// interrupted. When sim is not nil it is polled instead of the PLC from the
+// config. The config is reloaded when its files change, on SIGHUP and on
+// POST /api/v1/admin/reload. On SIGINT or SIGTERM the collector shuts down
+// as described at shutdown; a second signal stops it at once.
+func runCollector(sim *utils.SimulatedPLC) error {
+	cfg := *utils.CurrentConfig()
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	var server *http.Server
+	serverErrs := make(chan error, 3)
+	if cfg.WebServer {
 		// Set up web server
-		http.HandleFunc("/plcdata", plcDataHandler)
-		go func() {
-			log.Println("Starting web server on http://localhost:9999")
-			if err := http.ListenAndServe(":9999", nil); err != nil {
-				log.Fatalf("Web server failed: %v", err)
-			}
-		}()
+		handle("/plcdata", utils.RoleViewer, plcDataHandler)
+		registerAPIHandlers()
+		registerHealthHandlers()
+		server = startWeb(cfg, serverErrs)
 	}
 
 	// If InfluxDB is enabled, wait for it to become accessible
-	if useInfluxDB {
-		utils.WaitForInfluxDB(utils.ConfigData.InfluxDBHealth, 5*time.Second)
+	if cfg.WriteToInfluxDB {
+		if err := utils.WaitForInfluxDB(ctx, cfg.InfluxDBHealth, 5*time.Second); err != nil {
+			return nil
+		}
 
 		// Check if PLC is reachable
-		plcReachable := utils.IsReachable(utils.ConfigData.PlcIP, utils.ConfigData.PlcPort)
-
-		/*	// Run chrome
-			browserOpen := utils.OpenBrowser(utils.ConfigData.InfluxDBURL)
-			if browserOpen {
-				fmt.Println("InfluxDB is accessible and ready ")
-			}
-		*/
-		if !plcReachable {
-			log.Fatalf("PLC at %s:%s is not reachable", utils.ConfigData.PlcIP, utils.ConfigData.PlcPort)
+		if sim == nil && !utils.IsReachable(cfg.PlcIP, cfg.PlcPort) {
+			return fmt.Errorf("PLC at %s:%s is not reachable", cfg.PlcIP, cfg.PlcPort)
 		}
 
 		// Check if InfluxDB is accessible
-		influxDbHealth := utils.IsInfluxDBAccessible(utils.ConfigData.InfluxDBHealth)
+		influxDbHealth := utils.IsInfluxDBAccessible(cfg.InfluxDBHealth)
 		if !influxDbHealth {
-			log.Fatalf("InfluxDB at %s is not accessible or not ready", utils.ConfigData.InfluxDBHealth)
+			return fmt.Errorf("InfluxDB at %s is not accessible or not ready", cfg.InfluxDBHealth)
 		}
-		fmt.Println("InfluxDB is accessible and ready @ " + utils.ConfigData.InfluxDBURL)
-		fmt.Println("PLC is reachable @" + utils.ConfigData.PlcIP + ":" + "120")
+		utils.Infof("InfluxDB is accessible and ready @ %s", cfg.InfluxDBURL)
 	}
 
-	// Wait for the PLC to become reachable
-	utils.WaitForPLC(utils.ConfigData.PlcIP, utils.ConfigData.PlcPort, 5*time.Second)
-	fmt.Println("PLC is reachable @" + utils.ConfigData.PlcIP + ":" + "120")
-	// Define the PLC connection parameters
-	handler := gos7.NewTCPClientHandler(utils.ConfigData.PlcIP, 0, 1)
-	handler.IdleTimeout = utils.GetReconnectDelay()
+	var err error
+	if accumulators, err = utils.OpenAccumulators(cfg.AccumulatorState); err != nil {
+		return fmt.Errorf("accumulator totals: %w", err)
+	}
 
-	// Connect to the PLC
-	err := handler.Connect()
-	if err != nil {
-		log.Fatalf("Failed to connect to PLC: %v", err)
+	rt := &runtime{cfg: cfg, sim: sim}
+	if err := rt.open(ctx, nil); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	setActiveClient(rt.client)
+	setActiveHistorian(rt.historian())
+	contexts.SetConfig(cfg.Context)
+	dispatcher.SetSinks(rt.sinks)
+	snapshots.SetConfig(cfg.Snapshots, cfg.PlcName, rt.tags)
+
+	var modbus *utils.ModbusServer
+	if rt.modbus != nil {
+		modbus = startModbus(cfg, rt.modbus, serverErrs)
+	}
+	var opcua *utils.OPCUAServer
+	if rt.opcua != nil {
+		opcua = startOPCUA(cfg, rt.opcua, serverErrs)
 	}
-	defer handler.Close()
 
-	// Create a new PLC client
-	client := gos7.NewClient(handler)
+	stopStatus := rt.startStatusPoller(ctx)
 
-	// Create a new InfluxDB client if useInfluxDB flag is true
-	if useInfluxDB {
-		influxClient = influxdb2.NewClient(utils.ConfigData.InfluxDBURL, utils.ConfigData.InfluxDBToken)
-		defer influxClient.Close()
-		writeAPI = influxClient.WriteAPIBlocking(utils.ConfigData.InfluxDBOrg, utils.ConfigData.InfluxDBBucket)
+	fileChanged := make(chan struct{}, 1)
+	watcher, err := watchConfig(configFile, fileChanged)
+	if err != nil {
+		utils.Warnf("Not watching %s for changes: %v", configFile, err)
+	} else {
+		defer watcher.Close()
 	}
 
 	// Create a ticker to read data every second
-	ticker := time.NewTicker(1 * time.Second)
+	ticker := time.NewTicker(pollInterval)
 	defer ticker.Stop()
 
-	// Channel to handle system interrupt signals
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+
+	var failure error
+	for failure == nil && ctx.Err() == nil {
+		var result reloadResult
+		select {
+		case <-ticker.C:
+			failure = rt.poll(ctx)
+			continue
+		case failure = <-serverErrs:
+			continue
+		case <-fileChanged:
+			rt, result = reload(ctx, rt, "file change")
+		case <-hupChan:
+			rt, result = reload(ctx, rt, "SIGHUP")
+		case req := <-reloadRequests:
+			rt, result = reload(ctx, rt, req.source)
+			req.reply <- result
+		case <-ctx.Done():
+			fmt.Println("\nReceived interrupt signal, shutting down...")
+			continue
+		}
+		if result.Err == nil {
+			stopStatus()
+			stopStatus = rt.startStatusPoller(ctx)
+			if modbus != nil {
+				modbus.SetMap(rt.modbus)
+			}
+			if opcua != nil && rt.opcua != nil {
+				opcua.SetAddressSpace(rt.opcua)
+			}
+		}
+		if watcher != nil {
+			watcher.update()
+		}
+	}
 
-	done := make(chan bool, 1)
+	// Restore the default signal handling so a second signal stops the
+	// process when the shutdown hangs.
+	stopSignals()
+	if err := shutdown(rt, server, modbus, opcua, stopStatus); err != nil {
+		return err
+	}
+	return failure
+}
 
+// shutdown stops the collector in order: the CPU status poller is cancelled
+// and waited for, the web, Modbus and OPC UA servers finish the requests in
+// progress, snapshots in progress are ended, the sinks write what is queued,
+// are flushed and closed, the accumulator totals are saved and the PLC
+// session is closed. The poll loop has returned before, so no read is in
+// progress. Everything must be done within ShutdownTimeout; otherwise
+// errShutdownIncomplete is returned.
+func shutdown(rt *runtime, server *http.Server, modbus *utils.ModbusServer, opcua *utils.OPCUAServer, stopStatus func()) error {
+	timeout := time.Duration(rt.cfg.ShutdownTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var errs []error
+	done := make(chan struct{})
 	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				// Read data from DB1, starting at byte 0
-				dbNumber := 1
-				startAddress := 0
-				numBytes := 7 // We need 7 bytes for our struct: 3 bytes for Tag1, Tag2, Tag3 and 4 bytes for Tag4
-				data := make([]byte, numBytes)
-
-				err := client.AGReadDB(dbNumber, startAddress, numBytes, data)
-				if err != nil {
-					log.Printf("Failed to read data from PLC: %v", err)
-
-					// Check if PLC is reachable
-					plcReachable := utils.IsReachable(utils.ConfigData.PlcIP, utils.ConfigData.PlcPort)
-					if !plcReachable {
-						handler.Close()
-					}
-					// Wait for the PLC to become reachable
-					utils.WaitForPLC(utils.ConfigData.PlcIP, utils.ConfigData.PlcPort, 5*time.Second)
-					// Connect to the PLC
-					err := handler.Connect()
-					if err != nil {
-						log.Fatalf("Failed to connect to PLC: %v", err)
-					}
-					//defer handler.Close() - dont need it - it closes connection at end of each call
-
-					// Create a new PLC client
-					client = gos7.NewClient(handler)
-					continue
-				}
-
-				// Map the byte slice to the struct
-				plcData = utils.MapBytesToPLCData(data)
-
-				// Print the data
-				fmt.Printf("PLC Data - Tag1: %d, Tag2: %d, Tag3: %d, Tag4: %d, \n", plcData.Tag1, plcData.Tag2, plcData.Tag3, plcData.Tag4)
-
-				// Write data to InfluxDB if enabled
-				if useInfluxDB {
-					p := influxdb2.NewPointWithMeasurement("temperature").
-						AddTag("host", "plc").
-						AddField("temperature1", plcData.Tag1).
-						AddField("temperature2", plcData.Tag2).
-						AddField("temperature3", plcData.Tag3).
-						SetTime(time.Now())
-
-					if err := writeAPI.WritePoint(context.Background(), p); err != nil {
-						log.Printf("Failed to write data to InfluxDB: %v", err)
-					}
-					fmt.Printf(" InfluxDB | OK | temperature1: %d, temperature2: %d, temperature3: %d, Mesurment name: temperature \n", plcData.Tag1, plcData.Tag2, plcData.Tag3)
-				}
-
-			case <-done:
-				return
+		stopStatus()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("CPU status poller did not stop"))
+	}
+	if server != nil {
+		if err := server.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("web server: %w", err))
+		}
+	}
+	if modbus != nil {
+		modbus.Close()
+	}
+	if opcua != nil {
+		opcua.Close()
+	}
+	dispatchSnapshots(ctx, snapshots.Flush())
+	if err := dispatcher.Close(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := accumulators.Save(rt.tags); err != nil {
+		errs = append(errs, fmt.Errorf("accumulator totals: %w", err))
+	}
+	rt.close()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %v", errShutdownIncomplete, errors.Join(errs...))
+	}
+	utils.Infof("Shutdown complete")
+	return nil
+}
+
+// open connects what rt needs. Connections of old that the config change
+// does not affect are reused. On error everything opened here is closed
+// again and old is left as it was.
+func (rt *runtime) open(ctx context.Context, old *runtime) (err error) {
+	if rt.tags, err = utils.ParseTags(rt.cfg); err != nil {
+		return err
+	}
+	var opened []func()
+	defer func() {
+		if err != nil {
+			for _, closeFn := range opened {
+				closeFn()
 			}
 		}
 	}()
 
-	// Wait for interrupt signal
-	<-sigChan
-	fmt.Println("\nReceived interrupt signal, shutting down...")
+	switch {
+	case rt.sim != nil:
+		if old == nil {
+			utils.Infof("Simulating PLC, no connection to %s is made", rt.cfg.PlcIP)
+		}
+		rt.sim.Animate(rt.tags)
+		rt.client = rt.sim
+	case old != nil && !plcChanged(old.cfg, rt.cfg):
+		rt.handler, rt.client = old.handler, old.client
+	default:
+		if old == nil {
+			// Wait for the PLC to become reachable
+			if err := utils.WaitForPLC(ctx, rt.cfg.PlcIP, rt.cfg.PlcPort, 5*time.Second); err != nil {
+				return err
+			}
+			utils.Infof("PLC is reachable @ %s:%s", rt.cfg.PlcIP, rt.cfg.PlcPort)
+		}
+
+		// Connect to the PLC
+		handler, client, err := utils.ConnectPLC(rt.cfg)
+		if err != nil {
+			return err
+		}
+		opened = append(opened, func() { handler.Close() })
+		rt.handler, rt.client = handler, client
+	}
+
+	// Check the tag addresses against the DB sizes in the PLC
+	if mode := rt.cfg.TagBoundsCheck; mode != "off" {
+		dbs, problems := utils.CheckTagBounds(rt.client, rt.tags)
+		for _, db := range dbs {
+			if db.Error != "" {
+				utils.Warnf("Cannot check tags in DB%d: %s", db.Number, db.Error)
+				continue
+			}
+			utils.Infof("DB%d: %d bytes, code %s, interface %s", db.Number, db.Size, db.CodeDate, db.InterfaceDate)
+		}
+		for _, p := range problems {
+			utils.Errorf("Tag %s (%s): %s", p.Tag, p.Address, p.Problem)
+		}
+		if len(problems) > 0 && mode == "fail" {
+			return fmt.Errorf("%d tag(s) do not fit the PLC's DBs", len(problems))
+		}
+		utils.MarkBadTags(rt.tags, problems)
+	}
+
+	// Lay out the Modbus registers
+	if rt.cfg.Modbus != nil {
+		if rt.modbus, err = utils.NewModbusMap(*rt.cfg.Modbus, rt.tags); err != nil {
+			return err
+		}
+	}
 
-	// Stop the goroutine
-	done <- true
+	// Build the OPC UA address space
+	if rt.cfg.OPCUA != nil {
+		if rt.opcua, err = utils.NewOPCUAAddressSpace(rt.cfg.PlcName, rt.tags); err != nil {
+			return err
+		}
+	}
+
+	// Open the sinks, keeping those whose settings are the same
+	var oldSinks []utils.ConfiguredSink
+	if old != nil {
+		oldSinks = old.sinks
+	}
+	rt.sinks, err = utils.OpenSinks(rt.cfg, rt.tags, oldSinks)
+	return err
 }
 
-// plcDataHandler handles HTTP requests and returns the PLC data as JSON
-func plcDataHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(plcData)
+// close closes the connections of rt.
+func (rt *runtime) close() {
+	rt.closeReplaced(&runtime{})
+}
+
+// closeReplaced closes the connections of rt that next does not reuse. The
+// sinks are closed by dispatcher.
+func (rt *runtime) closeReplaced(next *runtime) {
+	if rt.handler != nil && rt.handler != next.handler {
+		rt.handler.Close()
+	}
+}
+
+// historian returns the historian sink of rt, nil without a Historian config.
+func (rt *runtime) historian() *utils.Historian {
+	for _, s := range rt.sinks {
+		if h, ok := s.Sink.(*utils.Historian); ok {
+			return h
+		}
+	}
+	return nil
 }
 
-/*
-How to compile software in VsCode
-	compile with go build -o my-go-app.exr main.go
+// influx returns the InfluxDB sink of rt, nil when WriteToInfluxDB is off.
+func (rt *runtime) influx() *utils.InfluxSink {
+	for _, s := range rt.sinks {
+		if i, ok := s.Sink.(*utils.InfluxSink); ok {
+			return i
+		}
+	}
+	return nil
+}
+
+// plcChanged reports whether the PLC connection must be reopened.
+func plcChanged(a, b utils.Config) bool {
+	return a.PlcIP != b.PlcIP || a.PlcPort != b.PlcPort || a.PlcRack != b.PlcRack ||
+		a.PlcSlot != b.PlcSlot || a.PlcConnectionType != b.PlcConnectionType ||
+		a.ReconnectDelay != b.ReconnectDelay || a.PlcPassword != b.PlcPassword
+}
+
+// poll reads all tags once, reconnecting when the PLC is lost, and writes
+// the values to the cache and hands them to the sinks. The error is only set
+// when the PLC cannot be reconnected.
+func (rt *runtime) poll(ctx context.Context) error {
+	readings, err := utils.ReadTags(rt.client, rt.tags)
+	accumulators.Update(rt.tags, readings)
+	recordPoll(err)
+	if err != nil {
+		utils.Errorf("Failed to read data from PLC: %v", err)
+		values.Update(readings)
+		if rt.handler == nil {
+			return nil
+		}
+
+		// Check if PLC is reachable
+		plcReachable := utils.IsReachable(rt.cfg.PlcIP, rt.cfg.PlcPort)
+		if !plcReachable {
+			rt.handler.Close()
+		}
+		// Wait for the PLC to become reachable
+		if err := utils.WaitForPLC(ctx, rt.cfg.PlcIP, rt.cfg.PlcPort, 5*time.Second); err != nil {
+			return nil // Shutting down
+		}
+		// Connect to the PLC
+		err := rt.handler.Connect()
+		if err != nil {
+			return fmt.Errorf("failed to reconnect to PLC: %w", err)
+		}
+		//defer handler.Close() - dont need it - it closes connection at end of each call
+
+		// Create a new PLC client
+		rt.client = gos7.NewClient(rt.handler)
+		if err := utils.SetPLCPassword(rt.client, rt.cfg.PlcPassword); err != nil {
+			utils.Errorf("%v", err)
+		}
+		setActiveClient(rt.client)
+		return nil
+	}
+	values.Update(readings)
+
+	// Print the data
+	utils.Infof("PLC Data - %s", formatReadings(readings))
+
+	// Hand the values to the sinks
+	batch := utils.Batch{Time: time.Now(), Tags: rt.tags, Values: readings}
+	if len(readings) > 0 {
+		batch.Time = readings[0].Timestamp
+	}
+	contexts.Update(&batch)
+	dispatcher.Dispatch(ctx, batch)
+	dispatchSnapshots(ctx, snapshots.Update(batch))
+	return nil
+}
+
+// dispatchSnapshots hands the snapshots taken to the sinks.
+func dispatchSnapshots(ctx context.Context, taken []*utils.Snapshot) {
+	for _, s := range taken {
+		dispatcher.Dispatch(ctx, utils.Batch{Time: s.Time, Context: s.Context, Snapshot: s})
+	}
+}
+
+// writeThrough writes data to the address of tag on the connected PLC, for
+// the Modbus and OPC UA servers.
+func writeThrough(tag utils.Tag, data []byte) error {
+	client := activeClient()
+	if client == nil {
+		return fmt.Errorf("PLC is not connected")
+	}
+	return utils.WriteAddress(client, tag.Addr, data)
+}
+
+// startModbus starts the Modbus TCP server for m. Clients write through to
+// the PLC. An error that stops the server is sent on errs.
+func startModbus(cfg utils.Config, m *utils.ModbusMap, errs chan<- error) *utils.ModbusServer {
+	server := utils.NewModbusServer(values, m, writeThrough)
+	utils.Infof("Starting Modbus TCP server on %s", cfg.Modbus.Listen)
+	go func() {
+		if err := server.ListenAndServe(cfg.Modbus.Listen); err != nil {
+			errs <- fmt.Errorf("Modbus server failed: %w", err)
+		}
+	}()
+	return server
+}
+
+// startOPCUA starts the OPC UA server for space. Anonymous clients are let
+// in when the web server is open too, read-only unless AnonymousWrite is
+// set; others log in as a WebUsers user with their role. Clients write through to the PLC. An
+// error that stops the server is sent on errs.
+func startOPCUA(cfg utils.Config, space *utils.OPCUAAddressSpace, errs chan<- error) *utils.OPCUAServer {
+	server := utils.NewOPCUAServer(values, space, *cfg.OPCUA, pollInterval, func(user, password string) (string, bool) {
+		cfg := utils.CurrentConfig()
+		if user == "" {
+			return cfg.OPCUA.AnonymousRole(), !cfg.AuthEnabled()
+		}
+		return cfg.CheckPassword(user, password)
+	}, writeThrough)
+	if cfg.AuthEnabled() {
+		utils.Warnf("OPC UA server has no encryption, user passwords are sent in plain text")
+	}
+	utils.Infof("Starting OPC UA server on %s", cfg.OPCUA.Endpoint)
+	go func() {
+		if err := server.ListenAndServe(cfg.OPCUA.Listen); err != nil {
+			errs <- fmt.Errorf("OPC UA server failed: %w", err)
+		}
+	}()
+	return server
+}
+
+// startStatusPoller starts pollCPUStatus for rt and returns the function
+// that stops it and waits until a status read in progress has finished.
+func (rt *runtime) startStatusPoller(ctx context.Context) func() {
+	if rt.cfg.StatusInterval <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	var writeAPI api.WriteAPIBlocking
+	if influx := rt.influx(); influx != nil {
+		writeAPI = influx.WriteAPI()
+	}
+	go func() {
+		defer close(done)
+		pollCPUStatus(ctx, rt.client, time.Duration(rt.cfg.StatusInterval)*time.Second, writeAPI)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// pollCPUStatus records the run/stop state of the CPU every interval and
+// writes it to InfluxDB as the "status" field of the plc_status measurement
+// when writeAPI is not nil.
+func pollCPUStatus(ctx context.Context, client gos7.Client, interval time.Duration, writeAPI api.WriteAPIBlocking) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		status, err := utils.ReadCPUStatus(client)
+		if err != nil {
+			utils.Warnf("Failed to read CPU status: %v", err)
+		}
+		if previous := cpuStatus(); previous != status {
+			utils.Infof("CPU status changed from %q to %s", previous, status)
+		}
+		setCPUStatus(status)
+
+		if writeAPI != nil {
+			p := influxdb2.NewPointWithMeasurement("plc_status").
+				AddTag("host", utils.CurrentConfig().PlcName).
+				AddField("status", status).
+				AddField("running", status == "RUN").
+				SetTime(time.Now())
+			if err := writeAPI.WritePoint(context.Background(), p); err != nil {
+				utils.Errorf("Failed to write CPU status to InfluxDB: %v", err)
+			}
+		}
 
-To run the program without InfluxDB:
-	go run main.go -useInfluxDB=false
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
-*/
+// formatReadings renders tag values as "Tag1: 20, Tag2: 21" for the log.
+func formatReadings(readings []utils.TagValue) string {
+	parts := make([]string, len(readings))
+	for i, r := range readings {
+		if r.Quality != utils.QualityGood {
+			parts[i] = fmt.Sprintf("%s: BAD", r.Name)
+			continue
+		}
+		parts[i] = fmt.Sprintf("%s: %v", r.Name, r.Value)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// plcDataHandler handles HTTP requests and returns the PLC data as JSON
+func plcDataHandler(w http.ResponseWriter, r *http.Request) {
+	var good []utils.TagValue
+	for _, v := range values.Snapshot() {
+		if v.Quality == utils.QualityGood {
+			good = append(good, v)
+		}
+	}
+	var data map[string]interface{}
+	if jsonLayout(r) == utils.LayoutNested {
+		data = utils.NestValues(good, func(v utils.TagValue) interface{} { return v.Value })
+	} else {
+		data = map[string]interface{}{}
+		for _, v := range good {
+			data[v.Name] = v.Value
+		}
+	}
+	if status := cpuStatus(); status != "" {
+		data["CPUStatus"] = status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"syscall"
+	"time"
+
+	"s7_plc_read/utils"
+
+	"github.com/robinson/gos7"
+)
+
+// registerPLCFlags adds the short connection flags used during commissioning.
+// They are aliases of the PlcIP, PlcPort, PlcRack, PlcSlot and
+// PlcConnectionType overrides.
+func registerPLCFlags(fs *flag.FlagSet) {
+	fs.Func("plc", "PLC address as host or host:port (overrides PlcIP and PlcPort)", func(value string) error {
+		host, port, err := net.SplitHostPort(value)
+		if err != nil {
+			host, port = value, ""
+		}
+		overrides["PlcIP"] = host
+		if port != "" {
+			overrides["PlcPort"] = port
+		}
+		return nil
+	})
+	intFlag := func(name, key, usage string) {
+		fs.Func(name, usage, func(value string) error {
+			if _, err := strconv.Atoi(value); err != nil {
+				return fmt.Errorf("invalid number %q", value)
+			}
+			overrides[key] = value
+			return nil
+		})
+	}
+	intFlag("rack", "PlcRack", "PLC rack (overrides PlcRack)")
+	intFlag("slot", "PlcSlot", "PLC slot (overrides PlcSlot)")
+	fs.Func("conn-type", "connection type PG, OP or BASIC (overrides PlcConnectionType)", func(value string) error {
+		overrides["PlcConnectionType"] = value
+		return nil
+	})
+}
+
+// connectOnce opens a PLC session for a one-shot command.
+func connectOnce() (gos7.Client, func(), error) {
+	cfg := *utils.CurrentConfig()
+	if cfg.PlcIP == "" {
+		return nil, nil, fmt.Errorf("no PLC address, pass --plc or set PlcIP in the config")
+	}
+	handler, client, err := utils.ConnectPLC(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, func() { handler.Close() }, nil
+}
+
+// readResult is one value printed by the read and write commands.
+type readResult struct {
+	Address   string      `json:"address"`
+	Type      string      `json:"type"`
+	Value     interface{} `json:"value,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// printer writes results to w either as aligned text or as one JSON object
+// per line, which keeps --watch output easy to pipe into other tools.
+type printer struct {
+	w    io.Writer
+	json bool
+	enc  *json.Encoder
+}
+
+func newPrinter(format string, w io.Writer) (*printer, error) {
+	switch format {
+	case "human", "text":
+		return &printer{w: w}, nil
+	case "json":
+		return &printer{w: w, json: true, enc: json.NewEncoder(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q (use human or json)", format)
+}
+
+func (p *printer) print(r readResult) {
+	if p.json {
+		p.enc.Encode(r)
+		return
+	}
+	if r.Error != "" {
+		fmt.Fprintf(p.w, "%s  %-24s ERROR %s\n", r.Timestamp.Format("15:04:05.000"), r.Address, r.Error)
+		return
+	}
+	fmt.Fprintf(p.w, "%s  %-24s %v\n", r.Timestamp.Format("15:04:05.000"), r.Address, r.Value)
+}
+
+// displayValue converts decoded values into a form that prints well both as
+// text and as JSON.
+func displayValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return v
+}
+
+func setupRead(fs *flag.FlagSet) func(args []string) error {
+	registerPLCFlags(fs)
+	format := fs.String("format", "human", "output format: human or json")
+	watch := fs.Duration("watch", 0, "keep reading at this interval and print values when they change (e.g. 500ms)")
+
+	return func(args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+		out, err := newPrinter(*format, os.Stdout)
+		if err != nil {
+			return err
+		}
+		addrs := make([]utils.Address, len(args))
+		for i, arg := range args {
+			if addrs[i], err = utils.ParseAddress(arg); err != nil {
+				return err
+			}
+		}
+
+		client, closeFn, err := connectOnce()
+		if err != nil {
+			return err
+		}
+		defer closeFn()
+
+		read := func(addr utils.Address) readResult {
+			r := readResult{Address: addr.String(), Type: string(addr.Type), Timestamp: time.Now()}
+			data, err := utils.ReadAddress(client, addr)
+			if err != nil {
+				r.Error = err.Error()
+			} else {
+				r.Value = displayValue(utils.DecodeValue(addr, data))
+			}
+			return r
+		}
+
+		if *watch <= 0 {
+			failed := false
+			for _, addr := range addrs {
+				r := read(addr)
+				out.print(r)
+				failed = failed || r.Error != ""
+			}
+			if failed {
+				return fmt.Errorf("not all addresses could be read")
+			}
+			return nil
+		}
+
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		ticker := time.NewTicker(*watch)
+		defer ticker.Stop()
+
+		last := make([]readResult, len(addrs))
+		for first := true; ; first = false {
+			for i, addr := range addrs {
+				r := read(addr)
+				if first || r.Error != last[i].Error || !reflect.DeepEqual(r.Value, last[i].Value) {
+					out.print(r)
+				}
+				last[i] = r
+			}
+			select {
+			case <-ticker.C:
+			case <-sigChan:
+				return nil
+			}
+		}
+	}
+}
+
+// writeTarget resolves the target of the write command: an S7 address, or
+// the name of a tag marked Writable in the config.
+func writeTarget(target string) (utils.Address, error) {
+	addr, err := utils.ParseAddress(target)
+	if err == nil {
+		return addr, nil
+	}
+	tags, tagErr := utils.ParseTags(*utils.CurrentConfig())
+	if tagErr != nil {
+		return addr, err
+	}
+	for _, tag := range tags {
+		if tag.Name != target {
+			continue
+		}
+		if !tag.Writable {
+			return addr, fmt.Errorf("tag %s is not Writable in the config", tag.Name)
+		}
+		return tag.Addr, nil
+	}
+	return addr, err
+}
+
+func setupWrite(fs *flag.FlagSet) func(args []string) error {
+	registerPLCFlags(fs)
+	format := fs.String("format", "human", "output format: human or json")
+
+	return func(args []string) error {
+		if len(args) != 2 {
+			return errUsage
+		}
+		out, err := newPrinter(*format, os.Stdout)
+		if err != nil {
+			return err
+		}
+		addr, err := writeTarget(args[0])
+		if err != nil {
+			return err
+		}
+		data, err := utils.EncodeValue(addr, args[1])
+		if err != nil {
+			return err
+		}
+		client, closeFn, err := connectOnce()
+		if err != nil {
+			return err
+		}
+		defer closeFn()
+
+		if err := utils.WriteAddress(client, addr, data); err != nil {
+			return fmt.Errorf("write %s: %w", addr, err)
+		}
+
+		// Read the value back so the operator sees what the PLC now holds.
+		r := readResult{Address: addr.String(), Type: string(addr.Type), Timestamp: time.Now()}
+		if data, err := utils.ReadAddress(client, addr); err != nil {
+			r.Error = fmt.Sprintf("written, but read back failed: %v", err)
+		} else {
+			r.Value = displayValue(utils.DecodeValue(addr, data))
+		}
+		out.print(r)
+		return nil
+	}
+}
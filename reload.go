@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"s7_plc_read/utils"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadRequest asks the collector to reload its config and to send the
+// outcome on reply.
+type reloadRequest struct {
+	source string
+	reply  chan reloadResult
+}
+
+// reloadResult is the outcome of a reload. On error the collector keeps
+// running with the config it had.
+type reloadResult struct {
+	Changes  []string
+	Problems utils.ConfigErrors
+	Err      error
+}
+
+// reloadRequests is served by the poll loop of runCollector.
+var reloadRequests = make(chan reloadRequest)
+
+// reload reads the config again and returns the runtime to continue with.
+// The new config is validated and connected before anything is swapped:
+// tags are replaced, the PLC connection and the sinks are only reopened when
+// their settings changed, and if any step fails old is returned unchanged.
+// Removed sinks write what they have queued in the background.
+func reload(ctx context.Context, old *runtime, source string) (*runtime, reloadResult) {
+	utils.Infof("Reloading %s (%s)", configFile, source)
+	cfg, problems, err := buildConfig(true)
+	var parseErrs utils.ConfigParseErrors
+	if errors.As(err, &parseErrs) {
+		problems, err = parseErrs.ConfigErrors, nil
+	}
+	if err == nil && len(problems) > 0 {
+		err = fmt.Errorf("%s has %d problem(s)", configFile, len(problems))
+	}
+	if err != nil {
+		for _, p := range problems {
+			utils.Errorf("%s: %s", configFile, p)
+		}
+		utils.Errorf("Reload failed, keeping the running config: %v", err)
+		return old, reloadResult{Problems: problems, Err: err}
+	}
+
+	next := &runtime{cfg: cfg, sim: old.sim}
+	if err := next.open(ctx, old); err != nil {
+		if old.sim != nil {
+			old.sim.Animate(old.tags)
+		}
+		utils.Errorf("Reload failed, keeping the running config: %v", err)
+		return old, reloadResult{Err: err}
+	}
+
+	utils.SetCurrentConfig(cfg)
+	utils.SetLogLevel(cfg.LogLevel)
+	setActiveClient(next.client)
+	setActiveHistorian(next.historian())
+	contexts.SetConfig(cfg.Context)
+	dispatcher.SetSinks(next.sinks)
+	dispatchSnapshots(ctx, snapshots.SetConfig(cfg.Snapshots, cfg.PlcName, next.tags))
+	old.closeReplaced(next)
+	names := make([]string, len(next.tags))
+	for i, tag := range next.tags {
+		names[i] = tag.Name
+	}
+	values.Retain(names)
+
+	changes := describeChanges(old, next)
+	if len(changes) == 0 {
+		utils.Infof("Config reloaded, nothing changed")
+	} else {
+		utils.Infof("Config reloaded: %s", strings.Join(changes, ", "))
+	}
+	if old.cfg.WebServer != cfg.WebServer || old.cfg.WebPort != cfg.WebPort || old.cfg.WebTLSCert != cfg.WebTLSCert ||
+		old.cfg.WebTLSKey != cfg.WebTLSKey || old.cfg.WebTLSSelfSigned != cfg.WebTLSSelfSigned {
+		utils.Warnf("WebServer, WebPort and the WebTLS settings only take effect after a restart")
+	}
+	if old.cfg.AccumulatorState != cfg.AccumulatorState {
+		utils.Warnf("AccumulatorState only takes effect after a restart")
+	}
+	if (old.cfg.Modbus == nil) != (cfg.Modbus == nil) || cfg.Modbus != nil && old.cfg.Modbus.Listen != cfg.Modbus.Listen {
+		utils.Warnf("Starting, stopping or moving the Modbus server only takes effect after a restart")
+	}
+	if (old.cfg.OPCUA == nil) != (cfg.OPCUA == nil) || cfg.OPCUA != nil && *old.cfg.OPCUA != *cfg.OPCUA {
+		utils.Warnf("Starting, stopping or moving the OPC UA server only takes effect after a restart")
+	}
+	return next, reloadResult{Changes: changes}
+}
+
+// describeChanges lists what a reload from old to next changed.
+func describeChanges(old, next *runtime) []string {
+	changes := []string{}
+	previous := map[string]utils.TagConfig{}
+	for _, tag := range old.tags {
+		previous[tag.Name] = tag.TagConfig
+	}
+	added, changed := 0, 0
+	for _, tag := range next.tags {
+		tc, ok := previous[tag.Name]
+		switch {
+		case !ok:
+			added++
+		case !reflect.DeepEqual(tc, tag.TagConfig):
+			changed++
+		}
+		delete(previous, tag.Name)
+	}
+	if added > 0 {
+		changes = append(changes, fmt.Sprintf("%d tag(s) added", added))
+	}
+	if changed > 0 {
+		changes = append(changes, fmt.Sprintf("%d tag(s) changed", changed))
+	}
+	if len(previous) > 0 {
+		changes = append(changes, fmt.Sprintf("%d tag(s) removed", len(previous)))
+	}
+
+	if next.handler != old.handler {
+		changes = append(changes, fmt.Sprintf("reconnected to PLC at %s:%s", next.cfg.PlcIP, next.cfg.PlcPort))
+	}
+	for _, sink := range next.sinks {
+		i := slices.IndexFunc(old.sinks, func(s utils.ConfiguredSink) bool { return s.Sink == sink.Sink })
+		switch {
+		case i < 0:
+			changes = append(changes, "opened "+sink.Name())
+		case old.sinks[i].Queue != sink.Queue || !reflect.DeepEqual(old.sinks[i].Tags(old.tags), sink.Tags(next.tags)) ||
+			!old.sinks[i].SameAggregation(sink):
+			changes = append(changes, "reconfigured "+sink.Name())
+		}
+	}
+	for _, sink := range old.sinks {
+		if !slices.ContainsFunc(next.sinks, func(s utils.ConfiguredSink) bool { return s.Sink == sink.Sink }) {
+			changes = append(changes, "closed "+sink.Name())
+		}
+	}
+
+	if !reflect.DeepEqual(old.cfg.Context, next.cfg.Context) {
+		changes = append(changes, "context changed")
+	}
+
+	settings := []struct {
+		name      string
+		old, next interface{}
+	}{
+		{"PlcName", old.cfg.PlcName, next.cfg.PlcName},
+		{"StatusInterval", old.cfg.StatusInterval, next.cfg.StatusInterval},
+		{"LogLevel", old.cfg.LogLevel, next.cfg.LogLevel},
+		{"TagBoundsCheck", old.cfg.TagBoundsCheck, next.cfg.TagBoundsCheck},
+		{"JSONLayout", old.cfg.JSONLayout, next.cfg.JSONLayout},
+		{"WebServer", old.cfg.WebServer, next.cfg.WebServer},
+		{"WebPort", old.cfg.WebPort, next.cfg.WebPort},
+	}
+	for _, s := range settings {
+		if s.old != s.next {
+			changes = append(changes, fmt.Sprintf("%s %v -> %v", s.name, s.old, s.next))
+		}
+	}
+	return changes
+}
+
+// configWatcher watches the config file and the files it includes. Editors
+// often replace a file instead of writing it, so the directories are
+// watched rather than the files.
+type configWatcher struct {
+	*fsnotify.Watcher
+	path string
+
+	mu    sync.Mutex
+	files map[string]bool
+	dirs  map[string]bool
+}
+
+// watchConfig starts watching the config file at path. Bursts of changes
+// are collapsed into one send on changed.
+func watchConfig(path string, changed chan<- struct{}) (*configWatcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &configWatcher{Watcher: fw, path: path, dirs: map[string]bool{}}
+	w.update()
+	if len(w.dirs) == 0 {
+		fw.Close()
+		return nil, fmt.Errorf("no config files to watch")
+	}
+
+	go func() {
+		var debounce <-chan time.Time
+		for {
+			select {
+			case event, ok := <-fw.Events:
+				if !ok {
+					return
+				}
+				if w.relevant(event) {
+					debounce = time.After(500 * time.Millisecond)
+				}
+			case err, ok := <-fw.Errors:
+				if !ok {
+					return
+				}
+				utils.Warnf("Watching config files: %v", err)
+			case <-debounce:
+				debounce = nil
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return w, nil
+}
+
+// update watches the files the config consists of now, which change when
+// includes are added or removed.
+func (w *configWatcher) update() {
+	files, _ := utils.ConfigFiles(w.path)
+	if abs, err := filepath.Abs(w.path); err == nil {
+		files = append(files, abs)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files = map[string]bool{}
+	dirs := map[string]bool{}
+	for _, file := range files {
+		w.files[file] = true
+		dirs[filepath.Dir(file)] = true
+	}
+	for dir := range dirs {
+		if !w.dirs[dir] {
+			if err := w.Add(dir); err != nil {
+				utils.Warnf("Cannot watch %s: %v", dir, err)
+				delete(dirs, dir)
+				continue
+			}
+		}
+		delete(w.dirs, dir)
+	}
+	for dir := range w.dirs {
+		w.Remove(dir)
+	}
+	w.dirs = dirs
+}
+
+// relevant reports whether event may change the config: a change of one of
+// its files, or a new config file that an include pattern may match.
+func (w *configWatcher) relevant(event fsnotify.Event) bool {
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+	name, err := filepath.Abs(event.Name)
+	if err != nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.files[name] || event.Op.Has(fsnotify.Create) && utils.IsConfigFile(name)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"s7_plc_read/utils"
+)
+
+// A config with problems is rejected as a whole and the collector keeps
+// running with the config it had.
+func TestReloadRejectsBadConfig(t *testing.T) {
+	defer func(path string) { configFile = path }(configFile)
+	configFile = filepath.Join(t.TempDir(), "config.json")
+	running := utils.DefaultConfig()
+	running.PlcIP = "10.0.0.1"
+	utils.SetCurrentConfig(running)
+
+	tests := []struct {
+		name, doc string
+		want      string // Path of a problem
+	}{
+		{"syntax", `{"PlcIP": "10.0.0.2",`, ""},
+		{"unknown key", `{"PlcIP": "10.0.0.2", "PlcIp": "10.0.0.3"}`, "PlcIp"},
+		{"wrong type", `{"PlcIP": "10.0.0.2", "PlcRack": "0"}`, "PlcRack"},
+		{"invalid value", `{"PlcIP": "plc 2"}`, "PlcIP"},
+		{"bad tag", `{"PlcIP": "10.0.0.2", "Tags": [{"Name": "A", "Address": "DB1.DBQ4"}]}`, "Tags[0].Address"},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(configFile, []byte(tt.doc), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		old := &runtime{cfg: running}
+		next, result := reload(context.Background(), old, "test")
+		if next != old || result.Err == nil || len(result.Changes) > 0 {
+			t.Errorf("%s: reload was applied: %+v", tt.name, result)
+		}
+		if len(result.Problems) == 0 {
+			t.Errorf("%s: no problems reported", tt.name)
+		}
+		if tt.want != "" && !slices.ContainsFunc(result.Problems, func(p utils.ConfigError) bool { return p.Path == tt.want }) {
+			t.Errorf("%s: no problem at %s in:\n%v", tt.name, tt.want, result.Problems)
+		}
+		if ip := utils.CurrentConfig().PlcIP; ip != "10.0.0.1" {
+			t.Errorf("%s: current PlcIP %s after the failed reload", tt.name, ip)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+import _ "embed"
+
+// configSchema is the JSON Schema of the config file. Editors that support
+// JSON Schema pick it up from the "$schema" key of config.json.
+//
+//go:embed config.schema.json
+var configSchema []byte
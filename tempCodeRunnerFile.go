@@ -1 +0,0 @@
-continue
\ No newline at end of file
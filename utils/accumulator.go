@@ -0,0 +1,380 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AccumulatorConfig makes a tag add up the values of another tag over time,
+// for run hours and part counts the PLC does not keep itself.
+type AccumulatorConfig struct {
+	Type       string   `json:"Type"`       // runtime, totalizer or counter
+	Source     string   `json:"Source"`     // Tag accumulated: running bit, rate or PLC counter
+	Unit       string   `json:"Unit"`       // runtime: unit of the value; totalizer: time unit of the rate; s, min or h (default)
+	Bits       int      `json:"Bits"`       // counter: width at which the PLC counter wraps, defaults to the size of Source
+	MaxGap     string   `json:"MaxGap"`     // runtime and totalizer: longer gaps between polls are not counted, defaults to 1m
+	Reset      string   `json:"Reset"`      // never (default), daily or shift
+	ResetTimes []string `json:"ResetTimes"` // Local times of the resets, defaults to 00:00 for daily and the DefaultShiftStarts for shift
+}
+
+// Types of accumulators.
+const (
+	// AccumulateRuntime counts the time Source is true or not 0.
+	AccumulateRuntime = "runtime"
+	// AccumulateTotalizer integrates the rate Source over time, e.g. m³/h
+	// into m³.
+	AccumulateTotalizer = "totalizer"
+	// AccumulateCounter adds up the increments of the PLC counter Source,
+	// across wraps and resets of the counter.
+	AccumulateCounter = "counter"
+)
+
+// Reset schedules of accumulators.
+const (
+	ResetNever = "never"
+	ResetDaily = "daily"
+	ResetShift = "shift"
+)
+
+// accumulatorUnits are the units of runtime and totalizer accumulators.
+var accumulatorUnits = map[string]time.Duration{"s": time.Second, "min": time.Minute, "h": time.Hour}
+
+// dataType returns the type of the values of the accumulator.
+func (c *AccumulatorConfig) dataType() DataType {
+	if c.Type == AccumulateCounter {
+		return TypeLInt
+	}
+	return TypeLReal
+}
+
+func (c *AccumulatorConfig) unit() time.Duration {
+	if d, ok := accumulatorUnits[c.Unit]; ok {
+		return d
+	}
+	return time.Hour
+}
+
+func (c *AccumulatorConfig) maxGap() time.Duration {
+	if d, err := time.ParseDuration(c.MaxGap); err == nil && d > 0 {
+		return d
+	}
+	return time.Minute
+}
+
+// sameTotal reports whether a total kept for c is one for other. Changes of
+// MaxGap and the resets apply to the running total.
+func (c *AccumulatorConfig) sameTotal(other *AccumulatorConfig) bool {
+	return c.Type == other.Type && c.Source == other.Source && c.unit() == other.unit() && c.Bits == other.Bits
+}
+
+// resetTimes returns the local times of day of the resets in minutes after
+// midnight, none when the accumulator is never reset.
+func (c *AccumulatorConfig) resetTimes() []int {
+	clocks := c.ResetTimes
+	switch {
+	case c.Reset == "" || c.Reset == ResetNever:
+		return nil
+	case clocks != nil:
+	case c.Reset == ResetShift:
+		clocks = DefaultShiftStarts
+	default:
+		clocks = []string{"00:00"}
+	}
+	var minutes []int
+	for _, clock := range clocks {
+		if m, err := parseClock(clock); err == nil {
+			minutes = append(minutes, m)
+		}
+	}
+	sort.Ints(minutes)
+	return minutes
+}
+
+// validate checks the fields of c, reporting problems under path. source is
+// the tag named by Source, nil when there is none.
+func (c *AccumulatorConfig) validate(path string, source *Tag, errs *ConfigErrors) {
+	checkOneOf(errs, path+".Type", c.Type, AccumulateRuntime, AccumulateTotalizer, AccumulateCounter)
+	switch {
+	case c.Source == "":
+		errs.add(path+".Source", "is required")
+	case source == nil:
+		errs.add(path+".Source", "unknown tag %q", c.Source)
+	case source.Accumulate != nil:
+		errs.add(path+".Source", "%s is an accumulator itself", c.Source)
+	case c.Type == AccumulateRuntime && !numericType(source.Addr.Type):
+		errs.add(path+".Source", "%s of type %s is not a BOOL or a number", c.Source, source.Addr.Type)
+	case c.Type == AccumulateTotalizer && (!numericType(source.Addr.Type) || source.Addr.Type == TypeBool):
+		errs.add(path+".Source", "%s of type %s is not a number", c.Source, source.Addr.Type)
+	case c.Type == AccumulateCounter && (!numericType(source.Addr.Type) || slices.Contains([]DataType{TypeBool, TypeReal, TypeLReal}, source.Addr.Type)):
+		errs.add(path+".Source", "%s of type %s is not an integer", c.Source, source.Addr.Type)
+	}
+	if c.Unit != "" {
+		checkOneOf(errs, path+".Unit", c.Unit, "s", "min", "h")
+	}
+	if c.Bits != 0 {
+		if c.Type != AccumulateCounter {
+			errs.add(path+".Bits", "only applies to counter")
+		} else if !slices.Contains([]int{8, 16, 32, 64}, c.Bits) {
+			errs.add(path+".Bits", "must be 8, 16, 32 or 64, found %d", c.Bits)
+		}
+	}
+	if c.MaxGap != "" {
+		if d, err := time.ParseDuration(c.MaxGap); err != nil || d <= 0 {
+			errs.add(path+".MaxGap", "must be a positive duration like 1m, found %q", c.MaxGap)
+		}
+	}
+	if c.Reset != "" {
+		checkOneOf(errs, path+".Reset", c.Reset, ResetNever, ResetDaily, ResetShift)
+	}
+	for i, clock := range c.ResetTimes {
+		if _, err := parseClock(clock); err != nil {
+			errs.add(fmt.Sprintf("%s.ResetTimes[%d]", path, i), "%v", err)
+		}
+	}
+	if c.ResetTimes != nil && (c.Reset == "" || c.Reset == ResetNever) {
+		errs.add(path+".ResetTimes", "needs Reset daily or shift")
+	}
+}
+
+// Accumulators keeps the totals of the accumulator tags and saves them to a
+// file, so they survive restarts. It is safe for concurrent use.
+type Accumulators struct {
+	path string
+
+	mu     sync.Mutex
+	states map[string]*accumulatorState // By tag name
+	saved  time.Time
+}
+
+// accumulatorState is the total of one accumulator as it is saved.
+type accumulatorState struct {
+	Config      AccumulatorConfig `json:"config"` // The total starts over when it changes, see sameTotal
+	Value       float64           `json:"value"`
+	PeriodStart time.Time         `json:"periodStart,omitzero"` // Of the current reset period
+	Last        float64           `json:"last"`                 // Source value at LastAt
+	LastAt      time.Time         `json:"lastAt,omitzero"`      // Zero when there is no last value
+}
+
+// accumulatorSaveInterval is how often Update saves the totals.
+const accumulatorSaveInterval = 10 * time.Second
+
+// OpenAccumulators loads the totals saved in the file at path, which need
+// not exist yet.
+func OpenAccumulators(path string) (*Accumulators, error) {
+	a := &Accumulators{path: path, states: map[string]*accumulatorState{}, saved: time.Now()}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &a.states); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return a, nil
+}
+
+// Update sets the values of the accumulator tags among tags from the values
+// of their sources in values, which belong to one poll. The totals are
+// saved every few seconds.
+func (a *Accumulators) Update(tags []Tag, values []TagValue) {
+	index := map[string]int{}
+	for _, tag := range tags {
+		if tag.Accumulate != nil {
+			index[tag.Accumulate.Source] = -1
+		}
+	}
+	if len(index) == 0 {
+		return
+	}
+	for i, tag := range tags {
+		if _, ok := index[tag.Name]; ok {
+			index[tag.Name] = i
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, tag := range tags {
+		if tag.Accumulate == nil {
+			continue
+		}
+		values[i].Error = ""
+		j := index[tag.Accumulate.Source]
+		if j < 0 {
+			values[i].Error = fmt.Sprintf("unknown source %s", tag.Accumulate.Source)
+			continue
+		}
+		s, ok := a.states[tag.Name]
+		if !ok || !s.Config.sameTotal(tag.Accumulate) {
+			s = &accumulatorState{}
+			a.states[tag.Name] = s
+		}
+		s.Config = *tag.Accumulate
+		s.update(tag.Name, values[j], values[i].Timestamp)
+		values[i].Value = s.Value
+		if tag.Accumulate.Type == AccumulateCounter {
+			values[i].Value = int64(s.Value)
+		}
+		values[i].Quality = QualityGood
+		if values[j].Quality != QualityGood {
+			// The total is still known, it just does not grow.
+			values[i].Error = fmt.Sprintf("%s is bad", tags[j].Name)
+		}
+	}
+
+	if time.Since(a.saved) >= accumulatorSaveInterval {
+		a.saved = time.Now()
+		if err := a.save(tags); err != nil {
+			Errorf("Failed to save the accumulators: %v", err)
+		}
+	}
+}
+
+// Save writes the totals of the accumulator tags among tags to the file,
+// dropping those of tags that are gone.
+func (a *Accumulators) Save(tags []Tag) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.save(tags)
+}
+
+func (a *Accumulators) save(tags []Tag) error {
+	for name := range a.states {
+		if !slices.ContainsFunc(tags, func(t Tag) bool { return t.Name == name && t.Accumulate != nil }) {
+			delete(a.states, name)
+		}
+	}
+	data, err := json.MarshalIndent(a.states, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// update adds the source value v polled at now to the total of the
+// accumulator name.
+func (s *accumulatorState) update(name string, v TagValue, now time.Time) {
+	cfg := &s.Config
+	if v.Quality != QualityGood {
+		// A gap: nothing is known about the time until the next value.
+		if cfg.Type != AccumulateCounter {
+			s.LastAt = time.Time{}
+		}
+		return
+	}
+	current, _ := numericValue(v.Value)
+
+	var increment float64
+	if !s.LastAt.IsZero() && now.After(s.LastAt) {
+		dt := now.Sub(s.LastAt)
+		switch cfg.Type {
+		case AccumulateRuntime:
+			if s.Last != 0 && dt <= cfg.maxGap() {
+				increment = float64(dt) / float64(cfg.unit())
+			}
+		case AccumulateTotalizer:
+			if dt <= cfg.maxGap() {
+				increment = (s.Last + current) / 2 * float64(dt) / float64(cfg.unit())
+			}
+		case AccumulateCounter:
+			increment = counterDelta(name, cfg.Bits, v, s.Last, current)
+		}
+	}
+	if cfg.Type == AccumulateCounter && cfg.Bits < 64 {
+		current = unsignedCount(current, counterBits(cfg.Bits, v))
+	}
+
+	// Time based totals only keep the part of the increment after a reset,
+	// counters start the new period with theirs.
+	if clocks := cfg.resetTimes(); len(clocks) > 0 {
+		boundary := lastBoundary(now, clocks)
+		if s.PeriodStart.IsZero() {
+			s.PeriodStart = boundary
+		}
+		if boundary.After(s.PeriodStart) {
+			Infof("Accumulator %s: reset at %s after %g", name, boundary.Format("2006-01-02 15:04"), s.Value)
+			s.Value = 0
+			s.PeriodStart = boundary
+			if cfg.Type != AccumulateCounter && boundary.After(s.LastAt) && !s.LastAt.IsZero() {
+				increment *= float64(now.Sub(boundary)) / float64(now.Sub(s.LastAt))
+			}
+		}
+	}
+	s.Value += increment
+	s.Last, s.LastAt = current, now
+}
+
+// counterBits returns the width of the counter v, bits or the size of its
+// type.
+func counterBits(bits int, v TagValue) int {
+	if bits != 0 {
+		return bits
+	}
+	switch v.Value.(type) {
+	case uint8, int8:
+		return 8
+	case uint16, int16:
+		return 16
+	case uint32, int32:
+		return 32
+	}
+	return 64
+}
+
+// unsignedCount maps a signed counter value onto 0..2^bits-1, where it
+// wraps.
+func unsignedCount(v float64, bits int) float64 {
+	if v < 0 {
+		return v + math.Exp2(float64(bits))
+	}
+	return v
+}
+
+// counterDelta returns how much the PLC counter of the accumulator name went
+// up from last to current. A counter that went down wrapped when the wrap
+// is the smaller step, otherwise the PLC reset it and it counted up from 0.
+func counterDelta(name string, bits int, v TagValue, last, current float64) float64 {
+	bits = counterBits(bits, v)
+	if bits < 64 {
+		current = unsignedCount(current, bits)
+	}
+	if current >= last {
+		return current - last
+	}
+	if bits < 64 {
+		span := math.Exp2(float64(bits))
+		if wrapped := current + span - last; wrapped < span/2 {
+			return wrapped
+		}
+	}
+	Infof("Accumulator %s: the PLC counter went back from %g to %g, counting it as reset", name, last, current)
+	return current
+}
+
+// lastBoundary returns the latest local time of day in clocks, minutes
+// after midnight, at or before t.
+func lastBoundary(t time.Time, clocks []int) time.Time {
+	t = t.Local()
+	y, m, d := t.Date()
+	for day := 0; day >= -1; day-- {
+		for i := len(clocks) - 1; i >= 0; i-- {
+			if b := time.Date(y, m, d+day, 0, clocks[i], 0, 0, time.Local); !b.After(t) {
+				return b
+			}
+		}
+	}
+	return time.Date(y, m, d-1, 0, clocks[0], 0, 0, time.Local)
+}
@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// accumulatorPoll is one poll of the source of an accumulator, at seconds
+// after the start.
+type accumulatorPoll struct {
+	at    int
+	value interface{}
+	bad   bool
+}
+
+// runAccumulator feeds polls to an accumulator of cfg starting at start
+// and returns its last value. The source of the accumulator is Source.
+func runAccumulator(t *testing.T, a *Accumulators, cfg AccumulatorConfig, start time.Time, polls []accumulatorPoll) interface{} {
+	t.Helper()
+	cfg.Source = "Source"
+	tags := []Tag{
+		{TagConfig: TagConfig{Name: "Source"}},
+		{TagConfig: TagConfig{Name: "Total", Accumulate: &cfg}},
+	}
+	var total TagValue
+	for _, p := range polls {
+		at := start.Add(time.Duration(p.at) * time.Second)
+		source := TagValue{Name: "Source", Value: p.value, Quality: QualityGood, Timestamp: at}
+		if p.bad {
+			source = TagValue{Name: "Source", Quality: QualityBad, Error: "timeout", Timestamp: at}
+		}
+		values := []TagValue{source, {Name: "Total", Timestamp: at}}
+		a.Update(tags, values)
+		total = values[1]
+		if total.Quality != QualityGood || (total.Error != "") != p.bad {
+			t.Fatalf("poll at %ds: %+v", p.at, total)
+		}
+	}
+	return total.Value
+}
+
+func TestAccumulators(t *testing.T) {
+	start := time.Date(2024, 3, 5, 10, 0, 0, 0, time.Local)
+	tests := []struct {
+		name  string
+		cfg   AccumulatorConfig
+		polls []accumulatorPoll
+		want  interface{}
+	}{
+		{"runtime", AccumulatorConfig{Type: AccumulateRuntime, Unit: "s"},
+			[]accumulatorPoll{{0, true, false}, {10, true, false}, {20, false, false}, {30, true, false}, {40, true, false}}, 30.0},
+		{"runtime in hours", AccumulatorConfig{Type: AccumulateRuntime},
+			[]accumulatorPoll{{0, int16(1), false}, {36, int16(1), false}}, 0.01},
+		{"runtime gap", AccumulatorConfig{Type: AccumulateRuntime, Unit: "s", MaxGap: "15s"},
+			[]accumulatorPoll{{0, true, false}, {60, true, false}, {70, true, false}}, 10.0},
+		{"runtime bad poll", AccumulatorConfig{Type: AccumulateRuntime, Unit: "s"},
+			[]accumulatorPoll{{0, true, false}, {10, nil, true}, {20, true, false}, {30, true, false}}, 10.0},
+		{"totalizer", AccumulatorConfig{Type: AccumulateTotalizer, Unit: "s"},
+			[]accumulatorPoll{{0, float32(2), false}, {10, float32(4), false}, {20, float32(6), false}}, 80.0},
+		{"counter", AccumulatorConfig{Type: AccumulateCounter},
+			[]accumulatorPoll{{0, uint16(100), false}, {10, uint16(130), false}, {20, nil, true}, {30, uint16(135), false}}, int64(35)},
+		{"counter wraps", AccumulatorConfig{Type: AccumulateCounter},
+			[]accumulatorPoll{{0, uint16(65530), false}, {10, uint16(4), false}, {20, uint16(10), false}}, int64(16)},
+		{"signed counter wraps", AccumulatorConfig{Type: AccumulateCounter},
+			[]accumulatorPoll{{0, int16(32760), false}, {10, int16(-32766), false}}, int64(10)},
+		{"counter reset by the PLC", AccumulatorConfig{Type: AccumulateCounter},
+			[]accumulatorPoll{{0, uint16(5000), false}, {10, uint16(5010), false}, {20, uint16(3), false}}, int64(13)},
+		{"counter with Bits", AccumulatorConfig{Type: AccumulateCounter, Bits: 8},
+			[]accumulatorPoll{{0, int32(250), false}, {10, int32(4), false}}, int64(10)},
+	}
+	for _, tt := range tests {
+		a, err := OpenAccumulators(filepath.Join(t.TempDir(), "totals.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := runAccumulator(t, a, tt.cfg, start, tt.polls)
+		if f, ok := got.(float64); ok {
+			got = float64(int64(f*1e9+0.5)) / 1e9
+		}
+		if got != tt.want {
+			t.Errorf("%s: %v (%T), want %v (%T)", tt.name, got, got, tt.want, tt.want)
+		}
+	}
+}
+
+func TestAccumulatorReset(t *testing.T) {
+	midnight := time.Date(2024, 3, 6, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		name  string
+		cfg   AccumulatorConfig
+		start time.Time
+		polls []accumulatorPoll
+		want  interface{}
+	}{
+		// Only the 5s after midnight count for the new day.
+		{"daily runtime", AccumulatorConfig{Type: AccumulateRuntime, Unit: "s", Reset: ResetDaily}, midnight.Add(-25 * time.Second),
+			[]accumulatorPoll{{0, true, false}, {10, true, false}, {20, true, false}, {30, true, false}, {40, true, false}}, 15.0},
+		{"shift totalizer", AccumulatorConfig{Type: AccumulateTotalizer, Unit: "s", Reset: ResetShift, ResetTimes: []string{"06:00", "18:00"}}, midnight.Add(18*time.Hour - 10*time.Second),
+			[]accumulatorPoll{{0, 1.0, false}, {10, 1.0, false}, {20, 1.0, false}}, 10.0},
+		// A counter starts the new period with the counts since the last
+		// poll.
+		{"daily counter", AccumulatorConfig{Type: AccumulateCounter, Reset: ResetDaily}, midnight.Add(-15 * time.Second),
+			[]accumulatorPoll{{0, uint16(1), false}, {10, uint16(3), false}, {20, uint16(7), false}, {30, uint16(8), false}}, int64(5)},
+		{"never", AccumulatorConfig{Type: AccumulateCounter}, midnight.Add(-15 * time.Second),
+			[]accumulatorPoll{{0, uint16(1), false}, {10, uint16(3), false}, {20, uint16(7), false}, {30, uint16(8), false}}, int64(7)},
+	}
+	for _, tt := range tests {
+		a, err := OpenAccumulators(filepath.Join(t.TempDir(), "totals.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := runAccumulator(t, a, tt.cfg, tt.start, tt.polls); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAccumulatorsSaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "totals.json")
+	cfg := AccumulatorConfig{Type: AccumulateCounter, Source: "Source"}
+	tags := []Tag{
+		{TagConfig: TagConfig{Name: "Source"}},
+		{TagConfig: TagConfig{Name: "Total", Accumulate: &cfg}},
+	}
+	start := time.Date(2024, 3, 5, 10, 0, 0, 0, time.Local)
+	a, err := OpenAccumulators(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runAccumulator(t, a, cfg, start, []accumulatorPoll{{0, uint16(10), false}, {10, uint16(25), false}})
+	if err := a.Save(tags); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a restart the total carries on from the saved counter value.
+	a, err = OpenAccumulators(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runAccumulator(t, a, cfg, start, []accumulatorPoll{{20, uint16(30), false}}); got != int64(20) {
+		t.Errorf("after a restart %v, want 20", got)
+	}
+	// A counter of another width starts a new total.
+	other := AccumulatorConfig{Type: AccumulateCounter, Source: "Source", Bits: 8}
+	if got := runAccumulator(t, a, other, start, []accumulatorPoll{{30, uint16(40), false}}); got != int64(0) {
+		t.Errorf("after a config change %v, want 0", got)
+	}
+
+	// Totals of tags that are gone are dropped.
+	if err := a.Save(tags[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if a, err = OpenAccumulators(path); err != nil || len(a.states) != 0 {
+		t.Errorf("states %v, %v after the tag was removed", a.states, err)
+	}
+}
+
+func TestAccumulatorValidate(t *testing.T) {
+	tags := map[string]*Tag{
+		"Running": {TagConfig: TagConfig{Name: "Running"}, Addr: Address{Type: TypeBool}},
+		"Flow":    {TagConfig: TagConfig{Name: "Flow"}, Addr: Address{Type: TypeReal}},
+		"Parts":   {TagConfig: TagConfig{Name: "Parts"}, Addr: Address{Type: TypeDInt}},
+		"Recipe":  {TagConfig: TagConfig{Name: "Recipe"}, Addr: Address{Type: TypeString}},
+		"Hours":   {TagConfig: TagConfig{Name: "Hours", Accumulate: &AccumulatorConfig{Type: AccumulateRuntime, Source: "Running"}}},
+	}
+	tests := []struct {
+		cfg  AccumulatorConfig
+		want []string // Paths of the problems
+	}{
+		{AccumulatorConfig{Type: AccumulateRuntime, Source: "Running", Unit: "min", MaxGap: "30s", Reset: ResetShift}, nil},
+		{AccumulatorConfig{Type: AccumulateCounter, Source: "Parts", Bits: 16, Reset: ResetDaily, ResetTimes: []string{"06:00"}}, nil},
+		{AccumulatorConfig{Type: "sum", Source: ""}, []string{"A.Type", "A.Source"}},
+		{AccumulatorConfig{Type: AccumulateRuntime, Source: "Missing"}, []string{"A.Source"}},
+		{AccumulatorConfig{Type: AccumulateRuntime, Source: "Hours"}, []string{"A.Source"}},
+		{AccumulatorConfig{Type: AccumulateRuntime, Source: "Recipe"}, []string{"A.Source"}},
+		{AccumulatorConfig{Type: AccumulateTotalizer, Source: "Running"}, []string{"A.Source"}},
+		{AccumulatorConfig{Type: AccumulateCounter, Source: "Flow"}, []string{"A.Source"}},
+		{AccumulatorConfig{Type: AccumulateTotalizer, Source: "Flow", Unit: "d", Bits: 16, MaxGap: "-1s"}, []string{"A.Unit", "A.Bits", "A.MaxGap"}},
+		{AccumulatorConfig{Type: AccumulateCounter, Source: "Parts", Bits: 12, Reset: "weekly"}, []string{"A.Bits", "A.Reset"}},
+		{AccumulatorConfig{Type: AccumulateCounter, Source: "Parts", ResetTimes: []string{"6"}}, []string{"A.ResetTimes[0]", "A.ResetTimes"}},
+	}
+	for _, tt := range tests {
+		var errs ConfigErrors
+		tt.cfg.validate("A", tags[tt.cfg.Source], &errs)
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Path)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%+v: problems at %v, want %v:\n%v", tt.cfg, got, tt.want, errs)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/robinson/gos7"
+)
+
+// Area is the PLC memory area an address points into.
+type Area int
+
+const (
+	AreaDB Area = iota
+	AreaMerker
+	AreaInput
+	AreaOutput
+)
+
+func (a Area) String() string {
+	switch a {
+	case AreaDB:
+		return "DB"
+	case AreaMerker:
+		return "M"
+	case AreaInput:
+		return "I"
+	case AreaOutput:
+		return "Q"
+	}
+	return "?"
+}
+
+// Address is a parsed S7 address such as DB1.DBX0.1, DB1.DBD4:REAL, MW10 or
+// I0.3. Without a type suffix the type follows the size letter: X is BOOL,
+// B is BYTE, W is WORD and D is DWORD.
+type Address struct {
+	Area   Area
+	DB     int // DB number, only for AreaDB
+	Start  int // Byte offset
+	Bit    int // Bit within the byte, only for BOOL
+	Type   DataType
+	Length int // Maximum length, only for STRING and WSTRING
+}
+
+// Size returns the number of bytes the address occupies.
+func (a Address) Size() int {
+	return TypeSize(a.Type, a.Length)
+}
+
+func (a Address) String() string {
+	var prefix string
+	if a.Area == AreaDB {
+		prefix = fmt.Sprintf("DB%d.DB", a.DB)
+	} else {
+		prefix = a.Area.String()
+	}
+	if a.Type == TypeBool {
+		if a.Area == AreaDB {
+			return fmt.Sprintf("%sX%d.%d", prefix, a.Start, a.Bit)
+		}
+		return fmt.Sprintf("%s%d.%d", prefix, a.Start, a.Bit)
+	}
+
+	letter, defaultType := "B", TypeByte
+	switch a.Size() {
+	case 2:
+		letter, defaultType = "W", TypeWord
+	case 4:
+		letter, defaultType = "D", TypeDWord
+	}
+	s := fmt.Sprintf("%s%s%d", prefix, letter, a.Start)
+	switch {
+	case a.Type == defaultType:
+		return s
+	case a.Type == TypeString || a.Type == TypeWString:
+		return fmt.Sprintf("%s:%s[%d]", s, a.Type, a.Length)
+	}
+	return s + ":" + string(a.Type)
+}
+
+// ParseAddress parses an S7 address with an optional ":TYPE" suffix. Both the
+// English (I/Q) and German (E/A) mnemonics are accepted for inputs and
+// outputs.
+func ParseAddress(s string) (Address, error) {
+	var addr Address
+	text := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(s), " ", ""))
+	if text == "" {
+		return addr, fmt.Errorf("empty address")
+	}
+	text, typeName, hasType := strings.Cut(text, ":")
+
+	rest := text
+	if strings.HasPrefix(text, "DB") {
+		dot := strings.Index(text, ".")
+		if dot < 0 {
+			return addr, fmt.Errorf("address %q: expected DB<n>.DB<X|B|W|D><offset>", s)
+		}
+		db, err := strconv.Atoi(text[2:dot])
+		if err != nil || db <= 0 {
+			return addr, fmt.Errorf("address %q: invalid DB number", s)
+		}
+		rest = text[dot+1:]
+		if !strings.HasPrefix(rest, "DB") {
+			return addr, fmt.Errorf("address %q: expected DB<n>.DB<X|B|W|D><offset>", s)
+		}
+		addr.Area = AreaDB
+		addr.DB = db
+		rest = rest[2:]
+	} else {
+		switch rest[0] {
+		case 'M':
+			addr.Area = AreaMerker
+		case 'I', 'E':
+			addr.Area = AreaInput
+		case 'Q', 'A':
+			addr.Area = AreaOutput
+		default:
+			return addr, fmt.Errorf("address %q: unknown area", s)
+		}
+		rest = rest[1:]
+		// M0.1, I0.0 and Q1.7 have no size letter.
+		if rest != "" && rest[0] >= '0' && rest[0] <= '9' {
+			rest = "X" + rest
+		}
+	}
+
+	if rest == "" {
+		return addr, fmt.Errorf("address %q: missing size and offset", s)
+	}
+	switch rest[0] {
+	case 'X':
+		addr.Type = TypeBool
+	case 'B':
+		addr.Type = TypeByte
+	case 'W':
+		addr.Type = TypeWord
+	case 'D':
+		addr.Type = TypeDWord
+	default:
+		return addr, fmt.Errorf("address %q: unknown size %q", s, rest[0])
+	}
+	rest = rest[1:]
+
+	offset := rest
+	if addr.Type == TypeBool {
+		var bit string
+		var ok bool
+		offset, bit, ok = strings.Cut(rest, ".")
+		if !ok {
+			return addr, fmt.Errorf("address %q: bit address needs <byte>.<bit>", s)
+		}
+		n, err := strconv.Atoi(bit)
+		if err != nil || n < 0 || n > 7 {
+			return addr, fmt.Errorf("address %q: bit must be 0..7", s)
+		}
+		addr.Bit = n
+	}
+	start, err := strconv.Atoi(offset)
+	if err != nil || start < 0 {
+		return addr, fmt.Errorf("address %q: invalid byte offset", s)
+	}
+	addr.Start = start
+
+	if hasType {
+		t, length, err := ParseDataType(typeName)
+		if err != nil {
+			return addr, fmt.Errorf("address %q: %w", s, err)
+		}
+		if (t == TypeBool) != (addr.Type == TypeBool) {
+			return addr, fmt.Errorf("address %q: BOOL needs a bit address and a bit address needs BOOL", s)
+		}
+		addr.Type, addr.Length = t, length
+	}
+	return addr, nil
+}
+
+// ReadAddress reads the raw bytes of addr from the PLC.
+func ReadAddress(client gos7.Client, addr Address) ([]byte, error) {
+	buf := make([]byte, addr.Size())
+	return buf, readArea(client, addr, buf)
+}
+
+// WriteAddress writes raw bytes to addr. Bits are written individually so the
+// other bits of the byte are left untouched.
+func WriteAddress(client gos7.Client, addr Address, data []byte) error {
+	if addr.Type == TypeBool {
+		item := gos7.S7DataItem{
+			Area:     s7AreaCode(addr.Area),
+			WordLen:  s7WordLenBit,
+			DBNumber: addr.DB,
+			Start:    addr.Start*8 + addr.Bit,
+			Amount:   1,
+			Data:     data[:1],
+		}
+		items := []gos7.S7DataItem{item}
+		err := withoutStdout(func() error { return client.AGWriteMulti(items, 1) })
+		if err != nil {
+			return err
+		}
+		if items[0].Error != "" {
+			return errors.New(items[0].Error)
+		}
+		return nil
+	}
+	switch addr.Area {
+	case AreaDB:
+		return client.AGWriteDB(addr.DB, addr.Start, len(data), data)
+	case AreaMerker:
+		return client.AGWriteMB(addr.Start, len(data), data)
+	case AreaInput:
+		return client.AGWriteEB(addr.Start, len(data), data)
+	case AreaOutput:
+		return client.AGWriteAB(addr.Start, len(data), data)
+	}
+	return fmt.Errorf("unsupported area %v", addr.Area)
+}
+
+// S7 protocol codes used with AGWriteMulti, which gos7 does not export.
+const (
+	s7AreaInput  = 0x81
+	s7AreaOutput = 0x82
+	s7AreaMerker = 0x83
+	s7AreaDB     = 0x84
+	s7WordLenBit = 0x01
+)
+
+func s7AreaCode(area Area) int {
+	switch area {
+	case AreaInput:
+		return s7AreaInput
+	case AreaOutput:
+		return s7AreaOutput
+	case AreaMerker:
+		return s7AreaMerker
+	}
+	return s7AreaDB
+}
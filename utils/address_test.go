@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/robinson/gos7"
+)
+
+// rejectingClient answers multi-item writes like a PLC that refuses every
+// item.
+type rejectingClient struct {
+	gos7.Client
+}
+
+func (rejectingClient) AGWriteMulti(items []gos7.S7DataItem, count int) error {
+	for i := range count {
+		items[i].Error = "CPU : Address out of range"
+	}
+	return nil
+}
+
+func TestWriteAddressBitRejected(t *testing.T) {
+	addr, err := ParseAddress("DB1.DBX0.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteAddress(rejectingClient{}, addr, []byte{1}); err == nil {
+		t.Fatal("write rejected by the PLC returned no error")
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Address
+		str  string // String of the result
+	}{
+		{"DB1.DBX0.1", Address{Area: AreaDB, DB: 1, Start: 0, Bit: 1, Type: TypeBool}, "DB1.DBX0.1"},
+		{"db10.dbb3", Address{Area: AreaDB, DB: 10, Start: 3, Type: TypeByte}, "DB10.DBB3"},
+		{"DB1.DBW4", Address{Area: AreaDB, DB: 1, Start: 4, Type: TypeWord}, "DB1.DBW4"},
+		{"DB1.DBD3:DINT", Address{Area: AreaDB, DB: 1, Start: 3, Type: TypeDInt}, "DB1.DBD3:DINT"},
+		{"DB1.DBD8:REAL", Address{Area: AreaDB, DB: 1, Start: 8, Type: TypeReal}, "DB1.DBD8:REAL"},
+		{"DB2.DBB10:STRING[20]", Address{Area: AreaDB, DB: 2, Start: 10, Type: TypeString, Length: 20}, "DB2.DBB10:STRING[20]"},
+		{"DB2.DBB10:STRING", Address{Area: AreaDB, DB: 2, Start: 10, Type: TypeString, Length: 254}, "DB2.DBB10:STRING[254]"},
+		{"DB2.DBB0:DATE_AND_TIME", Address{Area: AreaDB, DB: 2, Type: TypeDT}, "DB2.DBB0:DT"},
+		{"MW10:INT", Address{Area: AreaMerker, Start: 10, Type: TypeInt}, "MW10:INT"},
+		{"M0.1", Address{Area: AreaMerker, Bit: 1, Type: TypeBool}, "M0.1"},
+		{"I0.3", Address{Area: AreaInput, Bit: 3, Type: TypeBool}, "I0.3"},
+		{"E1.7", Address{Area: AreaInput, Start: 1, Bit: 7, Type: TypeBool}, "I1.7"},
+		{"QB2", Address{Area: AreaOutput, Start: 2, Type: TypeByte}, "QB2"},
+		{"AW4", Address{Area: AreaOutput, Start: 4, Type: TypeWord}, "QW4"},
+		{" DB1.DBD 0 : lreal ", Address{Area: AreaDB, DB: 1, Type: TypeLReal}, "DB1.DBB0:LREAL"},
+	}
+	for _, tt := range tests {
+		got, err := ParseAddress(tt.in)
+		if err != nil {
+			t.Errorf("ParseAddress(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseAddress(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+		if s := got.String(); s != tt.str {
+			t.Errorf("ParseAddress(%q).String() = %q, want %q", tt.in, s, tt.str)
+		}
+		// The string form parses back to the same address.
+		if again, err := ParseAddress(got.String()); err != nil || again != got {
+			t.Errorf("ParseAddress(%q) = %+v, %v, want %+v", got.String(), again, err, got)
+		}
+	}
+}
+
+func TestParseAddressErrors(t *testing.T) {
+	for _, in := range []string{
+		"", "DB1", "DB0.DBX0.0", "DBx.DBB0", "DB1.X0.0", "DB1.DBX0", "DB1.DBX0.8", "DB1.DBB-1",
+		"Z0.0", "M", "DB1.DBX0.0:INT", "DB1.DBW0:BOOL", "DB1.DBW0:FOO", "DB1.DBB0:STRING[0]", "DB1.DBB0:INT[2]",
+	} {
+		if addr, err := ParseAddress(in); err == nil {
+			t.Errorf("ParseAddress(%q) = %+v, want an error", in, addr)
+		}
+	}
+}
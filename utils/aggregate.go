@@ -0,0 +1,409 @@
+package utils
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// SinkAggregateConfig makes a sink get aggregates over tumbling windows
+// instead of every polled value, for example min, max and mean per 10s of a
+// vibration value polled every 100ms. Windows are aligned to UTC, so 1m
+// windows start on full minutes, and their aggregates are written with the
+// start of the window as timestamp once a poll after the window comes in. A
+// change of the context splits a window in two, the second part starting at
+// the change. The aggregates of tag are the tags <tag>_<function>, in the
+// fields <field>_<function> of the same measurement.
+type SinkAggregateConfig struct {
+	Window    string         `json:"Window"`    // Window for all tags, e.g. 10s or 1m; empty to write the polled values
+	Functions []string       `json:"Functions"` // Aggregates of every window, defaults to mean
+	Tags      []TagAggregate `json:"Tags"`      // Windows of some tags, the first that matches a tag applies
+}
+
+// TagAggregate sets the window of the tags Match matches. Tags are matched
+// by the names the route of the sink gives them.
+type TagAggregate struct {
+	Match     TagFilter `json:"Match"`
+	Window    string    `json:"Window"`    // Defaults to the Window of the sink; raw writes the polled values
+	Functions []string  `json:"Functions"` // Defaults to the Functions of the sink
+}
+
+// Aggregate functions. Tags that are not numbers only get first, last and
+// count; tags none of the functions apply to are left out.
+const (
+	AggMin    = "min"
+	AggMax    = "max"
+	AggMean   = "mean"
+	AggFirst  = "first"
+	AggLast   = "last"
+	AggCount  = "count"  // Number of good values
+	AggStddev = "stddev" // Sample standard deviation
+	AggTWA    = "twa"    // Time-weighted average, every value counts until the next one
+)
+
+var aggFunctions = []string{AggMin, AggMax, AggMean, AggFirst, AggLast, AggCount, AggStddev, AggTWA}
+
+// WindowRaw as Window of a TagAggregate writes the polled values of its
+// tags.
+const WindowRaw = "raw"
+
+// applyDefaults fills in the optional fields of c.
+func (c *SinkAggregateConfig) applyDefaults() {
+	if c.Functions == nil {
+		c.Functions = []string{AggMean}
+	}
+}
+
+// validate checks the fields of c, reporting problems under path, and
+// returns the tags the sink gets, or tags when the settings are invalid.
+// tags are the tags of the sink after its route.
+func (c *SinkAggregateConfig) validate(path, plcName string, tags []Tag, errs *ConfigErrors) []Tag {
+	before := len(*errs)
+	if _, err := parseWindow(c.Window); err != nil || c.Window == WindowRaw {
+		errs.add(path+".Window", "must be a positive duration like 10s")
+	}
+	checkFunctions(path+".Functions", c.Functions, errs)
+	for i, rule := range c.Tags {
+		p := fmt.Sprintf("%s.Tags[%d]", path, i)
+		rule.Match.validate(p+".Match", errs)
+		if _, err := parseWindow(rule.Window); err != nil {
+			errs.add(p+".Window", "must be raw or a positive duration like 10s")
+		}
+		if rule.Functions != nil {
+			checkFunctions(p+".Functions", rule.Functions, errs)
+		}
+	}
+	if len(*errs) > before {
+		return tags
+	}
+
+	a := NewAggregator(*c, plcName, tags)
+	seen := map[string]bool{}
+	for _, tag := range a.Tags() {
+		if seen[tag.Name] {
+			errs.add(path, "the aggregate %s clashes with a tag of the same name", tag.Name)
+		}
+		seen[tag.Name] = true
+	}
+	return a.Tags()
+}
+
+func checkFunctions(path string, functions []string, errs *ConfigErrors) {
+	if len(functions) == 0 {
+		errs.add(path, "must not be empty")
+	}
+	for i, fn := range functions {
+		checkOneOf(errs, fmt.Sprintf("%s[%d]", path, i), fn, aggFunctions...)
+		if slices.Index(functions, fn) < i {
+			errs.add(fmt.Sprintf("%s[%d]", path, i), "%s is listed twice", fn)
+		}
+	}
+}
+
+// parseWindow parses the Window of an aggregate config, which is 0 for raw
+// values.
+func parseWindow(s string) (time.Duration, error) {
+	if s == "" || s == WindowRaw {
+		return 0, nil
+	}
+	d, err := ParseLongDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("window %q is not positive", s)
+	}
+	return d, nil
+}
+
+// aggregateTags applies the aggregate config of a sink to tags, the tags
+// after its route. It returns the aggregator for ConfiguredSink, nil when
+// the sink gets the polled values, and the tags the sink gets.
+func aggregateTags(cfg SinkAggregateConfig, plcName string, tags []Tag) (*Aggregator, []Tag) {
+	if cfg.Window == "" && len(cfg.Tags) == 0 {
+		return nil, tags
+	}
+	a := NewAggregator(cfg, plcName, tags)
+	return a, a.Tags()
+}
+
+// Aggregator turns the batches of a sink into aggregates over tumbling
+// windows, passing on the values of tags that are not aggregated. It is
+// not safe for concurrent use.
+type Aggregator struct {
+	plans   []aggPlan   // Per tag of the batches given to Add
+	windows []aggWindow // Per tag of the batches given to Add
+	tags    []Tag       // Tags of the batches Add returns
+	last    time.Time   // Of the last batch
+}
+
+// aggPlan is how the values of one tag are aggregated.
+type aggPlan struct {
+	window    time.Duration // 0 to pass the values on
+	functions []string      // Those that apply to the type of the tag
+	out       int           // Index in tags of the first aggregate, or of the tag when it is passed on
+}
+
+// aggWindow accumulates the values of one tag in the current window.
+type aggWindow struct {
+	start       time.Time         // Zero before the first value
+	slot        time.Time         // The aligned window start is in, after start when a context change split it
+	context     map[string]string // Of the batches in the window
+	count       int
+	mean, m2    float64 // Welford's running mean and sum of squared deviations
+	min, max    float64
+	first, last interface{}
+
+	// The time-weighted average: the last numeric value holds from heldAt
+	// until the next value, unless it is bad.
+	held     float64
+	heldAt   time.Time
+	holding  bool
+	weighted float64 // Sum of value * seconds
+	covered  time.Duration
+}
+
+// NewAggregator prepares the aggregation of cfg for tags of the PLC
+// plcName. cfg must be valid.
+func NewAggregator(cfg SinkAggregateConfig, plcName string, tags []Tag) *Aggregator {
+	a := &Aggregator{plans: make([]aggPlan, len(tags)), windows: make([]aggWindow, len(tags))}
+	for i, tag := range tags {
+		window, functions := cfg.Window, cfg.Functions
+		for _, rule := range cfg.Tags {
+			if rule.Match.matches(tag, plcName) {
+				if rule.Window != "" {
+					window = rule.Window
+				}
+				if rule.Functions != nil {
+					functions = rule.Functions
+				}
+				break
+			}
+		}
+		p := &a.plans[i]
+		p.out = len(a.tags)
+		p.window, _ = parseWindow(window)
+		if p.window == 0 {
+			a.tags = append(a.tags, tag)
+			continue
+		}
+		numeric := numericType(tag.Addr.Type)
+		for _, fn := range functions {
+			if numeric || fn == AggFirst || fn == AggLast || fn == AggCount {
+				p.functions = append(p.functions, fn)
+				a.tags = append(a.tags, aggregateTag(tag, fn))
+			}
+		}
+	}
+	return a
+}
+
+// numericType reports whether values of type t can be averaged. Booleans
+// count as 0 and 1, so their mean is the share of the time they were on.
+func numericType(t DataType) bool {
+	switch t {
+	case TypeBool, TypeByte, TypeWord, TypeDWord, TypeLWord, TypeSInt, TypeUSInt, TypeInt, TypeUInt,
+		TypeDInt, TypeUDInt, TypeLInt, TypeULInt, TypeReal, TypeLReal:
+		return true
+	}
+	return false
+}
+
+// aggregateTag returns the tag the aggregate fn of tag is written as.
+func aggregateTag(tag Tag, fn string) Tag {
+	tag.Name += "_" + fn
+	tag.Field += "_" + fn
+	switch fn {
+	case AggCount:
+		tag.Addr.Type = TypeUDInt
+	case AggFirst, AggLast:
+	default:
+		tag.Addr.Type = TypeLReal
+	}
+	return tag
+}
+
+// Tags returns the tags of the batches Add returns: the aggregates, and the
+// tags that are passed on.
+func (a *Aggregator) Tags() []Tag {
+	return a.tags
+}
+
+// Add adds the values of batch to their windows. It returns the aggregates
+// of the windows batch ends, one batch per window start, followed by the
+// values that are passed on. A change of the context ends the windows too.
+func (a *Aggregator) Add(batch Batch) []Batch {
+	a.last = batch.Time
+	closed := map[time.Time]*Batch{}
+	passed := Batch{Time: batch.Time, Context: batch.Context}
+	for i, v := range batch.Values {
+		p := &a.plans[i]
+		if p.window == 0 {
+			passed.Tags = append(passed.Tags, a.tags[p.out])
+			passed.Values = append(passed.Values, v)
+			continue
+		}
+		w := &a.windows[i]
+		slot := batch.Time.Truncate(p.window)
+		switch {
+		case w.start.IsZero():
+			w.start, w.slot = slot, slot
+		case !w.slot.Equal(slot):
+			end := w.slot.Add(p.window)
+			a.emit(closed, i, end)
+			w.reset(slot, slot, slot.Equal(end))
+		case !maps.Equal(w.context, batch.Context):
+			// A new context, such as the next batch, ends the window early
+			// so no aggregate mixes two of them. The rest of the window
+			// starts with the change.
+			a.emit(closed, i, batch.Time)
+			w.reset(batch.Time, slot, false)
+		}
+		w.context = batch.Context
+		w.add(v, batch.Time)
+	}
+
+	batches := a.sorted(closed)
+	if len(passed.Values) > 0 {
+		batches = append(batches, passed)
+	}
+	return batches
+}
+
+// Flush returns the aggregates of the windows in progress, as if they ended
+// with the last batch, and starts over.
+func (a *Aggregator) Flush() []Batch {
+	closed := map[time.Time]*Batch{}
+	for i := range a.windows {
+		if !a.windows[i].start.IsZero() {
+			a.emit(closed, i, a.last)
+			a.windows[i] = aggWindow{}
+		}
+	}
+	return a.sorted(closed)
+}
+
+// sameAs reports whether a and b aggregate the same tags the same way, so
+// the windows a has in progress can be carried on by b. Both may be nil.
+func (a *Aggregator) sameAs(b *Aggregator) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return reflect.DeepEqual(a.plans, b.plans) && reflect.DeepEqual(a.tags, b.tags)
+}
+
+// emit adds the aggregates of the window of tag i, ending at end, to the
+// batch of its start in closed.
+func (a *Aggregator) emit(closed map[time.Time]*Batch, i int, end time.Time) {
+	w, p := &a.windows[i], &a.plans[i]
+	b, ok := closed[w.start]
+	if !ok {
+		b = &Batch{Time: w.start, Context: w.context}
+		closed[w.start] = b
+	}
+	for j, fn := range p.functions {
+		tag := a.tags[p.out+j]
+		b.Tags = append(b.Tags, tag)
+		b.Values = append(b.Values, w.value(tag.Name, fn, end))
+	}
+}
+
+func (a *Aggregator) sorted(closed map[time.Time]*Batch) []Batch {
+	batches := make([]Batch, 0, len(closed)+1)
+	for _, b := range closed {
+		batches = append(batches, *b)
+	}
+	slices.SortFunc(batches, func(x, y Batch) int { return x.Time.Compare(y.Time) })
+	return batches
+}
+
+// reset starts the window at start, in the aligned window slot. The last
+// value keeps counting for the time-weighted average when the new window
+// follows on the old one.
+func (w *aggWindow) reset(start, slot time.Time, adjacent bool) {
+	held, holding := w.held, w.holding && adjacent
+	*w = aggWindow{start: start, slot: slot, held: held, heldAt: start, holding: holding}
+}
+
+// add adds the value v polled at t.
+func (w *aggWindow) add(v TagValue, t time.Time) {
+	w.hold(t)
+	w.holding = false
+	if v.Quality != QualityGood {
+		return
+	}
+	w.count++
+	if w.count == 1 {
+		w.first = v.Value
+	}
+	w.last = v.Value
+	f, ok := numericValue(v.Value)
+	if !ok {
+		return
+	}
+	if w.count == 1 || f < w.min {
+		w.min = f
+	}
+	if w.count == 1 || f > w.max {
+		w.max = f
+	}
+	delta := f - w.mean
+	w.mean += delta / float64(w.count)
+	w.m2 += delta * (f - w.mean)
+	w.held, w.heldAt, w.holding = f, t, true
+}
+
+// hold counts the held value for the time-weighted average until t.
+func (w *aggWindow) hold(t time.Time) {
+	if w.holding && t.After(w.heldAt) {
+		d := t.Sub(w.heldAt)
+		w.weighted += w.held * d.Seconds()
+		w.covered += d
+		w.heldAt = t
+	}
+}
+
+// value returns the aggregate fn of the window ending at end as the value
+// of the tag name.
+func (w *aggWindow) value(name, fn string, end time.Time) TagValue {
+	v := TagValue{Name: name, Quality: QualityGood, Timestamp: w.start}
+	if fn == AggCount {
+		v.Value = uint32(w.count)
+		return v
+	}
+	if w.count == 0 {
+		v.Quality, v.Error = QualityBad, "no good values in the window"
+		return v
+	}
+	switch fn {
+	case AggMin:
+		v.Value = w.min
+	case AggMax:
+		v.Value = w.max
+	case AggMean:
+		v.Value = w.mean
+	case AggFirst:
+		v.Value = w.first
+	case AggLast:
+		v.Value = w.last
+	case AggStddev:
+		v.Value = 0.0
+		if w.count > 1 {
+			v.Value = math.Sqrt(w.m2 / float64(w.count-1))
+		}
+	case AggTWA:
+		// The last value holds until the end of the window. Without any
+		// time to weigh, at the end of a flushed window with one value, the
+		// mean is all there is.
+		held := *w
+		held.hold(end)
+		v.Value = w.mean
+		if held.covered > 0 {
+			v.Value = held.weighted / held.covered.Seconds()
+		}
+	}
+	return v
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAggregatorContextSplitsWindow(t *testing.T) {
+	tags := []Tag{{TagConfig: TagConfig{Name: "T", Field: "T"}, Addr: Address{Type: TypeReal}}}
+	cfg := SinkAggregateConfig{Window: "10s", Functions: []string{AggMean, AggCount}}
+	a := NewAggregator(cfg, "plc", tags)
+
+	start := time.Date(2024, 1, 1, 0, 0, 10, 0, time.UTC)
+	var out []Batch
+	for i := range 12 {
+		ts := start.Add(time.Duration(i) * time.Second)
+		batch := Batch{Time: ts, Values: []TagValue{{Name: "T", Value: float32(i), Quality: QualityGood, Timestamp: ts}}}
+		// The batch changes 3s into the window.
+		batch.Context = map[string]string{"batch": "A"}
+		if i >= 3 {
+			batch.Context = map[string]string{"batch": "B"}
+		}
+		out = append(out, a.Add(batch)...)
+	}
+
+	want := []struct {
+		time  time.Time
+		batch string
+		mean  float64
+		count uint32
+	}{
+		{start, "A", 1, 3},
+		{start.Add(3 * time.Second), "B", 6, 7},
+	}
+	if len(out) != len(want) {
+		t.Fatalf("%d batches, want %d: %+v", len(out), len(want), out)
+	}
+	for i, w := range want {
+		b := out[i]
+		if !b.Time.Equal(w.time) || b.Context["batch"] != w.batch {
+			t.Errorf("batch %d at %v in %v, want %v in %s", i, b.Time, b.Context, w.time, w.batch)
+		}
+		if len(b.Values) != 2 || b.Values[0].Value != w.mean || b.Values[1].Value != w.count {
+			t.Errorf("batch %d values %+v, want mean %v and count %d", i, b.Values, w.mean, w.count)
+		}
+		for _, v := range b.Values {
+			if !v.Timestamp.Equal(w.time) {
+				t.Errorf("batch %d value %s at %v, want %v", i, v.Name, v.Timestamp, w.time)
+			}
+		}
+	}
+}
+
+func TestAggregatorWindows(t *testing.T) {
+	tags := []Tag{
+		{TagConfig: TagConfig{Name: "T", Field: "T"}, Addr: Address{Type: TypeInt}},
+		{TagConfig: TagConfig{Name: "S", Field: "S"}, Addr: Address{Type: TypeString}},
+	}
+	cfg := SinkAggregateConfig{Window: "5s", Functions: []string{AggMin, AggMax, AggLast, AggTWA}}
+	a := NewAggregator(cfg, "plc", tags)
+	names := []string{}
+	for _, tag := range a.Tags() {
+		names = append(names, tag.Name)
+	}
+	// Strings only get the functions that apply to them.
+	if got := len(names); got != 5 || names[4] != "S_last" {
+		t.Fatalf("tags %v", names)
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	values := []int16{4, 2, 8, 6, 0, 1}
+	var out []Batch
+	for i, v := range values {
+		ts := start.Add(time.Duration(i) * time.Second)
+		out = append(out, a.Add(Batch{Time: ts, Values: []TagValue{
+			{Name: "T", Value: v, Quality: QualityGood, Timestamp: ts},
+			{Name: "S", Value: string(rune('a' + i)), Quality: QualityGood, Timestamp: ts},
+		}})...)
+	}
+	if len(out) != 1 || !out[0].Time.Equal(start) {
+		t.Fatalf("got %+v, want the window at %v", out, start)
+	}
+	got := map[string]interface{}{}
+	for _, v := range out[0].Values {
+		got[v.Name] = v.Value
+	}
+	want := map[string]interface{}{"T_min": 0.0, "T_max": 8.0, "T_last": int16(0), "T_twa": 4.0, "S_last": "e"}
+	for name, w := range want {
+		if got[name] != w {
+			t.Errorf("%s = %v (%T), want %v (%T)", name, got[name], got[name], w, w)
+		}
+	}
+
+	flushed := a.Flush()
+	if len(flushed) != 1 || !flushed[0].Time.Equal(start.Add(5*time.Second)) {
+		t.Fatalf("flushed %+v", flushed)
+	}
+}
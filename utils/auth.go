@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles of web users and API keys. Each role may do everything the roles
+// before it may do.
+const (
+	RoleViewer   = "viewer"   // Read tag values and PLC information
+	RoleOperator = "operator" // Also write Writable tags
+	RoleAdmin    = "admin"    // Also reload and inspect the config
+)
+
+var roleRanks = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// RoleAllows reports whether role grants the rights of required.
+func RoleAllows(role, required string) bool {
+	return roleRanks[role] >= roleRanks[required] && roleRanks[role] > 0
+}
+
+// WebUser is a user of the web server, authenticated with HTTP basic auth.
+type WebUser struct {
+	Name     string `json:"Name"`
+	Password string `json:"Password"` // bcrypt hash, see HashPassword
+	Role     string `json:"Role"`
+}
+
+// WebAPIKey is a key for programs using the web API, sent as
+// "Authorization: Bearer <key>" or in the X-API-Key header.
+type WebAPIKey struct {
+	Name string `json:"Name"`
+	Key  string `json:"Key"` // sha256: followed by the hex digest, see NewAPIKey
+	Role string `json:"Role"`
+}
+
+// apiKeyPrefix marks the hash of an API key.
+const apiKeyPrefix = "sha256:"
+
+// HashPassword returns the bcrypt hash of password for WebUsers.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// NewAPIKey returns a random API key and the hash to put in WebAPIKeys.
+// Keys are random, so unlike passwords a plain SHA-256 hash protects them.
+func NewAPIKey() (key, hash string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key = "s7k_" + hex.EncodeToString(b)
+	return key, hashAPIKey(key), nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return apiKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+// verified caches successful password checks, as bcrypt is deliberately
+// too slow to run on every request. Entries are keyed by a hash of the
+// password hash and the password.
+var verified sync.Map
+
+// CheckPassword returns the role of the user name with password, or false
+// when the user is unknown or the password is wrong.
+func (c *Config) CheckPassword(name, password string) (string, bool) {
+	for _, u := range c.WebUsers {
+		if u.Name != name {
+			continue
+		}
+		sum := sha256.Sum256([]byte(u.Password + "\x00" + password))
+		if _, ok := verified.Load(sum); ok {
+			return u.Role, true
+		}
+		if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) != nil {
+			return "", false
+		}
+		verified.Store(sum, true)
+		return u.Role, true
+	}
+	return "", false
+}
+
+// CheckAPIKey returns the role and name of the API key, or false when the
+// key is unknown.
+func (c *Config) CheckAPIKey(key string) (role, name string, ok bool) {
+	hash := hashAPIKey(key)
+	for _, k := range c.WebAPIKeys {
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(k.Key)), []byte(hash)) == 1 {
+			return k.Role, k.Name, true
+		}
+	}
+	return "", "", false
+}
+
+// AuthEnabled reports whether the web server requires credentials. Without
+// WebUsers and WebAPIKeys it is open, as before authentication existed.
+func (c *Config) AuthEnabled() bool {
+	return len(c.WebUsers) > 0 || len(c.WebAPIKeys) > 0
+}
+
+// validateAuth checks WebUsers, WebAPIKeys and the TLS settings.
+func (c *Config) validateAuth(errs *ConfigErrors) {
+	checkRole := func(path, role string) {
+		if roleRanks[role] == 0 {
+			errs.add(path, "must be viewer, operator or admin, found %q", role)
+		}
+	}
+	names := map[string]bool{}
+	for i, u := range c.WebUsers {
+		path := fmt.Sprintf("WebUsers[%d]", i)
+		switch {
+		case u.Name == "":
+			errs.add(path+".Name", "is required")
+		case strings.Contains(u.Name, ":"):
+			errs.add(path+".Name", "must not contain a colon")
+		case names[u.Name]:
+			errs.add(path+".Name", "duplicate user %s", u.Name)
+		}
+		names[u.Name] = true
+		if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+			errs.add(path+".Password", "must be a bcrypt hash, create one with the hash-password command")
+		}
+		checkRole(path+".Role", u.Role)
+	}
+	for i, k := range c.WebAPIKeys {
+		path := fmt.Sprintf("WebAPIKeys[%d]", i)
+		if k.Name == "" {
+			errs.add(path+".Name", "is required")
+		}
+		digest := strings.TrimPrefix(strings.ToLower(k.Key), apiKeyPrefix)
+		if _, err := hex.DecodeString(digest); err != nil || len(digest) != 64 || !strings.HasPrefix(k.Key, apiKeyPrefix) {
+			errs.add(path+".Key", "must be sha256: and a hex digest, create one with the new-api-key command")
+		}
+		checkRole(path+".Role", k.Role)
+	}
+
+	if (c.WebTLSCert == "") != (c.WebTLSKey == "") {
+		errs.add("WebTLSCert", "WebTLSCert and WebTLSKey must be set together")
+	}
+	for _, f := range []struct{ path, file string }{{"WebTLSCert", c.WebTLSCert}, {"WebTLSKey", c.WebTLSKey}} {
+		if f.file != "" && !FileExists(f.file) {
+			errs.add(f.path, "file %s does not exist", f.file)
+		}
+	}
+	if c.WebTLSSelfSigned && c.WebTLSCert != "" {
+		errs.add("WebTLSSelfSigned", "cannot be combined with WebTLSCert")
+	}
+}
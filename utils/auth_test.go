@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoleAllows(t *testing.T) {
+	tests := []struct {
+		role, required string
+		want           bool
+	}{
+		{RoleViewer, RoleViewer, true},
+		{RoleViewer, RoleOperator, false},
+		{RoleOperator, RoleOperator, true},
+		{RoleOperator, RoleAdmin, false},
+		{RoleAdmin, RoleViewer, true},
+		{RoleAdmin, RoleAdmin, true},
+		{"", RoleViewer, false},
+		{"root", RoleViewer, false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := RoleAllows(tt.role, tt.required); got != tt.want {
+			t.Errorf("RoleAllows(%q, %q) = %v, want %v", tt.role, tt.required, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCredentials(t *testing.T) {
+	hash, err := HashPassword("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, keyHash, err := NewAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		WebUsers:   []WebUser{{Name: "op", Password: hash, Role: RoleOperator}},
+		WebAPIKeys: []WebAPIKey{{Name: "scada", Key: apiKeyPrefix + strings.ToUpper(strings.TrimPrefix(keyHash, apiKeyPrefix)), Role: RoleViewer}},
+	}
+	if !cfg.AuthEnabled() || (&Config{}).AuthEnabled() {
+		t.Error("AuthEnabled does not follow WebUsers and WebAPIKeys")
+	}
+
+	for _, tt := range []struct {
+		user, password string
+		role           string // Empty when the login fails
+	}{
+		{"op", "s3cret", RoleOperator},
+		{"op", "s3cret", RoleOperator}, // From the cache
+		{"op", "wrong", ""},
+		{"op", "", ""},
+		{"admin", "s3cret", ""},
+	} {
+		role, ok := cfg.CheckPassword(tt.user, tt.password)
+		if ok != (tt.role != "") || role != tt.role {
+			t.Errorf("CheckPassword(%q, %q) = %q, %v, want %q", tt.user, tt.password, role, ok, tt.role)
+		}
+	}
+
+	// Hex digests are compared without regard to case, keys are not.
+	if role, name, ok := cfg.CheckAPIKey(key); !ok || role != RoleViewer || name != "scada" {
+		t.Errorf("CheckAPIKey = %q, %q, %v", role, name, ok)
+	}
+	for _, wrong := range []string{"", strings.ToUpper(key), key + "0", keyHash} {
+		if _, _, ok := cfg.CheckAPIKey(wrong); ok {
+			t.Errorf("CheckAPIKey accepted %q", wrong)
+		}
+	}
+}
+
+func TestValidateAuth(t *testing.T) {
+	hash, err := HashPassword("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, keyHash, err := NewAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		cfg  Config
+		want []string // Paths of the problems
+	}{
+		{"valid", Config{
+			WebUsers:   []WebUser{{Name: "op", Password: hash, Role: RoleOperator}},
+			WebAPIKeys: []WebAPIKey{{Name: "scada", Key: keyHash, Role: RoleAdmin}},
+		}, nil},
+		{"users", Config{WebUsers: []WebUser{
+			{Name: "", Password: hash, Role: RoleViewer},
+			{Name: "a:b", Password: hash, Role: RoleViewer},
+			{Name: "op", Password: "s3cret", Role: "root"},
+			{Name: "op", Password: hash, Role: RoleViewer},
+		}}, []string{"WebUsers[0].Name", "WebUsers[1].Name", "WebUsers[2].Password", "WebUsers[2].Role", "WebUsers[3].Name"}},
+		{"API keys", Config{WebAPIKeys: []WebAPIKey{
+			{Name: "", Key: keyHash, Role: RoleViewer},
+			{Name: "plain", Key: "s7k_0123", Role: RoleViewer},
+			{Name: "short", Key: "sha256:abcd", Role: ""},
+		}}, []string{"WebAPIKeys[0].Name", "WebAPIKeys[1].Key", "WebAPIKeys[2].Key", "WebAPIKeys[2].Role"}},
+		{"TLS", Config{WebTLSCert: "missing.pem", WebTLSSelfSigned: true},
+			[]string{"WebTLSCert", "WebTLSCert", "WebTLSSelfSigned"}},
+	}
+	for _, tt := range tests {
+		var errs ConfigErrors
+		tt.cfg.validateAuth(&errs)
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Path)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: problems at %v, want %v:\n%v", tt.name, got, tt.want, errs)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/robinson/gos7"
+)
+
+// BlockInventory lists the blocks loaded in a PLC.
+type BlockInventory struct {
+	OB  []int    `json:"OB"`
+	FB  []int    `json:"FB"`
+	FC  []int    `json:"FC"`
+	DB  []int    `json:"DB"`
+	SFB []int    `json:"SFB"`
+	SFC []int    `json:"SFC"`
+	SDB []int    `json:"SDB"`
+	DBs []DBInfo `json:"DBs,omitempty"`
+}
+
+// DBInfo describes a data block as reported by the PLC.
+type DBInfo struct {
+	Number        int    `json:"number"`
+	Size          int    `json:"size"` // Size of the data in bytes
+	LoadSize      int    `json:"loadSize"`
+	CodeDate      string `json:"codeDate"`
+	InterfaceDate string `json:"interfaceDate"`
+	Author        string `json:"author,omitempty"`
+	Family        string `json:"family,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Version       string `json:"version,omitempty"`
+	Missing       bool   `json:"missing,omitempty"` // Not in the PLC's block list
+	Error         string `json:"error,omitempty"`
+}
+
+// ListBlocks returns the block numbers of every block type in the PLC.
+func ListBlocks(client gos7.Client) (BlockInventory, error) {
+	var list gos7.S7BlocksList
+	err := protect(func() error {
+		return withoutStdout(func() (err error) {
+			list, err = client.PGListBlocks()
+			return err
+		})
+	})
+	if err != nil {
+		return BlockInventory{}, err
+	}
+	inv := BlockInventory{
+		OB: list.OBList, FB: list.FBList, FC: list.FCList, DB: list.DBList,
+		SFB: list.SFBList, SFC: list.SFCList, SDB: list.SDBList,
+	}
+	for _, numbers := range [][]int{inv.OB, inv.FB, inv.FC, inv.DB, inv.SFB, inv.SFC, inv.SDB} {
+		sort.Ints(numbers)
+	}
+	return inv, nil
+}
+
+// ReadDBInfo returns the size and timestamps of a data block.
+func ReadDBInfo(client gos7.Client, number int) (DBInfo, error) {
+	var bi gos7.S7BlockInfo
+	err := protect(func() (err error) {
+		bi, err = client.GetAgBlockInfo(BlockTypeDB, number)
+		return err
+	})
+	if err != nil {
+		return DBInfo{Number: number, Error: err.Error()}, err
+	}
+	clean := func(s string) string { return strings.TrimSpace(strings.Trim(s, "\x00")) }
+	return DBInfo{
+		Number:        number,
+		Size:          bi.MC7Size,
+		LoadSize:      bi.LoadSize,
+		CodeDate:      bi.CodeDate,
+		InterfaceDate: bi.IntfDate,
+		Author:        clean(bi.Author),
+		Family:        clean(bi.Family),
+		Name:          clean(bi.Header),
+		Version:       fmt.Sprintf("%d.%d", bi.Version>>4, bi.Version&0x0F),
+	}, nil
+}
+
+// TagProblem is a tag whose address does not fit the PLC's DBs.
+type TagProblem struct {
+	Tag     string `json:"tag"`
+	Address string `json:"address"`
+	Problem string `json:"problem"`
+}
+
+// CheckTagBounds reads the size of every DB used by tags and reports the
+// tags that point past the end of their DB or into a DB that does not exist.
+// DBs whose size cannot be read, as on S7-1200/1500 CPUs without PUT/GET
+// block access, are skipped and returned with Error set.
+func CheckTagBounds(client gos7.Client, tags []Tag) (map[int]DBInfo, []TagProblem) {
+	dbs := map[int]DBInfo{}
+	var numbers []int
+	for _, tag := range tags {
+		if tag.Addr.Area != AreaDB || tag.Derived() {
+			continue
+		}
+		if _, ok := dbs[tag.Addr.DB]; !ok {
+			dbs[tag.Addr.DB] = DBInfo{}
+			numbers = append(numbers, tag.Addr.DB)
+		}
+	}
+	sort.Ints(numbers)
+
+	// A missing DB is reported by the block list, which also works on CPUs
+	// that refuse block info requests.
+	loaded := map[int]bool{}
+	inv, listErr := ListBlocks(client)
+	for _, n := range inv.DB {
+		loaded[n] = true
+	}
+
+	var problems []TagProblem
+	for _, n := range numbers {
+		info, _ := ReadDBInfo(client, n)
+		info.Missing = info.Error != "" && listErr == nil && len(inv.DB) > 0 && !loaded[n]
+		dbs[n] = info
+	}
+
+	for _, tag := range tags {
+		if tag.Addr.Area != AreaDB || tag.Derived() {
+			continue
+		}
+		info := dbs[tag.Addr.DB]
+		switch {
+		case info.Missing:
+			problems = append(problems, TagProblem{tag.Name, tag.Addr.String(),
+				fmt.Sprintf("DB%d does not exist in the PLC", tag.Addr.DB)})
+		case info.Error != "":
+			continue
+		case tag.Addr.Start+tag.Addr.Size() > info.Size:
+			problems = append(problems, TagProblem{tag.Name, tag.Addr.String(),
+				fmt.Sprintf("ends at byte %d but DB%d is only %d bytes long",
+					tag.Addr.Start+tag.Addr.Size(), tag.Addr.DB, info.Size)})
+		}
+	}
+	return dbs, problems
+}
+
+// MarkBadTags sets Bad on the tags named in problems so they are not polled.
+func MarkBadTags(tags []Tag, problems []TagProblem) {
+	for _, p := range problems {
+		for i := range tags {
+			if tags[i].Name == p.Tag {
+				tags[i].Bad = p.Problem
+			}
+		}
+	}
+}
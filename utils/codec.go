@@ -0,0 +1,413 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// DataType is the S7 type of the value stored at an address.
+type DataType string
+
+const (
+	TypeBool    DataType = "BOOL"
+	TypeByte    DataType = "BYTE"
+	TypeWord    DataType = "WORD"
+	TypeDWord   DataType = "DWORD"
+	TypeLWord   DataType = "LWORD"
+	TypeChar    DataType = "CHAR"
+	TypeWChar   DataType = "WCHAR"
+	TypeSInt    DataType = "SINT"
+	TypeUSInt   DataType = "USINT"
+	TypeInt     DataType = "INT"
+	TypeUInt    DataType = "UINT"
+	TypeDInt    DataType = "DINT"
+	TypeUDInt   DataType = "UDINT"
+	TypeLInt    DataType = "LINT"
+	TypeULInt   DataType = "ULINT"
+	TypeReal    DataType = "REAL"
+	TypeLReal   DataType = "LREAL"
+	TypeString  DataType = "STRING"
+	TypeWString DataType = "WSTRING"
+	TypeTime    DataType = "TIME"
+	TypeS5Time  DataType = "S5TIME"
+	TypeDate    DataType = "DATE"
+	TypeTOD     DataType = "TOD"
+	TypeDT      DataType = "DT"
+	TypeDTL     DataType = "DTL"
+)
+
+// typeAliases maps the long IEC names to the short names used above.
+var typeAliases = map[string]DataType{
+	"TIME_OF_DAY":   TypeTOD,
+	"DATE_AND_TIME": TypeDT,
+}
+
+// typeSizes holds the size in bytes of every fixed-size type.
+var typeSizes = map[DataType]int{
+	TypeBool: 1, TypeByte: 1, TypeChar: 1, TypeSInt: 1, TypeUSInt: 1,
+	TypeWord: 2, TypeWChar: 2, TypeInt: 2, TypeUInt: 2, TypeS5Time: 2, TypeDate: 2,
+	TypeDWord: 4, TypeDInt: 4, TypeUDInt: 4, TypeReal: 4, TypeTime: 4, TypeTOD: 4,
+	TypeLWord: 8, TypeLInt: 8, TypeULInt: 8, TypeLReal: 8, TypeDT: 8,
+	TypeDTL: 12,
+}
+
+// defaultStringLength is the S7 default for STRING and WSTRING without [n].
+const defaultStringLength = 254
+
+// maxStringLength is the longest STRING, whose length bytes hold up to 254.
+const maxStringLength = 254
+
+// ParseDataType parses a type name such as DINT, REAL or STRING[20]. The
+// returned length is the declared maximum length of STRING and WSTRING.
+func ParseDataType(s string) (DataType, int, error) {
+	name := strings.ToUpper(strings.TrimSpace(s))
+	length := 0
+	if open := strings.Index(name, "["); open >= 0 {
+		if !strings.HasSuffix(name, "]") {
+			return "", 0, fmt.Errorf("invalid type %q", s)
+		}
+		n, err := strconv.Atoi(name[open+1 : len(name)-1])
+		if err != nil || n <= 0 {
+			return "", 0, fmt.Errorf("invalid length in type %q", s)
+		}
+		name, length = name[:open], n
+	}
+	t := DataType(name)
+	if alias, ok := typeAliases[name]; ok {
+		t = alias
+	}
+	switch t {
+	case TypeString, TypeWString:
+		if length == 0 {
+			length = defaultStringLength
+		}
+		return t, length, nil
+	}
+	if _, ok := typeSizes[t]; !ok || length != 0 {
+		return "", 0, fmt.Errorf("unknown type %q", s)
+	}
+	return t, 0, nil
+}
+
+// TypeSize returns the number of bytes a value of type t occupies. length is
+// the maximum length of STRING and WSTRING and ignored for other types.
+func TypeSize(t DataType, length int) int {
+	switch t {
+	case TypeString:
+		return length + 2
+	case TypeWString:
+		return 2*length + 4
+	}
+	return typeSizes[t]
+}
+
+var s7Epoch = time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// DecodeValue converts the raw bytes read from addr into a Go value. TIME,
+// TOD and S5TIME decode to time.Duration, DATE, DT and DTL to time.Time.
+func DecodeValue(addr Address, data []byte) interface{} {
+	switch addr.Type {
+	case TypeBool:
+		return data[0]&(1<<uint(addr.Bit)) != 0
+	case TypeByte, TypeUSInt:
+		return data[0]
+	case TypeSInt:
+		return int8(data[0])
+	case TypeChar:
+		return string(rune(data[0]))
+	case TypeWord, TypeUInt:
+		return binary.BigEndian.Uint16(data)
+	case TypeInt:
+		return int16(binary.BigEndian.Uint16(data))
+	case TypeWChar:
+		return string(utf16.Decode([]uint16{binary.BigEndian.Uint16(data)}))
+	case TypeDWord, TypeUDInt:
+		return binary.BigEndian.Uint32(data)
+	case TypeDInt:
+		return int32(binary.BigEndian.Uint32(data))
+	case TypeLWord, TypeULInt:
+		return binary.BigEndian.Uint64(data)
+	case TypeLInt:
+		return int64(binary.BigEndian.Uint64(data))
+	case TypeReal:
+		return math.Float32frombits(binary.BigEndian.Uint32(data))
+	case TypeLReal:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	case TypeString:
+		n := int(data[1])
+		if n > len(data)-2 {
+			n = len(data) - 2
+		}
+		return string(data[2 : 2+n])
+	case TypeWString:
+		n := int(binary.BigEndian.Uint16(data[2:]))
+		if n > (len(data)-4)/2 {
+			n = (len(data) - 4) / 2
+		}
+		chars := make([]uint16, n)
+		for i := range chars {
+			chars[i] = binary.BigEndian.Uint16(data[4+2*i:])
+		}
+		return string(utf16.Decode(chars))
+	case TypeTime:
+		return time.Duration(int32(binary.BigEndian.Uint32(data))) * time.Millisecond
+	case TypeTOD:
+		return time.Duration(binary.BigEndian.Uint32(data)) * time.Millisecond
+	case TypeS5Time:
+		return decodeS5Time(binary.BigEndian.Uint16(data))
+	case TypeDate:
+		return s7Epoch.AddDate(0, 0, int(binary.BigEndian.Uint16(data)))
+	case TypeDT:
+		return decodeDT(data)
+	case TypeDTL:
+		return time.Date(int(binary.BigEndian.Uint16(data)), time.Month(data[2]), int(data[3]),
+			int(data[5]), int(data[6]), int(data[7]), int(binary.BigEndian.Uint32(data[8:])), time.Local)
+	}
+	return data[0]
+}
+
+// EncodeValue converts a value given as text into the raw bytes for addr.
+func EncodeValue(addr Address, text string) ([]byte, error) {
+	buf := make([]byte, addr.Size())
+	invalid := fmt.Errorf("invalid %s value %q", addr.Type, text)
+	switch addr.Type {
+	case TypeBool:
+		v, err := strconv.ParseBool(text)
+		if err != nil {
+			return nil, invalid
+		}
+		if v {
+			buf[0] = 1
+		}
+	case TypeByte, TypeWord, TypeDWord, TypeLWord, TypeUSInt, TypeUInt, TypeUDInt, TypeULInt:
+		v, err := parseUint(text, len(buf)*8)
+		if err != nil {
+			return nil, invalid
+		}
+		putUint(buf, v)
+	case TypeSInt, TypeInt, TypeDInt, TypeLInt:
+		v, err := parseInt(text, len(buf)*8)
+		if err != nil {
+			return nil, invalid
+		}
+		putUint(buf, uint64(v))
+	case TypeChar:
+		if len(text) != 1 {
+			return nil, invalid
+		}
+		buf[0] = text[0]
+	case TypeWChar:
+		chars := utf16.Encode([]rune(text))
+		if len(chars) != 1 {
+			return nil, invalid
+		}
+		binary.BigEndian.PutUint16(buf, chars[0])
+	case TypeReal:
+		v, err := strconv.ParseFloat(text, 32)
+		if err != nil {
+			return nil, invalid
+		}
+		binary.BigEndian.PutUint32(buf, math.Float32bits(float32(v)))
+	case TypeLReal:
+		v, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, invalid
+		}
+		binary.BigEndian.PutUint64(buf, math.Float64bits(v))
+	case TypeString:
+		if addr.Length > maxStringLength {
+			return nil, fmt.Errorf("STRING[%d] exceeds the maximum length of %d", addr.Length, maxStringLength)
+		}
+		if len(text) > addr.Length {
+			return nil, fmt.Errorf("string longer than %d characters", addr.Length)
+		}
+		buf[0], buf[1] = byte(addr.Length), byte(len(text))
+		copy(buf[2:], text)
+	case TypeWString:
+		chars := utf16.Encode([]rune(text))
+		if len(chars) > addr.Length {
+			return nil, fmt.Errorf("string longer than %d characters", addr.Length)
+		}
+		binary.BigEndian.PutUint16(buf, uint16(addr.Length))
+		binary.BigEndian.PutUint16(buf[2:], uint16(len(chars)))
+		for i, c := range chars {
+			binary.BigEndian.PutUint16(buf[4+2*i:], c)
+		}
+	case TypeTime, TypeTOD, TypeS5Time:
+		d, err := parseS7Duration(text)
+		if err != nil {
+			return nil, invalid
+		}
+		switch addr.Type {
+		case TypeS5Time:
+			v, ok := encodeS5Time(d)
+			if !ok {
+				return nil, fmt.Errorf("%s is out of range for S5TIME", d)
+			}
+			binary.BigEndian.PutUint16(buf, v)
+		case TypeTOD:
+			if d < 0 || d >= 24*time.Hour {
+				return nil, fmt.Errorf("%s is out of range for TOD", d)
+			}
+			binary.BigEndian.PutUint32(buf, uint32(d/time.Millisecond))
+		default:
+			ms := d / time.Millisecond
+			if ms < math.MinInt32 || ms > math.MaxInt32 {
+				return nil, fmt.Errorf("%s is out of range for TIME", d)
+			}
+			binary.BigEndian.PutUint32(buf, uint32(int32(ms)))
+		}
+	case TypeDate, TypeDT, TypeDTL:
+		t, err := parseS7Time(text)
+		if err != nil {
+			return nil, invalid
+		}
+		switch addr.Type {
+		case TypeDate:
+			days := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Sub(s7Epoch).Hours() / 24
+			if days < 0 || days > math.MaxUint16 {
+				return nil, fmt.Errorf("%s is out of range for DATE", t.Format("2006-01-02"))
+			}
+			binary.BigEndian.PutUint16(buf, uint16(days))
+		case TypeDT:
+			if t.Year() < 1990 || t.Year() > 2089 {
+				return nil, fmt.Errorf("%s is out of range for DT", t.Format("2006-01-02"))
+			}
+			encodeDT(buf, t)
+		default:
+			binary.BigEndian.PutUint16(buf, uint16(t.Year()))
+			buf[2], buf[3], buf[4] = byte(t.Month()), byte(t.Day()), byte(t.Weekday()+1)
+			buf[5], buf[6], buf[7] = byte(t.Hour()), byte(t.Minute()), byte(t.Second())
+			binary.BigEndian.PutUint32(buf[8:], uint32(t.Nanosecond()))
+		}
+	default:
+		return nil, fmt.Errorf("writing %s is not supported", addr.Type)
+	}
+	return buf, nil
+}
+
+// parseUint parses a decimal number, or a hexadecimal one with a 0x prefix.
+func parseUint(text string, bits int) (uint64, error) {
+	if hex, ok := cutHexPrefix(text); ok {
+		return strconv.ParseUint(hex, 16, bits)
+	}
+	return strconv.ParseUint(text, 10, bits)
+}
+
+// parseInt parses a decimal number, or a hexadecimal one with a 0x prefix
+// after the sign.
+func parseInt(text string, bits int) (int64, error) {
+	sign := ""
+	if strings.HasPrefix(text, "-") || strings.HasPrefix(text, "+") {
+		sign, text = text[:1], text[1:]
+	}
+	if hex, ok := cutHexPrefix(text); ok {
+		return strconv.ParseInt(sign+hex, 16, bits)
+	}
+	return strconv.ParseInt(sign+text, 10, bits)
+}
+
+func cutHexPrefix(text string) (string, bool) {
+	if len(text) > 2 && text[0] == '0' && (text[1] == 'x' || text[1] == 'X') && text[2] != '+' && text[2] != '-' {
+		return text[2:], true
+	}
+	return text, false
+}
+
+func putUint(buf []byte, v uint64) {
+	switch len(buf) {
+	case 1:
+		buf[0] = byte(v)
+	case 2:
+		binary.BigEndian.PutUint16(buf, uint16(v))
+	case 4:
+		binary.BigEndian.PutUint32(buf, uint32(v))
+	default:
+		binary.BigEndian.PutUint64(buf, v)
+	}
+}
+
+// parseS7Duration accepts Go durations ("1m30s") and IEC literals ("T#1M30S").
+func parseS7Duration(text string) (time.Duration, error) {
+	s := strings.ToLower(strings.TrimSpace(text))
+	for _, prefix := range []string{"s5t#", "time#", "tod#", "t#"} {
+		s = strings.TrimPrefix(s, prefix)
+	}
+	if strings.Contains(s, ":") {
+		// Time of day such as 12:30:00.500
+		t, err := time.Parse("15:04:05.999", s)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+			time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond()), nil
+	}
+	return time.ParseDuration(strings.ReplaceAll(s, "_", ""))
+}
+
+// parseS7Time accepts RFC 3339 and "2006-01-02 15:04:05" in local time.
+func parseS7Time(text string) (time.Time, error) {
+	s := strings.TrimSpace(text)
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.In(time.Local), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999", "2006-01-02T15:04:05.999999999", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", text)
+}
+
+var s5TimeBases = []time.Duration{10 * time.Millisecond, 100 * time.Millisecond, time.Second, 10 * time.Second}
+
+func decodeS5Time(v uint16) time.Duration {
+	value := time.Duration(bcdToInt(byte(v>>8)&0x0F)*100 + bcdToInt(byte(v)))
+	return value * s5TimeBases[(v>>12)&0x03]
+}
+
+func encodeS5Time(d time.Duration) (uint16, bool) {
+	if d < 0 {
+		return 0, false
+	}
+	// Use the finest time base that can hold the value.
+	for base, unit := range s5TimeBases {
+		if n := int(d / unit); n <= 999 {
+			return uint16(base)<<12 | uint16(intToBCD(n/100))<<8 | uint16(intToBCD(n%100)), true
+		}
+	}
+	return 0, false
+}
+
+func decodeDT(data []byte) time.Time {
+	year := bcdToInt(data[0])
+	if year < 90 {
+		year += 2000
+	} else {
+		year += 1900
+	}
+	ms := bcdToInt(data[6])*10 + int(data[7]>>4)
+	return time.Date(year, time.Month(bcdToInt(data[1])), bcdToInt(data[2]),
+		bcdToInt(data[3]), bcdToInt(data[4]), bcdToInt(data[5]), ms*int(time.Millisecond), time.Local)
+}
+
+func encodeDT(buf []byte, t time.Time) {
+	ms := t.Nanosecond() / int(time.Millisecond)
+	buf[0] = intToBCD(t.Year() % 100)
+	buf[1] = intToBCD(int(t.Month()))
+	buf[2] = intToBCD(t.Day())
+	buf[3] = intToBCD(t.Hour())
+	buf[4] = intToBCD(t.Minute())
+	buf[5] = intToBCD(t.Second())
+	buf[6] = intToBCD(ms / 10)
+	buf[7] = byte(ms%10)<<4 | byte(t.Weekday()+1)
+}
+
+func bcdToInt(b byte) int { return int(b>>4)*10 + int(b&0x0F) }
+
+func intToBCD(n int) byte { return byte(n/10)<<4 | byte(n%10) }
@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEncodeDecodeValue(t *testing.T) {
+	tests := []struct {
+		addr  string
+		text  string
+		bytes []byte
+		value interface{}
+	}{
+		{"DB1.DBX0.3", "true", []byte{1}, nil}, // Bits are written alone, see WriteAddress
+		{"DB1.DBB0", "0x2A", []byte{42}, uint8(42)},
+		{"DB1.DBB0", "042", []byte{42}, uint8(42)}, // Decimal, not octal
+		{"DB1.DBW0:INT", "-0x10", []byte{0xFF, 0xF0}, int16(-16)},
+		{"DB1.DBW0:INT", "+010", []byte{0, 10}, int16(10)},
+		{"DB1.DBB0:SINT", "-2", []byte{0xFE}, int8(-2)},
+		{"DB1.DBW0", "513", []byte{2, 1}, uint16(513)},
+		{"DB1.DBW0:INT", "-5", []byte{0xFF, 0xFB}, int16(-5)},
+		{"DB1.DBD0:DINT", "-42", []byte{0xFF, 0xFF, 0xFF, 0xD6}, int32(-42)},
+		{"DB1.DBD0:UDINT", "4294967295", []byte{0xFF, 0xFF, 0xFF, 0xFF}, uint32(4294967295)},
+		{"DB1.DBB0:LINT", "-1", []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, int64(-1)},
+		{"DB1.DBD0:REAL", "3.5", []byte{0x40, 0x60, 0, 0}, float32(3.5)},
+		{"DB1.DBB0:LREAL", "-0.25", []byte{0xBF, 0xD0, 0, 0, 0, 0, 0, 0}, -0.25},
+		{"DB1.DBB0:CHAR", "A", []byte{'A'}, "A"},
+		{"DB1.DBW0:WCHAR", "ž", []byte{0x01, 0x7E}, "ž"},
+		{"DB1.DBB0:STRING[4]", "ab", []byte{4, 2, 'a', 'b', 0, 0}, "ab"},
+		{"DB1.DBB0:WSTRING[2]", "ž", []byte{0, 2, 0, 1, 0x01, 0x7E, 0, 0}, "ž"},
+		{"DB1.DBD0:TIME", "T#1m30s", []byte{0, 0x01, 0x5F, 0x90}, 90 * time.Second},
+		{"DB1.DBD0:TIME", "-1s", []byte{0xFF, 0xFF, 0xFC, 0x18}, -time.Second},
+		{"DB1.DBD0:TIME", "596h31m23.647s", []byte{0x7F, 0xFF, 0xFF, 0xFF}, math.MaxInt32 * time.Millisecond},
+		{"DB1.DBD0:TOD", "12:30:00.5", []byte{0x02, 0xAE, 0xA7, 0x34}, 12*time.Hour + 30*time.Minute + 500*time.Millisecond},
+		{"DB1.DBW0:S5TIME", "S5T#2m30s", []byte{0x21, 0x50}, 150 * time.Second},
+		{"DB1.DBW0:S5TIME", "120ms", []byte{0x00, 0x12}, 120 * time.Millisecond},
+		{"DB1.DBW0:DATE", "2024-02-29", []byte{0x30, 0xBD}, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"DB1.DBW0:DATE", "2169-06-06", []byte{0xFF, 0xFF}, time.Date(2169, 6, 6, 0, 0, 0, 0, time.UTC)},
+		{"DB1.DBB0:DT", "2024-05-06 07:08:09.123", []byte{0x24, 0x05, 0x06, 0x07, 0x08, 0x09, 0x12, 0x32},
+			time.Date(2024, 5, 6, 7, 8, 9, 123e6, time.Local)},
+		{"DB1.DBB0:DTL", "2024-05-06 07:08:09.5", []byte{0x07, 0xE8, 5, 6, 2, 7, 8, 9, 0x1D, 0xCD, 0x65, 0},
+			time.Date(2024, 5, 6, 7, 8, 9, 5e8, time.Local)},
+	}
+	for _, tt := range tests {
+		addr, err := ParseAddress(tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := EncodeValue(addr, tt.text)
+		if err != nil {
+			t.Errorf("EncodeValue(%s, %q): %v", tt.addr, tt.text, err)
+			continue
+		}
+		if !bytes.Equal(data, tt.bytes) {
+			t.Errorf("EncodeValue(%s, %q) = % X, want % X", tt.addr, tt.text, data, tt.bytes)
+		}
+		if tt.value == nil {
+			continue
+		}
+		got := DecodeValue(addr, data)
+		if want, ok := tt.value.(time.Time); ok {
+			if got, ok := got.(time.Time); !ok || !got.Equal(want) {
+				t.Errorf("DecodeValue(%s, % X) = %v, want %v", tt.addr, data, got, want)
+			}
+			continue
+		}
+		if got != tt.value {
+			t.Errorf("DecodeValue(%s, % X) = %v (%T), want %v (%T)", tt.addr, data, got, got, tt.value, tt.value)
+		}
+	}
+}
+
+func TestDecodeBit(t *testing.T) {
+	addr, _ := ParseAddress("DB1.DBX0.3")
+	if !DecodeValue(addr, []byte{0x08}).(bool) || DecodeValue(addr, []byte{0xF7}).(bool) {
+		t.Error("bit 3 decoded wrong")
+	}
+}
+
+func TestEncodeValueErrors(t *testing.T) {
+	tests := []struct{ addr, text string }{
+		{"DB1.DBX0.0", "maybe"},
+		{"DB1.DBB0", "256"},
+		{"DB1.DBB0", "-1"},
+		{"DB1.DBW0:INT", "32768"},
+		{"DB1.DBD0:REAL", "x"},
+		{"DB1.DBB0:CHAR", "ab"},
+		{"DB1.DBB0:STRING[2]", "abc"},
+		{"DB1.DBW0:S5TIME", "3h"},
+		{"DB1.DBW0:S5TIME", "-1s"},
+		{"DB1.DBW0:DATE", "yesterday"},
+		{"DB1.DBB0", "0b101"},
+		{"DB1.DBB0", "0o17"},
+		{"DB1.DBB0", "0x"},
+		{"DB1.DBW0:INT", "0x-5"},
+		{"DB1.DBB0:STRING[300]", "ab"},
+		{"DB1.DBD0:TIME", "600h"},
+		{"DB1.DBD0:TIME", "-600h"},
+		{"DB1.DBD0:TOD", "24h"},
+		{"DB1.DBD0:TOD", "-1s"},
+		{"DB1.DBW0:DATE", "1989-12-31"},
+		{"DB1.DBW0:DATE", "2169-06-07"},
+		{"DB1.DBB0:DT", "2090-01-01 00:00:00"},
+	}
+	for _, tt := range tests {
+		addr, err := ParseAddress(tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := EncodeValue(addr, tt.text); err == nil {
+			t.Errorf("EncodeValue(%s, %q) = % X, want an error", tt.addr, tt.text, data)
+		}
+	}
+}
+
+func TestParseDataType(t *testing.T) {
+	tests := []struct {
+		in     string
+		typ    DataType
+		length int
+		size   int
+	}{
+		{"int", TypeInt, 0, 2},
+		{" Real ", TypeReal, 0, 4},
+		{"DATE_AND_TIME", TypeDT, 0, 8},
+		{"STRING", TypeString, 254, 256},
+		{"string[10]", TypeString, 10, 12},
+		{"WSTRING[5]", TypeWString, 5, 14},
+		{"DTL", TypeDTL, 0, 12},
+	}
+	for _, tt := range tests {
+		typ, length, err := ParseDataType(tt.in)
+		if err != nil || typ != tt.typ || length != tt.length {
+			t.Errorf("ParseDataType(%q) = %s, %d, %v, want %s, %d", tt.in, typ, length, err, tt.typ, tt.length)
+			continue
+		}
+		if size := TypeSize(typ, length); size != tt.size {
+			t.Errorf("TypeSize(%s, %d) = %d, want %d", typ, length, size, tt.size)
+		}
+	}
+	for _, in := range []string{"", "FOO", "INT[2]", "STRING[0]", "STRING[x]", "STRING[3"} {
+		if typ, _, err := ParseDataType(in); err == nil {
+			t.Errorf("ParseDataType(%q) = %s, want an error", in, typ)
+		}
+	}
+}
@@ -2,26 +2,102 @@ package utils
 
 import (
 	"encoding/json"
-	"io/ioutil"
-	"log"
+	"flag"
+	"fmt"
 	"os"
-	"time"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 )
 
 type Config struct {
-	PlcIP           string `json:"PlcIP"`
-	InfluxDBURL     string `json:"InfluxDBURL"`
-	InfluxDBHealth  string `json:"InfluxDBHealth"`
-	InfluxDBToken   string `json:"InfluxDBToken"`
-	InfluxDBOrg     string `json:"InfluxDBOrg"`
-	InfluxDBBucket  string `json:"InfluxDBBucket"`
-	ReconnectDelay  int    `json:"ReconnectDelay"` // In seconds
-	PlcPort         string `json:"PlcPort"`
-	WriteToInfluxDB bool   `json:"WriteToInfluxDB"` // New field for enabling/disabling InfluxDB writing
-	WebServer       bool   `json:"WebServer"`       // New field for enabling/disabling the web server
+	PlcName           string `json:"PlcName"` // Used in the API and as InfluxDB host tag, defaults to "plc"
+	PlcIP             string `json:"PlcIP"`
+	InfluxDBURL       string `json:"InfluxDBURL"`
+	InfluxDBHealth    string `json:"InfluxDBHealth"`
+	InfluxDBToken     string `json:"InfluxDBToken"` // Or a reference such as secret:influxdb_token, see ResolveSecrets
+	InfluxDBOrg       string `json:"InfluxDBOrg"`
+	InfluxDBBucket    string `json:"InfluxDBBucket"`
+	ReconnectDelay    int    `json:"ReconnectDelay"` // In seconds
+	PlcPort           string `json:"PlcPort"`
+	PlcRack           int    `json:"PlcRack"`
+	PlcSlot           int    `json:"PlcSlot"`           // Defaults to 1 (S7-1200/1500)
+	PlcConnectionType string `json:"PlcConnectionType"` // PG, OP or BASIC, defaults to PG
+	PlcPassword       string `json:"PlcPassword"`       // Session password of protected CPUs, or a reference like InfluxDBToken
+	Keystore          string `json:"Keystore"`          // Encrypted file for keystore: references, see Keystore
+	AccumulatorState  string `json:"AccumulatorState"`  // File keeping the totals of accumulator tags, defaults to accumulators.json
+	StatusInterval    int    `json:"StatusInterval"`    // Seconds between CPU run/stop checks, defaults to 10, negative disables
+	ShutdownTimeout   int    `json:"ShutdownTimeout"`   // Seconds to finish requests and flush outputs on shutdown, defaults to 10
+	ReadinessPolls    int    `json:"ReadinessPolls"`    // Polls that may fail in a row before /readyz fails, defaults to 3
+	WriteToInfluxDB   bool   `json:"WriteToInfluxDB"`   // New field for enabling/disabling InfluxDB writing
+	WebServer         bool   `json:"WebServer"`         // New field for enabling/disabling the web server
+	WebPort           string `json:"WebPort"`           // Port of the web server, defaults to 9999
+	WebTLSCert        string `json:"WebTLSCert"`        // PEM certificate file, serves HTTPS together with WebTLSKey
+	WebTLSKey         string `json:"WebTLSKey"`         // PEM private key file
+	WebTLSSelfSigned  bool   `json:"WebTLSSelfSigned"`  // Serve HTTPS with a certificate generated at startup
+	LogLevel          string `json:"LogLevel"`          // debug, info, warn or error
+	TagBoundsCheck    string `json:"TagBoundsCheck"`    // mark (default), fail or off, see CheckTagBounds
+	JSONLayout        string `json:"JSONLayout"`        // flat (default) or nested, the shape of tag values in the web API
+
+	WebUsers   []WebUser   `json:"WebUsers"`   // Basic auth users; with WebAPIKeys, the web server requires credentials when set
+	WebAPIKeys []WebAPIKey `json:"WebAPIKeys"` // Keys for programs using the API
+
+	ReadinessCritical []string `json:"ReadinessCritical"` // Checks that make /readyz fail, defaults to ReadinessChecks
+
+	InfluxDBQueue     SinkQueueConfig     `json:"InfluxDBQueue"`     // Queue of poll results in front of InfluxDB
+	InfluxDBRoute     SinkRouteConfig     `json:"InfluxDBRoute"`     // Tags written to InfluxDB and their names there
+	InfluxDBAggregate SinkAggregateConfig `json:"InfluxDBAggregate"` // Aggregates written to InfluxDB instead of every polled value
+
+	Historian   *HistorianConfig   `json:"Historian"`   // Keeps tag values in a local SQLite database when set
+	FileSinks   []FileSinkConfig   `json:"FileSinks"`   // CSV and Parquet files with one row per poll
+	StreamSinks []StreamSinkConfig `json:"StreamSinks"` // NATS, JetStream and Kafka with one message per tag and poll
+	Modbus      *ModbusConfig      `json:"Modbus"`      // Serves tags to Modbus TCP clients when set
+	OPCUA       *OPCUAConfig       `json:"OPCUA"`       // Serves tags to OPC UA clients when set
+	Context     *ContextConfig     `json:"Context"`     // Shift, order and batch recorded with every sample when set
+	Snapshots   []SnapshotConfig   `json:"Snapshots"`   // Tags captured around events such as faults
+
+	Types map[string][]MemberConfig `json:"Types"` // Struct types (UDTs) used by Tags
+	Tags  []TagConfig               `json:"Tags"`  // Defaults to DefaultTags
 }
 
-var ConfigData Config
+// currentConfig is the config in use. The collector replaces it as a whole
+// on reload while the web and OPC UA servers read it.
+var currentConfig atomic.Pointer[Config]
+
+// CurrentConfig returns the config in use, which is safe to read from any
+// goroutine. It is shared, so it must not be modified.
+func CurrentConfig() *Config {
+	if cfg := currentConfig.Load(); cfg != nil {
+		return cfg
+	}
+	return &Config{}
+}
+
+// SetCurrentConfig makes cfg the config in use.
+func SetCurrentConfig(cfg Config) {
+	currentConfig.Store(&cfg)
+}
+
+// Readiness checks of the collector, see ReadinessCritical.
+const (
+	CheckPLC      = "plc"      // The last poll could read from the PLC
+	CheckPoll     = "poll"     // A poll succeeded within ReadinessPolls intervals
+	CheckInfluxDB = "influxdb" // The last write to InfluxDB succeeded, only when WriteToInfluxDB is set
+	CheckSinks    = "sinks"    // The historian, file and stream sinks are healthy, only when there are any
+)
+
+// ReadinessChecks lists all readiness checks.
+var ReadinessChecks = []string{CheckPLC, CheckPoll, CheckInfluxDB, CheckSinks}
+
+// DefaultConfigFile is used when neither --config nor CONFIG_FILE is given
+// and none of the DefaultConfigFiles exists.
+const DefaultConfigFile = "config.json"
+
+// DefaultConfigFiles are looked for in this order when neither --config nor
+// CONFIG_FILE is given.
+var DefaultConfigFiles = []string{DefaultConfigFile, "config.yaml", "config.yml", "config.toml"}
 
 // Check if file exists
 func FileExists(filePath string) bool {
@@ -29,19 +105,222 @@ func FileExists(filePath string) bool {
 	return err == nil
 }
 
-func LoadConfig(filePath string) {
+// DefaultConfigPath returns the config file named by the CONFIG_FILE
+// environment variable, falling back to the first of DefaultConfigFiles that
+// exists.
+func DefaultConfigPath() string {
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		return path
+	}
+	for _, path := range DefaultConfigFiles {
+		if FileExists(path) {
+			return path
+		}
+	}
+	return DefaultConfigFile
+}
+
+// ReadConfig reads and parses a config file in JSON, YAML or TOML on top of
+// DefaultConfig. Defaults that depend on other fields, such as
+// InfluxDBHealth, are left to ApplyDefaults, which the caller runs once
+// command line overrides are in place. A file that cannot be decoded returns
+// ConfigParseErrors. Unknown keys and values of the wrong type are returned
+// as ConfigErrors together with the config decoded from the remaining
+// values, so the caller can still run Validate and report every problem at
+// once.
+func ReadConfig(filePath string) (Config, error) {
+	cfg := DefaultConfig()
 
-	data, err := ioutil.ReadFile(filePath)
+	doc, err := readConfigDoc(filePath, nil, nil)
 	if err != nil {
-		log.Fatalf("Failed to read config file: %v", err)
+		if errs, ok := err.(ConfigErrors); ok {
+			return cfg, ConfigParseErrors{errs}
+		}
+		return cfg, fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	err = json.Unmarshal(data, &ConfigData)
-	if err != nil {
-		log.Fatalf("Failed to unmarshal config file: %v", err)
+	errs := checkDoc(doc)
+	data, err := json.Marshal(doc)
+	if err == nil {
+		err = json.Unmarshal(data, &cfg)
+	}
+	if err != nil && len(errs) == 0 {
+		return cfg, fmt.Errorf("failed to unmarshal config file: %w", err)
+	}
+	if len(errs) > 0 {
+		return cfg, errs
 	}
+	return cfg, nil
 }
 
-func GetReconnectDelay() time.Duration {
-	return time.Duration(ConfigData.ReconnectDelay) * time.Second
+// DefaultConfig returns a config with all defaults set. Fields whose zero
+// value is meaningful, such as PlcSlot, get their default here so a value in
+// the file can still set them to zero.
+func DefaultConfig() Config {
+	cfg := Config{PlcSlot: 1}
+	cfg.ApplyDefaults()
+	return cfg
+}
+
+// ApplyDefaults fills in values for optional fields left empty in the file.
+func (c *Config) ApplyDefaults() {
+	if c.InfluxDBHealth == "" && c.InfluxDBURL != "" {
+		c.InfluxDBHealth = strings.TrimSuffix(c.InfluxDBURL, "/") + "/health"
+	}
+	if c.PlcPort == "" {
+		c.PlcPort = "102"
+	}
+	if c.ReconnectDelay <= 0 {
+		c.ReconnectDelay = 5
+	}
+	if c.WebPort == "" {
+		c.WebPort = "9999"
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	if c.PlcConnectionType == "" {
+		c.PlcConnectionType = "PG"
+	}
+	if c.PlcName == "" {
+		c.PlcName = "plc"
+	}
+	if c.ReadinessPolls <= 0 {
+		c.ReadinessPolls = 3
+	}
+	if c.ReadinessCritical == nil {
+		c.ReadinessCritical = append([]string(nil), ReadinessChecks...)
+	}
+	if c.ShutdownTimeout <= 0 {
+		c.ShutdownTimeout = 10
+	}
+	if c.StatusInterval == 0 {
+		c.StatusInterval = 10
+	}
+	if c.TagBoundsCheck == "" {
+		c.TagBoundsCheck = "mark"
+	}
+	if c.JSONLayout == "" {
+		c.JSONLayout = "flat"
+	}
+	if c.AccumulatorState == "" {
+		c.AccumulatorState = "accumulators.json"
+	}
+	c.InfluxDBQueue.applyDefaults()
+	c.InfluxDBAggregate.applyDefaults()
+	if c.Historian != nil {
+		c.Historian.applyDefaults()
+	}
+	for i := range c.FileSinks {
+		c.FileSinks[i].applyDefaults(c.PlcName)
+	}
+	for i := range c.StreamSinks {
+		c.StreamSinks[i].applyDefaults()
+	}
+	if c.Modbus != nil {
+		c.Modbus.applyDefaults()
+	}
+	if c.Context != nil {
+		c.Context.applyDefaults()
+	}
+	for i := range c.Snapshots {
+		c.Snapshots[i].applyDefaults()
+	}
+	if c.OPCUA != nil {
+		c.OPCUA.applyDefaults()
+	}
+}
+
+// ConfigOverrides holds config values given on the command line, keyed by
+// the JSON name of the config field.
+type ConfigOverrides map[string]string
+
+// configFlag is a flag.Value that records an override for one config field.
+type configFlag struct {
+	overrides ConfigOverrides
+	key       string
+	kind      reflect.Kind
+}
+
+func (f *configFlag) String() string { return "" }
+
+func (f *configFlag) IsBoolFlag() bool { return f.kind == reflect.Bool }
+
+func (f *configFlag) Set(value string) error {
+	if _, err := parseConfigValue(f.kind, value); err != nil {
+		return err
+	}
+	f.overrides[f.key] = value
+	return nil
+}
+
+// RegisterConfigFlags adds one flag per top-level config field to fs, named
+// after the field's JSON key (for example --PlcIP or --WriteToInfluxDB=false).
+func RegisterConfigFlags(fs *flag.FlagSet) ConfigOverrides {
+	overrides := ConfigOverrides{}
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := configKey(field)
+		switch field.Type.Kind() {
+		case reflect.String, reflect.Int, reflect.Bool:
+		default:
+			continue
+		}
+		if fs.Lookup(key) != nil {
+			continue
+		}
+		fs.Var(&configFlag{overrides: overrides, key: key, kind: field.Type.Kind()}, key,
+			fmt.Sprintf("override %s from the config file", key))
+	}
+	return overrides
+}
+
+// Apply writes the recorded overrides into cfg.
+func (o ConfigOverrides) Apply(cfg *Config) error {
+	keys := make([]string, 0, len(o))
+	for key := range o {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for _, key := range keys {
+		found := false
+		for i := 0; i < t.NumField(); i++ {
+			if configKey(t.Field(i)) != key {
+				continue
+			}
+			value, err := parseConfigValue(t.Field(i).Type.Kind(), o[key])
+			if err != nil {
+				return fmt.Errorf("--%s: %w", key, err)
+			}
+			v.Field(i).Set(reflect.ValueOf(value).Convert(t.Field(i).Type))
+			found = true
+			break
+		}
+		if !found {
+			return fmt.Errorf("unknown config field %q", key)
+		}
+	}
+	return nil
+}
+
+func configKey(field reflect.StructField) string {
+	if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); name != "" && name != "-" {
+		return name
+	}
+	return field.Name
+}
+
+func parseConfigValue(kind reflect.Kind, value string) (interface{}, error) {
+	switch kind {
+	case reflect.Bool:
+		return strconv.ParseBool(value)
+	case reflect.Int:
+		return strconv.Atoi(value)
+	default:
+		return value, nil
+	}
 }
@@ -0,0 +1,253 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configFormats maps the extensions of config files to their format.
+var configFormats = map[string]string{
+	".json": "json",
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".toml": "toml",
+}
+
+// includeKey lists further config files, typically the tags of one machine
+// each, that are merged into the file that names them.
+const includeKey = "include"
+
+// envPattern matches $$, ${NAME} and ${NAME:-default}.
+var envPattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces ${NAME} and ${NAME:-default} in s with the value of
+// the environment variable NAME. The default is used when NAME is unset or
+// empty; the names of unset variables referenced without a default are
+// returned. $$ stands for a literal $.
+func expandEnv(s string) (string, []string) {
+	var missing []string
+	expanded := envPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$$" {
+			return "$"
+		}
+		m := envPattern.FindStringSubmatch(ref)
+		value, ok := os.LookupEnv(m[1])
+		if value == "" && m[2] != "" {
+			return m[3]
+		}
+		if !ok {
+			missing = append(missing, m[1])
+		}
+		return value
+	})
+	return expanded, missing
+}
+
+// expandEnvDoc expands the environment references in the string values of
+// the decoded config value v, which is at path. References are expanded
+// after parsing, so a value cannot change the structure of the file, and
+// they only work in strings. where prefixes the problems reported.
+func expandEnvDoc(path, where string, v interface{}, errs *ConfigErrors) interface{} {
+	switch v := v.(type) {
+	case string:
+		expanded, missing := expandEnv(v)
+		switch len(missing) {
+		case 0:
+		case 1:
+			errs.add(path, "%senvironment variable %s is not set, set it or give a default as ${%s:-default}",
+				where, missing[0], missing[0])
+		default:
+			errs.add(path, "%senvironment variables %s are not set", where, strings.Join(missing, ", "))
+		}
+		return expanded
+	case map[string]interface{}:
+		for _, key := range sortedKeys(v) {
+			v[key] = expandEnvDoc(joinPath(path, key), where, v[key], errs)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = expandEnvDoc(fmt.Sprintf("%s[%d]", path, i), where, v[i], errs)
+		}
+	}
+	return v
+}
+
+// readConfigDoc reads a JSON, YAML or TOML config file, expands environment
+// references and merges the files it includes. Included files come first, so
+// values in the including file win and its Tags follow the included ones.
+// Problems with the content are returned as ConfigErrors. The names of the
+// files read are added to files when it is not nil.
+func readConfigDoc(path string, parents []string, files *[]string) (map[string]interface{}, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	// Problems in included files name the file they are in.
+	where := ""
+	if len(parents) > 0 {
+		where = path + ": "
+	}
+	for _, parent := range parents {
+		if parent == abs {
+			return nil, ConfigErrors{{Path: includeKey, Message: where + "the file includes itself"}}
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if files != nil {
+		*files = append(*files, abs)
+	}
+	doc, err := decodeConfigDoc(path, data)
+	if err != nil {
+		return nil, ConfigErrors{{Message: where + err.Error()}}
+	}
+	var envErrs ConfigErrors
+	expandEnvDoc("", where, doc, &envErrs)
+	if len(envErrs) > 0 {
+		return nil, envErrs
+	}
+
+	includes, err := includeList(doc[includeKey])
+	if err != nil {
+		return nil, ConfigErrors{{Path: includeKey, Message: where + err.Error()}}
+	}
+	delete(doc, includeKey)
+	merged := map[string]interface{}{}
+	var errs ConfigErrors
+	for _, pattern := range includes {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err == nil && len(matches) == 0 {
+			err = fmt.Errorf("%s matches no files", pattern)
+		}
+		if err != nil {
+			errs.add(includeKey, "%s%v", where, err)
+			continue
+		}
+		sort.Strings(matches)
+		for _, file := range matches {
+			included, err := readConfigDoc(file, append(parents, abs), files)
+			if err != nil {
+				if nested, ok := err.(ConfigErrors); ok {
+					errs = append(errs, nested...)
+				} else {
+					errs.add(includeKey, "%s%v", where, err)
+				}
+				continue
+			}
+			mergeConfigDocs(merged, included)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	mergeConfigDocs(merged, doc)
+	return merged, nil
+}
+
+// ConfigFiles returns the absolute names of the config file at path and
+// of the files it includes. Files that could be read are returned even when
+// the config has problems, so they can be watched until it is fixed.
+func ConfigFiles(path string) ([]string, error) {
+	var files []string
+	_, err := readConfigDoc(path, nil, &files)
+	return files, err
+}
+
+// IsConfigFile reports whether name has the extension of a config file.
+func IsConfigFile(name string) bool {
+	_, ok := configFormats[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+// decodeConfigDoc parses a config file in the format given by its
+// extension. The result is passed through JSON so numbers, lists and maps
+// have the same Go types whatever the format.
+func decodeConfigDoc(path string, data []byte) (map[string]interface{}, error) {
+	format, ok := configFormats[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		format = "json"
+	}
+	var doc map[string]interface{}
+	switch format {
+	case "yaml":
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+	case "toml":
+		if _, err := toml.Decode(string(data), &doc); err != nil {
+			return nil, err
+		}
+	default:
+		if err := json.Unmarshal(data, &doc); err != nil {
+			if syntax, ok := err.(*json.SyntaxError); ok {
+				line, col := lineColumn(data, syntax.Offset)
+				return nil, fmt.Errorf("line %d, column %d: %v", line, col, err)
+			}
+			return nil, err
+		}
+		return doc, nil
+	}
+
+	normalized, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	doc = nil
+	if err := json.Unmarshal(normalized, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func includeList(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		list := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("must be a file name or a list of file names")
+			}
+			list[i] = s
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("must be a file name or a list of file names")
+}
+
+// mergeConfigDocs merges src into dst: objects are merged key by key, lists
+// are appended and other values in src replace those in dst.
+func mergeConfigDocs(dst, src map[string]interface{}) {
+	for key, value := range src {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if existing, ok := dst[key].(map[string]interface{}); ok {
+				mergeConfigDocs(existing, v)
+				continue
+			}
+		case []interface{}:
+			if existing, ok := dst[key].([]interface{}); ok {
+				dst[key] = append(existing, v...)
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
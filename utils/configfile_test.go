@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("S7_TEST_SET", "value")
+	t.Setenv("S7_TEST_EMPTY", "")
+	tests := []struct {
+		in, want string
+		missing  []string
+	}{
+		{"plain", "plain", nil},
+		{"${S7_TEST_SET}", "value", nil},
+		{"a-${S7_TEST_SET}-b", "a-value-b", nil},
+		{"${S7_TEST_EMPTY}", "", nil},
+		{"${S7_TEST_EMPTY:-default}", "default", nil},
+		{"${S7_TEST_UNSET:-default}", "default", nil},
+		{"${S7_TEST_UNSET:-}", "", nil},
+		{"${S7_TEST_UNSET}", "", []string{"S7_TEST_UNSET"}},
+		{"$${S7_TEST_SET}", "${S7_TEST_SET}", nil},
+		{"cost $5", "cost $5", nil},
+	}
+	for _, tt := range tests {
+		got, missing := expandEnv(tt.in)
+		if got != tt.want || !reflect.DeepEqual(missing, tt.missing) {
+			t.Errorf("expandEnv(%q) = %q, %v, want %q, %v", tt.in, got, missing, tt.want, tt.missing)
+		}
+	}
+}
+
+// writeFiles writes files, named relative to a new directory, and returns
+// the directory.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestReadConfigDocEnvCannotInject(t *testing.T) {
+	// A value that would close the string and add a key if it were
+	// substituted into the text.
+	t.Setenv("S7_TEST_TOKEN", "x\", \"WebUsers\": [{\"Name\": \"evil\", \"Role\": \"admin\"}], \"y\": \"\n}")
+	for name, content := range map[string]string{
+		"c.json": `{"InfluxDBToken": "${S7_TEST_TOKEN}"}`,
+		"c.yaml": "InfluxDBToken: ${S7_TEST_TOKEN}\n",
+		"c.toml": "InfluxDBToken = \"${S7_TEST_TOKEN}\"\n",
+	} {
+		dir := writeFiles(t, map[string]string{name: content})
+		doc, err := readConfigDoc(filepath.Join(dir, name), nil, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(doc) != 1 || doc["InfluxDBToken"] != os.Getenv("S7_TEST_TOKEN") {
+			t.Errorf("%s: got %v", name, doc)
+		}
+	}
+}
+
+func TestReadConfigDocEnvInComments(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"c.yaml": "# Set ${S7_TEST_UNSET} to override\nPlcIP: 10.0.0.1\n",
+		"c.toml": "# Set ${S7_TEST_UNSET} to override\nPlcIP = \"10.0.0.1\"\n",
+	})
+	for _, name := range []string{"c.yaml", "c.toml"} {
+		doc, err := readConfigDoc(filepath.Join(dir, name), nil, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if doc["PlcIP"] != "10.0.0.1" {
+			t.Errorf("%s: got %v", name, doc)
+		}
+	}
+}
+
+func TestReadConfigDocEnvUnset(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"c.json": `{"Tags": [{"Name": "${S7_TEST_UNSET}"}]}`,
+	})
+	_, err := readConfigDoc(filepath.Join(dir, "c.json"), nil, nil)
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 1 || errs[0].Path != "Tags[0].Name" || !strings.Contains(errs[0].Message, "S7_TEST_UNSET") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestReadConfigDocIncludes(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml": "include: machines/*.toml\nPlcIP: 10.0.0.1\nTags:\n  - Name: Main\n",
+	})
+	if err := os.Mkdir(filepath.Join(dir, "machines"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"b.toml": "[[Tags]]\nName = \"B\"\n",
+		"a.toml": "PlcIP = \"10.0.0.2\"\n[[Tags]]\nName = \"A\"\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, "machines", name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var files []string
+	doc, err := readConfigDoc(filepath.Join(dir, "config.yaml"), nil, &files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The including file wins, its tags follow those of the included files
+	// in the order of their names.
+	if doc["PlcIP"] != "10.0.0.1" {
+		t.Errorf("PlcIP = %v", doc["PlcIP"])
+	}
+	var names []string
+	for _, tag := range doc["Tags"].([]interface{}) {
+		names = append(names, tag.(map[string]interface{})["Name"].(string))
+	}
+	if want := []string{"A", "B", "Main"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("tags %v, want %v", names, want)
+	}
+	if _, ok := doc[includeKey]; ok {
+		t.Error("include left in the merged config")
+	}
+	if len(files) != 3 {
+		t.Errorf("files %v, want 3", files)
+	}
+}
+
+func TestReadConfigDocIncludeErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"self.json":    `{"include": "self.json"}`,
+		"missing.json": `{"include": "none/*.json"}`,
+		"type.json":    `{"include": 5}`,
+		"nested.json":  `{"include": "broken.yaml"}`,
+		"broken.yaml":  "PlcIP: [\n",
+	})
+	for name, want := range map[string]string{
+		"self.json":    "includes itself",
+		"missing.json": "matches no files",
+		"type.json":    "must be a file name",
+		"nested.json":  "broken.yaml: ",
+	} {
+		_, err := readConfigDoc(filepath.Join(dir, name), nil, nil)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", name, err, want)
+		}
+	}
+}
+
+// Defaults derived from other fields follow the command line overrides.
+func TestReadConfigDefaultsAfterOverrides(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.json": `{"InfluxDBURL": "http://file:8086", "FileSinks": [{"Dir": "data"}]}`,
+	})
+	cfg, err := ReadConfig(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrides := ConfigOverrides{"InfluxDBURL": "http://flag:8086/", "PlcName": "Line1"}
+	if err := overrides.Apply(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.ApplyDefaults()
+	if cfg.InfluxDBHealth != "http://flag:8086/health" {
+		t.Errorf("InfluxDBHealth %q, want the health URL of the override", cfg.InfluxDBHealth)
+	}
+	if prefix := cfg.FileSinks[0].Prefix; prefix != "Line1" {
+		t.Errorf("FileSinks[0].Prefix %q, want the overridden PlcName", prefix)
+	}
+}
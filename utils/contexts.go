@@ -0,0 +1,310 @@
+package utils
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContextConfig describes the context recorded with every sample for
+// traceability, such as the shift and the order and batch a value was
+// produced in.
+type ContextConfig struct {
+	Shift            *ShiftCalendarConfig `json:"Shift"`            // Records the current shift when set
+	Tags             []ContextTagConfig   `json:"Tags"`             // Context read from PLC tags, e.g. the order number
+	EventMeasurement string               `json:"EventMeasurement"` // InfluxDB measurement of start and end events, defaults to context_events
+}
+
+// ShiftCalendarConfig names the shift of every time of day.
+type ShiftCalendarConfig struct {
+	Name   string   `json:"Name"`   // Context name, defaults to shift
+	Starts []string `json:"Starts"` // Local start times, defaults to DefaultShiftStarts
+	Names  []string `json:"Names"`  // Shift names in the order of Starts, defaults to 1, 2, 3 and so on
+}
+
+// ContextTagConfig takes a context from a PLC tag. The context is active
+// while the tag is not empty; when the value changes the context of the old
+// value ends and that of the new one starts.
+type ContextTagConfig struct {
+	Name string `json:"Name"` // Context name, e.g. order
+	Tag  string `json:"Tag"`  // Tag holding the value, usually a STRING
+}
+
+// contextName is what context names must look like, since they become
+// InfluxDB tag keys, column names and message headers.
+var contextName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// applyDefaults fills in the optional fields of c.
+func (c *ContextConfig) applyDefaults() {
+	if c.EventMeasurement == "" {
+		c.EventMeasurement = "context_events"
+	}
+	if s := c.Shift; s != nil {
+		if s.Name == "" {
+			s.Name = "shift"
+		}
+		if s.Starts == nil {
+			s.Starts = append([]string(nil), DefaultShiftStarts...)
+		}
+		if s.Names == nil {
+			for i := range s.Starts {
+				s.Names = append(s.Names, fmt.Sprint(i+1))
+			}
+		}
+	}
+}
+
+// validate checks the fields of c, reporting problems under path. tags are
+// all tags by name.
+func (c *ContextConfig) validate(path string, tags map[string]Tag, errs *ConfigErrors) {
+	names := map[string]string{}
+	checkName := func(path, name string) {
+		switch {
+		case !contextName.MatchString(name):
+			errs.add(path, "must be letters, digits and _, found %q", name)
+		case name == "host" || name == "timestamp":
+			errs.add(path, "%s is reserved", name)
+		case names[name] != "":
+			errs.add(path, "duplicate context name %q, also used by %s", name, names[name])
+		default:
+			if _, ok := tags[name]; ok {
+				errs.add(path, "%q is also a tag name", name)
+			}
+			names[name] = path
+		}
+	}
+	if s := c.Shift; s != nil {
+		checkName(path+".Shift.Name", s.Name)
+		if len(s.Starts) == 0 {
+			errs.add(path+".Shift.Starts", "is required")
+		}
+		seen := map[int]bool{}
+		for i, start := range s.Starts {
+			minutes, err := parseClock(start)
+			if err != nil {
+				errs.add(fmt.Sprintf("%s.Shift.Starts[%d]", path, i), "%v", err)
+			} else if seen[minutes] {
+				errs.add(fmt.Sprintf("%s.Shift.Starts[%d]", path, i), "%s is listed twice", start)
+			}
+			seen[minutes] = true
+		}
+		if len(s.Names) != len(s.Starts) {
+			errs.add(path+".Shift.Names", "must have one name per start, found %d for %d", len(s.Names), len(s.Starts))
+		}
+	}
+	for i, t := range c.Tags {
+		p := fmt.Sprintf("%s.Tags[%d]", path, i)
+		checkName(p+".Name", t.Name)
+		if t.Tag == "" {
+			errs.add(p+".Tag", "is required")
+		} else if _, ok := tags[t.Tag]; !ok {
+			errs.add(p+".Tag", "unknown tag %q", t.Tag)
+		}
+	}
+}
+
+// eventMeasurement returns the InfluxDB measurement of context events.
+func (c *Config) eventMeasurement() string {
+	if c.Context == nil || c.Context.EventMeasurement == "" {
+		return "context_events"
+	}
+	return c.Context.EventMeasurement
+}
+
+// Names returns the names of the contexts of c in a stable order: the
+// shift, then the tags as configured.
+func (c *ContextConfig) Names() []string {
+	if c == nil {
+		return nil
+	}
+	var names []string
+	if c.Shift != nil {
+		names = append(names, c.Shift.Name)
+	}
+	for _, t := range c.Tags {
+		names = append(names, t.Name)
+	}
+	return names
+}
+
+// shiftAt returns the name of the shift at t.
+func (s *ShiftCalendarConfig) shiftAt(t time.Time) string {
+	type start struct {
+		minutes int
+		name    string
+	}
+	var starts []start
+	for i, clock := range s.Starts {
+		if minutes, err := parseClock(clock); err == nil && i < len(s.Names) {
+			starts = append(starts, start{minutes, s.Names[i]})
+		}
+	}
+	if len(starts) == 0 {
+		return ""
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].minutes < starts[j].minutes })
+	t = t.Local()
+	minutes := t.Hour()*60 + t.Minute()
+	// Before the first start of the day it is still the last shift of the
+	// day before.
+	current := starts[len(starts)-1].name
+	for _, s := range starts {
+		if s.minutes <= minutes {
+			current = s.name
+		}
+	}
+	return current
+}
+
+// ContextEvent is the start or end of a context, such as a batch.
+type ContextEvent struct {
+	Time     time.Time `json:"time"`
+	Name     string    `json:"name"`               // Context name, e.g. batch
+	Event    string    `json:"event"`              // start or end
+	Value    string    `json:"value"`              // The batch ID, order number, shift...
+	Duration float64   `json:"duration,omitempty"` // end only: seconds since the start, 0 when unknown
+}
+
+// Kinds of ContextEvent.
+const (
+	ContextStart = "start"
+	ContextEnd   = "end"
+)
+
+// contextEventHistory is the number of events ContextTracker keeps for the
+// API.
+const contextEventHistory = 100
+
+// ContextTracker follows the contexts of a config from poll to poll. It is
+// safe for concurrent use.
+type ContextTracker struct {
+	mu      sync.Mutex
+	cfg     *ContextConfig
+	current map[string]string    // Active contexts by name
+	since   map[string]time.Time // Starts of the active contexts, unknown for those active at startup
+	seen    map[string]bool      // Contexts whose value has been read before
+	events  []ContextEvent       // The latest contextEventHistory events, oldest first
+}
+
+// NewContextTracker returns a tracker without contexts.
+func NewContextTracker() *ContextTracker {
+	return &ContextTracker{current: map[string]string{}, since: map[string]time.Time{}, seen: map[string]bool{}}
+}
+
+// SetConfig makes cfg, which may be nil, the contexts tracked. Contexts
+// that are no longer configured are dropped without an end event.
+func (c *ContextTracker) SetConfig(cfg *ContextConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cfg = cfg
+	names := cfg.Names()
+	for name := range c.seen {
+		if !slices.Contains(names, name) {
+			delete(c.current, name)
+			delete(c.since, name)
+			delete(c.seen, name)
+		}
+	}
+}
+
+// Update sets the Context of batch and adds an end and a start event for
+// every context that changed since the last poll. Contexts read from a tag
+// keep their value while the tag is bad. A context found active at startup
+// or when it is added to the config gets no start event, since it may have
+// started long before.
+func (c *ContextTracker) Update(batch *Batch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cfg == nil {
+		return
+	}
+	next := maps.Clone(c.current)
+	read := map[string]bool{}
+	if s := c.cfg.Shift; s != nil {
+		next[s.Name], read[s.Name] = s.shiftAt(batch.Time), true
+	}
+	for _, ct := range c.cfg.Tags {
+		i := slices.IndexFunc(batch.Tags, func(t Tag) bool { return t.Name == ct.Tag })
+		if i < 0 || batch.Values[i].Quality != QualityGood {
+			continue
+		}
+		next[ct.Name], read[ct.Name] = contextValue(batch.Values[i].Value), true
+	}
+
+	for _, name := range c.cfg.Names() {
+		if !read[name] {
+			continue
+		}
+		old, value, seen := c.current[name], next[name], c.seen[name]
+		c.seen[name] = true
+		if old == value || !seen {
+			continue
+		}
+		if old != "" {
+			event := ContextEvent{Time: batch.Time, Name: name, Event: ContextEnd, Value: old}
+			if since := c.since[name]; !since.IsZero() {
+				event.Duration = batch.Time.Sub(since).Seconds()
+			}
+			c.record(batch, event)
+		}
+		delete(c.since, name)
+		if value != "" {
+			c.record(batch, ContextEvent{Time: batch.Time, Name: name, Event: ContextStart, Value: value})
+			c.since[name] = batch.Time
+		}
+	}
+	for name, value := range next {
+		if value == "" {
+			delete(next, name)
+		}
+	}
+	c.current = next
+	if len(next) > 0 {
+		batch.Context = maps.Clone(next)
+	}
+}
+
+// record adds event to batch and to the history. c.mu is held.
+func (c *ContextTracker) record(batch *Batch, event ContextEvent) {
+	Infof("Context %s %s: %s", event.Name, event.Event, event.Value)
+	batch.Events = append(batch.Events, event)
+	c.events = append(c.events, event)
+	if len(c.events) > contextEventHistory {
+		c.events = c.events[len(c.events)-contextEventHistory:]
+	}
+}
+
+// ContextStatus is the current context and the latest events.
+type ContextStatus struct {
+	Context map[string]string `json:"context"`
+	Events  []ContextEvent    `json:"events"`
+}
+
+// Status returns the active contexts and the latest events, newest first.
+func (c *ContextTracker) Status() ContextStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	events := slices.Clone(c.events)
+	slices.Reverse(events)
+	if events == nil {
+		events = []ContextEvent{}
+	}
+	return ContextStatus{Context: maps.Clone(c.current), Events: events}
+}
+
+// contextValue formats the value of a context tag, with the spaces PLC
+// strings are often padded with removed.
+func contextValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShiftAt(t *testing.T) {
+	clock := func(hour, min int) time.Time {
+		return time.Date(2024, 3, 5, hour, min, 0, 0, time.Local)
+	}
+	defaults := &ShiftCalendarConfig{}
+	(&ContextConfig{Shift: defaults}).applyDefaults()
+	named := &ShiftCalendarConfig{Starts: []string{"18:00", "06:00"}, Names: []string{"night", "day"}}
+	tests := []struct {
+		shift *ShiftCalendarConfig
+		t     time.Time
+		want  string
+	}{
+		{defaults, clock(6, 0), "1"},
+		{defaults, clock(13, 59), "1"},
+		{defaults, clock(14, 0), "2"},
+		{defaults, clock(23, 0), "3"},
+		{defaults, clock(5, 59), "3"}, // Still the night shift of the day before
+		{named, clock(5, 0), "night"},
+		{named, clock(12, 0), "day"},
+		{named, clock(18, 30), "night"},
+		{&ShiftCalendarConfig{Starts: []string{"6"}, Names: []string{"1"}}, clock(12, 0), ""},
+	}
+	for _, tt := range tests {
+		if got := tt.shift.shiftAt(tt.t); got != tt.want {
+			t.Errorf("%v at %s: %q, want %q", tt.shift.Starts, tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestContextTracker(t *testing.T) {
+	cfg := &ContextConfig{Shift: &ShiftCalendarConfig{}, Tags: []ContextTagConfig{{Name: "batch", Tag: "BatchID"}}}
+	cfg.applyDefaults()
+	c := NewContextTracker()
+	c.SetConfig(cfg)
+	tags := []Tag{{TagConfig: TagConfig{Name: "Speed"}}, {TagConfig: TagConfig{Name: "BatchID"}}}
+	start := time.Date(2024, 3, 5, 13, 59, 50, 0, time.Local)
+
+	tests := []struct {
+		at      int         // Seconds after start
+		batchID interface{} // nil for a bad value
+		context map[string]string
+		events  []string // Event Name Value Duration
+	}{
+		// Contexts active at startup have no start event.
+		{0, "B1    ", map[string]string{"shift": "1", "batch": "B1"}, nil},
+		{10, "B1", map[string]string{"shift": "2", "batch": "B1"}, []string{"end shift 1 0", "start shift 2 0"}},
+		// A bad tag keeps its context.
+		{20, nil, map[string]string{"shift": "2", "batch": "B1"}, nil},
+		{30, "B2", map[string]string{"shift": "2", "batch": "B2"}, []string{"end batch B1 0", "start batch B2 0"}},
+		{60, "", map[string]string{"shift": "2"}, []string{"end batch B2 30"}},
+		{70, "B3", map[string]string{"shift": "2", "batch": "B3"}, []string{"start batch B3 0"}},
+	}
+	var all []string
+	for _, tt := range tests {
+		at := start.Add(time.Duration(tt.at) * time.Second)
+		batch := Batch{Time: at, Tags: tags, Values: []TagValue{
+			{Name: "Speed", Value: 1.0, Quality: QualityGood},
+			{Name: "BatchID", Value: tt.batchID, Quality: QualityGood},
+		}}
+		if tt.batchID == nil {
+			batch.Values[1].Quality = QualityBad
+		}
+		c.Update(&batch)
+		var events []string
+		for _, e := range batch.Events {
+			if !e.Time.Equal(at) {
+				t.Errorf("%ds: event at %v", tt.at, e.Time)
+			}
+			events = append(events, fmt.Sprintf("%s %s %s %g", e.Event, e.Name, e.Value, e.Duration))
+		}
+		if !maps.Equal(batch.Context, tt.context) || !slices.Equal(events, tt.events) {
+			t.Errorf("%ds: context %v and events %q, want %v and %q", tt.at, batch.Context, events, tt.context, tt.events)
+		}
+		all = append(all, events...)
+	}
+
+	status := c.Status()
+	if !maps.Equal(status.Context, map[string]string{"shift": "2", "batch": "B3"}) || len(status.Events) != len(all) ||
+		status.Events[0].Value != "B3" || status.Events[len(all)-1].Value != "1" {
+		t.Errorf("status %+v", status)
+	}
+
+	// A context taken out of the config is dropped without an end event.
+	cfg = &ContextConfig{Shift: cfg.Shift}
+	c.SetConfig(cfg)
+	batch := Batch{Time: start.Add(80 * time.Second), Tags: tags, Values: []TagValue{
+		{Name: "Speed", Value: 1.0, Quality: QualityGood},
+		{Name: "BatchID", Value: "B3", Quality: QualityGood},
+	}}
+	c.Update(&batch)
+	if !maps.Equal(batch.Context, map[string]string{"shift": "2"}) || len(batch.Events) != 0 {
+		t.Errorf("after the batch context was removed: context %v, events %+v", batch.Context, batch.Events)
+	}
+}
+
+func TestContextValidate(t *testing.T) {
+	tags := map[string]Tag{
+		"BatchID": {TagConfig: TagConfig{Name: "BatchID"}},
+		"order":   {TagConfig: TagConfig{Name: "order"}},
+	}
+	tests := []struct {
+		name string
+		cfg  ContextConfig
+		want []string // Paths of the problems
+	}{
+		{"valid", ContextConfig{Shift: &ShiftCalendarConfig{}, Tags: []ContextTagConfig{{Name: "batch", Tag: "BatchID"}}}, nil},
+		{"names", ContextConfig{Shift: &ShiftCalendarConfig{Name: "host"}, Tags: []ContextTagConfig{
+			{Name: "batch id", Tag: "BatchID"},
+			{Name: "order", Tag: "BatchID"},
+			{Name: "lot", Tag: ""},
+			{Name: "lot", Tag: "Missing"},
+		}}, []string{"C.Shift.Name", "C.Tags[0].Name", "C.Tags[1].Name", "C.Tags[2].Tag", "C.Tags[3].Name", "C.Tags[3].Tag"}},
+		{"shifts", ContextConfig{Shift: &ShiftCalendarConfig{Starts: []string{"06:00", "6:00", "25:00"}, Names: []string{"early"}}},
+			[]string{"C.Shift.Starts[1]", "C.Shift.Starts[2]", "C.Shift.Names"}},
+		{"no shifts", ContextConfig{Shift: &ShiftCalendarConfig{Starts: []string{}}}, []string{"C.Shift.Starts"}},
+	}
+	for _, tt := range tests {
+		tt.cfg.applyDefaults()
+		var errs ConfigErrors
+		tt.cfg.validate("C", tags, &errs)
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Path)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: problems at %v, want %v:\n%v", tt.name, got, tt.want, errs)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// DBSource is the content of a STEP 7 or TIA Portal source file with data
+// blocks (.db, .awl) or struct types (.udt, .scl).
+type DBSource struct {
+	Types TypeNames
+	DBs   []SourceDB
+}
+
+// SourceDB is one DATA_BLOCK of a source file.
+type SourceDB struct {
+	Name      string // Symbolic name, or DB<n> when the source gives a number
+	Number    int    // 0 when the source only has the symbolic name
+	Optimized bool   // S7_Optimized_Access is on, offsets are not fixed
+	Type      TypeDecl
+}
+
+// ParseDBSource parses the TYPE and DATA_BLOCK declarations of a source file.
+// Initial values, code blocks and comments are ignored.
+func ParseDBSource(text string) (DBSource, error) {
+	p := &srcParser{toks: lexSource(text)}
+	src := DBSource{Types: TypeNames{}}
+	for {
+		tok := p.next()
+		switch {
+		case tok.kind == tokEOF:
+			return src, nil
+		case tok.is("TYPE"):
+			name, _, err := p.blockName()
+			if err != nil {
+				return src, err
+			}
+			decl, _, err := p.blockBody()
+			if err != nil {
+				return src, fmt.Errorf("type %s: %w", name, err)
+			}
+			src.Types[name] = decl
+			p.skipTo("END_TYPE")
+		case tok.is("DATA_BLOCK"):
+			name, number, err := p.blockName()
+			if err != nil {
+				return src, err
+			}
+			db := SourceDB{Name: name, Number: number}
+			if db.Type, db.Optimized, err = p.blockBody(); err != nil {
+				return src, fmt.Errorf("%s: %w", name, err)
+			}
+			src.DBs = append(src.DBs, db)
+			p.skipTo("END_DATA_BLOCK")
+		case tok.is("FUNCTION_BLOCK"), tok.is("FUNCTION"), tok.is("ORGANIZATION_BLOCK"):
+			p.skipTo("END_" + strings.ToUpper(tok.text))
+		}
+	}
+}
+
+// optimizedAccess reports whether a block attribute list such as
+// { S7_Optimized_Access := 'TRUE' } switches optimized access on.
+func optimizedAccess(attrs string) bool {
+	for _, attr := range strings.Split(attrs, ";") {
+		key, value, ok := strings.Cut(attr, ":=")
+		if ok && strings.EqualFold(strings.TrimSpace(key), "S7_Optimized_Access") {
+			return strings.EqualFold(strings.Trim(strings.TrimSpace(value), "'"), "TRUE")
+		}
+	}
+	return false
+}
+
+type tokKind int
+
+const (
+	tokEOF    tokKind = iota
+	tokIdent          // Keyword, type or member name
+	tokName           // "Quoted name"
+	tokString         // 'string literal'
+	tokNumber         // Number or typed constant such as 16#FF
+	tokPunct          // : ; [ ] , .. := and the like
+	tokAttr           // Contents of { ... }
+)
+
+type srcToken struct {
+	kind tokKind
+	text string
+	line int
+}
+
+// is reports whether the token is the keyword kw.
+func (t srcToken) is(kw string) bool {
+	return t.kind == tokIdent && strings.EqualFold(t.text, kw)
+}
+
+// lexSource splits a source file into tokens, dropping comments and the
+// free text of TITLE lines.
+func lexSource(text string) []srcToken {
+	var toks []srcToken
+	r := []rune(text)
+	line := 1
+	emit := func(kind tokKind, s string) {
+		toks = append(toks, srcToken{kind, s, line})
+	}
+	// until returns the index of end after position i, or len(r).
+	until := func(i int, end string) int {
+		for ; i < len(r); i++ {
+			if strings.HasPrefix(string(r[i:min(i+len(end), len(r))]), end) {
+				return i
+			}
+		}
+		return len(r)
+	}
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case unicode.IsSpace(c):
+			i++
+		case c == '/' && i+1 < len(r) && r[i+1] == '/':
+			i = until(i, "\n")
+		case c == '(' && i+1 < len(r) && r[i+1] == '*':
+			end := until(i+2, "*)")
+			line += strings.Count(string(r[i:end]), "\n")
+			i = end + 2
+		case c == '{' || c == '"' || c == '\'':
+			closing, kind := "}", tokAttr
+			if c == '"' {
+				closing, kind = `"`, tokName
+			} else if c == '\'' {
+				closing, kind = "'", tokString
+			}
+			end := until(i+1, closing)
+			emit(kind, string(r[i+1:end]))
+			line += strings.Count(string(r[i:end]), "\n")
+			i = end + 1
+		case unicode.IsLetter(c) || c == '_' || unicode.IsDigit(c):
+			start := i
+			for i < len(r) && (unicode.IsLetter(r[i]) || unicode.IsDigit(r[i]) || r[i] == '_' || r[i] == '#' ||
+				(r[i] == '.' && i+1 < len(r) && unicode.IsDigit(r[i+1]) && unicode.IsDigit(r[start]))) {
+				i++
+			}
+			word := string(r[start:i])
+			if strings.EqualFold(word, "TITLE") {
+				j := i
+				for j < len(r) && (r[j] == ' ' || r[j] == '\t') {
+					j++
+				}
+				if j < len(r) && r[j] == '=' {
+					i = until(j, "\n")
+					continue
+				}
+			}
+			if unicode.IsDigit(c) {
+				emit(tokNumber, word)
+			} else {
+				emit(tokIdent, word)
+			}
+		default:
+			two := string(r[i:min(i+2, len(r))])
+			if two == ":=" || two == ".." {
+				emit(tokPunct, two)
+				i += 2
+			} else {
+				emit(tokPunct, string(c))
+				i++
+			}
+		}
+	}
+	return toks
+}
+
+type srcParser struct {
+	toks []srcToken
+	pos  int
+}
+
+func (p *srcParser) peek() srcToken {
+	if p.pos >= len(p.toks) {
+		return srcToken{kind: tokEOF}
+	}
+	return p.toks[p.pos]
+}
+
+func (p *srcParser) next() srcToken {
+	tok := p.peek()
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *srcParser) errorf(tok srcToken, format string, args ...interface{}) error {
+	if tok.kind == tokEOF {
+		return fmt.Errorf("unexpected end of file: "+format, args...)
+	}
+	return fmt.Errorf("line %d: "+format, append([]interface{}{tok.line}, args...)...)
+}
+
+// expect consumes a punctuation token.
+func (p *srcParser) expect(punct string) error {
+	if tok := p.next(); tok.kind != tokPunct || tok.text != punct {
+		return p.errorf(tok, "expected %q, found %q", punct, tok.text)
+	}
+	return nil
+}
+
+// accept consumes a punctuation token if it is next.
+func (p *srcParser) accept(punct string) bool {
+	if tok := p.peek(); tok.kind == tokPunct && tok.text == punct {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// skipTo consumes tokens up to and including the keyword kw.
+func (p *srcParser) skipTo(kw string) {
+	for tok := p.next(); tok.kind != tokEOF && !tok.is(kw); tok = p.next() {
+	}
+}
+
+// blockName parses "Name", DB 10, DB10 or UDT 1 and returns the name with
+// the block number, if any.
+func (p *srcParser) blockName() (string, int, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokName:
+		return tok.text, 0, nil
+	case tokIdent:
+		upper := strings.ToUpper(tok.text)
+		for _, prefix := range []string{"DB", "UDT", "FB"} {
+			if !strings.HasPrefix(upper, prefix) {
+				continue
+			}
+			digits := upper[len(prefix):]
+			if digits == "" && p.peek().kind == tokNumber {
+				digits = p.next().text
+			}
+			if n, err := strconv.Atoi(digits); err == nil {
+				return prefix + digits, n, nil
+			}
+		}
+		return tok.text, 0, nil
+	}
+	return "", 0, p.errorf(tok, "expected a block name, found %q", tok.text)
+}
+
+// blockBody skips the block header (VERSION, AUTHOR, attributes and so on)
+// and parses the STRUCT or the type the block is an instance of. optimized
+// is set when the header switches on optimized access.
+func (p *srcParser) blockBody() (decl TypeDecl, optimized bool, err error) {
+	for {
+		tok := p.peek()
+		switch {
+		case tok.kind == tokEOF:
+			return decl, optimized, p.errorf(tok, "missing STRUCT")
+		case tok.kind == tokAttr:
+			optimized = optimized || optimizedAccess(tok.text)
+			p.next()
+		case tok.is("NON_RETAIN"), tok.is("READ_ONLY"), tok.is("UNLINKED"),
+			tok.is("KNOW_HOW_PROTECT"), tok.kind == tokPunct && tok.text == ":":
+			p.next()
+		case tok.is("VERSION"), tok.is("AUTHOR"), tok.is("FAMILY"), tok.is("NAME"):
+			p.next()
+			if p.accept(":") {
+				p.next()
+			}
+		default:
+			if decl, err = p.parseType(); err != nil {
+				return decl, optimized, err
+			}
+			p.accept(";")
+			return decl, optimized, nil
+		}
+	}
+}
+
+// parseType parses a type: an elementary type, STRING[n], STRUCT ...
+// END_STRUCT, ARRAY[a..b, c..d] OF type, UDT n or a type name.
+func (p *srcParser) parseType() (TypeDecl, error) {
+	tok := p.next()
+	switch {
+	case tok.kind == tokName:
+		return TypeDecl{Ref: tok.text}, nil
+	case tok.is("STRUCT"):
+		fields, err := p.parseMembers()
+		return TypeDecl{Fields: fields}, err
+	case tok.is("ARRAY"):
+		return p.parseArray()
+	case tok.is("STRING"), tok.is("WSTRING"):
+		t, length, _ := ParseDataType(tok.text)
+		if p.accept("[") {
+			n := p.next()
+			var err error
+			if length, err = strconv.Atoi(n.text); err != nil || length <= 0 {
+				return TypeDecl{}, p.errorf(n, "invalid string length %q", n.text)
+			}
+			if err := p.expect("]"); err != nil {
+				return TypeDecl{}, err
+			}
+		}
+		return TypeDecl{Type: t, Length: length}, nil
+	case tok.kind == tokIdent:
+		if name, n, err := p.udtName(tok); err == nil && n > 0 {
+			return TypeDecl{Ref: name}, nil
+		}
+		if size, ok := skipTypes[strings.ToUpper(tok.text)]; ok {
+			return TypeDecl{Skip: size}, nil
+		}
+		if t, _, err := ParseDataType(tok.text); err == nil {
+			return TypeDecl{Type: t}, nil
+		}
+		return TypeDecl{Ref: tok.text}, nil
+	}
+	return TypeDecl{}, p.errorf(tok, "expected a type, found %q", tok.text)
+}
+
+// udtName parses UDT 1 or UDT1 after tok.
+func (p *srcParser) udtName(tok srcToken) (string, int, error) {
+	upper := strings.ToUpper(tok.text)
+	if !strings.HasPrefix(upper, "UDT") {
+		return "", 0, fmt.Errorf("not a UDT")
+	}
+	p.pos--
+	return p.blockName()
+}
+
+// parseMembers parses the members of a STRUCT up to END_STRUCT.
+func (p *srcParser) parseMembers() ([]FieldDecl, error) {
+	fields := []FieldDecl{}
+	for {
+		tok := p.next()
+		switch {
+		case tok.is("END_STRUCT"):
+			return fields, nil
+		case tok.kind == tokAttr:
+			continue
+		case tok.kind != tokIdent && tok.kind != tokName:
+			return nil, p.errorf(tok, "expected a member name or END_STRUCT, found %q", tok.text)
+		}
+		for p.peek().kind == tokAttr {
+			p.next()
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		t, err := p.parseType()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", tok.text, err)
+		}
+		fields = append(fields, FieldDecl{Name: tok.text, Type: t})
+		if p.accept(":=") {
+			p.skipValue()
+		}
+		p.accept(";")
+	}
+}
+
+// skipValue skips an initial value up to the ";" that ends the declaration.
+func (p *srcParser) skipValue() {
+	depth := 0
+	for {
+		tok := p.peek()
+		if tok.kind == tokEOF || tok.is("END_STRUCT") {
+			return
+		}
+		if tok.kind == tokPunct {
+			switch tok.text {
+			case "(", "[":
+				depth++
+			case ")", "]":
+				depth--
+			case ";":
+				if depth <= 0 {
+					return
+				}
+			}
+		}
+		p.next()
+	}
+}
+
+// parseArray parses [a..b, c..d] OF type after ARRAY.
+func (p *srcParser) parseArray() (TypeDecl, error) {
+	var decl TypeDecl
+	if err := p.expect("["); err != nil {
+		return decl, err
+	}
+	for {
+		low, err := p.parseInt()
+		if err != nil {
+			return decl, err
+		}
+		if err := p.expect(".."); err != nil {
+			return decl, err
+		}
+		high, err := p.parseInt()
+		if err != nil {
+			return decl, err
+		}
+		decl.Dims = append(decl.Dims, ArrayDim{Low: low, High: high})
+		if !p.accept(",") {
+			break
+		}
+	}
+	if err := p.expect("]"); err != nil {
+		return decl, err
+	}
+	if tok := p.next(); !tok.is("OF") {
+		return decl, p.errorf(tok, "expected OF, found %q", tok.text)
+	}
+	elem, err := p.parseType()
+	if err != nil {
+		return decl, err
+	}
+	decl.Elem = &elem
+	return decl, nil
+}
+
+func (p *srcParser) parseInt() (int, error) {
+	sign := 1
+	if p.accept("-") {
+		sign = -1
+	}
+	tok := p.next()
+	n, err := strconv.Atoi(tok.text)
+	if tok.kind != tokNumber || err != nil {
+		return 0, p.errorf(tok, "expected a number, found %q", tok.text)
+	}
+	return sign * n, nil
+}
+
+// ParseTypeDecl parses a type written as in a DB source, such as REAL,
+// String[20], Array[1..20] of Motor or "Motor".
+func ParseTypeDecl(s string) (TypeDecl, error) {
+	p := &srcParser{toks: lexSource(s)}
+	t, err := p.parseType()
+	if err == nil && p.peek().kind != tokEOF {
+		err = fmt.Errorf("unexpected %q after the type", p.peek().text)
+	}
+	if err != nil {
+		return t, fmt.Errorf("type %q: %w", s, err)
+	}
+	return t, nil
+}
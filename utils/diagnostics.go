@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/robinson/gos7"
+)
+
+// PLCInfo is the identity and state of a PLC as reported by its system
+// status lists. Older CPUs and CPs do not support every list, so each part
+// that could not be read is reported in Errors instead of failing the whole
+// request.
+type PLCInfo struct {
+	Name           string            `json:"name"`
+	Address        string            `json:"address"`
+	ModuleType     string            `json:"moduleType,omitempty"`
+	SerialNumber   string            `json:"serialNumber,omitempty"`
+	ASName         string            `json:"asName,omitempty"`
+	ModuleName     string            `json:"moduleName,omitempty"`
+	Copyright      string            `json:"copyright,omitempty"`
+	OrderCode      string            `json:"orderCode,omitempty"`
+	Firmware       string            `json:"firmware,omitempty"`
+	Status         string            `json:"status"`
+	Protection     *ProtectionInfo   `json:"protection,omitempty"`
+	MaxPDULength   int               `json:"maxPduLength,omitempty"`
+	MaxConnections int               `json:"maxConnections,omitempty"`
+	PLCClock       *time.Time        `json:"plcClock,omitempty"`
+	HostClock      time.Time         `json:"hostClock"`
+	ClockDrift     string            `json:"clockDrift,omitempty"`
+	ClockDriftMs   int64             `json:"clockDriftMs"`
+	Errors         map[string]string `json:"errors,omitempty"`
+}
+
+// ProtectionInfo is the decoded SZL 0x0232 protection record, see §33.19 of
+// "System Software for S7-300/400 System and Standard Functions".
+type ProtectionInfo struct {
+	Level          int    `json:"level"`          // Valid protection level of the CPU
+	SelectorLevel  int    `json:"selectorLevel"`  // Level set with the mode selector
+	ParameterLevel int    `json:"parameterLevel"` // Level set in parameters, 0 means no password
+	ModeSelector   string `json:"modeSelector"`
+	StartupSwitch  string `json:"startupSwitch"`
+}
+
+// CPUStatusName returns RUN, STOP or UNKNOWN for a PLCGetStatus result.
+func CPUStatusName(status int) string {
+	switch status {
+	case CPUStatusRun:
+		return "RUN"
+	case CPUStatusStop:
+		return "STOP"
+	}
+	return "UNKNOWN"
+}
+
+// ReadCPUStatus returns the run state of the CPU.
+func ReadCPUStatus(client gos7.Client) (string, error) {
+	var status int
+	err := protect(func() (err error) {
+		status, err = client.PLCGetStatus()
+		return err
+	})
+	if err != nil {
+		return CPUStatusName(CPUStatusUnknown), err
+	}
+	return CPUStatusName(status), nil
+}
+
+// ReadPLCClock reads the PLC clock. The PLC keeps wall-clock time without a
+// zone, so it is interpreted in the host's local time zone.
+func ReadPLCClock(client gos7.Client) (time.Time, error) {
+	var t time.Time
+	// gos7 has the clock functions swapped: PGClockWrite reads the clock.
+	err := protect(func() (err error) {
+		t, err = client.PGClockWrite()
+		return err
+	})
+	if err != nil {
+		return t, err
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.Local), nil
+}
+
+// ReadPLCInfo queries the identity, state and clock of the PLC.
+func ReadPLCInfo(client gos7.Client) PLCInfo {
+	info := PLCInfo{Errors: map[string]string{}}
+	fail := func(part string, err error) {
+		info.Errors[part] = err.Error()
+	}
+
+	var cpu gos7.S7CpuInfo
+	if err := protect(func() (err error) { cpu, err = client.GetCPUInfo(); return }); err != nil {
+		fail("cpuInfo", err)
+	} else {
+		info.ModuleType = cpu.ModuleTypeName
+		info.SerialNumber = cpu.SerialNumber
+		info.ASName = cpu.ASName
+		info.ModuleName = cpu.ModuleName
+		info.Copyright = cpu.Copyright
+	}
+
+	var order gos7.S7OrderCode
+	if err := protect(func() (err error) { order, err = client.GetOrderCode(); return }); err != nil {
+		fail("orderCode", err)
+	} else {
+		info.OrderCode = order.Code
+		info.Firmware = fmt.Sprintf("V%d.%d.%d", order.V1, order.V2, order.V3)
+	}
+
+	var cp gos7.S7CpInfo
+	if err := protect(func() (err error) { cp, err = client.GetCPInfo(); return }); err != nil {
+		fail("cpInfo", err)
+	} else {
+		info.MaxPDULength = cp.MaxPduLength
+		info.MaxConnections = cp.MaxConnections
+	}
+
+	status, err := ReadCPUStatus(client)
+	if err != nil {
+		fail("status", err)
+	}
+	info.Status = status
+
+	var protection gos7.S7Protection
+	if err := protect(func() (err error) { protection, err = client.GetProtection(); return }); err != nil {
+		fail("protection", err)
+	} else {
+		info.Protection = decodeProtection(protection)
+	}
+
+	// Measure drift against the host clock half way through the request.
+	before := time.Now()
+	clock, err := ReadPLCClock(client)
+	after := time.Now()
+	info.HostClock = before.Add(after.Sub(before) / 2)
+	if err != nil {
+		fail("clock", err)
+	} else {
+		info.PLCClock = &clock
+		drift := clock.Sub(info.HostClock).Round(time.Millisecond)
+		info.ClockDrift = drift.String()
+		info.ClockDriftMs = drift.Milliseconds()
+	}
+
+	if len(info.Errors) == 0 {
+		info.Errors = nil
+	}
+	return info
+}
+
+var modeSelectorNames = map[int]string{1: "RUN", 2: "RUN-P", 3: "STOP", 4: "MRES"}
+var startupSwitchNames = map[int]string{1: "CRST", 2: "WRST"}
+
+// decodeProtection reads the fields of gos7.S7Protection, which gos7 does
+// not export.
+func decodeProtection(p gos7.S7Protection) *ProtectionInfo {
+	v := reflect.ValueOf(p)
+	field := func(name string) int {
+		if f := v.FieldByName(name); f.IsValid() {
+			return int(f.Uint())
+		}
+		return 0
+	}
+	name := func(names map[int]string, value int) string {
+		if n, ok := names[value]; ok {
+			return n
+		}
+		return "UNKNOWN"
+	}
+	return &ProtectionInfo{
+		Level:          field("schRel"),
+		SelectorLevel:  field("schSchal"),
+		ParameterLevel: field("schPar"),
+		ModeSelector:   name(modeSelectorNames, field("bartSch")),
+		StartupSwitch:  name(startupSwitchNames, field("anlSch")),
+	}
+}
+
+// protect runs a gos7 call and turns a panic into an error. Some gos7
+// functions dereference the response before checking for a send error.
+func protect(call func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("PLC request failed: %v", r)
+		}
+	}()
+	return call()
+}
+
+// stdoutMu serializes withoutStdout, so one call cannot restore the
+// /dev/null of another.
+var stdoutMu sync.Mutex
+
+// withoutStdout runs a gos7 call with os.Stdout pointed at /dev/null and
+// restores it afterwards, because gos7 prints debug lines from PGListBlocks
+// and AGWriteMulti. The log goes to stderr and is not affected.
+func withoutStdout(call func() error) error {
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return call()
+	}
+	defer devNull.Close()
+	stdout := os.Stdout
+	os.Stdout = devNull
+	defer func() { os.Stdout = stdout }()
+	return call()
+}
@@ -0,0 +1,686 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Expressions compute derived tags from other tags, for example
+// "Voltage * Current * 1.732" or "Level > 80 && !Pump.On". They know
+// numbers, booleans and strings:
+//
+//	+ - * / % ^             arithmetic on numbers, ^ is the power
+//	== != < <= > >=         comparisons
+//	&& || !  (and, or, not) boolean logic
+//	c ? a : b, if(c, a, b)  conditionals
+//	abs sqrt exp ln log10 sin cos tan floor ceil round(x[, digits])
+//	min max avg sum pow clamp(x, lo, hi)
+//
+// Tags are referred to by name, like Motors[1].Speed, or in braces when the
+// name has other characters, like {Line 1 speed}. Booleans count as 0 and 1
+// in arithmetic, TIME values as milliseconds.
+
+// exprKind is the type of the value of an expression.
+type exprKind int
+
+const (
+	kindNumber exprKind = iota
+	kindBool
+	kindString
+)
+
+func (k exprKind) String() string {
+	switch k {
+	case kindBool:
+		return "boolean"
+	case kindString:
+		return "string"
+	}
+	return "number"
+}
+
+// dataType returns the data type of derived tags of kind k.
+func (k exprKind) dataType() DataType {
+	switch k {
+	case kindBool:
+		return TypeBool
+	case kindString:
+		return TypeString
+	}
+	return TypeLReal
+}
+
+// exprNode is a node of a parsed expression.
+type exprNode struct {
+	op    string      // Operator, "lit" for literals, "tag" for tags, "call" for functions
+	value interface{} // Literal value: float64, bool or string
+	name  string      // Tag or function name
+	args  []*exprNode
+	pos   int // Of the node in the expression, for errors
+
+	tag  int      // Index of the tag, set by check
+	kind exprKind // Set by check
+}
+
+// exprToken is a token of an expression.
+type exprToken struct {
+	kind  string // "num", "str", "name", "op" or "end"
+	text  string
+	value interface{} // Of numbers and strings; true for names in braces
+	pos   int
+}
+
+// lexExpression splits an expression into tokens.
+func lexExpression(s string) ([]exprToken, error) {
+	var tokens []exprToken
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9':
+			j := i
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.') {
+				j++
+			}
+			if j < len(s) && (s[j] == 'e' || s[j] == 'E') {
+				k := j + 1
+				if k < len(s) && (s[k] == '+' || s[k] == '-') {
+					k++
+				}
+				if k < len(s) && s[k] >= '0' && s[k] <= '9' {
+					for j = k; j < len(s) && s[j] >= '0' && s[j] <= '9'; j++ {
+					}
+				}
+			}
+			f, err := strconv.ParseFloat(s[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("at %d: invalid number %q", i+1, s[i:j])
+			}
+			tokens = append(tokens, exprToken{kind: "num", text: s[i:j], value: f, pos: i})
+			i = j
+		case c == '"' || c == '\'':
+			j := strings.IndexByte(s[i+1:], c)
+			if j < 0 {
+				return nil, fmt.Errorf("at %d: unterminated string", i+1)
+			}
+			tokens = append(tokens, exprToken{kind: "str", text: s[i : i+j+2], value: s[i+1 : i+1+j], pos: i})
+			i += j + 2
+		case c == '{':
+			j := strings.IndexByte(s[i+1:], '}')
+			if j < 0 {
+				return nil, fmt.Errorf("at %d: missing }", i+1)
+			}
+			tokens = append(tokens, exprToken{kind: "name", text: s[i+1 : i+1+j], value: true, pos: i})
+			i += j + 2
+		case c == '_' || unicode.IsLetter(rune(c)) || c >= 0x80:
+			// Names may go on with dots and array indexes, as in
+			// Motors[1].Speed.
+			j := i
+			for j < len(s) {
+				r := rune(s[j])
+				if r == '_' || r == '.' || r >= 0x80 || unicode.IsLetter(r) || unicode.IsDigit(r) {
+					j++
+					continue
+				}
+				if r == '[' {
+					if k := strings.IndexByte(s[j:], ']'); k > 0 && isIndexList(s[j+1:j+k]) {
+						j += k + 1
+						continue
+					}
+				}
+				break
+			}
+			tokens = append(tokens, exprToken{kind: "name", text: s[i:j], pos: i})
+			i = j
+		default:
+			op := ""
+			for _, o := range []string{"==", "!=", "<=", ">=", "&&", "||", "+", "-", "*", "/", "%", "^", "(", ")", ",", "?", ":", "<", ">", "!"} {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("at %d: unexpected %q", i+1, string(c))
+			}
+			tokens = append(tokens, exprToken{kind: "op", text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, exprToken{kind: "end", pos: len(s)}), nil
+}
+
+// isIndexList reports whether s is the inside of an array index like 1 or
+// 1,2.
+func isIndexList(s string) bool {
+	for _, part := range strings.Split(s, ",") {
+		if _, err := strconv.Atoi(strings.TrimSpace(part)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// exprParser is a recursive descent parser of expressions.
+type exprParser struct {
+	tokens []exprToken
+	next   int
+}
+
+// parseExpression parses s without checking tags and types.
+func parseExpression(s string) (*exprNode, error) {
+	tokens, err := lexExpression(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	n, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "end" {
+		return nil, p.unexpected(t)
+	}
+	return n, nil
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.next]
+}
+
+// accept consumes the next token when it is one of the operators or
+// keywords ops.
+func (p *exprParser) accept(ops ...string) (exprToken, bool) {
+	t := p.peek()
+	if t.kind == "op" || t.kind == "name" && t.value == nil {
+		for _, op := range ops {
+			if t.text == op {
+				p.next++
+				return t, true
+			}
+		}
+	}
+	return t, false
+}
+
+func (p *exprParser) expect(op string) error {
+	if t, ok := p.accept(op); !ok {
+		return fmt.Errorf("at %d: expected %q, found %s", t.pos+1, op, describeToken(t))
+	}
+	return nil
+}
+
+func (p *exprParser) unexpected(t exprToken) error {
+	return fmt.Errorf("at %d: unexpected %s", t.pos+1, describeToken(t))
+}
+
+func describeToken(t exprToken) string {
+	if t.kind == "end" {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// conditional parses c ? a : b.
+func (p *exprParser) conditional() (*exprNode, error) {
+	cond, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := p.accept("?")
+	if !ok {
+		return cond, nil
+	}
+	a, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	b, err := p.conditional()
+	if err != nil {
+		return nil, err
+	}
+	return &exprNode{op: "?", args: []*exprNode{cond, a, b}, pos: t.pos}, nil
+}
+
+// exprLevels are the binary operators from the lowest precedence to the
+// highest.
+var exprLevels = [][]string{
+	{"||", "or"},
+	{"&&", "and"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// exprAliases are the keywords for binary operators.
+var exprAliases = map[string]string{"or": "||", "and": "&&"}
+
+// binary parses the operators of exprLevels[level] and above. Comparisons
+// do not chain.
+func (p *exprParser) binary(level int) (*exprNode, error) {
+	if level == len(exprLevels) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.accept(exprLevels[level]...)
+		if !ok {
+			return left, nil
+		}
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		op := t.text
+		if alias, ok := exprAliases[op]; ok {
+			op = alias
+		}
+		left = &exprNode{op: op, args: []*exprNode{left, right}, pos: t.pos}
+		if level == 2 {
+			if t, ok := p.accept(exprLevels[level]...); ok {
+				return nil, fmt.Errorf("at %d: comparisons cannot be chained, use && instead", t.pos+1)
+			}
+			return left, nil
+		}
+	}
+}
+
+// unary parses -x, !x and not x.
+func (p *exprParser) unary() (*exprNode, error) {
+	if t, ok := p.accept("-", "!", "not"); ok {
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		op := t.text
+		if op == "-" {
+			op = "neg"
+		} else {
+			op = "!"
+		}
+		return &exprNode{op: op, args: []*exprNode{x}, pos: t.pos}, nil
+	}
+	return p.power()
+}
+
+// power parses x ^ y, which binds tighter than unary minus on its left
+// and groups to the right.
+func (p *exprParser) power() (*exprNode, error) {
+	base, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	t, ok := p.accept("^")
+	if !ok {
+		return base, nil
+	}
+	exp, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return &exprNode{op: "^", args: []*exprNode{base, exp}, pos: t.pos}, nil
+}
+
+// primary parses literals, tags, function calls and parentheses.
+func (p *exprParser) primary() (*exprNode, error) {
+	t := p.peek()
+	switch t.kind {
+	case "num", "str":
+		p.next++
+		return &exprNode{op: "lit", value: t.value, pos: t.pos}, nil
+	case "name":
+		p.next++
+		if t.value == nil && (t.text == "true" || t.text == "false") {
+			return &exprNode{op: "lit", value: t.text == "true", pos: t.pos}, nil
+		}
+		if _, ok := p.accept("("); !ok {
+			return &exprNode{op: "tag", name: t.text, pos: t.pos}, nil
+		}
+		call := &exprNode{op: "call", name: t.text, pos: t.pos}
+		if _, ok := p.accept(")"); ok {
+			return call, nil
+		}
+		for {
+			arg, err := p.conditional()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if _, ok := p.accept(","); !ok {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return call, nil
+	case "op":
+		if t.text == "(" {
+			p.next++
+			n, err := p.conditional()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		}
+	}
+	return nil, p.unexpected(t)
+}
+
+// exprFunc is a function of expressions over numbers.
+type exprFunc struct {
+	min, max int // Number of arguments, max -1 for any
+	fn       func(args []float64) float64
+}
+
+var exprFuncs = map[string]exprFunc{
+	"abs":   {1, 1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"sqrt":  {1, 1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"exp":   {1, 1, func(a []float64) float64 { return math.Exp(a[0]) }},
+	"ln":    {1, 1, func(a []float64) float64 { return math.Log(a[0]) }},
+	"log10": {1, 1, func(a []float64) float64 { return math.Log10(a[0]) }},
+	"sin":   {1, 1, func(a []float64) float64 { return math.Sin(a[0]) }},
+	"cos":   {1, 1, func(a []float64) float64 { return math.Cos(a[0]) }},
+	"tan":   {1, 1, func(a []float64) float64 { return math.Tan(a[0]) }},
+	"floor": {1, 1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"ceil":  {1, 1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"round": {1, 2, func(a []float64) float64 {
+		if len(a) == 1 {
+			return math.Round(a[0])
+		}
+		scale := math.Pow(10, math.Round(a[1]))
+		return math.Round(a[0]*scale) / scale
+	}},
+	"pow": {2, 2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+	"min": {1, -1, func(a []float64) float64 {
+		m := a[0]
+		for _, x := range a[1:] {
+			m = math.Min(m, x)
+		}
+		return m
+	}},
+	"max": {1, -1, func(a []float64) float64 {
+		m := a[0]
+		for _, x := range a[1:] {
+			m = math.Max(m, x)
+		}
+		return m
+	}},
+	"sum": {1, -1, func(a []float64) float64 {
+		s := 0.0
+		for _, x := range a {
+			s += x
+		}
+		return s
+	}},
+	"avg": {1, -1, func(a []float64) float64 {
+		s := 0.0
+		for _, x := range a {
+			s += x
+		}
+		return s / float64(len(a))
+	}},
+	"clamp": {3, 3, func(a []float64) float64 { return math.Max(a[1], math.Min(a[2], a[0])) }},
+}
+
+// exprTagKind returns the kind a tag of type t has in expressions.
+func exprTagKind(t DataType) (exprKind, bool) {
+	switch t {
+	case TypeBool:
+		return kindBool, true
+	case TypeString, TypeWString, TypeChar, TypeWChar:
+		return kindString, true
+	case TypeTime, TypeTOD, TypeS5Time:
+		return kindNumber, true
+	}
+	return kindNumber, numericType(t)
+}
+
+// check resolves the tags of n with lookup, which returns the index and
+// kind of a tag, and sets the kinds of the nodes.
+func (n *exprNode) check(lookup func(name string) (int, exprKind, error)) error {
+	for _, arg := range n.args {
+		if err := arg.check(lookup); err != nil {
+			return err
+		}
+	}
+	numbers := func() error {
+		for _, arg := range n.args {
+			if arg.kind == kindString {
+				return fmt.Errorf("at %d: %s needs numbers, not strings", n.pos+1, n.describe())
+			}
+		}
+		return nil
+	}
+	switch n.op {
+	case "lit":
+		switch n.value.(type) {
+		case bool:
+			n.kind = kindBool
+		case string:
+			n.kind = kindString
+		}
+	case "tag":
+		index, kind, err := lookup(n.name)
+		if err != nil {
+			return fmt.Errorf("at %d: %w", n.pos+1, err)
+		}
+		n.tag, n.kind = index, kind
+	case "neg", "+", "-", "*", "/", "%", "^":
+		n.kind = kindNumber
+		return numbers()
+	case "<", "<=", ">", ">=":
+		n.kind = kindBool
+		return numbers()
+	case "==", "!=":
+		n.kind = kindBool
+		if (n.args[0].kind == kindString) != (n.args[1].kind == kindString) {
+			return fmt.Errorf("at %d: %s compares a string with a %s", n.pos+1, n.op, n.args[1].kind)
+		}
+	case "!", "&&", "||":
+		n.kind = kindBool
+		for _, arg := range n.args {
+			if arg.kind != kindBool {
+				return fmt.Errorf("at %d: %s needs true or false, not a %s", n.pos+1, n.describe(), arg.kind)
+			}
+		}
+	case "?":
+		return n.checkConditional()
+	case "call":
+		if n.name == "if" {
+			if len(n.args) != 3 {
+				return fmt.Errorf("at %d: if needs 3 arguments, found %d", n.pos+1, len(n.args))
+			}
+			return n.checkConditional()
+		}
+		f, ok := exprFuncs[n.name]
+		if !ok {
+			return fmt.Errorf("at %d: unknown function %s", n.pos+1, n.name)
+		}
+		if len(n.args) < f.min || f.max >= 0 && len(n.args) > f.max {
+			return fmt.Errorf("at %d: wrong number of arguments for %s: %d", n.pos+1, n.name, len(n.args))
+		}
+		n.kind = kindNumber
+		return numbers()
+	}
+	return nil
+}
+
+// checkConditional checks c ? a : b and if(c, a, b), whose branches must
+// have the same kind; a boolean and a number make a number.
+func (n *exprNode) checkConditional() error {
+	cond, a, b := n.args[0], n.args[1], n.args[2]
+	if cond.kind != kindBool {
+		return fmt.Errorf("at %d: the condition must be true or false, not a %s", n.pos+1, cond.kind)
+	}
+	switch {
+	case a.kind == b.kind:
+		n.kind = a.kind
+	case a.kind != kindString && b.kind != kindString:
+		n.kind = kindNumber
+	default:
+		return fmt.Errorf("at %d: the branches are a %s and a %s", n.pos+1, a.kind, b.kind)
+	}
+	return nil
+}
+
+// describe names the operator of n in errors.
+func (n *exprNode) describe() string {
+	switch n.op {
+	case "neg":
+		return "-"
+	case "call":
+		return n.name
+	}
+	return n.op
+}
+
+// tags calls f for every tag n refers to.
+func (n *exprNode) tags(f func(name string)) {
+	if n.op == "tag" {
+		f(n.name)
+	}
+	for _, arg := range n.args {
+		arg.tags(f)
+	}
+}
+
+// eval computes n. get returns the value of a tag as float64, bool or
+// string, or an error when it is bad.
+func (n *exprNode) eval(get func(index int) (interface{}, error)) (interface{}, error) {
+	switch n.op {
+	case "lit":
+		return n.value, nil
+	case "tag":
+		return get(n.tag)
+	case "?", "call":
+		if n.op == "?" || n.name == "if" {
+			cond, err := n.args[0].eval(get)
+			if err != nil {
+				return nil, err
+			}
+			branch := n.args[2]
+			if cond.(bool) {
+				branch = n.args[1]
+			}
+			v, err := branch.eval(get)
+			if err != nil || n.kind != kindNumber {
+				return v, err
+			}
+			return exprNumber(v), nil
+		}
+	case "&&", "||":
+		// Only evaluate the right side when it matters, so a bad tag there
+		// does not make the result bad.
+		a, err := n.args[0].eval(get)
+		if err != nil {
+			return nil, err
+		}
+		if a.(bool) == (n.op == "||") {
+			return a, nil
+		}
+		return n.args[1].eval(get)
+	}
+
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(get)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	switch n.op {
+	case "!":
+		return !args[0].(bool), nil
+	case "==", "!=":
+		var equal bool
+		if s, ok := args[0].(string); ok {
+			equal = s == args[1].(string)
+		} else {
+			equal = exprNumber(args[0]) == exprNumber(args[1])
+		}
+		return equal == (n.op == "=="), nil
+	case "call":
+		numbers := make([]float64, len(args))
+		for i, a := range args {
+			numbers[i] = exprNumber(a)
+		}
+		return exprFuncs[n.name].fn(numbers), nil
+	}
+
+	x := exprNumber(args[0])
+	if n.op == "neg" {
+		return -x, nil
+	}
+	y := exprNumber(args[1])
+	switch n.op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/":
+		if y == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return x / y, nil
+	case "%":
+		if y == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return math.Mod(x, y), nil
+	case "^":
+		return math.Pow(x, y), nil
+	case "<":
+		return x < y, nil
+	case "<=":
+		return x <= y, nil
+	case ">":
+		return x > y, nil
+	case ">=":
+		return x >= y, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", n.op)
+}
+
+// exprNumber converts a number or boolean of an expression to float64.
+func exprNumber(v interface{}) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+	}
+	return 0
+}
+
+// exprValue converts a tag value to its value in expressions.
+func exprValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bool, string:
+		return v
+	case time.Duration:
+		return float64(v.Milliseconds())
+	}
+	f, _ := numericValue(v)
+	return f
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+// exprTags are the tags the expression tests refer to.
+var exprTags = []struct {
+	name  string
+	kind  exprKind
+	value interface{}
+}{
+	{"Voltage", kindNumber, 400.0},
+	{"Current", kindNumber, 2.5},
+	{"Pump.On", kindBool, true},
+	{"Motors[1].Speed", kindNumber, 1500.0},
+	{"Line 1 speed", kindNumber, 3.0},
+	{"Recipe", kindString, "PVC"},
+	{"Broken", kindNumber, nil},
+}
+
+// evalExpression parses, checks and evaluates s against exprTags.
+func evalExpression(s string) (interface{}, error) {
+	n, err := parseExpression(s)
+	if err != nil {
+		return nil, err
+	}
+	err = n.check(func(name string) (int, exprKind, error) {
+		for i, tag := range exprTags {
+			if tag.name == name {
+				return i, tag.kind, nil
+			}
+		}
+		return 0, 0, errors.New("unknown tag " + name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return n.eval(func(i int) (interface{}, error) {
+		if exprTags[i].value == nil {
+			return nil, errors.New("bad value")
+		}
+		return exprTags[i].value, nil
+	})
+}
+
+func TestExpressions(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+	}{
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"2 ^ 3 ^ 2", 512.0},
+		{"-2 ^ 2", -4.0},
+		{"7 % 4", 3.0},
+		{"Voltage * Current", 1000.0},
+		{"Motors[1].Speed / 60", 25.0},
+		{"{Line 1 speed} + 1", 4.0},
+		{"Pump.On + 1", 2.0},
+		{"Voltage > 380 && !Pump.On", false},
+		{"Voltage > 380 and not Pump.On or true", true},
+		{"Recipe == \"PVC\"", true},
+		{"Recipe != 'PE'", true},
+		{"Pump.On ? Voltage : 0", 400.0},
+		{"if(Voltage < 100, 1, 2)", 2.0},
+		{"false && Broken > 0", false},
+		{"true || Broken > 0", true},
+		{"round(2.345, 2)", 2.35},
+		{"max(1, Current, 2)", 2.5},
+		{"avg(1, 2, 3, 6)", 3.0},
+		{"clamp(Voltage, 0, 230)", 230.0},
+		{"abs(-3) + sqrt(16) + floor(1.5) + ceil(1.5)", 10.0},
+	}
+	for _, tt := range tests {
+		got, err := evalExpression(tt.in)
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %v (%T), want %v (%T)", tt.in, got, got, tt.want, tt.want)
+		}
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 2",
+		"Voltage $ 2",
+		"{Line 1 speed",
+		"\"open",
+		"Unknown + 1",
+		"Recipe * 2",
+		"Recipe == 1",
+		"Pump.On ? 1",
+		"Voltage ? 1 : 2",
+		"Pump.On ? 1 : \"x\"",
+		"nosuch(1)",
+		"pow(1)",
+		"round(1, 2, 3)",
+		"1 / 0",
+		"Broken + 1",
+	} {
+		if got, err := evalExpression(in); err == nil {
+			t.Errorf("%q = %v, want an error", in, got)
+		}
+	}
+}
@@ -0,0 +1,674 @@
+package utils
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// FileSinkConfig configures a file that gets one row per poll, for
+// spreadsheets (CSV) or data lake loads (Parquet).
+type FileSinkConfig struct {
+	Name             string   `json:"Name"`             // Used in log messages, defaults to Dir
+	Format           string   `json:"Format"`           // csv (default) or parquet
+	Dir              string   `json:"Dir"`              // Directory of the files
+	Prefix           string   `json:"Prefix"`           // Start of the file names, defaults to PlcName
+	Columns          []string `json:"Columns"`          // Tags written, in this order; defaults to all tags
+	TimestampFormat  string   `json:"TimestampFormat"`  // CSV only: rfc3339 (default), unix, unixms, excel or a Go time layout
+	Delimiter        string   `json:"Delimiter"`        // CSV only: defaults to , or to ; when DecimalSeparator is ,; tab for tabs
+	DecimalSeparator string   `json:"DecimalSeparator"` // CSV only: . (default) or ,
+	Rotate           string   `json:"Rotate"`           // Start a new file hourly, daily (default), per shift or none
+	ShiftStarts      []string `json:"ShiftStarts"`      // Local start times for Rotate shift, defaults to 06:00, 14:00 and 22:00
+	MaxSizeMB        int      `json:"MaxSizeMB"`        // Also start a new file past this size, 0 for no limit
+	Gzip             bool     `json:"Gzip"`             // CSV only: compress files once they are closed
+
+	Queue     SinkQueueConfig     `json:"Queue"`
+	Route     SinkRouteConfig     `json:"Route"`     // Columns holds the tags as renamed by the route
+	Aggregate SinkAggregateConfig `json:"Aggregate"` // Columns may hold aggregates like Speed_mean
+}
+
+// Rotation schedules of file sinks.
+const (
+	RotateHourly = "hourly"
+	RotateDaily  = "daily"
+	RotateShift  = "shift"
+	RotateNone   = "none"
+)
+
+// DefaultShiftStarts are the starts of three eight hour shifts.
+var DefaultShiftStarts = []string{"06:00", "14:00", "22:00"}
+
+// applyDefaults fills in the optional fields of f.
+func (f *FileSinkConfig) applyDefaults(plcName string) {
+	if f.Name == "" {
+		f.Name = f.Dir
+	}
+	if f.Format == "" {
+		f.Format = "csv"
+	}
+	if f.Prefix == "" {
+		f.Prefix = plcName
+	}
+	if f.TimestampFormat == "" {
+		f.TimestampFormat = "rfc3339"
+	}
+	if f.DecimalSeparator == "" {
+		f.DecimalSeparator = "."
+	}
+	if f.Delimiter == "" {
+		f.Delimiter = ","
+		if f.DecimalSeparator == "," {
+			f.Delimiter = ";"
+		}
+	}
+	if f.Rotate == "" {
+		f.Rotate = RotateDaily
+	}
+	if f.ShiftStarts == nil {
+		f.ShiftStarts = append([]string(nil), DefaultShiftStarts...)
+	}
+	f.Queue.applyDefaults()
+	f.Aggregate.applyDefaults()
+}
+
+// validate checks the fields of f, reporting problems under path. tags are
+// all tags, plcName is the PlcName of the config.
+func (f *FileSinkConfig) validate(path, plcName string, tags []Tag, errs *ConfigErrors) {
+	if f.Dir == "" {
+		errs.add(path+".Dir", "is required")
+	}
+	checkOneOf(errs, path+".Format", f.Format, "csv", "parquet")
+	checkOneOf(errs, path+".Rotate", f.Rotate, RotateHourly, RotateDaily, RotateShift, RotateNone)
+	checkOneOf(errs, path+".DecimalSeparator", f.DecimalSeparator, ".", ",")
+	if strings.ContainsAny(f.Prefix, `/\`) {
+		errs.add(path+".Prefix", "must not contain path separators")
+	}
+	if d := f.delimiter(); d == '"' || d == '\r' || d == '\n' || len([]rune(f.Delimiter)) != 1 && f.Delimiter != "tab" {
+		errs.add(path+".Delimiter", "must be a single character or tab, found %q", f.Delimiter)
+	} else if string(d) == f.DecimalSeparator {
+		errs.add(path+".Delimiter", "must differ from DecimalSeparator")
+	}
+	if f.MaxSizeMB < 0 {
+		errs.add(path+".MaxSizeMB", "must not be negative")
+	}
+	if f.Gzip && f.Format == "parquet" {
+		errs.add(path+".Gzip", "Parquet files are compressed already")
+	}
+	for i, start := range f.ShiftStarts {
+		if _, err := parseClock(start); err != nil {
+			errs.add(fmt.Sprintf("%s.ShiftStarts[%d]", path, i), "%v", err)
+		}
+	}
+	if f.Rotate == RotateShift && len(f.ShiftStarts) == 0 {
+		errs.add(path+".ShiftStarts", "required when Rotate is shift")
+	}
+	f.Queue.validate(path+".Queue", errs)
+	routed := f.Route.validate(path+".Route", plcName, tags, errs)
+	routed = f.Aggregate.validate(path+".Aggregate", plcName, routed, errs)
+	for i, name := range f.Columns {
+		if !slices.ContainsFunc(routed, func(t Tag) bool { return t.Name == name }) {
+			errs.add(fmt.Sprintf("%s.Columns[%d]", path, i), "unknown tag %q", name)
+		}
+	}
+}
+
+func (f *FileSinkConfig) delimiter() rune {
+	if f.Delimiter == "tab" {
+		return '\t'
+	}
+	r := []rune(f.Delimiter)
+	if len(r) == 0 {
+		return 0
+	}
+	return r[0]
+}
+
+// parseClock parses a time of day like 06:00 into minutes after midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day like 06:00", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// FileSink writes tag values to rotating CSV or Parquet files. Files are
+// named <Prefix>_<start of the period>.csv, with _2, _3 ... when a file
+// grows past MaxSizeMB. A CSV file of the current period is appended to
+// after a restart when its header still matches. The active contexts, such
+// as the shift, have columns between the timestamp and the tags.
+type FileSink struct {
+	cfg      FileSinkConfig
+	contexts []string // Context names, see ContextConfig
+	columns  []Tag
+	schema   *parquet.Schema // Only for parquet
+
+	file      *os.File
+	size      *countingWriter
+	csv       *csv.Writer
+	parquet   *parquet.Writer
+	rows      int // Rows in the parquet writer since its last flush
+	path      string
+	start     time.Time // Start of the period of file
+	periodEnd time.Time
+	part      int
+
+	compressing sync.WaitGroup
+}
+
+// parquetFlushRows is the number of rows written to a Parquet row group.
+const parquetFlushRows = 1000
+
+// OpenFileSink prepares a file sink for tags and the contexts named. The
+// first file is created by the first Write.
+func OpenFileSink(cfg FileSinkConfig, tags []Tag, contexts []string) (*FileSink, error) {
+	columns, err := fileSinkColumns(cfg, tags)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("file sink %s: %w", cfg.Name, err)
+	}
+	s := &FileSink{cfg: cfg, contexts: contexts, columns: columns}
+	if cfg.Format == "parquet" {
+		group := parquet.Group{"timestamp": parquet.Timestamp(parquet.Millisecond)}
+		for _, name := range contexts {
+			group[name] = parquet.Optional(parquet.String())
+		}
+		for _, tag := range columns {
+			group[tag.Name] = parquet.Optional(parquetNode(tag.Addr.Type))
+		}
+		s.schema = parquet.NewSchema("tags", group)
+	}
+	return s, nil
+}
+
+func init() {
+	RegisterSink("file", openFileSinks)
+}
+
+// openFileSinks prepares the FileSinks of cfg, keeping those of old whose
+// files stay the same.
+func openFileSinks(cfg Config, tags []Tag, old []ConfiguredSink) ([]ConfiguredSink, error) {
+	var sinks []ConfiguredSink
+	contexts := cfg.Context.Names()
+	for _, fc := range cfg.FileSinks {
+		route, routed := routeTags(fc.Route, cfg.PlcName, tags)
+		aggregate, routed := aggregateTags(fc.Aggregate, cfg.PlcName, routed)
+		var sink *FileSink
+		for _, o := range old {
+			if s, ok := o.Sink.(*FileSink); ok && s.Reusable(fc, routed, contexts) && !containsSink(sinks, s) {
+				sink = s
+			}
+		}
+		if sink == nil {
+			var err error
+			if sink, err = OpenFileSink(fc, routed, contexts); err != nil {
+				closeOpenedSinks(sinks, old)
+				return nil, err
+			}
+		}
+		sinks = append(sinks, ConfiguredSink{Sink: sink, Queue: fc.Queue, Route: route, Aggregate: aggregate})
+	}
+	return sinks, nil
+}
+
+// fileSinkColumns returns the tags of the Columns of cfg, or all good and
+// bad tags when it has none.
+func fileSinkColumns(cfg FileSinkConfig, tags []Tag) ([]Tag, error) {
+	if len(cfg.Columns) == 0 {
+		return tags, nil
+	}
+	byName := map[string]Tag{}
+	for _, tag := range tags {
+		byName[tag.Name] = tag
+	}
+	columns := make([]Tag, len(cfg.Columns))
+	for i, name := range cfg.Columns {
+		tag, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("file sink %s: unknown tag %q in Columns", cfg.Name, name)
+		}
+		columns[i] = tag
+	}
+	return columns, nil
+}
+
+// Reusable reports whether the sink writes the same files as a sink opened
+// with cfg, tags and contexts would, so a reload can keep it. The queue
+// settings do not matter, nor do the route and aggregation as long as the
+// columns stay the same.
+func (s *FileSink) Reusable(cfg FileSinkConfig, tags []Tag, contexts []string) bool {
+	cfg.Queue, cfg.Route, cfg.Aggregate = s.cfg.Queue, s.cfg.Route, s.cfg.Aggregate
+	if !reflect.DeepEqual(s.cfg, cfg) || !slices.Equal(s.contexts, contexts) {
+		return false
+	}
+	columns, err := fileSinkColumns(cfg, tags)
+	if err != nil || len(columns) != len(s.columns) {
+		return false
+	}
+	for i, tag := range columns {
+		if tag.Name != s.columns[i].Name || tag.Addr.Type != s.columns[i].Addr.Type {
+			return false
+		}
+	}
+	return true
+}
+
+// Name returns the name of the sink for log messages.
+func (s *FileSink) Name() string {
+	return "file sink " + s.cfg.Name
+}
+
+// Start does nothing, files are created by Write.
+func (s *FileSink) Start(ctx context.Context) error {
+	return nil
+}
+
+// Flush makes sure the rows written so far are on disk.
+func (s *FileSink) Flush(ctx context.Context) error {
+	if s.file == nil {
+		return nil
+	}
+	if s.parquet != nil {
+		// Flushing ends a row group, which Close does anyway.
+		return nil
+	}
+	return s.file.Sync()
+}
+
+// Health always reports nil, failing writes are reported by Write.
+func (s *FileSink) Health() error {
+	return nil
+}
+
+// parquetNode returns the Parquet column type of an S7 data type.
+func parquetNode(t DataType) parquet.Node {
+	switch t {
+	case TypeBool:
+		return parquet.Leaf(parquet.BooleanType)
+	case TypeByte, TypeUSInt, TypeSInt, TypeWord, TypeUInt, TypeInt, TypeDInt:
+		return parquet.Int(32)
+	case TypeDWord, TypeUDInt, TypeLInt, TypeTime, TypeTOD, TypeS5Time:
+		return parquet.Int(64)
+	case TypeLWord, TypeULInt:
+		return parquet.Uint(64)
+	case TypeReal:
+		return parquet.Leaf(parquet.FloatType)
+	case TypeLReal:
+		return parquet.Leaf(parquet.DoubleType)
+	case TypeDate, TypeDT, TypeDTL:
+		return parquet.Timestamp(parquet.Millisecond)
+	}
+	return parquet.String()
+}
+
+// parquetValue converts a decoded value to the Go type of its parquetNode.
+// Durations are stored in milliseconds.
+func parquetValue(t DataType, v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Duration:
+		return v.Milliseconds()
+	case time.Time, bool, float32, float64, string:
+		return v
+	}
+	switch parquetNode(t).Type().Kind() {
+	case parquet.Int32:
+		f, _ := numericValue(v)
+		return int32(f)
+	case parquet.Int64:
+		switch v := v.(type) {
+		case uint32:
+			return int64(v)
+		case int64:
+			return v
+		}
+	case parquet.ByteArray:
+		return fmt.Sprint(v)
+	}
+	return v
+}
+
+// Write adds a row with the values of one poll, starting a new file when the
+// period of the current one is over or it is too large.
+func (s *FileSink) Write(batch Batch) error {
+	readings := batch.Values
+	if len(readings) == 0 {
+		return nil
+	}
+	now := batch.Time
+	if s.file != nil {
+		full := s.cfg.MaxSizeMB > 0 && s.size.n >= int64(s.cfg.MaxSizeMB)<<20
+		if full || !now.Before(s.periodEnd) {
+			if full {
+				s.part++
+			}
+			if err := s.closeFile(); err != nil {
+				Errorf("File sink %s: %v", s.cfg.Name, err)
+			}
+		}
+	}
+	if s.file == nil {
+		if err := s.openFile(now); err != nil {
+			return err
+		}
+	}
+
+	byName := make(map[string]TagValue, len(readings))
+	for _, r := range readings {
+		byName[r.Name] = r
+	}
+	if s.parquet != nil {
+		row := map[string]interface{}{"timestamp": now}
+		for _, name := range s.contexts {
+			var value interface{}
+			if v, ok := batch.Context[name]; ok {
+				value = v
+			}
+			row[name] = value
+		}
+		for _, tag := range s.columns {
+			var value interface{}
+			if r, ok := byName[tag.Name]; ok && r.Quality == QualityGood {
+				value = parquetValue(tag.Addr.Type, r.Value)
+			}
+			row[tag.Name] = value
+		}
+		if err := s.parquet.Write(row); err != nil {
+			return err
+		}
+		if s.rows++; s.rows >= parquetFlushRows {
+			s.rows = 0
+			if err := s.parquet.Flush(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	record := make([]string, 0, len(s.columns)+len(s.contexts)+1)
+	record = append(record, s.formatTime(now))
+	for _, name := range s.contexts {
+		record = append(record, batch.Context[name])
+	}
+	for _, tag := range s.columns {
+		var cell string
+		if r, ok := byName[tag.Name]; ok && r.Quality == QualityGood {
+			cell = s.formatValue(r.Value)
+		}
+		record = append(record, cell)
+	}
+	s.csv.Write(record)
+	s.csv.Flush()
+	if err := s.csv.Error(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// formatTime formats a timestamp in the TimestampFormat.
+func (s *FileSink) formatTime(t time.Time) string {
+	switch s.cfg.TimestampFormat {
+	case "rfc3339":
+		return t.Format("2006-01-02T15:04:05.000Z07:00")
+	case "unix":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "unixms":
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	case "excel":
+		// Days since 1899-12-30 in local time, what Excel stores for dates.
+		_, offset := t.Zone()
+		days := float64(t.UnixMilli()+int64(offset)*1000)/86400000 + 25569
+		return s.formatValue(days)
+	}
+	return t.Format(s.cfg.TimestampFormat)
+}
+
+// formatValue formats a tag value for a CSV cell. Booleans are written as 1
+// and 0, durations in milliseconds.
+func (s *FileSink) formatValue(v interface{}) string {
+	var text string
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case float32:
+		text = strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case float64:
+		text = strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Duration:
+		return strconv.FormatInt(v.Milliseconds(), 10)
+	case time.Time:
+		return s.formatTime(v)
+	default:
+		return fmt.Sprint(v)
+	}
+	if s.cfg.DecimalSeparator != "." {
+		text = strings.Replace(text, ".", s.cfg.DecimalSeparator, 1)
+	}
+	return text
+}
+
+// header returns the first row of CSV files.
+func (s *FileSink) header() []string {
+	header := append([]string{"timestamp"}, s.contexts...)
+	for _, tag := range s.columns {
+		header = append(header, tag.Name)
+	}
+	return header
+}
+
+// openFile opens the file for the period of now.
+func (s *FileSink) openFile(now time.Time) error {
+	start, end := s.period(now)
+	if !start.Equal(s.start) {
+		s.start, s.part = start, 1
+	}
+	s.periodEnd = end
+	ext := "." + s.cfg.Format
+	base := filepath.Join(s.cfg.Dir, s.cfg.Prefix+"_"+start.Format("20060102_1504"))
+	maxSize := int64(s.cfg.MaxSizeMB) << 20
+	for ; ; s.part++ {
+		path := base + ext
+		if s.part > 1 {
+			path = fmt.Sprintf("%s_%d%s", base, s.part, ext)
+		}
+		if FileExists(path + ".gz") {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err == nil {
+			// Continue a CSV file written before a restart.
+			if s.cfg.Format == "parquet" || maxSize > 0 && info.Size() >= maxSize || !s.headerMatches(path) {
+				continue
+			}
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				return err
+			}
+			s.setFile(path, file, info.Size())
+			Infof("File sink %s: appending to %s", s.cfg.Name, path)
+			return nil
+		}
+
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return err
+		}
+		s.setFile(path, file, 0)
+		if s.csv != nil {
+			s.csv.Write(s.header())
+		}
+		Infof("File sink %s: writing %s", s.cfg.Name, path)
+		return nil
+	}
+}
+
+func (s *FileSink) setFile(path string, file *os.File, size int64) {
+	s.path, s.file = path, file
+	s.size = &countingWriter{w: file, n: size}
+	if s.cfg.Format == "parquet" {
+		s.parquet = parquet.NewWriter(s.size, s.schema)
+		s.rows = 0
+		return
+	}
+	s.csv = csv.NewWriter(s.size)
+	s.csv.Comma = s.cfg.delimiter()
+}
+
+// headerMatches reports whether the CSV file at path has the header of s.
+func (s *FileSink) headerMatches(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	r := csv.NewReader(bufio.NewReader(file))
+	r.Comma = s.cfg.delimiter()
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	return err == nil && reflect.DeepEqual(header, s.header())
+}
+
+// period returns the start and end of the rotation period around t, in
+// local time.
+func (s *FileSink) period(t time.Time) (time.Time, time.Time) {
+	t = t.Local()
+	y, m, d := t.Date()
+	switch s.cfg.Rotate {
+	case RotateHourly:
+		start := time.Date(y, m, d, t.Hour(), 0, 0, 0, time.Local)
+		return start, start.Add(time.Hour)
+	case RotateShift:
+		var starts []int
+		for _, clock := range s.cfg.ShiftStarts {
+			if minutes, err := parseClock(clock); err == nil {
+				starts = append(starts, minutes)
+			}
+		}
+		sort.Ints(starts)
+		var boundaries []time.Time
+		for day := -1; day <= 1; day++ {
+			for _, minutes := range starts {
+				boundaries = append(boundaries, time.Date(y, m, d+day, 0, minutes, 0, 0, time.Local))
+			}
+		}
+		for i := len(boundaries) - 2; i >= 0; i-- {
+			if !boundaries[i].After(t) {
+				return boundaries[i], boundaries[i+1]
+			}
+		}
+	case RotateNone:
+		if s.start.IsZero() {
+			return t, never
+		}
+		return s.start, never
+	}
+	start := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	return start, time.Date(y, m, d+1, 0, 0, 0, 0, time.Local)
+}
+
+// never ends the period of files that are not rotated by time.
+var never = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// closeFile closes the current file and starts compressing it when Gzip is
+// set.
+func (s *FileSink) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+	var err error
+	if s.parquet != nil {
+		err = s.parquet.Close()
+		s.parquet = nil
+	}
+	if s.csv != nil {
+		s.csv.Flush()
+		err = s.csv.Error()
+		s.csv = nil
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file = nil
+	if err != nil {
+		return err
+	}
+	if s.cfg.Gzip {
+		path := s.path
+		s.compressing.Add(1)
+		go func() {
+			defer s.compressing.Done()
+			if err := gzipFile(path); err != nil {
+				Errorf("File sink %s: %v", s.cfg.Name, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// Close closes the current file and waits until closed files are
+// compressed.
+func (s *FileSink) Close() error {
+	err := s.closeFile()
+	s.compressing.Wait()
+	return err
+}
+
+// gzipFile replaces path with path.gz.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz.tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(path)
+	_, err = io.Copy(zw, in)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".gz.tmp", path+".gz")
+	}
+	if err != nil {
+		os.Remove(path + ".gz.tmp")
+		return fmt.Errorf("cannot compress %s: %w", path, err)
+	}
+	return os.Remove(path)
+}
+
+// countingWriter counts the bytes written to a file.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
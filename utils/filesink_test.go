@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestFileSinkPeriod(t *testing.T) {
+	day := func(d, hour, min int) time.Time {
+		return time.Date(2024, 3, d, hour, min, 0, 0, time.Local)
+	}
+	tests := []struct {
+		rotate     string
+		starts     []string
+		t          time.Time
+		start, end time.Time
+	}{
+		{RotateHourly, nil, day(5, 10, 25), day(5, 10, 0), day(5, 11, 0)},
+		{RotateDaily, nil, day(5, 10, 25), day(5, 0, 0), day(6, 0, 0)},
+		{RotateShift, DefaultShiftStarts, day(5, 10, 25), day(5, 6, 0), day(5, 14, 0)},
+		{RotateShift, DefaultShiftStarts, day(5, 14, 0), day(5, 14, 0), day(5, 22, 0)},
+		{RotateShift, DefaultShiftStarts, day(5, 23, 30), day(5, 22, 0), day(6, 6, 0)},
+		{RotateShift, DefaultShiftStarts, day(5, 3, 0), day(4, 22, 0), day(5, 6, 0)},
+		{RotateShift, []string{"18:00", "06:00"}, day(5, 5, 59), day(4, 18, 0), day(5, 6, 0)},
+		{RotateNone, nil, day(5, 10, 25), day(5, 10, 25), never},
+	}
+	for _, tt := range tests {
+		s := &FileSink{cfg: FileSinkConfig{Rotate: tt.rotate, ShiftStarts: tt.starts}}
+		start, end := s.period(tt.t)
+		if !start.Equal(tt.start) || !end.Equal(tt.end) {
+			t.Errorf("%s %v at %v: %v to %v, want %v to %v", tt.rotate, tt.starts, tt.t, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestFileSinkCSV(t *testing.T) {
+	dir := t.TempDir()
+	tags := []Tag{
+		{TagConfig: TagConfig{Name: "Speed"}, Addr: Address{Type: TypeReal}},
+		{TagConfig: TagConfig{Name: "Running"}, Addr: Address{Type: TypeBool}},
+		{TagConfig: TagConfig{Name: "Count"}, Addr: Address{Type: TypeInt}},
+	}
+	open := func(columns []string) *FileSink {
+		t.Helper()
+		cfg := FileSinkConfig{Dir: dir, Columns: columns, TimestampFormat: "unix", DecimalSeparator: ",", Rotate: RotateHourly}
+		cfg.applyDefaults("line1")
+		s, err := OpenFileSink(cfg, tags, []string{"shift"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	write := func(s *FileSink, at time.Time, speed float32, countQuality string) {
+		t.Helper()
+		batch := Batch{Time: at, Context: map[string]string{"shift": "early"}, Values: []TagValue{
+			{Name: "Speed", Value: speed, Quality: QualityGood},
+			{Name: "Running", Value: true, Quality: QualityGood},
+			{Name: "Count", Value: int16(7), Quality: countQuality},
+		}}
+		if err := s.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	at := time.Date(2024, 3, 5, 10, 0, 5, 0, time.Local)
+	name := func(hour int, part string) string {
+		return filepath.Join(dir, "line1_20240305_"+time.Date(2024, 3, 5, hour, 0, 0, 0, time.Local).Format("1504")+part+".csv")
+	}
+
+	s := open([]string{"Running", "Speed", "Count"})
+	write(s, at, 12.5, QualityGood)
+	write(s, at.Add(30*time.Minute), 3, QualityBad)
+	s.Close()
+	// After a restart the file of the hour is continued.
+	s = open([]string{"Running", "Speed", "Count"})
+	write(s, at.Add(45*time.Minute), 0.25, QualityGood)
+	write(s, at.Add(time.Hour), 1, QualityGood)
+	s.Close()
+	// Other columns do not fit the header, so a new part is started.
+	s = open([]string{"Speed"})
+	write(s, at.Add(70*time.Minute), 2, QualityGood)
+	s.Close()
+
+	unix := func(d time.Duration) string { return strconv.FormatInt(at.Add(d).Unix(), 10) }
+	want := map[string]string{
+		name(10, ""): "timestamp;shift;Running;Speed;Count\n" +
+			unix(0) + ";early;1;12,5;7\n" +
+			unix(30*time.Minute) + ";early;1;3;\n" +
+			unix(45*time.Minute) + ";early;1;0,25;7\n",
+		name(11, ""):   "timestamp;shift;Running;Speed;Count\n" + unix(time.Hour) + ";early;1;1;7\n",
+		name(11, "_2"): "timestamp;shift;Speed\n" + unix(70*time.Minute) + ";early;2\n",
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != len(want) {
+		t.Errorf("files %v, want %d", files, len(want))
+	}
+	for path, content := range want {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(data) != content {
+			t.Errorf("%s:\n%s\nwant:\n%s", filepath.Base(path), data, content)
+		}
+	}
+}
+
+func TestFileSinkGzip(t *testing.T) {
+	dir := t.TempDir()
+	cfg := FileSinkConfig{Dir: dir, Rotate: RotateHourly, Gzip: true}
+	cfg.applyDefaults("plc")
+	tags := []Tag{{TagConfig: TagConfig{Name: "T"}, Addr: Address{Type: TypeInt}}}
+	s, err := OpenFileSink(cfg, tags, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 3, 5, 10, 0, 0, 0, time.Local)
+	for _, d := range []time.Duration{0, time.Hour} {
+		if err := s.Write(Batch{Time: at.Add(d), Values: []TagValue{{Name: "T", Value: int16(1), Quality: QualityGood}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	files, _ := os.ReadDir(dir)
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	want := []string{"plc_20240305_1000.csv.gz", "plc_20240305_1100.csv.gz"}
+	if !slices.Equal(names, want) {
+		t.Errorf("files %v, want %v", names, want)
+	}
+}
+
+func TestFileSinkParquet(t *testing.T) {
+	dir := t.TempDir()
+	cfg := FileSinkConfig{Dir: dir, Format: "parquet", Rotate: RotateNone}
+	cfg.applyDefaults("plc")
+	tags := []Tag{
+		{TagConfig: TagConfig{Name: "Speed"}, Addr: Address{Type: TypeReal}},
+		{TagConfig: TagConfig{Name: "Recipe"}, Addr: Address{Type: TypeString}},
+	}
+	s, err := OpenFileSink(cfg, tags, []string{"batch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	for i, recipe := range []string{"PVC-40", "PVC-41"} {
+		if err := s.Write(Batch{Time: at.Add(time.Duration(i) * time.Second), Context: map[string]string{"batch": "B1"}, Values: []TagValue{
+			{Name: "Speed", Value: float32(i), Quality: QualityGood},
+			{Name: "Recipe", Value: recipe, Quality: QualityGood},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := parquet.ReadFile[struct {
+		Timestamp time.Time `parquet:"timestamp,timestamp(millisecond)"`
+		Batch     *string   `parquet:"batch,optional"`
+		Speed     *float32  `parquet:"Speed,optional"`
+		Recipe    *string   `parquet:"Recipe,optional"`
+	}](s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("%d rows, want 2", len(rows))
+	}
+	for i, row := range rows {
+		if !row.Timestamp.Equal(at.Add(time.Duration(i)*time.Second)) || *row.Batch != "B1" || *row.Speed != float32(i) {
+			t.Errorf("row %d: %v %s %v", i, row.Timestamp, *row.Batch, *row.Speed)
+		}
+	}
+	if *rows[1].Recipe != "PVC-41" {
+		t.Errorf("Recipe %q, want PVC-41", *rows[1].Recipe)
+	}
+}
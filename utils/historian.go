@@ -0,0 +1,561 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite" // Pure Go SQLite driver, registered as "sqlite"
+)
+
+// HistorianConfig configures the local SQLite history of tag values.
+type HistorianConfig struct {
+	Path           string `json:"Path"`           // SQLite database file
+	Retention      string `json:"Retention"`      // How long values are kept, e.g. 90d, defaults to 30d; Tags may set their own
+	RawRetention   string `json:"RawRetention"`   // How long numeric samples are kept before they are downsampled, defaults to 24h
+	DownsampleStep string `json:"DownsampleStep"` // Width of the buckets old samples are downsampled to, defaults to 1m
+
+	Queue     SinkQueueConfig     `json:"Queue"`
+	Route     SinkRouteConfig     `json:"Route"`     // Values are stored and queried by the renamed tag names
+	Aggregate SinkAggregateConfig `json:"Aggregate"` // Aggregates are stored as tags of their own
+}
+
+// applyDefaults fills in the optional fields of h.
+func (h *HistorianConfig) applyDefaults() {
+	if h.Retention == "" {
+		h.Retention = "30d"
+	}
+	if h.RawRetention == "" {
+		h.RawRetention = "24h"
+	}
+	if h.DownsampleStep == "" {
+		h.DownsampleStep = "1m"
+	}
+	h.Queue.applyDefaults()
+	h.Aggregate.applyDefaults()
+}
+
+// validate checks the fields of h, reporting problems under path. tags are
+// all tags, plcName is the PlcName of the config.
+func (h *HistorianConfig) validate(path, plcName string, tags []Tag, errs *ConfigErrors) {
+	if h.Path == "" {
+		errs.add(path+".Path", "is required")
+	}
+	for _, f := range []struct{ name, value string }{
+		{"Retention", h.Retention}, {"RawRetention", h.RawRetention}, {"DownsampleStep", h.DownsampleStep},
+	} {
+		if d, err := ParseLongDuration(f.value); err != nil {
+			errs.add(path+"."+f.name, "%v", err)
+		} else if d <= 0 {
+			errs.add(path+"."+f.name, "must be positive")
+		}
+	}
+	h.Queue.validate(path+".Queue", errs)
+	routed := h.Route.validate(path+".Route", plcName, tags, errs)
+	h.Aggregate.validate(path+".Aggregate", plcName, routed, errs)
+}
+
+// ParseLongDuration parses a duration like time.ParseDuration that may also
+// use d for days and w for weeks, e.g. 30d or 1w12h.
+func ParseLongDuration(s string) (time.Duration, error) {
+	var total time.Duration
+	rest := strings.TrimSpace(s)
+	for rest != "" {
+		i := strings.IndexAny(rest, "dw")
+		if i < 0 {
+			d, err := time.ParseDuration(rest)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return total + d, nil
+		}
+		n, err := strconv.ParseFloat(rest[:i], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		unit := 24 * time.Hour
+		if rest[i] == 'w' {
+			unit *= 7
+		}
+		total += time.Duration(n * float64(unit))
+		rest = rest[i+1:]
+	}
+	if s == "" {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return total, nil
+}
+
+const historianSchema = `
+CREATE TABLE IF NOT EXISTS tags (
+	id   INTEGER PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE
+);
+-- Every sample of the last RawRetention, and older text and bad samples.
+-- Numbers and booleans are stored in value, other values as text.
+CREATE TABLE IF NOT EXISTS samples (
+	tag     INTEGER NOT NULL,
+	ts      INTEGER NOT NULL, -- Unix milliseconds
+	value   REAL,
+	text    TEXT,
+	good    INTEGER NOT NULL,
+	PRIMARY KEY (tag, ts)
+) WITHOUT ROWID;
+-- Older numeric samples downsampled to buckets of DownsampleStep.
+CREATE TABLE IF NOT EXISTS rollups (
+	tag   INTEGER NOT NULL,
+	ts    INTEGER NOT NULL, -- Start of the bucket, Unix milliseconds
+	min   REAL NOT NULL,
+	max   REAL NOT NULL,
+	sum   REAL NOT NULL,
+	count INTEGER NOT NULL,
+	last  REAL NOT NULL,
+	PRIMARY KEY (tag, ts)
+) WITHOUT ROWID;
+`
+
+// Historian stores tag values in a local SQLite database and answers
+// history queries from it. Numeric samples older than RawRetention are
+// downsampled and everything older than the retention of its tag is deleted,
+// once a minute in the background.
+type Historian struct {
+	cfg  HistorianConfig
+	db   *sql.DB
+	stop context.CancelFunc
+	done chan struct{}
+
+	mu        sync.Mutex
+	ids       map[string]int64
+	retention map[string]time.Duration // Per tag, when it differs from Retention
+}
+
+func init() {
+	RegisterSink("historian", openHistorianSink)
+}
+
+// openHistorianSink opens the Historian of cfg, keeping the database of old
+// open when its settings are the same.
+func openHistorianSink(cfg Config, tags []Tag, old []ConfiguredSink) ([]ConfiguredSink, error) {
+	if cfg.Historian == nil {
+		return nil, nil
+	}
+	route, routed := routeTags(cfg.Historian.Route, cfg.PlcName, tags)
+	aggregate, routed := aggregateTags(cfg.Historian.Aggregate, cfg.PlcName, routed)
+	var h *Historian
+	for _, o := range old {
+		if o, ok := o.Sink.(*Historian); ok {
+			c := o.Config()
+			c.Queue, c.Route, c.Aggregate = cfg.Historian.Queue, cfg.Historian.Route, cfg.Historian.Aggregate
+			if reflect.DeepEqual(c, *cfg.Historian) {
+				h = o
+			}
+		}
+	}
+	if h == nil {
+		var err error
+		if h, err = OpenHistorian(*cfg.Historian); err != nil {
+			return nil, err
+		}
+		Infof("Historian database %s", cfg.Historian.Path)
+	}
+	h.SetTags(routed)
+	return []ConfiguredSink{{Sink: h, Queue: cfg.Historian.Queue, Route: route, Aggregate: aggregate}}, nil
+}
+
+// OpenHistorian opens or creates the database of cfg and starts its
+// maintenance.
+func OpenHistorian(cfg HistorianConfig) (*Historian, error) {
+	// Transactions take the write lock when they begin. Writes and the
+	// maintenance read before they write, and a deferred transaction whose
+	// snapshot went stale in between fails at once instead of waiting.
+	dsn := "file:" + (&url.URL{Path: cfg.Path}).EscapedPath() +
+		"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("historian %s: %w", cfg.Path, err)
+	}
+	if _, err := db.Exec(historianSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("historian %s: %w", cfg.Path, err)
+	}
+	h := &Historian{cfg: cfg, db: db, ids: map[string]int64{}, done: make(chan struct{})}
+
+	ctx, stop := context.WithCancel(context.Background())
+	h.stop = stop
+	go func() {
+		defer close(h.done)
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			if err := h.maintain(ctx, time.Now()); err != nil && ctx.Err() == nil {
+				Errorf("Historian maintenance failed: %v", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return h, nil
+}
+
+// Config returns the config the historian was opened with.
+func (h *Historian) Config() HistorianConfig {
+	return h.cfg
+}
+
+// SetTags sets the tags whose Retention differs from the default.
+func (h *Historian) SetTags(tags []Tag) {
+	retention := map[string]time.Duration{}
+	for _, tag := range tags {
+		if tag.Retention == "" {
+			continue
+		}
+		if d, err := ParseLongDuration(tag.Retention); err == nil {
+			retention[tag.Name] = d
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.retention = retention
+}
+
+// Name returns the name of the historian for log messages.
+func (h *Historian) Name() string {
+	return "historian " + h.cfg.Path
+}
+
+// Start does nothing, the database is opened by OpenHistorian.
+func (h *Historian) Start(ctx context.Context) error {
+	return nil
+}
+
+// Flush does nothing, every Write is committed.
+func (h *Historian) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Health always reports nil, failing writes are reported by Write.
+func (h *Historian) Health() error {
+	return nil
+}
+
+// Close stops the maintenance and closes the database.
+func (h *Historian) Close() error {
+	h.stop()
+	<-h.done
+	return h.db.Close()
+}
+
+// tagID returns the id of a tag name, adding it when it is new.
+func (h *Historian) tagID(ctx context.Context, tx *sql.Tx, name string) (int64, error) {
+	h.mu.Lock()
+	id, ok := h.ids[name]
+	h.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO tags (name) VALUES (?) ON CONFLICT (name) DO NOTHING`, name); err != nil {
+		return 0, err
+	}
+	if err := tx.QueryRowContext(ctx, `SELECT id FROM tags WHERE name = ?`, name).Scan(&id); err != nil {
+		return 0, err
+	}
+	h.mu.Lock()
+	h.ids[name] = id
+	h.mu.Unlock()
+	return id, nil
+}
+
+// Write stores one poll of tag values.
+func (h *Historian) Write(batch Batch) error {
+	ctx := context.Background()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO samples (tag, ts, value, text, good) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (tag, ts) DO UPDATE SET value = excluded.value, text = excluded.text, good = excluded.good`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, v := range batch.Values {
+		id, err := h.tagID(ctx, tx, v.Name)
+		if err != nil {
+			// The id cache may hold ids the rolled back transaction added.
+			h.mu.Lock()
+			h.ids = map[string]int64{}
+			h.mu.Unlock()
+			return err
+		}
+		var number sql.NullFloat64
+		var text sql.NullString
+		if v.Quality == QualityGood {
+			if f, ok := numericValue(v.Value); ok {
+				number = sql.NullFloat64{Float64: f, Valid: true}
+			} else {
+				text = sql.NullString{String: fmt.Sprint(v.Value), Valid: true}
+			}
+		}
+		if _, err := stmt.ExecContext(ctx, id, v.Timestamp.UnixMilli(), number, text, v.Quality == QualityGood); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		h.mu.Lock()
+		h.ids = map[string]int64{}
+		h.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// numericValue converts numbers and booleans to float64.
+func numericValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// rollup accumulates samples of one bucket.
+type rollup struct {
+	min, max, sum, last float64
+	count               int64
+}
+
+func (r *rollup) add(o rollup) {
+	if r.count == 0 {
+		*r = o
+		return
+	}
+	r.min = math.Min(r.min, o.min)
+	r.max = math.Max(r.max, o.max)
+	r.sum += o.sum
+	r.count += o.count
+	r.last = o.last
+}
+
+// maintain downsamples samples older than RawRetention and deletes data
+// older than the retention of its tag.
+func (h *Historian) maintain(ctx context.Context, now time.Time) error {
+	retention, _ := ParseLongDuration(h.cfg.Retention)
+	raw, _ := ParseLongDuration(h.cfg.RawRetention)
+	step, _ := ParseLongDuration(h.cfg.DownsampleStep)
+	stepMs := step.Milliseconds()
+	// Only whole buckets are downsampled, so no bucket is written twice.
+	cutoff := now.Add(-raw).UnixMilli() / stepMs * stepMs
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT tag, ts, value FROM samples
+		WHERE ts < ? AND value IS NOT NULL ORDER BY tag, ts`, cutoff)
+	if err != nil {
+		return err
+	}
+	type key struct{ tag, ts int64 }
+	buckets := map[key]*rollup{}
+	var order []key
+	for rows.Next() {
+		var tag, ts int64
+		var value float64
+		if err := rows.Scan(&tag, &ts, &value); err != nil {
+			rows.Close()
+			return err
+		}
+		k := key{tag, ts / stepMs * stepMs}
+		b, ok := buckets[k]
+		if !ok {
+			b = &rollup{}
+			buckets[k] = b
+			order = append(order, k)
+		}
+		b.add(rollup{min: value, max: value, sum: value, last: value, count: 1})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, k := range order {
+		b := buckets[k]
+		if _, err := tx.ExecContext(ctx, `INSERT INTO rollups (tag, ts, min, max, sum, count, last) VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (tag, ts) DO UPDATE SET min = MIN(min, excluded.min), max = MAX(max, excluded.max),
+				sum = sum + excluded.sum, count = count + excluded.count, last = excluded.last`,
+			k.tag, k.ts, b.min, b.max, b.sum, b.count, b.last); err != nil {
+			return err
+		}
+	}
+	// Text and bad samples have no rollup and are kept until the
+	// retention of their tag.
+	if _, err := tx.ExecContext(ctx, `DELETE FROM samples WHERE ts < ? AND value IS NOT NULL`, cutoff); err != nil {
+		return err
+	}
+
+	// Delete what is older than the retention of each tag.
+	h.mu.Lock()
+	custom := make(map[string]time.Duration, len(h.retention))
+	for name, d := range h.retention {
+		custom[name] = d
+	}
+	h.mu.Unlock()
+	names, err := tx.QueryContext(ctx, `SELECT id, name FROM tags`)
+	if err != nil {
+		return err
+	}
+	expiry := map[int64]int64{}
+	for names.Next() {
+		var id int64
+		var name string
+		if err := names.Scan(&id, &name); err != nil {
+			names.Close()
+			return err
+		}
+		keep := retention
+		if d, ok := custom[name]; ok {
+			keep = d
+		}
+		expiry[id] = now.Add(-keep).UnixMilli()
+	}
+	names.Close()
+	for id, before := range expiry {
+		for _, table := range []string{"samples", "rollups"} {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE tag = ? AND ts < ?`, id, before); err != nil {
+				return err
+			}
+		}
+	}
+	if len(order) > 0 {
+		Debugf("Historian downsampled %d bucket(s)", len(order))
+	}
+	return tx.Commit()
+}
+
+// HistoryPoint is one value of a history query. Raw points have Value;
+// points of an aggregated query have Min, Max, Avg, Last and Count.
+type HistoryPoint struct {
+	Time    time.Time   `json:"time"`
+	Value   interface{} `json:"value,omitempty"`
+	Quality string      `json:"quality,omitempty"`
+	Min     *float64    `json:"min,omitempty"`
+	Max     *float64    `json:"max,omitempty"`
+	Avg     *float64    `json:"avg,omitempty"`
+	Last    *float64    `json:"last,omitempty"`
+	Count   int64       `json:"count,omitempty"`
+}
+
+// MaxHistoryPoints limits the points a history query returns.
+const MaxHistoryPoints = 10000
+
+// History returns the values of tag from from up to, not including, to.
+// With a step of 0 every stored value is returned, downsampled buckets as
+// their average; otherwise values are aggregated into buckets of step.
+// truncated is set when the result was cut at MaxHistoryPoints.
+func (h *Historian) History(ctx context.Context, tag string, from, to time.Time, step time.Duration) (points []HistoryPoint, truncated bool, err error) {
+	// Samples and rollups never overlap: samples are deleted when they
+	// are rolled up.
+	rows, err := h.db.QueryContext(ctx, `
+		SELECT s.ts, s.value, s.text, s.good, s.value, s.value, s.value, s.value, 1 FROM samples s JOIN tags t ON t.id = s.tag
+		WHERE t.name = ? AND s.ts >= ? AND s.ts < ?
+		UNION ALL
+		SELECT r.ts, r.sum / r.count, NULL, 1, r.min, r.max, r.sum, r.last, r.count FROM rollups r JOIN tags t ON t.id = r.tag
+		WHERE t.name = ? AND r.ts >= ? AND r.ts < ?
+		ORDER BY 1`,
+		tag, from.UnixMilli(), to.UnixMilli(), tag, from.UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	stepMs := step.Milliseconds()
+	var bucket rollup
+	bucketStart := int64(-1)
+	flush := func() {
+		if bucket.count == 0 {
+			return
+		}
+		avg := bucket.sum / float64(bucket.count)
+		b := bucket
+		points = append(points, HistoryPoint{Time: time.UnixMilli(bucketStart).UTC(),
+			Min: &b.min, Max: &b.max, Avg: &avg, Last: &b.last, Count: b.count})
+		bucket = rollup{}
+	}
+	for rows.Next() {
+		if len(points) >= MaxHistoryPoints {
+			return points, true, nil
+		}
+		var ts, count int64
+		var value, min, max, sum, last sql.NullFloat64
+		var text sql.NullString
+		var good bool
+		if err := rows.Scan(&ts, &value, &text, &good, &min, &max, &sum, &last, &count); err != nil {
+			return nil, false, err
+		}
+
+		if stepMs <= 0 {
+			p := HistoryPoint{Time: time.UnixMilli(ts).UTC(), Quality: QualityGood}
+			switch {
+			case !good:
+				p.Quality = QualityBad
+			case value.Valid:
+				p.Value = value.Float64
+			default:
+				p.Value = text.String
+			}
+			points = append(points, p)
+			continue
+		}
+		if !value.Valid {
+			continue
+		}
+		if start := ts / stepMs * stepMs; start != bucketStart {
+			flush()
+			bucketStart = start
+		}
+		bucket.add(rollup{min: min.Float64, max: max.Float64, sum: sum.Float64, last: last.Float64, count: count})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	flush()
+	return points, false, nil
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryAggregatesRollups(t *testing.T) {
+	cfg := HistorianConfig{Path: filepath.Join(t.TempDir(), "h.db")}
+	cfg.applyDefaults()
+	h, err := OpenHistorian(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	// Recent enough that the maintenance run by OpenHistorian keeps the
+	// samples.
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	// Two minutes of samples 10s apart, the last of each minute is not its
+	// largest value so last and max differ.
+	values := []float64{1, 5, 3, 4, 2, 0.5, 10, 30, 20, 50, 40, 7}
+	for i, v := range values {
+		ts := start.Add(time.Duration(i) * 10 * time.Second)
+		if err := h.Write(Batch{Time: ts, Values: []TagValue{{Name: "T", Value: v, Quality: QualityGood, Timestamp: ts}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	raw, _, err := h.History(ctx, "T", start, start.Add(time.Hour), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Downsample everything into rollups of a minute.
+	if err := h.maintain(ctx, start.Add(48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	rolled, _, err := h.History(ctx, "T", start, start.Add(time.Hour), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct{ min, max, avg, last float64 }{
+		{0.5, 5, 15.5 / 6, 0.5},
+		{7, 50, 157.0 / 6, 7},
+	}
+	for name, points := range map[string][]HistoryPoint{"raw": raw, "rolled up": rolled} {
+		if len(points) != len(want) {
+			t.Fatalf("%s: %d points, want %d", name, len(points), len(want))
+		}
+		for i, p := range points {
+			w := want[i]
+			if *p.Min != w.min || *p.Max != w.max || *p.Avg != w.avg || *p.Last != w.last || p.Count != 6 {
+				t.Errorf("%s point %d: min %v max %v avg %v last %v count %d, want %+v",
+					name, i, *p.Min, *p.Max, *p.Avg, *p.Last, p.Count, w)
+			}
+		}
+	}
+}
+
+// Text and bad samples cannot be downsampled and are kept until the
+// retention of their tag.
+func TestHistorianKeepsTextAndBadSamples(t *testing.T) {
+	cfg := HistorianConfig{Path: filepath.Join(t.TempDir(), "h.db")}
+	cfg.applyDefaults()
+	h, err := OpenHistorian(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	ts := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	if err := h.Write(Batch{Time: ts, Values: []TagValue{
+		{Name: "Speed", Value: 21.5, Quality: QualityGood, Timestamp: ts},
+		{Name: "Recipe", Value: "PVC-40", Quality: QualityGood, Timestamp: ts},
+		{Name: "Pressure", Quality: QualityBad, Error: "address out of range", Timestamp: ts},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	history := func(tag string) []HistoryPoint {
+		t.Helper()
+		points, _, err := h.History(ctx, tag, ts, ts.Add(time.Minute), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return points
+	}
+
+	// Past RawRetention the number is rolled up, the others stay samples.
+	if err := h.maintain(ctx, ts.Add(48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	var samples, rollups int
+	if err := h.db.QueryRow(`SELECT (SELECT COUNT(*) FROM samples), (SELECT COUNT(*) FROM rollups)`).Scan(&samples, &rollups); err != nil {
+		t.Fatal(err)
+	}
+	if samples != 2 || rollups != 1 {
+		t.Errorf("%d samples and %d rollups, want 2 and 1", samples, rollups)
+	}
+	if p := history("Speed"); len(p) != 1 || p[0].Value != 21.5 {
+		t.Errorf("Speed: %+v, want the rollup of 21.5", p)
+	}
+	if p := history("Recipe"); len(p) != 1 || p[0].Value != "PVC-40" || p[0].Quality != QualityGood {
+		t.Errorf("Recipe: %+v, want the text sample", p)
+	}
+	if p := history("Pressure"); len(p) != 1 || p[0].Quality != QualityBad {
+		t.Errorf("Pressure: %+v, want the bad sample", p)
+	}
+
+	// Past Retention everything is gone.
+	if err := h.maintain(ctx, ts.Add(31*24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"Speed", "Recipe", "Pressure"} {
+		if p := history(tag); len(p) != 0 {
+			t.Errorf("%s: %+v after the retention", tag, p)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// ImportOptions controls how tags are imported from engineering exports.
+type ImportOptions struct {
+	Format      string // csv, xml, db, sdf or asc; empty picks it from the file extension
+	DB          int    // DB number of data blocks whose source only gives a symbolic name
+	Measurement string // InfluxDB measurement set on every imported tag
+}
+
+// ImportResult holds the imported tags and the entries that were skipped,
+// such as timers, block symbols or peripheral addresses.
+type ImportResult struct {
+	Tags    []TagConfig
+	Skipped []string
+}
+
+// importFormats maps file extensions to import formats.
+var importFormats = map[string]string{
+	".csv": "csv", ".txt": "csv",
+	".xml": "xml",
+	".db":  "db", ".scl": "db", ".awl": "db", ".udt": "db",
+	".sdf": "sdf",
+	".asc": "asc", ".seq": "asc",
+}
+
+// ImportTags reads a TIA Portal PLC tag table (saved as CSV, or exported as
+// XML), a DB or UDT source file or a STEP 7 symbol table (.sdf or .asc) and
+// returns the tags in config format.
+func ImportTags(path string, opts ImportOptions) (ImportResult, error) {
+	format := opts.Format
+	if format == "" {
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext == ".xlsx" {
+			return ImportResult{}, fmt.Errorf("%s: save the tag table as CSV in Excel first", path)
+		}
+		if format = importFormats[ext]; format == "" {
+			return ImportResult{}, fmt.Errorf("%s: unknown file type, pass the format", path)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	text := decodeText(data)
+
+	var result ImportResult
+	switch format {
+	case "csv":
+		result, err = importTIACSV(text)
+	case "xml":
+		result, err = importTIAXML(text)
+	case "db":
+		result, err = importDBSource(text, opts.DB)
+	case "sdf":
+		result, err = importSDF(text)
+	case "asc":
+		result, err = importASC(text)
+	default:
+		return result, fmt.Errorf("unknown import format %q", format)
+	}
+	if err != nil {
+		return result, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range result.Tags {
+		result.Tags[i].Measurement = opts.Measurement
+	}
+	return result, nil
+}
+
+// decodeText strips a UTF-8 byte order mark and converts files that are not
+// UTF-8 from Windows-1252, which STEP 7 uses for symbol tables.
+func decodeText(data []byte) string {
+	data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// symbolTag converts one entry of a symbol or tag table. addrText is an
+// absolute address such as %MW10, "E 0.0" or "MD 20".
+func symbolTag(name, addrText, typeText string) (TagConfig, error) {
+	name = strings.TrimSpace(name)
+	text := strings.ReplaceAll(strings.TrimSpace(addrText), " ", "")
+	text = strings.TrimPrefix(text, "%")
+	text, _, _ = strings.Cut(text, ":") // %IW256:P, the peripheral suffix
+	if name == "" || text == "" {
+		return TagConfig{}, fmt.Errorf("%s: no name or address", name)
+	}
+	t, length, err := ParseDataType(typeText)
+	if err != nil {
+		return TagConfig{}, fmt.Errorf("%s: unsupported type %q", name, strings.TrimSpace(typeText))
+	}
+	addr, err := ParseAddress(text)
+	if err != nil {
+		return TagConfig{}, fmt.Errorf("%s: unsupported address %q", name, strings.TrimSpace(addrText))
+	}
+	if (t == TypeBool) != (addr.Type == TypeBool) || (t != TypeString && t != TypeWString && TypeSize(t, length) != addr.Size()) {
+		return TagConfig{}, fmt.Errorf("%s: type %s does not fit address %s", name, t, text)
+	}
+	addr.Type, addr.Length = t, length
+	return TagConfig{Name: name, Address: addr.String()}, nil
+}
+
+// importTIACSV reads a PLC tag table exported from TIA Portal to Excel and
+// saved as CSV. The columns are found by their English or German headers.
+func importTIACSV(text string) (ImportResult, error) {
+	var result ImportResult
+	firstLine, _, _ := strings.Cut(text, "\n")
+	r := csv.NewReader(strings.NewReader(text))
+	r.Comma = ','
+	for _, sep := range []rune{';', '\t'} {
+		if strings.Count(firstLine, string(sep)) > strings.Count(firstLine, string(r.Comma)) {
+			r.Comma = sep
+		}
+	}
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return result, err
+	}
+	if len(records) == 0 {
+		return result, fmt.Errorf("empty file")
+	}
+
+	columns := map[string][]string{
+		"name":    {"name"},
+		"type":    {"data type", "datatype", "datentyp"},
+		"address": {"logical address", "address", "logische adresse", "adresse"},
+	}
+	index := map[string]int{}
+	for i, header := range records[0] {
+		header = strings.ToLower(strings.TrimSpace(header))
+		for column, names := range columns {
+			for _, n := range names {
+				if _, found := index[column]; !found && header == n {
+					index[column] = i
+				}
+			}
+		}
+	}
+	for _, column := range []string{"name", "type", "address"} {
+		if _, ok := index[column]; !ok {
+			return result, fmt.Errorf("no %q column, is this a PLC tag table export?", columns[column][0])
+		}
+	}
+
+	for line, record := range records[1:] {
+		field := func(column string) string {
+			if i := index[column]; i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		if strings.TrimSpace(field("name")) == "" {
+			continue
+		}
+		tag, err := symbolTag(field("name"), field("address"), field("type"))
+		if err != nil {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("line %d: %v", line+2, err))
+			continue
+		}
+		result.Tags = append(result.Tags, tag)
+	}
+	return result, nil
+}
+
+// importTIAXML reads a PLC tag table exported as XML, either in the
+// TIA Openness format (SW.Tags.PlcTag elements) or in the older format with
+// <Tag type="..." addr="...">Name</Tag> elements.
+func importTIAXML(text string) (ImportResult, error) {
+	var result ImportResult
+	add := func(name, addr, typeName string) {
+		tag, err := symbolTag(name, addr, typeName)
+		if err != nil {
+			result.Skipped = append(result.Skipped, err.Error())
+			return
+		}
+		result.Tags = append(result.Tags, tag)
+	}
+
+	d := xml.NewDecoder(strings.NewReader(text))
+	d.Strict = false
+	var stack []string
+	var current map[string]string // Attributes of the SW.Tags.PlcTag being read
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := t.Name.Local
+			n := len(stack)
+			switch {
+			case name == "Tag":
+				var content string
+				if err := d.DecodeElement(&content, &t); err != nil {
+					return result, err
+				}
+				var addr, typeName string
+				for _, a := range t.Attr {
+					switch a.Name.Local {
+					case "addr":
+						addr = a.Value
+					case "type":
+						typeName = a.Value
+					}
+				}
+				add(content, addr, typeName)
+				continue
+			case name == "SW.Tags.PlcTag":
+				current = map[string]string{}
+			case current != nil && n >= 2 && stack[n-1] == "AttributeList" && stack[n-2] == "SW.Tags.PlcTag":
+				var content string
+				if err := d.DecodeElement(&content, &t); err != nil {
+					return result, err
+				}
+				current[name] = content
+				continue
+			}
+			stack = append(stack, name)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			if t.Name.Local == "SW.Tags.PlcTag" && current != nil {
+				add(current["Name"], current["LogicalAddress"], current["DataTypeName"])
+				current = nil
+			}
+		}
+	}
+	if len(result.Tags) == 0 && len(result.Skipped) == 0 {
+		return result, fmt.Errorf("no tags found, is this a PLC tag table export?")
+	}
+	return result, nil
+}
+
+// importDBSource lays out the data blocks of a source file. db is used for
+// the one DB whose source only has a symbolic name.
+func importDBSource(text string, db int) (ImportResult, error) {
+	var result ImportResult
+	src, err := ParseDBSource(text)
+	if err != nil {
+		return result, err
+	}
+	if len(src.DBs) == 0 {
+		return result, fmt.Errorf("no DATA_BLOCK found")
+	}
+	usedDB := false
+	for _, sdb := range src.DBs {
+		if sdb.Optimized {
+			return result, fmt.Errorf("%s has optimized block access, switch it off in the DB properties so its offsets are fixed", sdb.Name)
+		}
+		number := sdb.Number
+		if number == 0 {
+			if db <= 0 {
+				return result, fmt.Errorf("%s: the source has no DB number, pass it", sdb.Name)
+			}
+			if usedDB {
+				return result, fmt.Errorf("%s: more than one DB without a number in the source", sdb.Name)
+			}
+			number, usedDB = db, true
+		}
+		tags, _, err := LayoutTags(sdb.Name, sdb.Type, Address{Area: AreaDB, DB: number}, src.Types)
+		if err != nil {
+			return result, err
+		}
+		result.Tags = append(result.Tags, tags...)
+	}
+	return result, nil
+}
+
+// importSDF reads a STEP 7 symbol table in System Data Format: quoted,
+// comma separated name, address, type and comment.
+func importSDF(text string) (ImportResult, error) {
+	var result ImportResult
+	r := csv.NewReader(strings.NewReader(text))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return result, err
+	}
+	for line, record := range records {
+		if len(record) < 3 {
+			continue
+		}
+		addSymbol(&result, line+1, record[0], record[1], record[2])
+	}
+	return result, nil
+}
+
+// ASCII symbol table columns after the "126," record prefix.
+const (
+	ascNameWidth    = 24
+	ascAddressWidth = 12
+	ascTypeWidth    = 10
+)
+
+// importASC reads a STEP 7 symbol table in the fixed width ASCII format.
+func importASC(text string) (ImportResult, error) {
+	var result ImportResult
+	for line, s := range strings.Split(text, "\n") {
+		s = strings.TrimRight(s, "\r")
+		_, record, ok := strings.Cut(s, ",")
+		if !ok {
+			continue
+		}
+		r := []rune(record)
+		column := func(from, width int) string {
+			if from >= len(r) {
+				return ""
+			}
+			return string(r[from:min(from+width, len(r))])
+		}
+		addSymbol(&result, line+1,
+			column(0, ascNameWidth),
+			column(ascNameWidth, ascAddressWidth),
+			column(ascNameWidth+ascAddressWidth, ascTypeWidth))
+	}
+	return result, nil
+}
+
+// addSymbol adds a STEP 7 symbol. Symbols of blocks and of timers and
+// counters are skipped silently, they have no value to read.
+func addSymbol(result *ImportResult, line int, name, addr, typeName string) {
+	area := strings.ToUpper(strings.TrimSpace(addr))
+	for _, prefix := range []string{"OB", "FB", "FC", "SFB", "SFC", "DB", "UDT", "VAT", "T ", "Z ", "C "} {
+		if strings.HasPrefix(area, prefix) {
+			return
+		}
+	}
+	tag, err := symbolTag(name, addr, typeName)
+	if err != nil {
+		result.Skipped = append(result.Skipped, fmt.Sprintf("line %d: %v", line, err))
+		return
+	}
+	result.Tags = append(result.Tags, tag)
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testDBSource = `TYPE "Motor"
+VERSION : 0.1
+   STRUCT
+      On : Bool;
+      Fault : Bool;   // packed into the same byte
+      Speed : Real;
+   END_STRUCT;
+END_TYPE
+
+DATA_BLOCK "Line"
+{ S7_Optimized_Access := 'FALSE' }
+VERSION : 0.1
+NON_RETAIN
+   STRUCT
+      Running : Bool := TRUE;
+      Count : Byte;
+      Level : Int;
+      Name : String[10] := 'line';
+      Motors : Array[1..2] of "Motor";
+      Alarm : Bool;
+      Total : LReal;
+   END_STRUCT;
+BEGIN
+   Count := 3;
+END_DATA_BLOCK
+
+FUNCTION_BLOCK "Ignored"
+   VAR x : Int; END_VAR
+END_FUNCTION_BLOCK
+`
+
+func TestImportDBSource(t *testing.T) {
+	result, err := importDBSource(testDBSource, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, tag := range result.Tags {
+		got = append(got, tag.Name+" "+tag.Address)
+	}
+	want := []string{
+		"Line.Running DB7.DBX0.0",
+		"Line.Count DB7.DBB1",
+		"Line.Level DB7.DBW2:INT",
+		"Line.Name DB7.DBB4:STRING[10]",
+		"Line.Motors[1].On DB7.DBX16.0",
+		"Line.Motors[1].Fault DB7.DBX16.1",
+		"Line.Motors[1].Speed DB7.DBD18:REAL",
+		"Line.Motors[2].On DB7.DBX22.0",
+		"Line.Motors[2].Fault DB7.DBX22.1",
+		"Line.Motors[2].Speed DB7.DBD24:REAL",
+		"Line.Alarm DB7.DBX28.0",
+		"Line.Total DB7.DBB30:LREAL",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestImportDBSourceErrors(t *testing.T) {
+	tests := []struct {
+		name, text string
+		db         int
+		want       string
+	}{
+		{"no block", `TYPE "T" STRUCT a : Int; END_STRUCT; END_TYPE`, 1, "no DATA_BLOCK"},
+		{"no number", `DATA_BLOCK "D" STRUCT a : Int; END_STRUCT; BEGIN END_DATA_BLOCK`, 0, "no DB number"},
+		{"optimized", `DATA_BLOCK DB3 { S7_Optimized_Access := 'TRUE' } STRUCT a : Int; END_STRUCT; BEGIN END_DATA_BLOCK`, 0, "optimized block access"},
+		{"unknown type", `DATA_BLOCK DB3 STRUCT a : "Nope"; END_STRUCT; BEGIN END_DATA_BLOCK`, 0, "Nope"},
+		{"syntax", `DATA_BLOCK DB3 STRUCT a Int; END_STRUCT; BEGIN END_DATA_BLOCK`, 0, "DB3"},
+	}
+	for _, tt := range tests {
+		_, err := importDBSource(tt.text, tt.db)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want one about %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestImportTags(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Line.db")
+	if err := os.WriteFile(path, []byte(testDBSource), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := ImportTags(path, ImportOptions{DB: 7, Measurement: "line"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Tags) != 12 || result.Tags[0].Measurement != "line" {
+		t.Errorf("got %+v", result.Tags)
+	}
+	if _, err := ImportTags(filepath.Join(dir, "tags.xlsx"), ImportOptions{}); err == nil || !strings.Contains(err.Error(), "CSV") {
+		t.Errorf("xlsx: %v, want a hint to save as CSV", err)
+	}
+}
@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+func init() {
+	RegisterSink("influxdb", openInfluxSink)
+}
+
+// openInfluxSink connects to InfluxDB when WriteToInfluxDB is set, keeping
+// the client of old when the connection settings are the same.
+func openInfluxSink(cfg Config, tags []Tag, old []ConfiguredSink) ([]ConfiguredSink, error) {
+	if !cfg.WriteToInfluxDB {
+		return nil, nil
+	}
+	route, routed := routeTags(cfg.InfluxDBRoute, cfg.PlcName, tags)
+	aggregate, _ := aggregateTags(cfg.InfluxDBAggregate, cfg.PlcName, routed)
+	for _, o := range old {
+		if s, ok := o.Sink.(*InfluxSink); ok && s.reusable(cfg) {
+			return []ConfiguredSink{{Sink: s, Queue: cfg.InfluxDBQueue, Route: route, Aggregate: aggregate}}, nil
+		}
+	}
+	if !IsInfluxDBAccessible(cfg.InfluxDBHealth) {
+		return nil, fmt.Errorf("InfluxDB at %s is not accessible or not ready", cfg.InfluxDBHealth)
+	}
+	return []ConfiguredSink{{Sink: NewInfluxSink(cfg), Queue: cfg.InfluxDBQueue, Route: route, Aggregate: aggregate}}, nil
+}
+
+// InfluxSink writes one point per measurement and poll to the InfluxDB
+// bucket of the config, with a field for every tag that was read
+// successfully, the PLC name as host tag and the active contexts as tags.
+// Context events go to the EventMeasurement of the Context config.
+type InfluxSink struct {
+	cfg      Config // Only the InfluxDB settings, PlcName and EventMeasurement are used
+	client   influxdb2.Client
+	writeAPI api.WriteAPIBlocking
+}
+
+// NewInfluxSink creates a client for the InfluxDB of cfg. It does not
+// connect until the first write.
+func NewInfluxSink(cfg Config) *InfluxSink {
+	client := influxdb2.NewClient(cfg.InfluxDBURL, cfg.InfluxDBToken)
+	return &InfluxSink{
+		cfg:      cfg,
+		client:   client,
+		writeAPI: client.WriteAPIBlocking(cfg.InfluxDBOrg, cfg.InfluxDBBucket),
+	}
+}
+
+// reusable reports whether the sink writes where a sink for cfg would.
+func (s *InfluxSink) reusable(cfg Config) bool {
+	return s.cfg.InfluxDBURL == cfg.InfluxDBURL && s.cfg.InfluxDBToken == cfg.InfluxDBToken &&
+		s.cfg.InfluxDBOrg == cfg.InfluxDBOrg && s.cfg.InfluxDBBucket == cfg.InfluxDBBucket &&
+		s.cfg.PlcName == cfg.PlcName && s.cfg.eventMeasurement() == cfg.eventMeasurement()
+}
+
+// WriteAPI returns the API the sink writes with, for other measurements of
+// the same bucket such as the CPU status.
+func (s *InfluxSink) WriteAPI() api.WriteAPIBlocking {
+	return s.writeAPI
+}
+
+// Name returns the name of the sink for log messages.
+func (s *InfluxSink) Name() string {
+	return "InfluxDB " + s.cfg.InfluxDBURL
+}
+
+// Start does nothing, the client connects with every write.
+func (s *InfluxSink) Start(ctx context.Context) error {
+	return nil
+}
+
+// Write writes the values of one poll.
+func (s *InfluxSink) Write(batch Batch) error {
+	points := s.points(batch)
+	if len(points) == 0 {
+		return nil
+	}
+	if err := s.writeAPI.WritePoint(context.Background(), points...); err != nil {
+		return err
+	}
+	Debugf("InfluxDB | OK | %d point(s)", len(points))
+	return nil
+}
+
+// points builds one point per measurement with a field for every tag that
+// was read successfully, tagged with the context of the batch, and one
+// point per context event.
+func (s *InfluxSink) points(batch Batch) []*write.Point {
+	if batch.Snapshot != nil {
+		return s.snapshotPoints(batch.Snapshot)
+	}
+	var points []*write.Point
+	byMeasurement := map[string]*write.Point{}
+	for i, tag := range batch.Tags {
+		if batch.Values[i].Quality != QualityGood {
+			continue
+		}
+		p, ok := byMeasurement[tag.Measurement]
+		if !ok {
+			p = influxdb2.NewPointWithMeasurement(tag.Measurement).
+				AddTag("host", s.cfg.PlcName).
+				SetTime(batch.Time)
+			for name, value := range batch.Context {
+				p.AddTag(name, value)
+			}
+			byMeasurement[tag.Measurement] = p
+			points = append(points, p)
+		}
+		p.AddField(tag.Field, influxValue(batch.Values[i].Value))
+	}
+	for _, e := range batch.Events {
+		p := influxdb2.NewPointWithMeasurement(s.cfg.eventMeasurement()).
+			AddTag("host", s.cfg.PlcName).
+			AddTag("context", e.Name).
+			AddTag("event", e.Event).
+			AddField("value", e.Value).
+			SetTime(e.Time)
+		if e.Duration > 0 {
+			p.AddField("duration", e.Duration)
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+// snapshotPoints builds a point per poll of snapshot, in its Measurement and
+// tagged with its name and ID. Tags are written by name, since the fields of
+// tags in different measurements may be the same.
+func (s *InfluxSink) snapshotPoints(snapshot *Snapshot) []*write.Point {
+	points := make([]*write.Point, 0, len(snapshot.Samples))
+	for _, sample := range snapshot.Samples {
+		p := influxdb2.NewPointWithMeasurement(snapshot.Measurement).
+			AddTag("host", s.cfg.PlcName).
+			AddTag("snapshot", snapshot.Name).
+			AddTag("id", snapshot.ID).
+			AddField("offset", sample.Offset).
+			SetTime(sample.Time)
+		for name, value := range snapshot.Context {
+			p.AddTag(name, value)
+		}
+		for _, v := range sample.Values {
+			if v.Quality == QualityGood {
+				p.AddField(v.Name, influxValue(v.Value))
+			}
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+// influxValue converts values InfluxDB cannot store natively.
+func influxValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Duration:
+		return v.Milliseconds()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return v
+}
+
+// Flush writes points the write API still holds.
+func (s *InfluxSink) Flush(ctx context.Context) error {
+	return s.writeAPI.Flush(ctx)
+}
+
+// Health always reports nil, failing writes are reported by Write.
+func (s *InfluxSink) Health() error {
+	return nil
+}
+
+// Close closes the client.
+func (s *InfluxSink) Close() error {
+	s.client.Close()
+	return nil
+}
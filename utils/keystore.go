@@ -0,0 +1,201 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// MasterKeyEnv and MasterKeyFileEnv name the environment variables the
+// master key of the keystore is read from. Without either, the Docker
+// secret s7_master_key is used when it exists.
+const (
+	MasterKeyEnv     = "S7_MASTER_KEY"
+	MasterKeyFileEnv = "S7_MASTER_KEY_FILE"
+)
+
+// keystoreCheck is encrypted into every keystore so a wrong master key is
+// reported as such rather than as a damaged secret.
+const keystoreCheck = "s7_plc_read keystore"
+
+// Keystore is a local file of secrets, each encrypted with AES-256-GCM under
+// a key derived from the master key with scrypt. The file can be kept next
+// to the config; without the master key it reveals only the secret names.
+type Keystore struct {
+	path string
+	key  []byte
+	file keystoreFile
+}
+
+type keystoreFile struct {
+	Version int               `json:"version"`
+	Salt    []byte            `json:"salt"`
+	Check   []byte            `json:"check"`
+	Secrets map[string][]byte `json:"secrets"` // Nonce followed by the sealed value
+}
+
+// MasterKey returns the master key from S7_MASTER_KEY, from the file named
+// by S7_MASTER_KEY_FILE or from the s7_master_key secret in SecretsDir.
+func MasterKey() (string, error) {
+	if key := os.Getenv(MasterKeyEnv); key != "" {
+		return key, nil
+	}
+	path := os.Getenv(MasterKeyFileEnv)
+	if path == "" {
+		path = filepath.Join(SecretsDir(), "s7_master_key")
+		if !FileExists(path) {
+			return "", fmt.Errorf("no master key, set %s or %s", MasterKeyEnv, MasterKeyFileEnv)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read master key: %w", err)
+	}
+	key := strings.TrimRight(string(data), "\r\n")
+	if key == "" {
+		return "", fmt.Errorf("master key in %s is empty", path)
+	}
+	return key, nil
+}
+
+// OpenKeystore opens the keystore at path with masterKey. When create is
+// set, a missing file is treated as an empty keystore that Save creates.
+func OpenKeystore(path, masterKey string, create bool) (*Keystore, error) {
+	k := &Keystore{path: path}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && create:
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		k.file = keystoreFile{Version: 1, Salt: salt, Secrets: map[string][]byte{}}
+		if k.key, err = deriveKey(masterKey, salt); err != nil {
+			return nil, err
+		}
+		if k.file.Check, err = k.seal("", keystoreCheck); err != nil {
+			return nil, err
+		}
+		return k, nil
+	case err != nil:
+		return nil, fmt.Errorf("cannot read keystore: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &k.file); err != nil {
+		return nil, fmt.Errorf("keystore %s is damaged: %w", path, err)
+	}
+	if k.file.Version != 1 {
+		return nil, fmt.Errorf("keystore %s has unsupported version %d", path, k.file.Version)
+	}
+	if k.file.Secrets == nil {
+		k.file.Secrets = map[string][]byte{}
+	}
+	if k.key, err = deriveKey(masterKey, k.file.Salt); err != nil {
+		return nil, err
+	}
+	if check, err := k.open("", k.file.Check); err != nil || check != keystoreCheck {
+		return nil, fmt.Errorf("wrong master key for keystore %s", path)
+	}
+	return k, nil
+}
+
+func deriveKey(masterKey string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(masterKey), salt, 1<<15, 8, 1, 32)
+}
+
+// seal encrypts value with the name as additional data, so sealed values
+// cannot be swapped between names.
+func (k *Keystore) seal(name, value string) ([]byte, error) {
+	gcm, err := k.cipher()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, []byte(value), []byte(name)), nil
+}
+
+func (k *Keystore) open(name string, sealed []byte) (string, error) {
+	gcm, err := k.cipher()
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("secret %s is damaged", name)
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	value, err := gcm.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("secret %s is damaged", name)
+	}
+	return string(value), nil
+}
+
+func (k *Keystore) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Get returns the secret stored under name.
+func (k *Keystore) Get(name string) (string, error) {
+	sealed, ok := k.file.Secrets[name]
+	if !ok {
+		return "", fmt.Errorf("keystore %s has no secret %s", k.path, name)
+	}
+	return k.open(name, sealed)
+}
+
+// Set stores value under name, replacing an existing secret.
+func (k *Keystore) Set(name, value string) error {
+	sealed, err := k.seal(name, value)
+	if err != nil {
+		return err
+	}
+	k.file.Secrets[name] = sealed
+	return nil
+}
+
+// Delete removes the secret stored under name and reports whether it
+// existed.
+func (k *Keystore) Delete(name string) bool {
+	_, ok := k.file.Secrets[name]
+	delete(k.file.Secrets, name)
+	return ok
+}
+
+// Names returns the names of all secrets in alphabetical order.
+func (k *Keystore) Names() []string {
+	names := make([]string, 0, len(k.file.Secrets))
+	for name := range k.file.Secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Save writes the keystore back to its file, readable by the owner only.
+func (k *Keystore) Save() error {
+	data, err := json.MarshalIndent(k.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.path)
+}
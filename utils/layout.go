@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TypeDecl is a declared S7 type: an elementary type, a STRUCT, an ARRAY or a
+// reference to a named struct type (a UDT).
+type TypeDecl struct {
+	Type   DataType    // Elementary type
+	Length int         // Maximum length of STRING and WSTRING
+	Skip   int         // Size of types that take space but are not read, such as POINTER
+	Fields []FieldDecl // STRUCT members
+	Dims   []ArrayDim  // ARRAY bounds, one per dimension
+	Elem   *TypeDecl   // ARRAY element type
+	Ref    string      // Name of a struct type
+}
+
+// FieldDecl is one member of a STRUCT.
+type FieldDecl struct {
+	Name string
+	Type TypeDecl
+}
+
+// ArrayDim is the index range of one array dimension, e.g. [1..20].
+type ArrayDim struct {
+	Low, High int
+}
+
+// skipTypes are types that occupy memory in a DB but have no value we can
+// decode. They are laid out so the members after them get the right offset.
+var skipTypes = map[string]int{
+	"POINTER": 6, "ANY": 10,
+	"TIMER": 2, "COUNTER": 2,
+	"BLOCK_DB": 2, "BLOCK_FB": 2, "BLOCK_FC": 2, "BLOCK_SDB": 2,
+}
+
+// TypeNames maps struct type names to their declarations. Names are matched
+// case-insensitively, as in STEP 7.
+type TypeNames map[string]TypeDecl
+
+func (t TypeNames) lookup(name string) (TypeDecl, bool) {
+	decl, ok := t[name]
+	if !ok {
+		for n, d := range t {
+			if strings.EqualFold(n, name) {
+				return d, true
+			}
+		}
+	}
+	return decl, ok
+}
+
+// layoutPos is the next free position while laying out a DB.
+type layoutPos struct {
+	byte, bit int
+}
+
+// alignByte moves to the next byte unless the position is at a byte start.
+func (p *layoutPos) alignByte() {
+	if p.bit > 0 {
+		p.byte++
+		p.bit = 0
+	}
+}
+
+// alignWord moves to the next even byte, which is where every value larger
+// than a byte, every STRUCT and every ARRAY starts.
+func (p *layoutPos) alignWord() {
+	p.alignByte()
+	if p.byte%2 == 1 {
+		p.byte++
+	}
+}
+
+// LayoutTags assigns addresses to every elementary member of t, starting at
+// at, and returns one tag per member named after its path, such as
+// Motors[3].Current. Offsets follow the rules for DBs with optimized access
+// switched off: BOOLs are packed into bits, one-byte types are byte aligned
+// and everything else, including each STRUCT and ARRAY, starts on an even
+// byte and is padded to an even size. The returned size is in bytes.
+func LayoutTags(name string, t TypeDecl, at Address, types TypeNames) ([]TagConfig, int, error) {
+	pos := layoutPos{byte: at.Start, bit: at.Bit}
+	var tags []TagConfig
+	emit := func(path string, addr Address) {
+		tags = append(tags, TagConfig{Name: path, Address: addr.String()})
+	}
+	if err := layout(name, t, &pos, at, types, emit, 0); err != nil {
+		return nil, 0, err
+	}
+	if t.Type == "" || t.Type == TypeString || t.Type == TypeWString {
+		pos.alignWord()
+	} else {
+		pos.alignByte()
+	}
+	return tags, pos.byte - at.Start, nil
+}
+
+// maxTypeDepth stops recursive struct types.
+const maxTypeDepth = 32
+
+func layout(path string, t TypeDecl, pos *layoutPos, at Address, types TypeNames, emit func(string, Address), depth int) error {
+	if depth > maxTypeDepth {
+		return fmt.Errorf("%s: types nested too deep, is a struct type used inside itself?", path)
+	}
+	switch {
+	case t.Ref != "":
+		decl, ok := types.lookup(t.Ref)
+		if !ok {
+			return fmt.Errorf("%s: unknown type %q", path, t.Ref)
+		}
+		return layout(path, decl, pos, at, types, emit, depth+1)
+
+	case t.Elem != nil:
+		if len(t.Dims) == 0 {
+			return fmt.Errorf("%s: array without bounds", path)
+		}
+		count := 1
+		for _, d := range t.Dims {
+			if d.High < d.Low {
+				return fmt.Errorf("%s: invalid array bounds [%d..%d]", path, d.Low, d.High)
+			}
+			count *= d.High - d.Low + 1
+		}
+		pos.alignWord()
+		index := make([]int, len(t.Dims))
+		for i := range t.Dims {
+			index[i] = t.Dims[i].Low
+		}
+		for n := 0; n < count; n++ {
+			parts := make([]string, len(index))
+			for i, v := range index {
+				parts[i] = fmt.Sprint(v)
+			}
+			if err := layout(fmt.Sprintf("%s[%s]", path, strings.Join(parts, ",")), *t.Elem, pos, at, types, emit, depth+1); err != nil {
+				return err
+			}
+			// The last index changes fastest.
+			for i := len(index) - 1; i >= 0; i-- {
+				if index[i] < t.Dims[i].High {
+					index[i]++
+					break
+				}
+				index[i] = t.Dims[i].Low
+			}
+		}
+		pos.alignWord()
+
+	case t.Fields != nil:
+		pos.alignWord()
+		for _, f := range t.Fields {
+			if err := layout(joinPath(path, f.Name), f.Type, pos, at, types, emit, depth+1); err != nil {
+				return err
+			}
+		}
+		pos.alignWord()
+
+	case t.Skip > 0:
+		pos.alignWord()
+		pos.byte += t.Skip
+
+	case t.Type == TypeBool:
+		emit(path, Address{Area: at.Area, DB: at.DB, Start: pos.byte, Bit: pos.bit, Type: TypeBool})
+		pos.bit++
+		if pos.bit == 8 {
+			pos.byte++
+			pos.bit = 0
+		}
+
+	case t.Type != "":
+		size := TypeSize(t.Type, t.Length)
+		if size == 1 {
+			pos.alignByte()
+		} else {
+			pos.alignWord()
+		}
+		emit(path, Address{Area: at.Area, DB: at.DB, Start: pos.byte, Type: t.Type, Length: t.Length})
+		pos.byte += size
+
+	default:
+		return fmt.Errorf("%s: missing type", path)
+	}
+	return nil
+}
+
+// joinPath appends a member name to a tag path. A DB laid out without a name
+// gives its members their plain names.
+func joinPath(path, member string) string {
+	if path == "" {
+		return member
+	}
+	return path + "." + member
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel controls which messages are written by the leveled log helpers.
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevel atomic.Int32
+
+func init() {
+	logLevel.Store(int32(LevelInfo))
+}
+
+// ParseLogLevel converts a level name (debug, info, warn, error) to a LogLevel.
+func ParseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q (use debug, info, warn or error)", name)
+}
+
+// SetLogLevel sets the minimum level that is written to the log.
+func SetLogLevel(name string) error {
+	level, err := ParseLogLevel(name)
+	if err != nil {
+		return err
+	}
+	logLevel.Store(int32(level))
+	return nil
+}
+
+func logf(level LogLevel, prefix, format string, v ...interface{}) {
+	if LogLevel(logLevel.Load()) > level {
+		return
+	}
+	log.Print(prefix + Redact(fmt.Sprintf(format, v...)))
+}
+
+// Debugf logs a message at debug level.
+func Debugf(format string, v ...interface{}) { logf(LevelDebug, "DEBUG ", format, v...) }
+
+// Infof logs a message at info level.
+func Infof(format string, v ...interface{}) { logf(LevelInfo, "INFO ", format, v...) }
+
+// Warnf logs a message at warn level.
+func Warnf(format string, v ...interface{}) { logf(LevelWarn, "WARN ", format, v...) }
+
+// Errorf logs a message at error level.
+func Errorf(format string, v ...interface{}) { logf(LevelError, "ERROR ", format, v...) }
@@ -0,0 +1,671 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ModbusConfig makes the collector a Modbus TCP server that serves tag
+// values from the value cache, an S7 to Modbus gateway.
+type ModbusConfig struct {
+	Listen    string           `json:"Listen"`    // Address to listen on, defaults to :502
+	UnitID    int              `json:"UnitID"`    // Unit identifier to answer, 0 answers every unit
+	WordOrder string           `json:"WordOrder"` // high (default) sends the high word of 32 and 64 bit values first, low the low word
+	Registers []ModbusRegister `json:"Registers"`
+}
+
+// ModbusRegister maps a tag onto registers or a coil.
+type ModbusRegister struct {
+	Tag       string  `json:"Tag"`
+	Table     string  `json:"Table"`               // holding (default), input, coil or discrete; coils and discrete inputs need BOOL tags
+	Address   int     `json:"Address"`             // Register or coil number, from 0
+	Type      string  `json:"Type,omitempty"`      // int16, uint16, int32, uint32, int64, uint64, float32 or float64; defaults to the type of the tag
+	Scale     float64 `json:"Scale,omitempty"`     // Register value = tag value * Scale + Offset, defaults to 1
+	Offset    float64 `json:"Offset,omitempty"`    //
+	WordOrder string  `json:"WordOrder,omitempty"` // Overrides WordOrder of the server
+	Writable  bool    `json:"Writable,omitempty"`  // Clients may write the tag, which must be Writable too
+}
+
+// Modbus tables.
+const (
+	ModbusHolding  = "holding"
+	ModbusInput    = "input"
+	ModbusCoil     = "coil"
+	ModbusDiscrete = "discrete"
+)
+
+// modbusTypeWords holds the number of registers of each register type.
+var modbusTypeWords = map[string]int{
+	"int16": 1, "uint16": 1, "int32": 2, "uint32": 2, "int64": 4, "uint64": 4, "float32": 2, "float64": 4,
+}
+
+// applyDefaults fills in the optional fields of m.
+func (m *ModbusConfig) applyDefaults() {
+	if m.Listen == "" {
+		m.Listen = ":502"
+	}
+	if m.WordOrder == "" {
+		m.WordOrder = "high"
+	}
+	for i := range m.Registers {
+		r := &m.Registers[i]
+		if r.Table == "" {
+			r.Table = ModbusHolding
+		}
+		if r.Scale == 0 {
+			r.Scale = 1
+		}
+		if r.WordOrder == "" {
+			r.WordOrder = m.WordOrder
+		}
+	}
+}
+
+// validate checks the fields of m, reporting problems under path. tags
+// holds all tags by name.
+func (m *ModbusConfig) validate(path string, tags map[string]Tag, errs *ConfigErrors) {
+	if _, _, err := net.SplitHostPort(m.Listen); err != nil {
+		errs.add(path+".Listen", "must be host:port or :port, found %q", m.Listen)
+	}
+	if m.UnitID < 0 || m.UnitID > 255 {
+		errs.add(path+".UnitID", "must be 0..255, found %d", m.UnitID)
+	}
+	checkOneOf(errs, path+".WordOrder", m.WordOrder, "high", "low")
+	used := map[string]map[int]string{}
+	for i, r := range m.Registers {
+		path := fmt.Sprintf("%s.Registers[%d]", path, i)
+		v, err := newModbusValue(r, tags)
+		if err != nil {
+			errs.add(path, "%v", err)
+			continue
+		}
+		if used[r.Table] == nil {
+			used[r.Table] = map[int]string{}
+		}
+		for j := 0; j < max(v.words, 1); j++ {
+			if other, ok := used[r.Table][r.Address+j]; ok {
+				errs.add(path+".Address", "%s %d is also used by %s", r.Table, r.Address+j, other)
+				break
+			}
+			used[r.Table][r.Address+j] = r.Tag
+		}
+	}
+}
+
+// modbusValue is a register mapping resolved against its tag.
+type modbusValue struct {
+	reg   ModbusRegister
+	tag   Tag
+	typ   string // Register type, empty for coils and discrete inputs
+	words int
+}
+
+func newModbusValue(r ModbusRegister, tags map[string]Tag) (*modbusValue, error) {
+	tag, ok := tags[r.Tag]
+	if !ok {
+		return nil, fmt.Errorf("unknown tag %q", r.Tag)
+	}
+	v := &modbusValue{reg: r, tag: tag}
+	switch r.Table {
+	case ModbusCoil, ModbusDiscrete:
+		if tag.Addr.Type != TypeBool {
+			return nil, fmt.Errorf("%s %s needs a BOOL tag, %s is %s", r.Table, r.Tag, r.Tag, tag.Addr.Type)
+		}
+		if r.Type != "" {
+			return nil, fmt.Errorf("Type does not apply to a %s", r.Table)
+		}
+	case ModbusHolding, ModbusInput:
+		v.typ = r.Type
+		if v.typ == "" {
+			if v.typ = modbusType(tag.Addr.Type); v.typ == "" {
+				return nil, fmt.Errorf("tag %s of type %s cannot be mapped to registers", r.Tag, tag.Addr.Type)
+			}
+		}
+		if v.words = modbusTypeWords[v.typ]; v.words == 0 {
+			return nil, fmt.Errorf("Type must be int16, uint16, int32, uint32, int64, uint64, float32 or float64, found %q", v.typ)
+		}
+	default:
+		return nil, fmt.Errorf("Table must be holding, input, coil or discrete, found %q", r.Table)
+	}
+	if r.Address < 0 || r.Address+max(v.words, 1) > 65536 {
+		return nil, fmt.Errorf("Address must be 0..65535, found %d", r.Address)
+	}
+	if r.WordOrder != "high" && r.WordOrder != "low" {
+		return nil, fmt.Errorf("WordOrder must be high or low, found %q", r.WordOrder)
+	}
+	if r.Writable {
+		switch {
+		case r.Table == ModbusInput || r.Table == ModbusDiscrete:
+			return nil, fmt.Errorf("Modbus clients cannot write to the %s table", r.Table)
+		case !tag.Writable:
+			return nil, fmt.Errorf("tag %s must be Writable to be written by Modbus clients", r.Tag)
+		case modbusType(tag.Addr.Type) == "" || isDurationType(tag.Addr.Type):
+			return nil, fmt.Errorf("tag %s of type %s cannot be written by Modbus clients", r.Tag, tag.Addr.Type)
+		}
+	}
+	return v, nil
+}
+
+// modbusType returns the register type that holds values of an S7 type,
+// or "" when there is none. Durations are sent in milliseconds.
+func modbusType(t DataType) string {
+	switch t {
+	case TypeBool, TypeByte, TypeUSInt, TypeWord, TypeUInt:
+		return "uint16"
+	case TypeSInt, TypeInt:
+		return "int16"
+	case TypeDWord, TypeUDInt:
+		return "uint32"
+	case TypeDInt, TypeTime, TypeTOD, TypeS5Time:
+		return "int32"
+	case TypeLWord, TypeULInt:
+		return "uint64"
+	case TypeLInt:
+		return "int64"
+	case TypeReal:
+		return "float32"
+	case TypeLReal:
+		return "float64"
+	}
+	return ""
+}
+
+func isDurationType(t DataType) bool {
+	return t == TypeTime || t == TypeTOD || t == TypeS5Time
+}
+
+// registers encodes a tag value. Values outside the range of the register
+// type are clamped.
+func (v *modbusValue) registers(value interface{}) ([]uint16, bool) {
+	if d, ok := value.(time.Duration); ok {
+		value = d.Milliseconds()
+	}
+	var bits uint64
+	switch value := value.(type) {
+	case int64:
+		// Exact, as float64 cannot hold every 64 bit integer.
+		if v.reg.Scale == 1 && v.reg.Offset == 0 && (v.typ == "int64" || v.typ == "uint64" && value >= 0) {
+			bits = uint64(value)
+			return v.words16(bits), true
+		}
+	case uint64:
+		if v.reg.Scale == 1 && v.reg.Offset == 0 && (v.typ == "uint64" || v.typ == "int64" && value <= math.MaxInt64) {
+			bits = value
+			return v.words16(bits), true
+		}
+	}
+	f, ok := numericValue(value)
+	if !ok {
+		return nil, false
+	}
+	x := f*v.reg.Scale + v.reg.Offset
+	clamp := func(lo, hi float64) float64 { return math.Max(lo, math.Min(hi, math.Round(x))) }
+	switch v.typ {
+	case "int16":
+		bits = uint64(uint16(int16(clamp(math.MinInt16, math.MaxInt16))))
+	case "uint16":
+		bits = uint64(clamp(0, math.MaxUint16))
+	case "int32":
+		bits = uint64(uint32(int32(clamp(math.MinInt32, math.MaxInt32))))
+	case "uint32":
+		bits = uint64(clamp(0, math.MaxUint32))
+	case "int64":
+		bits = uint64(int64(clamp(math.MinInt64, math.MaxInt64)))
+	case "uint64":
+		bits = uint64(clamp(0, math.MaxUint64))
+	case "float32":
+		bits = uint64(math.Float32bits(float32(x)))
+	case "float64":
+		bits = math.Float64bits(x)
+	}
+	return v.words16(bits), true
+}
+
+// words16 splits the low words of bits into registers in the word order.
+func (v *modbusValue) words16(bits uint64) []uint16 {
+	words := make([]uint16, v.words)
+	for i := range words {
+		words[i] = uint16(bits >> (16 * (v.words - 1 - i)))
+	}
+	if v.reg.WordOrder == "low" {
+		for i, j := 0, len(words)-1; i < j; i, j = i+1, j-1 {
+			words[i], words[j] = words[j], words[i]
+		}
+	}
+	return words
+}
+
+// tagText decodes registers written by a client into the text EncodeValue
+// takes for the tag.
+func (v *modbusValue) tagText(words []uint16) string {
+	ordered := append([]uint16(nil), words...)
+	if v.reg.WordOrder == "low" {
+		for i, j := 0, len(ordered)-1; i < j; i, j = i+1, j-1 {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		}
+	}
+	var bits uint64
+	for _, w := range ordered {
+		bits = bits<<16 | uint64(w)
+	}
+	var x float64
+	switch v.typ {
+	case "int16":
+		x = float64(int16(bits))
+	case "uint16":
+		x = float64(uint16(bits))
+	case "int32":
+		x = float64(int32(bits))
+	case "uint32":
+		x = float64(uint32(bits))
+	case "int64":
+		if v.reg.Scale == 1 && v.reg.Offset == 0 && v.tag.Addr.Type != TypeReal && v.tag.Addr.Type != TypeLReal {
+			return strconv.FormatInt(int64(bits), 10)
+		}
+		x = float64(int64(bits))
+	case "uint64":
+		if v.reg.Scale == 1 && v.reg.Offset == 0 && v.tag.Addr.Type != TypeReal && v.tag.Addr.Type != TypeLReal {
+			return strconv.FormatUint(bits, 10)
+		}
+		x = float64(bits)
+	case "float32":
+		x = float64(math.Float32frombits(uint32(bits)))
+	case "float64":
+		x = math.Float64frombits(bits)
+	}
+	x = (x - v.reg.Offset) / v.reg.Scale
+	switch v.tag.Addr.Type {
+	case TypeBool:
+		return strconv.FormatBool(x != 0)
+	case TypeReal:
+		return strconv.FormatFloat(x, 'g', -1, 32)
+	case TypeLReal:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	}
+	return strconv.FormatFloat(math.Round(x), 'f', 0, 64)
+}
+
+// modbusEntry is one register or coil of a value.
+type modbusEntry struct {
+	value *modbusValue
+	index int // Register of the value, 0 for the first
+}
+
+// ModbusMap is the register layout the Modbus server serves.
+type ModbusMap struct {
+	unitID int
+	tables map[string]map[int]modbusEntry
+}
+
+// NewModbusMap resolves the registers of cfg against tags.
+func NewModbusMap(cfg ModbusConfig, tags []Tag) (*ModbusMap, error) {
+	byName := make(map[string]Tag, len(tags))
+	for _, tag := range tags {
+		byName[tag.Name] = tag
+	}
+	m := &ModbusMap{unitID: cfg.UnitID, tables: map[string]map[int]modbusEntry{
+		ModbusHolding: {}, ModbusInput: {}, ModbusCoil: {}, ModbusDiscrete: {},
+	}}
+	for i, r := range cfg.Registers {
+		v, err := newModbusValue(r, byName)
+		if err != nil {
+			return nil, fmt.Errorf("Modbus.Registers[%d]: %w", i, err)
+		}
+		table := m.tables[r.Table]
+		for j := 0; j < max(v.words, 1); j++ {
+			if other, ok := table[r.Address+j]; ok {
+				return nil, fmt.Errorf("Modbus.Registers[%d]: %s %d is also used by %s", i, r.Table, r.Address+j, other.value.reg.Tag)
+			}
+			table[r.Address+j] = modbusEntry{v, j}
+		}
+	}
+	return m, nil
+}
+
+// Modbus function codes.
+const (
+	fcReadCoils          = 0x01
+	fcReadDiscreteInputs = 0x02
+	fcReadHolding        = 0x03
+	fcReadInput          = 0x04
+	fcWriteCoil          = 0x05
+	fcWriteRegister      = 0x06
+	fcWriteCoils         = 0x0F
+	fcWriteRegisters     = 0x10
+)
+
+// Modbus exception codes.
+const (
+	exIllegalFunction    = 0x01
+	exIllegalAddress     = 0x02
+	exIllegalValue       = 0x03
+	exServerDeviceFailed = 0x04
+)
+
+// modbusException is an error answered with an exception code.
+type modbusException byte
+
+func (e modbusException) Error() string { return fmt.Sprintf("Modbus exception %d", byte(e)) }
+
+// ModbusServer answers Modbus TCP requests from the values in a
+// ValueCache. Reads that include a tag without a good value fail with
+// exception 4, so clients do not mistake a stale zero for a reading.
+// Registers not mapped to a tag read as 0.
+type ModbusServer struct {
+	cache *ValueCache
+	write func(tag Tag, data []byte) error
+	m     atomic.Pointer[ModbusMap]
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+// NewModbusServer returns a server for the values in cache that writes
+// tags with write.
+func NewModbusServer(cache *ValueCache, m *ModbusMap, write func(tag Tag, data []byte) error) *ModbusServer {
+	s := &ModbusServer{cache: cache, write: write, conns: map[net.Conn]bool{}}
+	s.m.Store(m)
+	return s
+}
+
+// SetMap replaces the register layout, e.g. after a reload. With nil every
+// request is answered with exception 2.
+func (s *ModbusServer) SetMap(m *ModbusMap) {
+	s.m.Store(m)
+}
+
+// ListenAndServe listens on addr and serves connections until Close.
+func (s *ModbusServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+// Close stops listening, closes the connections and waits for requests in
+// progress.
+func (s *ModbusServer) Close() error {
+	s.mu.Lock()
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// modbusIdleTimeout closes connections of clients that stopped asking.
+const modbusIdleTimeout = 5 * time.Minute
+
+func (s *ModbusServer) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	Debugf("Modbus: %s connected", conn.RemoteAddr())
+	header := make([]byte, 7)
+	for {
+		conn.SetReadDeadline(time.Now().Add(modbusIdleTimeout))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				Debugf("Modbus: %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		if binary.BigEndian.Uint16(header[2:]) != 0 || length < 2 || length > 254 {
+			Warnf("Modbus: %s sent an invalid frame, closing the connection", conn.RemoteAddr())
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+		m := s.m.Load()
+		unit := header[6]
+		if m != nil && m.unitID != 0 && int(unit) != m.unitID {
+			continue // Another unit behind a gateway; not ours to answer
+		}
+		resp := s.handle(m, pdu)
+		frame := make([]byte, 7, 7+len(resp))
+		copy(frame, header[:4])
+		binary.BigEndian.PutUint16(frame[4:], uint16(len(resp)+1))
+		frame[6] = unit
+		if _, err := conn.Write(append(frame, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers one request PDU.
+func (s *ModbusServer) handle(m *ModbusMap, pdu []byte) []byte {
+	fc := pdu[0]
+	resp, err := s.respond(m, fc, pdu[1:])
+	if err != nil {
+		code := byte(exServerDeviceFailed)
+		var ex modbusException
+		if errors.As(err, &ex) {
+			code = byte(ex)
+		} else {
+			Errorf("Modbus: %v", err)
+		}
+		return []byte{fc | 0x80, code}
+	}
+	return append([]byte{fc}, resp...)
+}
+
+func (s *ModbusServer) respond(m *ModbusMap, fc byte, data []byte) ([]byte, error) {
+	switch fc {
+	case fcReadCoils, fcReadDiscreteInputs, fcReadHolding, fcReadInput,
+		fcWriteCoil, fcWriteRegister, fcWriteCoils, fcWriteRegisters:
+	default:
+		return nil, modbusException(exIllegalFunction)
+	}
+	if m == nil {
+		return nil, modbusException(exIllegalAddress)
+	}
+	if len(data) < 4 {
+		return nil, modbusException(exIllegalValue)
+	}
+	start := int(binary.BigEndian.Uint16(data))
+	arg := binary.BigEndian.Uint16(data[2:])
+	switch fc {
+	case fcReadCoils, fcReadDiscreteInputs:
+		table := ModbusCoil
+		if fc == fcReadDiscreteInputs {
+			table = ModbusDiscrete
+		}
+		return s.readBits(m.tables[table], start, int(arg))
+	case fcReadHolding, fcReadInput:
+		table := ModbusHolding
+		if fc == fcReadInput {
+			table = ModbusInput
+		}
+		return s.readRegisters(m.tables[table], start, int(arg))
+	case fcWriteCoil:
+		if arg != 0xFF00 && arg != 0x0000 {
+			return nil, modbusException(exIllegalValue)
+		}
+		if err := s.writeBits(m.tables[ModbusCoil], start, []bool{arg == 0xFF00}); err != nil {
+			return nil, err
+		}
+		return data[:4], nil
+	case fcWriteRegister:
+		if err := s.writeRegisters(m.tables[ModbusHolding], start, []uint16{arg}); err != nil {
+			return nil, err
+		}
+		return data[:4], nil
+	case fcWriteCoils:
+		count := int(arg)
+		if count < 1 || count > 1968 || len(data) < 5 || int(data[4]) != (count+7)/8 || len(data) < 5+int(data[4]) {
+			return nil, modbusException(exIllegalValue)
+		}
+		bits := make([]bool, count)
+		for i := range bits {
+			bits[i] = data[5+i/8]&(1<<(i%8)) != 0
+		}
+		if err := s.writeBits(m.tables[ModbusCoil], start, bits); err != nil {
+			return nil, err
+		}
+		return data[:4], nil
+	default: // fcWriteRegisters
+		count := int(arg)
+		if count < 1 || count > 123 || len(data) < 5 || int(data[4]) != 2*count || len(data) < 5+2*count {
+			return nil, modbusException(exIllegalValue)
+		}
+		words := make([]uint16, count)
+		for i := range words {
+			words[i] = binary.BigEndian.Uint16(data[5+2*i:])
+		}
+		if err := s.writeRegisters(m.tables[ModbusHolding], start, words); err != nil {
+			return nil, err
+		}
+		return data[:4], nil
+	}
+}
+
+// goodValue returns the cached value of a tag when its quality is good.
+func (s *ModbusServer) goodValue(v *modbusValue) (interface{}, error) {
+	cached, ok := s.cache.Get(v.tag.Name)
+	if !ok || cached.Quality != QualityGood {
+		return nil, fmt.Errorf("%w: tag %s has no good value", modbusException(exServerDeviceFailed), v.tag.Name)
+	}
+	return cached.Value, nil
+}
+
+func (s *ModbusServer) readBits(table map[int]modbusEntry, start, count int) ([]byte, error) {
+	if count < 1 || count > 2000 {
+		return nil, modbusException(exIllegalValue)
+	}
+	if start+count > 65536 {
+		return nil, modbusException(exIllegalAddress)
+	}
+	resp := make([]byte, 1+(count+7)/8)
+	resp[0] = byte(len(resp) - 1)
+	for i := 0; i < count; i++ {
+		entry, ok := table[start+i]
+		if !ok {
+			continue
+		}
+		value, err := s.goodValue(entry.value)
+		if err != nil {
+			return nil, err
+		}
+		if on, _ := value.(bool); on {
+			resp[1+i/8] |= 1 << (i % 8)
+		}
+	}
+	return resp, nil
+}
+
+func (s *ModbusServer) readRegisters(table map[int]modbusEntry, start, count int) ([]byte, error) {
+	if count < 1 || count > 125 {
+		return nil, modbusException(exIllegalValue)
+	}
+	if start+count > 65536 {
+		return nil, modbusException(exIllegalAddress)
+	}
+	resp := make([]byte, 1+2*count)
+	resp[0] = byte(2 * count)
+	encoded := map[*modbusValue][]uint16{}
+	for i := 0; i < count; i++ {
+		entry, ok := table[start+i]
+		if !ok {
+			continue
+		}
+		words, ok := encoded[entry.value]
+		if !ok {
+			value, err := s.goodValue(entry.value)
+			if err != nil {
+				return nil, err
+			}
+			if words, ok = entry.value.registers(value); !ok {
+				return nil, fmt.Errorf("tag %s: cannot encode %v as %s", entry.value.tag.Name, value, entry.value.typ)
+			}
+			encoded[entry.value] = words
+		}
+		binary.BigEndian.PutUint16(resp[1+2*i:], words[entry.index])
+	}
+	return resp, nil
+}
+
+func (s *ModbusServer) writeBits(table map[int]modbusEntry, start int, bits []bool) error {
+	for i := range bits {
+		if entry, ok := table[start+i]; !ok || !entry.value.reg.Writable {
+			return modbusException(exIllegalAddress)
+		}
+	}
+	for i, on := range bits {
+		v := table[start+i].value
+		if err := s.writeTag(v, strconv.FormatBool(on)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRegisters writes the values whose registers are all in words.
+// Writing part of a value fails with exception 2.
+func (s *ModbusServer) writeRegisters(table map[int]modbusEntry, start int, words []uint16) error {
+	for i := 0; i < len(words); {
+		entry, ok := table[start+i]
+		if !ok || !entry.value.reg.Writable || entry.index != 0 || i+entry.value.words > len(words) {
+			return modbusException(exIllegalAddress)
+		}
+		i += entry.value.words
+	}
+	for i := 0; i < len(words); {
+		v := table[start+i].value
+		if err := s.writeTag(v, v.tagText(words[i:i+v.words])); err != nil {
+			return err
+		}
+		i += v.words
+	}
+	return nil
+}
+
+func (s *ModbusServer) writeTag(v *modbusValue, text string) error {
+	data, err := EncodeValue(v.tag.Addr, text)
+	if err != nil {
+		return fmt.Errorf("%w: %v", modbusException(exIllegalValue), err)
+	}
+	if err := s.write(v.tag, data); err != nil {
+		return fmt.Errorf("writing %s: %w", v.tag.Name, err)
+	}
+	Infof("Modbus: wrote %s to %s (%s)", text, v.tag.Name, v.tag.Addr)
+	return nil
+}
@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// modbusTestTag returns a tag at address, which may be written when
+// writable is set.
+func modbusTestTag(t *testing.T, name, address string, writable bool) Tag {
+	t.Helper()
+	addr, err := ParseAddress(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Tag{TagConfig: TagConfig{Name: name, Address: address, Writable: writable}, Addr: addr}
+}
+
+// modbusRead returns the PDU of a read of count registers or bits at start.
+func modbusRead(fc byte, start, count uint16) []byte {
+	return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16([]byte{fc}, start), count)
+}
+
+func TestModbusRegisters(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		reg     ModbusRegister
+		value   interface{}
+		want    []uint16
+	}{
+		{"REAL", "DB1.DBD0:REAL", ModbusRegister{}, float32(1.5), []uint16{0x3FC0, 0x0000}},
+		{"REAL low word first", "DB1.DBD0:REAL", ModbusRegister{WordOrder: "low"}, float32(1.5), []uint16{0x0000, 0x3FC0}},
+		{"INT", "DB1.DBW0:INT", ModbusRegister{}, int16(-2), []uint16{0xFFFE}},
+		{"DINT", "DB1.DBD0:DINT", ModbusRegister{}, int32(70000), []uint16{0x0001, 0x1170}},
+		{"scaled", "DB1.DBD0:REAL", ModbusRegister{Type: "int16", Scale: 10, Offset: 1}, float32(21.37), []uint16{215}},
+		{"clamped", "DB1.DBW0:INT", ModbusRegister{Type: "uint16"}, int16(-5), []uint16{0}},
+		{"clamped high", "DB1.DBD0:DINT", ModbusRegister{Type: "int16"}, int32(40000), []uint16{0x7FFF}},
+		{"TIME in ms", "DB1.DBD0:TIME", ModbusRegister{}, 1500 * time.Millisecond, []uint16{0, 1500}},
+		{"BOOL", "DB1.DBX0.0", ModbusRegister{}, true, []uint16{1}},
+		{"LINT exact", "DB1.DBB0:LINT", ModbusRegister{}, int64(math.MaxInt64 - 1), []uint16{0x7FFF, 0xFFFF, 0xFFFF, 0xFFFE}},
+		{"LREAL", "DB1.DBB0:LREAL", ModbusRegister{Type: "float64"}, 2.0, []uint16{0x4000, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		tag := modbusTestTag(t, "T", tt.address, false)
+		cfg := ModbusConfig{Registers: []ModbusRegister{tt.reg}}
+		cfg.Registers[0].Tag, cfg.Registers[0].Address = "T", 100
+		cfg.applyDefaults()
+		m, err := NewModbusMap(cfg, []Tag{tag})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		cache := NewValueCache()
+		cache.Update([]TagValue{{Name: "T", Value: tt.value, Quality: QualityGood}})
+		s := NewModbusServer(cache, m, nil)
+
+		// One register before and after the value reads as 0.
+		resp := s.handle(m, modbusRead(fcReadHolding, 99, uint16(len(tt.want)+2)))
+		want := []byte{fcReadHolding, byte(2 * (len(tt.want) + 2)), 0, 0}
+		for _, w := range append(tt.want, 0) {
+			want = binary.BigEndian.AppendUint16(want, w)
+		}
+		if !bytes.Equal(resp, want) {
+			t.Errorf("%s: read % X, want % X", tt.name, resp, want)
+		}
+	}
+}
+
+func TestModbusRequests(t *testing.T) {
+	tags := []Tag{
+		modbusTestTag(t, "Setpoint", "DB1.DBD0:REAL", true),
+		modbusTestTag(t, "Speed", "DB1.DBD4:REAL", false),
+		modbusTestTag(t, "Pump", "DB1.DBX8.0", true),
+		modbusTestTag(t, "Alarm", "DB1.DBX8.1", false),
+		modbusTestTag(t, "Level", "DB1.DBW10:INT", false),
+	}
+	cfg := ModbusConfig{Registers: []ModbusRegister{
+		{Tag: "Setpoint", Address: 0, Type: "int16", Scale: 10, Writable: true},
+		{Tag: "Speed", Address: 1},
+		{Tag: "Pump", Table: ModbusCoil, Address: 0, Writable: true},
+		{Tag: "Alarm", Table: ModbusDiscrete, Address: 3},
+		{Tag: "Level", Table: ModbusInput, Address: 0},
+	}}
+	cfg.applyDefaults()
+	m, err := NewModbusMap(cfg, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewValueCache()
+	cache.Update([]TagValue{
+		{Name: "Setpoint", Value: float32(12.5), Quality: QualityGood},
+		{Name: "Speed", Value: float32(0), Quality: QualityBad},
+		{Name: "Pump", Value: true, Quality: QualityGood},
+		{Name: "Alarm", Value: true, Quality: QualityGood},
+		{Name: "Level", Value: int16(42), Quality: QualityGood},
+	})
+	written := map[string][]byte{}
+	s := NewModbusServer(cache, m, func(tag Tag, data []byte) error {
+		if tag.Name == "Pump" && data[0] == 0 {
+			return errors.New("CPU : Address out of range")
+		}
+		written[tag.Name] = data
+		return nil
+	})
+
+	tests := []struct {
+		name string
+		pdu  []byte
+		want []byte
+	}{
+		{"read scaled", modbusRead(fcReadHolding, 0, 1), []byte{0x03, 2, 0, 125}},
+		{"read bad value", modbusRead(fcReadHolding, 0, 3), []byte{0x83, exServerDeviceFailed}},
+		{"read unmapped", modbusRead(fcReadHolding, 10, 2), []byte{0x03, 4, 0, 0, 0, 0}},
+		{"read input", modbusRead(fcReadInput, 0, 1), []byte{0x04, 2, 0, 42}},
+		{"read coils", modbusRead(fcReadCoils, 0, 9), []byte{0x01, 2, 0x01, 0}},
+		{"read discrete", modbusRead(fcReadDiscreteInputs, 0, 4), []byte{0x02, 1, 0x08}},
+		{"read none", modbusRead(fcReadHolding, 0, 0), []byte{0x83, exIllegalValue}},
+		{"read past the end", modbusRead(fcReadHolding, 65535, 2), []byte{0x83, exIllegalAddress}},
+		{"unknown function", modbusRead(0x2B, 0, 1), []byte{0xAB, exIllegalFunction}},
+		{"short request", []byte{fcReadHolding, 0}, []byte{0x83, exIllegalValue}},
+		{"write register", []byte{fcWriteRegister, 0, 0, 0x01, 0x00}, []byte{fcWriteRegister, 0, 0, 0x01, 0x00}},
+		{"write read-only register", []byte{fcWriteRegister, 0, 1, 0, 1}, []byte{0x86, exIllegalAddress}},
+		{"write half a value", append(modbusRead(fcWriteRegisters, 0, 2), 4, 0, 1, 0, 2), []byte{0x90, exIllegalAddress}},
+		{"write coil", []byte{fcWriteCoil, 0, 0, 0xFF, 0x00}, []byte{fcWriteCoil, 0, 0, 0xFF, 0x00}},
+		{"write coil bad value", []byte{fcWriteCoil, 0, 0, 0x12, 0x34}, []byte{0x85, exIllegalValue}},
+		{"write coil failing", []byte{fcWriteCoil, 0, 0, 0, 0}, []byte{0x85, exServerDeviceFailed}},
+		{"write discrete input", []byte{fcWriteCoil, 0, 3, 0xFF, 0x00}, []byte{0x85, exIllegalAddress}},
+	}
+	for _, tt := range tests {
+		if got := s.handle(m, tt.pdu); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: % X, want % X", tt.name, got, tt.want)
+		}
+	}
+	// 256 in the register is 25.6 with Scale 10.
+	setpoint := binary.BigEndian.AppendUint32(nil, math.Float32bits(25.6))
+	if !bytes.Equal(written["Setpoint"], setpoint) || !bytes.Equal(written["Pump"], []byte{1}) || len(written) != 2 {
+		t.Errorf("wrote %v, want Setpoint % X and Pump 01", written, setpoint)
+	}
+}
+
+func TestNewModbusMapErrors(t *testing.T) {
+	tags := []Tag{
+		modbusTestTag(t, "Speed", "DB1.DBD0:REAL", false),
+		modbusTestTag(t, "Pump", "DB1.DBX8.0", true),
+		modbusTestTag(t, "Recipe", "DB1.DBB10:STRING[20]", true),
+	}
+	tests := []struct {
+		name string
+		regs []ModbusRegister
+		want string // Part of the error
+	}{
+		{"unknown tag", []ModbusRegister{{Tag: "Level"}}, `unknown tag "Level"`},
+		{"overlap", []ModbusRegister{{Tag: "Speed", Address: 0}, {Tag: "Pump", Address: 1}}, "holding 1 is also used by Speed"},
+		{"coil of a REAL", []ModbusRegister{{Tag: "Speed", Table: ModbusCoil}}, "needs a BOOL tag"},
+		{"STRING", []ModbusRegister{{Tag: "Recipe"}}, "cannot be mapped to registers"},
+		{"bad type", []ModbusRegister{{Tag: "Speed", Type: "float16"}}, `found "float16"`},
+		{"past the end", []ModbusRegister{{Tag: "Speed", Address: 65535}}, "Address must be 0..65535"},
+		{"writable input", []ModbusRegister{{Tag: "Pump", Table: ModbusDiscrete, Writable: true}}, "cannot write to the discrete table"},
+		{"writable read-only tag", []ModbusRegister{{Tag: "Speed", Writable: true}}, "must be Writable"},
+	}
+	for _, tt := range tests {
+		cfg := ModbusConfig{Registers: tt.regs}
+		cfg.applyDefaults()
+		_, err := NewModbusMap(cfg, tags)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error with %q", tt.name, err, tt.want)
+		}
+	}
+}
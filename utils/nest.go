@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"strings"
+)
+
+// Layouts of tag values in JSON output.
+const (
+	LayoutFlat   = "flat"   // One key per tag, e.g. "Motors[3].Current"
+	LayoutNested = "nested" // Objects and arrays following the tag names
+)
+
+// nestNode is a level of the tree built from hierarchical tag names.
+type nestNode struct {
+	keys     []string
+	children map[string]*nestNode
+	array    bool // All children were added by an index, e.g. [3]
+	value    interface{}
+}
+
+func (n *nestNode) child(key string, index bool) *nestNode {
+	if n.children == nil {
+		n.children = map[string]*nestNode{}
+		n.array = index
+	}
+	n.array = n.array && index
+	c, ok := n.children[key]
+	if !ok {
+		c = &nestNode{}
+		n.children[key] = c
+		n.keys = append(n.keys, key)
+	}
+	return c
+}
+
+func (n *nestNode) render() interface{} {
+	if n.children == nil {
+		return n.value
+	}
+	if n.array {
+		list := make([]interface{}, len(n.keys))
+		for i, key := range n.keys {
+			list[i] = n.children[key].render()
+		}
+		return list
+	}
+	obj := make(map[string]interface{}, len(n.keys))
+	for _, key := range n.keys {
+		obj[key] = n.children[key].render()
+	}
+	return obj
+}
+
+// splitTagName splits a tag name such as Line.Motors[3].Grid[0,1] into its
+// members and array indexes. Indexes are reported with index set.
+func splitTagName(name string) (parts []string, index []bool) {
+	for _, member := range strings.Split(name, ".") {
+		base, rest, _ := strings.Cut(member, "[")
+		if base != "" {
+			parts, index = append(parts, base), append(index, false)
+		}
+		for rest != "" {
+			var group string
+			group, rest, _ = strings.Cut(rest, "]")
+			for _, i := range strings.Split(group, ",") {
+				parts, index = append(parts, strings.TrimSpace(i)), append(index, true)
+			}
+			rest = strings.TrimPrefix(rest, "[")
+		}
+	}
+	return parts, index
+}
+
+// NestValues arranges values by their hierarchical tag names, so that
+// Motors[1].Speed and Motors[2].Speed become {"Motors": [{"Speed": ...},
+// {"Speed": ...}]}. Array elements keep the order in which the tags were
+// configured, which for expanded tags is the index order starting at the
+// lower bound. leaf converts each value for output.
+func NestValues(values []TagValue, leaf func(TagValue) interface{}) map[string]interface{} {
+	root := &nestNode{}
+	for _, v := range values {
+		node := root
+		parts, index := splitTagName(v.Name)
+		for i, part := range parts {
+			node = node.child(part, index[i])
+		}
+		node.value = leaf(v)
+	}
+	if obj, ok := root.render().(map[string]interface{}); ok {
+		return obj
+	}
+	return map[string]interface{}{}
+}
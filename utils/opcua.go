@@ -0,0 +1,1002 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OPCUAConfig makes the collector an OPC UA server that publishes the tags
+// from the value cache. It speaks the binary protocol with security policy
+// None; clients log in anonymously, read-only unless AnonymousWrite is set,
+// or with a WebUsers name and password. Operators and admins may write tags
+// marked Writable.
+type OPCUAConfig struct {
+	Listen         string `json:"Listen"`         // Address to listen on, defaults to :4840
+	Endpoint       string `json:"Endpoint"`       // URL announced to clients, defaults to opc.tcp://<host name>:<port>
+	AnonymousWrite bool   `json:"AnonymousWrite"` // Lets anonymous clients write Writable tags, as operators
+}
+
+// AnonymousRole returns the role of clients that log in anonymously: viewer,
+// or operator with AnonymousWrite.
+func (o *OPCUAConfig) AnonymousRole() string {
+	if o != nil && o.AnonymousWrite {
+		return RoleOperator
+	}
+	return RoleViewer
+}
+
+// applyDefaults fills in the optional fields of o.
+func (o *OPCUAConfig) applyDefaults() {
+	if o.Listen == "" {
+		o.Listen = ":4840"
+	}
+	if o.Endpoint == "" {
+		host, _ := os.Hostname()
+		if host == "" {
+			host = "localhost"
+		}
+		_, port, _ := net.SplitHostPort(o.Listen)
+		o.Endpoint = "opc.tcp://" + net.JoinHostPort(host, port)
+	}
+}
+
+// validate checks the fields of o, reporting problems under path.
+func (o *OPCUAConfig) validate(path string, errs *ConfigErrors) {
+	if _, _, err := net.SplitHostPort(o.Listen); err != nil {
+		errs.add(path+".Listen", "must be host:port or :port, found %q", o.Listen)
+	}
+	if !strings.HasPrefix(o.Endpoint, "opc.tcp://") {
+		errs.add(path+".Endpoint", "must start with opc.tcp://, found %q", o.Endpoint)
+	}
+}
+
+// OPC UA transport limits of the server.
+const (
+	uaBufferSize     = 65536
+	uaMinBufferSize  = 8192
+	uaMaxMessageSize = 16 << 20
+	uaMaxSessions    = 50
+	uaSecurityNone   = "http://opcfoundation.org/UA/SecurityPolicy#None"
+	uaTransportTCP   = "http://opcfoundation.org/UA-Profile/Transport/uatcp-uasc-uabinary"
+	uaIdleTimeout    = 10 * time.Minute
+)
+
+// Binary encoding ids of the services and structures the server decodes
+// or encodes (OPC 10000-6, NodeIds.csv).
+const (
+	uaServiceFault                = 397
+	uaFindServersRequest          = 422
+	uaFindServersResponse         = 425
+	uaGetEndpointsRequest         = 428
+	uaGetEndpointsResponse        = 431
+	uaOpenSecureChannelRequest    = 446
+	uaOpenSecureChannelResponse   = 449
+	uaCloseSecureChannelRequest   = 452
+	uaCreateSessionRequest        = 461
+	uaCreateSessionResponse       = 464
+	uaActivateSessionRequest      = 467
+	uaActivateSessionResponse     = 470
+	uaCloseSessionRequest         = 473
+	uaCloseSessionResponse        = 476
+	uaBrowseRequest               = 527
+	uaBrowseResponse              = 530
+	uaBrowseNextRequest           = 533
+	uaBrowseNextResponse          = 536
+	uaRegisterNodesRequest        = 560
+	uaRegisterNodesResponse       = 563
+	uaUnregisterNodesRequest      = 566
+	uaUnregisterNodesResponse     = 569
+	uaReadRequest                 = 631
+	uaReadResponse                = 634
+	uaWriteRequest                = 673
+	uaWriteResponse               = 676
+	uaCreateMonitoredItemsRequest = 751
+	uaCreateMonitoredItemsResp    = 754
+	uaModifyMonitoredItemsRequest = 763
+	uaModifyMonitoredItemsResp    = 766
+	uaSetMonitoringModeRequest    = 769
+	uaSetMonitoringModeResponse   = 772
+	uaDeleteMonitoredItemsRequest = 781
+	uaDeleteMonitoredItemsResp    = 784
+	uaCreateSubscriptionRequest   = 787
+	uaCreateSubscriptionResponse  = 790
+	uaModifySubscriptionRequest   = 793
+	uaModifySubscriptionResponse  = 796
+	uaSetPublishingModeRequest    = 799
+	uaSetPublishingModeResponse   = 802
+	uaPublishRequest              = 826
+	uaPublishResponse             = 829
+	uaRepublishRequest            = 832
+	uaRepublishResponse           = 835
+	uaDeleteSubscriptionsRequest  = 847
+	uaDeleteSubscriptionsResponse = 850
+	uaAnonymousIdentityToken      = 321
+	uaUserNameIdentityToken       = 324
+)
+
+// User token types of a UserTokenPolicy.
+const (
+	uaTokenAnonymous = 0
+	uaTokenUserName  = 1
+)
+
+// OPCUAServer serves an OPCUAAddressSpace to OPC UA clients, with the
+// values of its variables from a ValueCache. Variables whose tag has no
+// good value carry a bad status code rather than a stale value.
+type OPCUAServer struct {
+	cache    *ValueCache
+	cfg      OPCUAConfig
+	sampling time.Duration
+	login    func(user, password string) (string, bool)
+	write    func(tag Tag, data []byte) error
+	space    atomic.Pointer[OPCUAAddressSpace]
+	started  time.Time
+	appURI   string
+
+	mu        sync.Mutex
+	listener  net.Listener
+	channels  map[*uaChannel]bool
+	sessions  map[string]*uaSession // By authentication token
+	lastID    uint32                // Last channel, session, subscription or item id issued
+	wg        sync.WaitGroup
+	stopTicks chan struct{}
+}
+
+// NewOPCUAServer returns a server for the values in cache, which is
+// updated every sampling interval. login checks the user name and
+// password a client activates its session with and returns the role of the
+// user; anonymous clients call it with an empty user name. Writable tags
+// are written with write.
+func NewOPCUAServer(cache *ValueCache, space *OPCUAAddressSpace, cfg OPCUAConfig, sampling time.Duration, login func(user, password string) (string, bool), write func(tag Tag, data []byte) error) *OPCUAServer {
+	host, _ := os.Hostname()
+	s := &OPCUAServer{
+		cache:     cache,
+		cfg:       cfg,
+		sampling:  sampling,
+		login:     login,
+		write:     write,
+		started:   time.Now(),
+		appURI:    "urn:" + host + ":s7_plc_read",
+		channels:  map[*uaChannel]bool{},
+		sessions:  map[string]*uaSession{},
+		stopTicks: make(chan struct{}),
+	}
+	s.space.Store(space)
+	return s
+}
+
+// SetAddressSpace replaces the published nodes, e.g. after a reload.
+// Monitored items of removed nodes report BadNodeIdUnknown.
+func (s *OPCUAServer) SetAddressSpace(space *OPCUAAddressSpace) {
+	s.space.Store(space)
+}
+
+// ListenAndServe listens on addr and serves connections until Close.
+func (s *OPCUAServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+	s.wg.Add(1)
+	go s.tick()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		c := &uaChannel{server: s, conn: conn, sendSize: uaBufferSize, seq: 1}
+		s.mu.Lock()
+		s.channels[c] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go c.serve()
+	}
+}
+
+// Close stops listening, closes the connections and sessions and waits for
+// requests in progress.
+func (s *OPCUAServer) Close() error {
+	s.mu.Lock()
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+		close(s.stopTicks)
+	}
+	for c := range s.channels {
+		c.conn.Close()
+	}
+	s.sessions = map[string]*uaSession{}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// nextID returns a new id for a channel, session, subscription or
+// monitored item. Called with s.mu held.
+func (s *OPCUAServer) nextID() uint32 {
+	s.lastID++
+	return s.lastID
+}
+
+// tick drives the subscriptions and expires idle sessions.
+func (s *OPCUAServer) tick() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(uaTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopTicks:
+			return
+		case now := <-ticker.C:
+			var out []uaOutgoing
+			s.mu.Lock()
+			for token, session := range s.sessions {
+				if now.Sub(session.lastSeen) > session.timeout {
+					Infof("OPC UA: session %q timed out", session.name)
+					out = append(out, session.close()...)
+					delete(s.sessions, token)
+					continue
+				}
+				for _, sub := range session.subs {
+					out = append(out, sub.cycle(now)...)
+				}
+			}
+			s.mu.Unlock()
+			for _, o := range out {
+				o.send()
+			}
+		}
+	}
+}
+
+// uaChannel is a client connection with its secure channel.
+type uaChannel struct {
+	server   *OPCUAServer
+	conn     net.Conn
+	id       uint32 // Secure channel id, 0 until opened
+	tokenID  uint32
+	sendSize int // Largest chunk the client accepts
+	maxSize  int // Largest message the client accepts, 0 for no limit
+
+	wmu sync.Mutex
+	seq uint32
+}
+
+func (c *uaChannel) serve() {
+	s := c.server
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.channels, c)
+		for _, session := range s.sessions {
+			session.dropChannel(c)
+		}
+		s.mu.Unlock()
+		c.conn.Close()
+	}()
+	Debugf("OPC UA: %s connected", c.conn.RemoteAddr())
+
+	var partial []byte // Body of the chunks of a message received so far
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(uaIdleTimeout))
+		msgType, chunk, body, err := c.readChunk()
+		var status uaStatus
+		switch {
+		case errors.As(err, &status):
+			c.fail(status)
+			return
+		case err != nil:
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				Debugf("OPC UA: %s: %v", c.conn.RemoteAddr(), err)
+			}
+			return
+		}
+		switch msgType {
+		case "HEL":
+			if err := c.hello(body); err != nil {
+				c.fail(err)
+				return
+			}
+			continue
+		case "OPN", "MSG", "CLO":
+		default:
+			c.fail(uaBadTCPMessageTypeInvalid)
+			return
+		}
+
+		d := &uaDecoder{b: body}
+		if channelID := d.uint32(); msgType != "OPN" && channelID != c.id {
+			c.fail(uaBadTCPSecureChannelUnknown)
+			return
+		}
+		if msgType == "OPN" {
+			if policy := d.string(); policy != uaSecurityNone {
+				c.fail(uaBadSecurityPolicyRejected)
+				return
+			}
+			d.bytes() // Sender certificate
+			d.bytes() // Receiver certificate thumbprint
+		} else {
+			d.uint32() // Token id
+		}
+		d.uint32() // Sequence number
+		requestID := d.uint32()
+		if d.err != nil {
+			c.fail(uaBadDecodingError)
+			return
+		}
+
+		switch chunk {
+		case 'A':
+			partial = nil
+			continue
+		case 'C':
+			if len(partial)+len(d.b) > uaMaxMessageSize {
+				c.fail(uaBadTCPMessageTooLarge)
+				return
+			}
+			partial = append(partial, d.b...)
+			continue
+		}
+		msg := d.b
+		if partial != nil {
+			msg = append(partial, d.b...)
+			partial = nil
+		}
+
+		switch msgType {
+		case "OPN":
+			if err := c.open(requestID, msg); err != nil {
+				c.fail(err)
+				return
+			}
+		case "CLO":
+			return
+		default:
+			s.dispatch(c, requestID, msg)
+		}
+	}
+}
+
+// readChunk reads one message chunk and returns its type, its chunk type
+// (F, C or A) and the rest of the chunk after the header.
+func (c *uaChannel) readChunk() (string, byte, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return "", 0, nil, err
+	}
+	size := int(binary.LittleEndian.Uint32(header[4:]))
+	if size < 8 || size > uaBufferSize {
+		return "", 0, nil, uaBadTCPMessageTooLarge
+	}
+	body := make([]byte, size-8)
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		return "", 0, nil, err
+	}
+	return string(header[:3]), header[3], body, nil
+}
+
+// hello answers the Hello message of the client with the buffer sizes both
+// sides use.
+func (c *uaChannel) hello(body []byte) error {
+	d := &uaDecoder{b: body}
+	d.uint32() // Protocol version, only 0 exists
+	receive := int(d.uint32())
+	send := int(d.uint32())
+	maxSize := int(d.uint32())
+	d.uint32() // Max chunk count
+	endpoint := d.string()
+	if d.err != nil {
+		return uaBadDecodingError
+	}
+	if receive < uaMinBufferSize || send < uaMinBufferSize {
+		return uaBadTCPMessageTooLarge
+	}
+	c.sendSize = min(receive, uaBufferSize)
+	c.maxSize = maxSize
+	Debugf("OPC UA: %s says hello to %s", c.conn.RemoteAddr(), endpoint)
+
+	e := &uaEncoder{}
+	e.uint32(0)
+	e.uint32(uaBufferSize)
+	e.uint32(uint32(c.sendSize))
+	e.uint32(uaMaxMessageSize)
+	e.uint32(0)
+	return c.write("ACKF", e.b)
+}
+
+// fail sends an Error message with the status of err before the
+// connection is closed.
+func (c *uaChannel) fail(err error) {
+	status := uaBadInternalError
+	errors.As(err, &status)
+	Debugf("OPC UA: closing the connection of %s: %v", c.conn.RemoteAddr(), err)
+	e := &uaEncoder{}
+	e.status(status)
+	e.string("")
+	c.write("ERRF", e.b)
+}
+
+// write sends one message chunk with the header for typ, e.g. MSGF.
+func (c *uaChannel) write(typ string, body []byte) error {
+	frame := make([]byte, 8, 8+len(body))
+	copy(frame, typ)
+	binary.LittleEndian.PutUint32(frame[4:], uint32(8+len(body)))
+	c.conn.SetWriteDeadline(time.Now().Add(uaIdleTimeout))
+	_, err := c.conn.Write(append(frame, body...))
+	return err
+}
+
+// open answers OpenSecureChannel, issuing or renewing the channel token.
+func (c *uaChannel) open(requestID uint32, msg []byte) error {
+	d := &uaDecoder{b: msg}
+	if d.nodeID() != (uaNodeID{ID: uaOpenSecureChannelRequest}) {
+		return uaBadDecodingError
+	}
+	handle := decodeRequestHeader(d).handle
+	d.uint32() // Client protocol version
+	requestType := d.uint32()
+	mode := d.uint32()
+	d.bytes() // Client nonce
+	lifetime := d.uint32()
+	if d.err != nil {
+		return uaBadDecodingError
+	}
+	if mode != 1 { // None
+		return uaBadSecurityPolicyRejected
+	}
+	s := c.server
+	s.mu.Lock()
+	switch {
+	case requestType == 0 && c.id == 0:
+		c.id = s.nextID()
+	case requestType == 1 && c.id != 0:
+	default:
+		s.mu.Unlock()
+		return uaBadSecureChannelIDInvalid
+	}
+	c.tokenID = s.nextID()
+	s.mu.Unlock()
+	lifetime = min(max(lifetime, 60000), 3600000)
+
+	e := &uaEncoder{}
+	e.nodeID(uaNodeID{ID: uaOpenSecureChannelResponse})
+	encodeResponseHeader(e, handle, uaGood)
+	e.uint32(0)
+	e.uint32(c.id)
+	e.uint32(c.tokenID)
+	e.time(time.Now())
+	e.uint32(lifetime)
+	e.bytes([]byte{})
+
+	head := &uaEncoder{}
+	head.uint32(c.id)
+	head.string(uaSecurityNone)
+	head.bytes(nil)
+	head.bytes(nil)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	head.uint32(c.seq)
+	head.uint32(requestID)
+	c.seq++
+	return c.write("OPNF", append(head.b, e.b...))
+}
+
+// send sends a service response, split into chunks the client accepts.
+func (c *uaChannel) send(requestID uint32, msg []byte) error {
+	if c.maxSize > 0 && len(msg) > c.maxSize {
+		return uaBadTCPMessageTooLarge
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	const headerSize = 24 // Message, security and sequence header
+	room := c.sendSize - headerSize
+	for {
+		n := min(len(msg), room)
+		chunk := "MSGC"
+		if n == len(msg) {
+			chunk = "MSGF"
+		}
+		e := &uaEncoder{}
+		e.uint32(c.id)
+		e.uint32(c.tokenID)
+		e.uint32(c.seq)
+		e.uint32(requestID)
+		c.seq++
+		if err := c.write(chunk, append(e.b, msg[:n]...)); err != nil {
+			return err
+		}
+		msg = msg[n:]
+		if len(msg) == 0 {
+			return nil
+		}
+	}
+}
+
+// uaRequestHeader holds the fields of a RequestHeader the server uses.
+type uaRequestHeader struct {
+	token  uaNodeID
+	handle uint32
+}
+
+func decodeRequestHeader(d *uaDecoder) uaRequestHeader {
+	var h uaRequestHeader
+	h.token = d.nodeID()
+	d.time()
+	h.handle = d.uint32()
+	d.uint32() // Return diagnostics
+	d.string() // Audit entry id
+	d.uint32() // Timeout hint
+	d.extensionObject()
+	return h
+}
+
+func encodeResponseHeader(e *uaEncoder, handle uint32, result uaStatus) {
+	e.time(time.Now())
+	e.uint32(handle)
+	e.status(result)
+	e.byte(0) // No diagnostics
+	e.int32(0)
+	e.extensionObject(0, nil)
+}
+
+// uaRequest is a decoded service request waiting for its response.
+type uaRequest struct {
+	channel   *uaChannel
+	requestID uint32
+	handle    uint32
+	session   *uaSession
+}
+
+// respond sends the response with the binary encoding id typeID; body
+// appends the fields after the response header.
+func (r *uaRequest) respond(typeID uint32, body func(e *uaEncoder)) {
+	e := &uaEncoder{}
+	e.nodeID(uaNodeID{ID: typeID})
+	encodeResponseHeader(e, r.handle, uaGood)
+	body(e)
+	if err := r.channel.send(r.requestID, e.b); err != nil {
+		if errors.Is(err, uaBadTCPMessageTooLarge) {
+			r.fault(uaBadTCPMessageTooLarge)
+			return
+		}
+		Debugf("OPC UA: %s: %v", r.channel.conn.RemoteAddr(), err)
+	}
+}
+
+// fault answers the request with a ServiceFault.
+func (r *uaRequest) fault(status uaStatus) {
+	e := &uaEncoder{}
+	e.nodeID(uaNodeID{ID: uaServiceFault})
+	encodeResponseHeader(e, r.handle, status)
+	if err := r.channel.send(r.requestID, e.b); err != nil {
+		Debugf("OPC UA: %s: %v", r.channel.conn.RemoteAddr(), err)
+	}
+}
+
+// dispatch decodes and answers one service request.
+func (s *OPCUAServer) dispatch(c *uaChannel, requestID uint32, msg []byte) {
+	d := &uaDecoder{b: msg}
+	typeID := d.nodeID()
+	header := decodeRequestHeader(d)
+	r := &uaRequest{channel: c, requestID: requestID, handle: header.handle}
+	if d.err != nil || typeID.NS != 0 || typeID.IsString {
+		r.fault(uaBadDecodingError)
+		return
+	}
+
+	// Services available without a session
+	switch typeID.ID {
+	case uaGetEndpointsRequest:
+		s.getEndpoints(r, d)
+		return
+	case uaFindServersRequest:
+		s.findServers(r, d)
+		return
+	case uaCreateSessionRequest:
+		s.createSession(r, d)
+		return
+	case uaActivateSessionRequest:
+		s.activateSession(r, header.token, d)
+		return
+	case uaCloseSecureChannelRequest:
+		c.conn.Close()
+		return
+	}
+
+	s.mu.Lock()
+	session := s.sessions[header.token.Opaque]
+	status := uaGood
+	switch {
+	case session == nil || header.token.Kind != 'b':
+		status = uaBadSessionIDInvalid
+	case !session.activated || session.channel != c:
+		status = uaBadSessionNotActivated
+	default:
+		session.lastSeen = time.Now()
+	}
+	s.mu.Unlock()
+	if status != uaGood {
+		r.fault(status)
+		return
+	}
+	r.session = session
+
+	switch typeID.ID {
+	case uaCloseSessionRequest:
+		s.closeSession(r, d)
+	case uaBrowseRequest:
+		s.browse(r, d)
+	case uaBrowseNextRequest:
+		s.browseNext(r, d)
+	case uaReadRequest:
+		s.read(r, d)
+	case uaWriteRequest:
+		s.writeValues(r, d)
+	case uaRegisterNodesRequest:
+		nodes := make([]uaNodeID, d.arrayLen())
+		for i := range nodes {
+			nodes[i] = d.nodeID()
+		}
+		if d.err != nil {
+			r.fault(uaBadDecodingError)
+			return
+		}
+		r.respond(uaRegisterNodesResponse, func(e *uaEncoder) {
+			e.int32(int32(len(nodes)))
+			for _, id := range nodes {
+				e.nodeID(id)
+			}
+		})
+	case uaUnregisterNodesRequest:
+		r.respond(uaUnregisterNodesResponse, func(e *uaEncoder) {})
+	case uaCreateSubscriptionRequest:
+		s.createSubscription(r, d)
+	case uaModifySubscriptionRequest:
+		s.modifySubscription(r, d)
+	case uaSetPublishingModeRequest:
+		s.setPublishingMode(r, d)
+	case uaDeleteSubscriptionsRequest:
+		s.deleteSubscriptions(r, d)
+	case uaCreateMonitoredItemsRequest:
+		s.createMonitoredItems(r, d)
+	case uaModifyMonitoredItemsRequest:
+		s.modifyMonitoredItems(r, d)
+	case uaSetMonitoringModeRequest:
+		s.setMonitoringMode(r, d)
+	case uaDeleteMonitoredItemsRequest:
+		s.deleteMonitoredItems(r, d)
+	case uaPublishRequest:
+		s.publish(r, d)
+	case uaRepublishRequest:
+		s.republish(r, d)
+	default:
+		Debugf("OPC UA: unsupported service %d from %s", typeID.ID, c.conn.RemoteAddr())
+		r.fault(uaBadServiceUnsupported)
+	}
+}
+
+// encodeApplication appends the ApplicationDescription of the server.
+func (s *OPCUAServer) encodeApplication(e *uaEncoder) {
+	e.string(s.appURI)
+	e.string("urn:s7_plc_read")
+	e.localizedText("s7_plc_read " + s.space.Load().plcName)
+	e.uint32(0) // Server
+	e.string("")
+	e.string("")
+	e.strings([]string{s.cfg.Endpoint})
+}
+
+// encodeEndpoints appends the endpoints of the server: one without
+// security that takes anonymous and user name tokens.
+func (s *OPCUAServer) encodeEndpoints(e *uaEncoder) {
+	e.int32(1)
+	e.string(s.cfg.Endpoint)
+	s.encodeApplication(e)
+	e.bytes(nil)
+	e.uint32(1) // MessageSecurityMode None
+	e.string(uaSecurityNone)
+	e.int32(2)
+	for _, p := range []struct {
+		id  string
+		typ uint32
+	}{{"anonymous", uaTokenAnonymous}, {"username", uaTokenUserName}} {
+		e.string(p.id)
+		e.uint32(p.typ)
+		e.string("")
+		e.string("")
+		e.string(uaSecurityNone)
+	}
+	e.string(uaTransportTCP)
+	e.byte(0)
+}
+
+func (s *OPCUAServer) getEndpoints(r *uaRequest, d *uaDecoder) {
+	d.string()  // Endpoint URL
+	d.strings() // Locale ids
+	profiles := d.strings()
+	if d.err != nil {
+		r.fault(uaBadDecodingError)
+		return
+	}
+	tcp := len(profiles) == 0
+	for _, p := range profiles {
+		tcp = tcp || p == uaTransportTCP
+	}
+	r.respond(uaGetEndpointsResponse, func(e *uaEncoder) {
+		if !tcp {
+			e.int32(0)
+			return
+		}
+		s.encodeEndpoints(e)
+	})
+}
+
+func (s *OPCUAServer) findServers(r *uaRequest, d *uaDecoder) {
+	d.string()  // Endpoint URL
+	d.strings() // Locale ids
+	uris := d.strings()
+	if d.err != nil {
+		r.fault(uaBadDecodingError)
+		return
+	}
+	match := len(uris) == 0
+	for _, uri := range uris {
+		match = match || uri == s.appURI
+	}
+	r.respond(uaFindServersResponse, func(e *uaEncoder) {
+		if !match {
+			e.int32(0)
+			return
+		}
+		e.int32(1)
+		s.encodeApplication(e)
+	})
+}
+
+// uaSession is a session of a client. Its fields are guarded by the mutex
+// of the server.
+type uaSession struct {
+	server    *OPCUAServer
+	id        uaNodeID
+	token     string
+	name      string
+	user      string // Who activated the session, for log messages
+	role      string // Role of the user, see RoleAllows
+	channel   *uaChannel
+	activated bool
+	timeout   time.Duration
+	lastSeen  time.Time
+	nonce     []byte
+
+	browsing  map[string]uaBrowseRest // By continuation point
+	subs      map[uint32]*uaSubscription
+	publishes []*uaPublish // Publish requests waiting for notifications
+}
+
+// dropChannel forgets the channel c the session was activated on when the
+// connection closes; the client may activate the session on a new channel
+// until it times out.
+func (session *uaSession) dropChannel(c *uaChannel) {
+	if session.channel != c {
+		return
+	}
+	session.channel = nil
+	publishes := session.publishes[:0]
+	for _, p := range session.publishes {
+		if p.request.channel != c {
+			publishes = append(publishes, p)
+		}
+	}
+	session.publishes = publishes
+}
+
+// close deletes the subscriptions of the session and returns the answers
+// to its waiting publish requests.
+func (session *uaSession) close() []uaOutgoing {
+	var out []uaOutgoing
+	for _, p := range session.publishes {
+		out = append(out, uaOutgoing{request: p.request, status: uaBadSessionIDInvalid})
+	}
+	session.publishes = nil
+	session.subs = nil
+	return out
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func (s *OPCUAServer) createSession(r *uaRequest, d *uaDecoder) {
+	d.string() // Client application URI
+	d.string() // Product URI
+	d.localizedText()
+	d.uint32()  // Application type
+	d.string()  // Gateway server URI
+	d.string()  // Discovery profile URI
+	d.strings() // Discovery URLs
+	d.string()  // Server URI
+	d.string()  // Endpoint URL
+	name := d.string()
+	d.bytes() // Client nonce
+	d.bytes() // Client certificate
+	timeout := time.Duration(d.double() * float64(time.Millisecond))
+	if d.err != nil {
+		r.fault(uaBadDecodingError)
+		return
+	}
+	timeout = min(max(timeout, 10*time.Second), time.Hour)
+
+	s.mu.Lock()
+	if len(s.sessions) >= uaMaxSessions {
+		s.mu.Unlock()
+		r.fault(uaBadTooManySessions)
+		return
+	}
+	session := &uaSession{
+		server:   s,
+		id:       uaNodeID{NS: 1, ID: s.nextID()},
+		token:    string(randomBytes(32)),
+		name:     name,
+		channel:  r.channel,
+		timeout:  timeout,
+		lastSeen: time.Now(),
+		nonce:    randomBytes(32),
+		browsing: map[string]uaBrowseRest{},
+		subs:     map[uint32]*uaSubscription{},
+	}
+	s.sessions[session.token] = session
+	s.mu.Unlock()
+
+	r.respond(uaCreateSessionResponse, func(e *uaEncoder) {
+		e.nodeID(session.id)
+		e.nodeID(uaNodeID{Opaque: session.token, Kind: 'b'})
+		e.double(float64(timeout) / float64(time.Millisecond))
+		e.bytes(session.nonce)
+		e.bytes(nil) // Server certificate
+		s.encodeEndpoints(e)
+		e.int32(0)   // Software certificates
+		e.string("") // Signature algorithm
+		e.bytes(nil) // Signature
+		e.uint32(uaMaxMessageSize)
+	})
+}
+
+func (s *OPCUAServer) activateSession(r *uaRequest, token uaNodeID, d *uaDecoder) {
+	d.string() // Client signature algorithm
+	d.bytes()  // Client signature
+	for n := d.arrayLen(); n > 0; n-- {
+		d.bytes() // Software certificate
+		d.bytes() // Signature
+	}
+	d.strings() // Locale ids
+	tokenType, body := d.extensionObject()
+	if d.err != nil {
+		r.fault(uaBadDecodingError)
+		return
+	}
+
+	// Check the identity token; a missing token is an anonymous login
+	user, password, status := "", "", uaGood
+	t := &uaDecoder{b: body}
+	switch tokenType {
+	case uaNodeID{}, uaNodeID{ID: uaAnonymousIdentityToken}:
+		t.string() // Policy id
+	case uaNodeID{ID: uaUserNameIdentityToken}:
+		t.string() // Policy id
+		user = t.string()
+		password = string(t.bytes())
+		if t.string() != "" || user == "" {
+			// Encrypted passwords need a server certificate
+			status = uaBadIdentityTokenInvalid
+		}
+	default:
+		status = uaBadIdentityTokenInvalid
+	}
+	if t.err != nil {
+		status = uaBadIdentityTokenInvalid
+	}
+	role, ok := "", false
+	if status == uaGood {
+		role, ok = s.login(user, password)
+	}
+	if status == uaGood && !ok {
+		if user == "" {
+			Warnf("OPC UA: anonymous login from %s rejected", r.channel.conn.RemoteAddr())
+		} else {
+			Warnf("OPC UA: login of %s from %s rejected", user, r.channel.conn.RemoteAddr())
+		}
+		status = uaBadIdentityTokenRejected
+	}
+	if status != uaGood {
+		r.fault(status)
+		return
+	}
+
+	s.mu.Lock()
+	session := s.sessions[token.Opaque]
+	switch {
+	case session == nil || token.Kind != 'b':
+		status = uaBadSessionIDInvalid
+	case session.activated && session.channel != r.channel && session.user != displayUser(user):
+		// Only the user who owns the session may move it to a new channel
+		status = uaBadIdentityTokenRejected
+	default:
+		session.user = displayUser(user)
+		session.role = role
+		session.channel = r.channel
+		session.activated = true
+		session.lastSeen = time.Now()
+		session.nonce = randomBytes(32)
+	}
+	s.mu.Unlock()
+	if status != uaGood {
+		r.fault(status)
+		return
+	}
+	Debugf("OPC UA: %s activated session %q from %s", session.user, session.name, r.channel.conn.RemoteAddr())
+	r.respond(uaActivateSessionResponse, func(e *uaEncoder) {
+		e.bytes(session.nonce)
+		e.int32(0) // Results
+		e.emptyDiagnostics()
+	})
+}
+
+// displayUser names user in log messages.
+func displayUser(user string) string {
+	if user == "" {
+		return "anonymous"
+	}
+	return user
+}
+
+func (s *OPCUAServer) closeSession(r *uaRequest, d *uaDecoder) {
+	d.bool() // Delete subscriptions, which are never transferred
+	s.mu.Lock()
+	delete(s.sessions, r.session.token)
+	out := r.session.close()
+	s.mu.Unlock()
+	for _, o := range out {
+		o.send()
+	}
+	r.respond(uaCloseSessionResponse, func(e *uaEncoder) {})
+}
+
+// uaOutgoing is a publish response to send once the server mutex is
+// released.
+type uaOutgoing struct {
+	request *uaRequest
+	status  uaStatus // Fault to answer with, or Good to send body
+	body    []byte   // Fields after the response header
+}
+
+func (o uaOutgoing) send() {
+	if o.status != uaGood {
+		o.request.fault(o.status)
+		return
+	}
+	o.request.respond(uaPublishResponse, func(e *uaEncoder) {
+		e.b = append(e.b, o.body...)
+	})
+}
+
+func (s uaStatus) Error() string {
+	return fmt.Sprintf("OPC UA status 0x%08X", uint32(s))
+}
@@ -0,0 +1,696 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// uaTestClient is a minimal OPC UA client for the binary protocol with
+// security policy None, built on the codec of the server.
+type uaTestClient struct {
+	t       *testing.T
+	conn    net.Conn
+	channel uint32
+	token   uint32
+	seq     uint32
+	request uint32
+	auth    uaNodeID
+}
+
+// uaTestWrites records what an OPCUAServer writes through to the PLC.
+type uaTestWrites struct {
+	mu     sync.Mutex
+	writes map[string][]byte
+}
+
+func (w *uaTestWrites) write(tag Tag, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes[tag.Name] = data
+	return nil
+}
+
+func (w *uaTestWrites) get(name string) []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writes[name]
+}
+
+var uaTestTags = []TagConfig{
+	{Name: "Speed", Address: "DB1.DBD0:REAL"},
+	{Name: "Running", Address: "DB1.DBX4.0", Writable: true},
+	{Name: "Setpoint", Address: "DB1.DBW6:INT", Writable: true},
+	{Name: "Motors[1].Hours", Address: "DB1.DBD8:UDINT"},
+}
+
+// startTestOPCUA serves uaTestTags of the PLC Line1 on a free port of the
+// loopback interface and returns the cache of their values and the
+// address of the server.
+func startTestOPCUA(t *testing.T, login func(user, password string) (string, bool)) (*ValueCache, *uaTestWrites, string) {
+	t.Helper()
+	tags, err := ParseTags(Config{Tags: uaTestTags})
+	if err != nil {
+		t.Fatal(err)
+	}
+	space, err := NewOPCUAAddressSpace("Line1", tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewValueCache()
+	writes := &uaTestWrites{writes: map[string][]byte{}}
+	s := NewOPCUAServer(cache, space, OPCUAConfig{Endpoint: "opc.tcp://localhost:4840"}, time.Second, login, writes.write)
+	go s.ListenAndServe("127.0.0.1:0")
+	t.Cleanup(func() { s.Close() })
+	for range 100 {
+		s.mu.Lock()
+		l := s.listener
+		s.mu.Unlock()
+		if l != nil {
+			return cache, writes, l.Addr().String()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("OPC UA server did not start")
+	return nil, nil, ""
+}
+
+// dialUA connects to addr and opens a secure channel.
+func dialUA(t *testing.T, addr string) *uaTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	c := &uaTestClient{t: t, conn: conn, seq: 1}
+
+	hello := &uaEncoder{}
+	hello.uint32(0)
+	hello.uint32(uaBufferSize)
+	hello.uint32(uaBufferSize)
+	hello.uint32(0)
+	hello.uint32(0)
+	hello.string("opc.tcp://localhost:4840")
+	c.writeChunk("HELF", hello.b)
+	if typ, _ := c.readChunk(); typ != "ACKF" {
+		t.Fatalf("got %s for Hello, want ACKF", typ)
+	}
+
+	msg := &uaEncoder{}
+	msg.nodeID(uaNodeID{ID: uaOpenSecureChannelRequest})
+	c.requestHeader(msg)
+	msg.uint32(0) // Protocol version
+	msg.uint32(0) // Issue
+	msg.uint32(1) // None
+	msg.bytes(nil)
+	msg.uint32(600000)
+	head := &uaEncoder{}
+	head.uint32(0)
+	head.string(uaSecurityNone)
+	head.bytes(nil)
+	head.bytes(nil)
+	head.uint32(c.seq)
+	head.uint32(c.request)
+	c.writeChunk("OPNF", append(head.b, msg.b...))
+
+	typ, body := c.readChunk()
+	if typ != "OPNF" {
+		t.Fatalf("got %s for OpenSecureChannel, want OPNF", typ)
+	}
+	d := &uaDecoder{b: body}
+	d.uint32()
+	d.string()
+	d.bytes()
+	d.bytes()
+	d.uint32()
+	d.uint32()
+	c.responseHeader(d, uaOpenSecureChannelResponse)
+	d.uint32() // Server protocol version
+	c.channel = d.uint32()
+	c.token = d.uint32()
+	if d.err != nil || c.channel == 0 {
+		t.Fatalf("OpenSecureChannel: channel %d, %v", c.channel, d.err)
+	}
+	return c
+}
+
+func (c *uaTestClient) writeChunk(typ string, body []byte) {
+	frame := make([]byte, 8, 8+len(body))
+	copy(frame, typ)
+	binary.LittleEndian.PutUint32(frame[4:], uint32(8+len(body)))
+	if _, err := c.conn.Write(append(frame, body...)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *uaTestClient) readChunk() (string, []byte) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		c.t.Fatal(err)
+	}
+	body := make([]byte, binary.LittleEndian.Uint32(header[4:])-8)
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		c.t.Fatal(err)
+	}
+	return string(header[:4]), body
+}
+
+func (c *uaTestClient) requestHeader(e *uaEncoder) {
+	c.request++
+	e.nodeID(c.auth)
+	e.time(time.Now())
+	e.uint32(c.request)
+	e.uint32(0)
+	e.string("")
+	e.uint32(0)
+	e.extensionObject(0, nil)
+}
+
+// responseHeader reads the header of a response of type typeID and
+// returns its service result. ServiceFaults end the test.
+func (c *uaTestClient) responseHeader(d *uaDecoder, typeID uint32) uaStatus {
+	c.t.Helper()
+	id := d.nodeID()
+	d.time()
+	d.uint32()
+	status := uaStatus(d.uint32())
+	d.byte()
+	d.strings()
+	d.extensionObject()
+	switch {
+	case d.err != nil:
+		c.t.Fatalf("response %d: %v", typeID, d.err)
+	case id != uaNodeID{ID: typeID}:
+		c.t.Fatalf("got response %v, %v, want %d", id, status, typeID)
+	}
+	return status
+}
+
+// call sends a request of type typeID whose fields body appends and
+// returns the decoder at the fields of the response, or the status of a
+// ServiceFault.
+func (c *uaTestClient) call(typeID uint32, body func(e *uaEncoder)) (*uaDecoder, uaStatus) {
+	c.t.Helper()
+	msg := &uaEncoder{}
+	msg.nodeID(uaNodeID{ID: typeID})
+	c.requestHeader(msg)
+	body(msg)
+	head := &uaEncoder{}
+	head.uint32(c.channel)
+	head.uint32(c.token)
+	c.seq++
+	head.uint32(c.seq)
+	head.uint32(c.request)
+	c.writeChunk("MSGF", append(head.b, msg.b...))
+
+	var response []byte
+	for {
+		typ, chunk := c.readChunk()
+		if typ != "MSGC" && typ != "MSGF" {
+			c.t.Fatalf("got %s, want a MSG chunk", typ)
+		}
+		response = append(response, chunk[16:]...)
+		if typ == "MSGF" {
+			break
+		}
+	}
+	d := &uaDecoder{b: response}
+	if id := (&uaDecoder{b: response}).nodeID(); id == (uaNodeID{ID: uaServiceFault}) {
+		return nil, c.responseHeader(d, uaServiceFault)
+	}
+	// Responses have the id of their request plus 3.
+	if status := c.responseHeader(d, typeID+3); status != uaGood {
+		return nil, status
+	}
+	return d, uaGood
+}
+
+// mustCall is call for requests that must succeed.
+func (c *uaTestClient) mustCall(typeID uint32, body func(e *uaEncoder)) *uaDecoder {
+	c.t.Helper()
+	d, status := c.call(typeID, body)
+	if status != uaGood {
+		c.t.Fatalf("request %d failed: %v", typeID, status)
+	}
+	return d
+}
+
+// login creates and activates a session, anonymous for an empty user.
+func (c *uaTestClient) login(user, password string) uaStatus {
+	c.t.Helper()
+	d := c.mustCall(uaCreateSessionRequest, func(e *uaEncoder) {
+		e.string("urn:test")
+		e.string("urn:test")
+		e.localizedText("test")
+		e.uint32(1) // Client
+		e.string("")
+		e.string("")
+		e.strings(nil)
+		e.string("")
+		e.string("opc.tcp://localhost:4840")
+		e.string("test session")
+		e.bytes(make([]byte, 32))
+		e.bytes(nil)
+		e.double(60000)
+		e.uint32(0)
+	})
+	d.nodeID()
+	c.auth = d.nodeID()
+
+	token := &uaEncoder{}
+	tokenType := uint32(uaAnonymousIdentityToken)
+	if user == "" {
+		token.string("anonymous")
+	} else {
+		tokenType = uaUserNameIdentityToken
+		token.string("username")
+		token.string(user)
+		token.bytes([]byte(password))
+		token.string("")
+	}
+	_, status := c.call(uaActivateSessionRequest, func(e *uaEncoder) {
+		e.string("")
+		e.bytes(nil)
+		e.int32(0)
+		e.strings(nil)
+		e.extensionObject(tokenType, token.b)
+		e.string("")
+		e.bytes(nil)
+	})
+	return status
+}
+
+// browse returns the browse names of the nodes node organizes.
+func (c *uaTestClient) browse(node uaNodeID) []uaQualifiedName {
+	c.t.Helper()
+	d := c.mustCall(uaBrowseRequest, func(e *uaEncoder) {
+		e.nodeID(uaNodeID{})
+		e.time(time.Time{})
+		e.uint32(0)
+		e.uint32(0)
+		e.int32(1)
+		e.nodeID(node)
+		e.uint32(0) // Forward
+		e.nodeID(uaNodeID{ID: uaRefOrganizes})
+		e.bool(true)
+		e.uint32(0)
+		e.uint32(0x3F)
+	})
+	if d.arrayLen() != 1 {
+		c.t.Fatal("want one BrowseResult")
+	}
+	if status := uaStatus(d.uint32()); status != uaGood {
+		c.t.Fatalf("browsing %v: %v", node, status)
+	}
+	d.bytes()
+	names := make([]uaQualifiedName, d.arrayLen())
+	for i := range names {
+		d.nodeID()
+		d.bool()
+		d.nodeID()
+		names[i] = d.qualifiedName()
+		d.localizedText()
+		d.uint32()
+		d.nodeID()
+	}
+	if d.err != nil {
+		c.t.Fatal(d.err)
+	}
+	return names
+}
+
+// read reads attributes of nodes, with both timestamps.
+func (c *uaTestClient) read(attr uint32, nodes ...uaNodeID) []uaDataValue {
+	c.t.Helper()
+	d := c.mustCall(uaReadRequest, func(e *uaEncoder) {
+		e.double(0)
+		e.uint32(uaTimestampsBoth)
+		e.int32(int32(len(nodes)))
+		for _, n := range nodes {
+			e.nodeID(n)
+			e.uint32(attr)
+			e.string("")
+			e.qualifiedName(uaQualifiedName{})
+		}
+	})
+	values := make([]uaDataValue, d.arrayLen())
+	for i := range values {
+		values[i] = d.dataValue()
+	}
+	if d.err != nil {
+		c.t.Fatal(d.err)
+	}
+	return values
+}
+
+// write writes values to the Value of nodes and returns the results.
+func (c *uaTestClient) write(nodes []uaNodeID, values ...interface{}) []uaStatus {
+	c.t.Helper()
+	d := c.mustCall(uaWriteRequest, func(e *uaEncoder) {
+		e.int32(int32(len(nodes)))
+		for i, n := range nodes {
+			e.nodeID(n)
+			e.uint32(uaAttrValue)
+			e.string("")
+			e.dataValue(uaDataValue{Value: values[i], HasValue: true, SourceTimestamp: time.Now()})
+		}
+	})
+	results := make([]uaStatus, d.arrayLen())
+	for i := range results {
+		results[i] = uaStatus(d.uint32())
+	}
+	if d.err != nil {
+		c.t.Fatal(d.err)
+	}
+	return results
+}
+
+// publish sends a Publish request acknowledging ack, if not 0, and returns
+// the sequence number and the values of the data change notification.
+func (c *uaTestClient) publish(sub, ack uint32) (uint32, map[uint32]uaDataValue) {
+	c.t.Helper()
+	d := c.mustCall(uaPublishRequest, func(e *uaEncoder) {
+		if ack == 0 {
+			e.int32(0)
+			return
+		}
+		e.int32(1)
+		e.uint32(sub)
+		e.uint32(ack)
+	})
+	if id := d.uint32(); id != sub {
+		c.t.Fatalf("notification of subscription %d, want %d", id, sub)
+	}
+	d.uint32s() // Available sequence numbers
+	d.bool()    // More notifications
+	seq := d.uint32()
+	d.time()
+	values := map[uint32]uaDataValue{}
+	for n := d.arrayLen(); n > 0; n-- {
+		typeID, body := d.extensionObject()
+		if typeID != (uaNodeID{ID: uaDataChangeNotification}) {
+			c.t.Fatalf("got notification %v, want a data change", typeID)
+		}
+		nd := &uaDecoder{b: body}
+		for i := nd.arrayLen(); i > 0; i-- {
+			handle := nd.uint32()
+			values[handle] = nd.dataValue()
+		}
+		if nd.err != nil {
+			c.t.Fatal(nd.err)
+		}
+	}
+	for i, status := range d.uint32s() {
+		if uaStatus(status) != uaGood {
+			c.t.Errorf("acknowledgement %d: %v", i, uaStatus(status))
+		}
+	}
+	if d.err != nil {
+		c.t.Fatal(d.err)
+	}
+	return seq, values
+}
+
+func uaTag(name string) uaNodeID { return uaNodeID{NS: 1, Name: name, IsString: true} }
+
+func TestOPCUABrowseReadWrite(t *testing.T) {
+	cache, writes, addr := startTestOPCUA(t, func(user, password string) (string, bool) {
+		return RoleAdmin, user == ""
+	})
+	ts := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	cache.Update([]TagValue{
+		{Name: "Speed", Value: float32(3.5), Quality: QualityGood, Timestamp: ts},
+		{Name: "Setpoint", Value: int16(10), Quality: QualityBad, Timestamp: ts},
+	})
+	c := dialUA(t, addr)
+	if status := c.login("", ""); status != uaGood {
+		t.Fatalf("anonymous login: %v", status)
+	}
+
+	// Objects > Line1 > plc > tags, with struct tags in nested folders
+	want := map[uaNodeID][]string{
+		{ID: uaNodeObjects}:          {"Server", "Line1"},
+		uaTag("Line1"):               {"plc"},
+		uaTag("Line1/plc"):           {"Speed", "Running", "Setpoint", "Motors[1]"},
+		uaTag("Line1/plc/Motors[1]"): {"Hours"},
+	}
+	for node, names := range want {
+		var got []string
+		for _, q := range c.browse(node) {
+			got = append(got, q.Name)
+		}
+		if !slices.Equal(got, names) {
+			t.Errorf("browse %v = %v, want %v", node, got, names)
+		}
+	}
+
+	values := c.read(uaAttrValue, uaTag("Speed"), uaTag("Setpoint"), uaTag("Running"), uaTag("Nope"))
+	if v := values[0]; v.Value != float32(3.5) || v.Status != uaGood || !v.SourceTimestamp.Equal(ts) || v.ServerTimestamp.IsZero() {
+		t.Errorf("Speed = %+v", v)
+	}
+	for i, status := range []uaStatus{uaBadNoCommunication, uaBadWaitingForInitialData, uaBadNodeIDUnknown} {
+		if v := values[i+1]; v.Status != status || v.HasValue {
+			t.Errorf("value %d = %+v, want %v", i+1, v, status)
+		}
+	}
+	types := c.read(uaAttrDataType, uaTag("Speed"), uaTag("Setpoint"), uaTag("Motors[1].Hours"))
+	for i, id := range []uint32{uaTypeFloat, uaTypeInt16, uaTypeUInt32} {
+		if types[i].Value != (uaNodeID{ID: id}) {
+			t.Errorf("data type %d = %v, want %d", i, types[i].Value, id)
+		}
+	}
+	access := c.read(uaAttrAccessLevel, uaTag("Speed"), uaTag("Setpoint"))
+	if access[0].Value != uint8(1) || access[1].Value != uint8(3) {
+		t.Errorf("access levels %v and %v, want 1 and 3", access[0].Value, access[1].Value)
+	}
+
+	results := c.write(
+		[]uaNodeID{uaTag("Setpoint"), uaTag("Running"), uaTag("Speed"), uaTag("Setpoint"), uaTag("Nope")},
+		int16(-2), true, float32(1), int32(5), int16(1))
+	wantResults := []uaStatus{uaGood, uaGood, uaBadNotWritable, uaBadTypeMismatch, uaBadNodeIDUnknown}
+	for i, status := range results {
+		if status != wantResults[i] {
+			t.Errorf("write %d: %v, want %v", i, status, wantResults[i])
+		}
+	}
+	if got := writes.get("Setpoint"); !bytes.Equal(got, []byte{0xFF, 0xFE}) {
+		t.Errorf("wrote % X to Setpoint, want FF FE", got)
+	}
+	if got := writes.get("Running"); !bytes.Equal(got, []byte{1}) {
+		t.Errorf("wrote % X to Running, want 01", got)
+	}
+	if got := writes.get("Speed"); got != nil {
+		t.Errorf("wrote % X to Speed, which is not Writable", got)
+	}
+}
+
+func TestOPCUASubscription(t *testing.T) {
+	cache, _, addr := startTestOPCUA(t, func(user, password string) (string, bool) {
+		return RoleAdmin, true
+	})
+	cache.Update([]TagValue{{Name: "Speed", Value: float32(1), Quality: QualityGood, Timestamp: time.Now()}})
+	c := dialUA(t, addr)
+	c.login("", "")
+
+	d := c.mustCall(uaCreateSubscriptionRequest, func(e *uaEncoder) {
+		e.double(100)
+		e.uint32(300)
+		e.uint32(100)
+		e.uint32(0)
+		e.bool(true)
+		e.byte(0)
+	})
+	sub := d.uint32()
+	if interval := d.double(); interval != 100 {
+		t.Errorf("publishing interval %v, want 100", interval)
+	}
+	d = c.mustCall(uaCreateMonitoredItemsRequest, func(e *uaEncoder) {
+		e.uint32(sub)
+		e.uint32(uaTimestampsSource)
+		e.int32(2)
+		for i, name := range []string{"Speed", "Nope"} {
+			e.nodeID(uaTag(name))
+			e.uint32(uaAttrValue)
+			e.string("")
+			e.qualifiedName(uaQualifiedName{})
+			e.uint32(uaModeReporting)
+			e.uint32(uint32(i + 7)) // Client handle
+			e.double(0)
+			e.extensionObject(0, nil)
+			e.uint32(1)
+			e.bool(true)
+		}
+	})
+	if n := d.arrayLen(); n != 2 {
+		t.Fatalf("%d monitored item results, want 2", n)
+	}
+	if status := uaStatus(d.uint32()); status != uaGood {
+		t.Fatalf("monitoring Speed: %v", status)
+	}
+	d.uint32()
+	d.double()
+	d.uint32()
+	d.extensionObject()
+	if status := uaStatus(d.uint32()); status != uaBadNodeIDUnknown {
+		t.Errorf("monitoring an unknown node: %v, want %v", status, uaBadNodeIDUnknown)
+	}
+
+	seq, values := c.publish(sub, 0)
+	if v, ok := values[7]; !ok || v.Value != float32(1) || !v.ServerTimestamp.IsZero() {
+		t.Fatalf("first notification %+v, want Speed 1 with its source timestamp only", values)
+	}
+	cache.Update([]TagValue{{Name: "Speed", Value: float32(2.5), Quality: QualityGood, Timestamp: time.Now()}})
+	next, values := c.publish(sub, seq)
+	if v := values[7]; v.Value != float32(2.5) || next != seq+1 {
+		t.Fatalf("notification %d: %+v, want %d with Speed 2.5", next, values, seq+1)
+	}
+	cache.Update([]TagValue{{Name: "Speed", Value: float32(2.5), Quality: QualityBad, Timestamp: time.Now()}})
+	if _, values := c.publish(sub, next); values[7].Status != uaBadNoCommunication {
+		t.Fatalf("notification %+v, want Speed bad", values)
+	}
+
+	c.mustCall(uaDeleteSubscriptionsRequest, func(e *uaEncoder) {
+		e.int32(1)
+		e.uint32(sub)
+	})
+	if _, status := c.call(uaPublishRequest, func(e *uaEncoder) { e.int32(0) }); status != uaBadNoSubscription {
+		t.Errorf("publish without subscriptions: %v, want %v", status, uaBadNoSubscription)
+	}
+}
+
+func TestOPCUALogin(t *testing.T) {
+	users := map[string]string{"viewer": RoleViewer, "operator": RoleOperator}
+	_, writes, addr := startTestOPCUA(t, func(user, password string) (string, bool) {
+		role, ok := users[user]
+		return role, ok && password == "secret"
+	})
+	for _, tt := range []struct {
+		user, password string
+		login, write   uaStatus
+	}{
+		{"", "", uaBadIdentityTokenRejected, 0},
+		{"operator", "wrong", uaBadIdentityTokenRejected, 0},
+		{"viewer", "secret", uaGood, uaBadUserAccessDenied},
+		{"operator", "secret", uaGood, uaGood},
+	} {
+		c := dialUA(t, addr)
+		if status := c.login(tt.user, tt.password); status != tt.login {
+			t.Errorf("login of %q: %v, want %v", tt.user, status, tt.login)
+			continue
+		}
+		if tt.login != uaGood {
+			if _, status := c.call(uaReadRequest, func(e *uaEncoder) {}); status != uaBadSessionNotActivated {
+				t.Errorf("read without login: %v, want %v", status, uaBadSessionNotActivated)
+			}
+			continue
+		}
+		if status := c.write([]uaNodeID{uaTag("Setpoint")}, int16(5))[0]; status != tt.write {
+			t.Errorf("write of %s: %v, want %v", tt.user, status, tt.write)
+		}
+	}
+	if got := writes.get("Setpoint"); !bytes.Equal(got, []byte{0, 5}) {
+		t.Errorf("wrote % X to Setpoint, want 00 05", got)
+	}
+}
+
+// Anonymous clients may only read unless the config lets them write.
+func TestOPCUAAnonymousRole(t *testing.T) {
+	for _, tt := range []struct {
+		cfg   *OPCUAConfig
+		role  string
+		write uaStatus
+	}{
+		{nil, RoleViewer, uaBadUserAccessDenied},
+		{&OPCUAConfig{}, RoleViewer, uaBadUserAccessDenied},
+		{&OPCUAConfig{AnonymousWrite: true}, RoleOperator, uaGood},
+	} {
+		if role := tt.cfg.AnonymousRole(); role != tt.role {
+			t.Errorf("%+v: role %q, want %q", tt.cfg, role, tt.role)
+		}
+		_, _, addr := startTestOPCUA(t, func(user, password string) (string, bool) {
+			return tt.cfg.AnonymousRole(), user == ""
+		})
+		c := dialUA(t, addr)
+		if status := c.login("", ""); status != uaGood {
+			t.Fatalf("anonymous login: %v", status)
+		}
+		if status := c.write([]uaNodeID{uaTag("Setpoint")}, int16(5))[0]; status != tt.write {
+			t.Errorf("%+v: anonymous write %v, want %v", tt.cfg, status, tt.write)
+		}
+	}
+}
+
+func TestUACodecRoundTrip(t *testing.T) {
+	now := time.Date(2024, 5, 6, 7, 8, 9, 123456700, time.UTC)
+	for _, v := range []interface{}{
+		nil, true, int8(-3), uint8(200), int16(-300), uint16(60000), int32(-70000), uint32(4000000000),
+		int64(-1 << 40), uint64(1 << 63), float32(1.5), -2.25, "žabe", now,
+		uaNodeID{NS: 1, Name: "Speed", IsString: true}, uaQualifiedName{NS: 1, Name: "plc"}, uaLocalizedText("Line1"),
+	} {
+		e := &uaEncoder{}
+		e.variant(v)
+		d := &uaDecoder{b: e.b}
+		got := d.variant()
+		if d.err != nil || len(d.b) != 0 {
+			t.Errorf("%T %v: %v, %d bytes left", v, v, d.err, len(d.b))
+		}
+		if want, ok := v.(time.Time); ok {
+			if got, ok := got.(time.Time); !ok || !got.Equal(want) {
+				t.Errorf("time %v read back as %v", want, got)
+			}
+			continue
+		}
+		if got != v {
+			t.Errorf("%T %v read back as %T %v", v, v, got, got)
+		}
+	}
+
+	for _, id := range []uaNodeID{
+		{ID: 85}, {ID: 2253}, {NS: 1, ID: 70000}, {NS: 300, ID: 5},
+		{NS: 1, Name: "Line1/plc", IsString: true},
+		{NS: 1, Opaque: "0123456789abcdef", Kind: 'g'},
+		{NS: 0, Opaque: "token", Kind: 'b'},
+	} {
+		e := &uaEncoder{}
+		e.nodeID(id)
+		d := &uaDecoder{b: e.b}
+		if got := d.nodeID(); got != id || d.err != nil {
+			t.Errorf("node id %+v read back as %+v, %v", id, got, d.err)
+		}
+	}
+
+	for _, dv := range []uaDataValue{
+		{},
+		{Value: float32(2), HasValue: true},
+		{Status: uaBadNoCommunication, SourceTimestamp: now},
+		{Value: "x", HasValue: true, SourceTimestamp: now, ServerTimestamp: now.Add(time.Second)},
+	} {
+		e := &uaEncoder{}
+		e.dataValue(dv)
+		d := &uaDecoder{b: e.b}
+		got := d.dataValue()
+		if d.err != nil || got.Value != dv.Value || got.HasValue != dv.HasValue || got.Status != dv.Status ||
+			!got.SourceTimestamp.Equal(dv.SourceTimestamp) || !got.ServerTimestamp.Equal(dv.ServerTimestamp) {
+			t.Errorf("data value %+v read back as %+v, %v", dv, got, d.err)
+		}
+	}
+
+	// Truncated and unsupported values fail the decoder.
+	for _, b := range [][]byte{{uaTypeInt32, 1, 2}, {uaTypeNodeID, 0x03, 1}, {uaTypeString | 0x80, 0, 0, 0, 0}, {uaTypeExtensionObject, 0, 0, 0}} {
+		d := &uaDecoder{b: b}
+		d.variant()
+		if d.err == nil {
+			t.Errorf("variant % X decoded", b)
+		}
+	}
+	if d := (&uaDecoder{b: []byte{0x06}}); d.nodeID() != (uaNodeID{}) || d.err == nil {
+		t.Error("node id with encoding 6 decoded")
+	}
+}
@@ -0,0 +1,583 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// This file holds the OPC UA binary encoding (OPC 10000-6, 5.2) of the
+// built-in types the server needs.
+
+// uaStatus is an OPC UA StatusCode.
+type uaStatus uint32
+
+// Status codes used by the server (OPC 10000-4, 7.34).
+const (
+	uaGood                         uaStatus = 0
+	uaBadInternalError             uaStatus = 0x80020000
+	uaBadCommunicationError        uaStatus = 0x80050000
+	uaBadDecodingError             uaStatus = 0x80070000
+	uaBadServiceUnsupported        uaStatus = 0x800B0000
+	uaBadNothingToDo               uaStatus = 0x800F0000
+	uaBadTooManyOperations         uaStatus = 0x80100000
+	uaBadUserAccessDenied          uaStatus = 0x801F0000
+	uaBadIdentityTokenInvalid      uaStatus = 0x80200000
+	uaBadIdentityTokenRejected     uaStatus = 0x80210000
+	uaBadSecureChannelIDInvalid    uaStatus = 0x80220000
+	uaBadSessionIDInvalid          uaStatus = 0x80250000
+	uaBadSessionNotActivated       uaStatus = 0x80270000
+	uaBadSubscriptionIDInvalid     uaStatus = 0x80280000
+	uaBadTimestampsToReturnInvalid uaStatus = 0x802B0000
+	uaBadNoCommunication           uaStatus = 0x80310000
+	uaBadWaitingForInitialData     uaStatus = 0x80320000
+	uaBadNodeIDUnknown             uaStatus = 0x80340000
+	uaBadAttributeIDInvalid        uaStatus = 0x80350000
+	uaBadIndexRangeInvalid         uaStatus = 0x80360000
+	uaBadDataEncodingInvalid       uaStatus = 0x80380000
+	uaBadNotWritable               uaStatus = 0x803B0000
+	uaBadOutOfRange                uaStatus = 0x803C0000
+	uaBadMonitoringModeInvalid     uaStatus = 0x80410000
+	uaBadMonitoredItemIDInvalid    uaStatus = 0x80420000
+	uaBadFilterNotAllowed          uaStatus = 0x80450000
+	uaBadContinuationPointInvalid  uaStatus = 0x804A0000
+	uaBadNoContinuationPoints      uaStatus = 0x804B0000
+	uaBadReferenceTypeIDInvalid    uaStatus = 0x804C0000
+	uaBadBrowseDirectionInvalid    uaStatus = 0x804D0000
+	uaBadSecurityPolicyRejected    uaStatus = 0x80550000
+	uaBadViewIDUnknown             uaStatus = 0x806B0000
+	uaBadMaxAgeInvalid             uaStatus = 0x80700000
+	uaBadWriteNotSupported         uaStatus = 0x80730000
+	uaBadTypeMismatch              uaStatus = 0x80740000
+	uaBadSequenceNumberUnknown     uaStatus = 0x807A0000
+	uaBadMonitoredItemFilterUnsupp uaStatus = 0x80440000
+	uaBadTimeout                   uaStatus = 0x800A0000
+	uaBadTooManySessions           uaStatus = 0x80560000
+	uaBadTooManySubscriptions      uaStatus = 0x80770000
+	uaBadTooManyPublishRequests    uaStatus = 0x80780000
+	uaBadNoSubscription            uaStatus = 0x80790000
+	uaBadMessageNotAvailable       uaStatus = 0x807B0000
+	uaBadTCPMessageTypeInvalid     uaStatus = 0x807E0000
+	uaBadTCPSecureChannelUnknown   uaStatus = 0x807F0000
+	uaBadTCPMessageTooLarge        uaStatus = 0x80800000
+	uaBadTooManyMonitoredItems     uaStatus = 0x80DB0000
+)
+
+// errUADecode is returned when a message is truncated or malformed.
+var errUADecode = errors.New("malformed OPC UA message")
+
+// uaDecoder reads OPC UA binary values from a message. The first error
+// sticks; later reads return zero values.
+type uaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *uaDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = errUADecode
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *uaDecoder) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *uaDecoder) bool() bool { return d.byte() != 0 }
+
+func (d *uaDecoder) uint16() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *uaDecoder) uint32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *uaDecoder) int32() int32 { return int32(d.uint32()) }
+
+func (d *uaDecoder) uint64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *uaDecoder) double() float64 { return math.Float64frombits(d.uint64()) }
+
+// arrayLen reads the length of an array, -1 (null) reads as 0.
+func (d *uaDecoder) arrayLen() int {
+	n := d.int32()
+	if n > int32(len(d.b)) {
+		// Every element takes at least a byte.
+		d.err = errUADecode
+		return 0
+	}
+	if n < 0 {
+		return 0
+	}
+	return int(n)
+}
+
+func (d *uaDecoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+func (d *uaDecoder) string() string { return string(d.bytes()) }
+
+func (d *uaDecoder) strings() []string {
+	s := make([]string, d.arrayLen())
+	for i := range s {
+		s[i] = d.string()
+	}
+	return s
+}
+
+func (d *uaDecoder) uint32s() []uint32 {
+	s := make([]uint32, d.arrayLen())
+	for i := range s {
+		s[i] = d.uint32()
+	}
+	return s
+}
+
+func (d *uaDecoder) time() time.Time { return uaTime(int64(d.uint64())) }
+
+func (d *uaDecoder) nodeID() uaNodeID {
+	switch enc := d.byte(); enc & 0x3F {
+	case 0x00:
+		return uaNodeID{ID: uint32(d.byte())}
+	case 0x01:
+		ns := uint16(d.byte())
+		return uaNodeID{NS: ns, ID: uint32(d.uint16())}
+	case 0x02:
+		ns := d.uint16()
+		return uaNodeID{NS: ns, ID: d.uint32()}
+	case 0x03:
+		ns := d.uint16()
+		return uaNodeID{NS: ns, Name: d.string(), IsString: true}
+	case 0x04:
+		ns := d.uint16()
+		return uaNodeID{NS: ns, Opaque: string(d.take(16)), Kind: 'g'}
+	case 0x05:
+		ns := d.uint16()
+		return uaNodeID{NS: ns, Opaque: string(d.bytes()), Kind: 'b'}
+	default:
+		d.err = errUADecode
+		return uaNodeID{}
+	}
+}
+
+func (d *uaDecoder) qualifiedName() uaQualifiedName {
+	ns := d.uint16()
+	return uaQualifiedName{NS: ns, Name: d.string()}
+}
+
+func (d *uaDecoder) localizedText() string {
+	mask := d.byte()
+	if mask&0x01 != 0 {
+		d.string()
+	}
+	if mask&0x02 != 0 {
+		return d.string()
+	}
+	return ""
+}
+
+// extensionObject returns the type id and the body of an ExtensionObject.
+func (d *uaDecoder) extensionObject() (uaNodeID, []byte) {
+	id := d.nodeID()
+	switch d.byte() {
+	case 0x00:
+		return id, nil
+	case 0x01, 0x02:
+		return id, d.bytes()
+	default:
+		d.err = errUADecode
+		return id, nil
+	}
+}
+
+// variant reads a scalar Variant into the Go types the encoder writes, nil
+// for an empty Variant. Arrays and other types cannot be skipped without
+// decoding them and fail the message.
+func (d *uaDecoder) variant() interface{} {
+	switch d.byte() {
+	case 0:
+		return nil
+	case uaTypeBoolean:
+		return d.bool()
+	case uaTypeSByte:
+		return int8(d.byte())
+	case uaTypeByte:
+		return d.byte()
+	case uaTypeInt16:
+		return int16(d.uint16())
+	case uaTypeUInt16:
+		return d.uint16()
+	case uaTypeInt32:
+		return d.int32()
+	case uaTypeUInt32:
+		return d.uint32()
+	case uaTypeInt64:
+		return int64(d.uint64())
+	case uaTypeUInt64:
+		return d.uint64()
+	case uaTypeFloat:
+		return math.Float32frombits(d.uint32())
+	case uaTypeDouble:
+		return d.double()
+	case uaTypeString:
+		return d.string()
+	case uaTypeDateTime:
+		return d.time()
+	case uaTypeNodeID:
+		return d.nodeID()
+	case uaTypeQualifiedName:
+		return d.qualifiedName()
+	case uaTypeLocalizedText:
+		return uaLocalizedText(d.localizedText())
+	}
+	d.err = errUADecode
+	return nil
+}
+
+func (d *uaDecoder) dataValue() uaDataValue {
+	var dv uaDataValue
+	mask := d.byte()
+	if mask&0x01 != 0 {
+		dv.Value, dv.HasValue = d.variant(), true
+	}
+	if mask&0x02 != 0 {
+		dv.Status = uaStatus(d.uint32())
+	}
+	if mask&0x04 != 0 {
+		dv.SourceTimestamp = d.time()
+	}
+	if mask&0x10 != 0 {
+		d.uint16() // Source picoseconds
+	}
+	if mask&0x08 != 0 {
+		dv.ServerTimestamp = d.time()
+	}
+	if mask&0x20 != 0 {
+		d.uint16() // Server picoseconds
+	}
+	return dv
+}
+
+// uaEncoder appends OPC UA binary values to a buffer.
+type uaEncoder struct {
+	b []byte
+}
+
+func (e *uaEncoder) byte(v byte) { e.b = append(e.b, v) }
+
+func (e *uaEncoder) bool(v bool) {
+	if v {
+		e.byte(1)
+	} else {
+		e.byte(0)
+	}
+}
+
+func (e *uaEncoder) uint16(v uint16) { e.b = binary.LittleEndian.AppendUint16(e.b, v) }
+
+func (e *uaEncoder) uint32(v uint32) { e.b = binary.LittleEndian.AppendUint32(e.b, v) }
+
+func (e *uaEncoder) int32(v int32) { e.uint32(uint32(v)) }
+
+func (e *uaEncoder) uint64(v uint64) { e.b = binary.LittleEndian.AppendUint64(e.b, v) }
+
+func (e *uaEncoder) double(v float64) { e.uint64(math.Float64bits(v)) }
+
+func (e *uaEncoder) status(s uaStatus) { e.uint32(uint32(s)) }
+
+func (e *uaEncoder) bytes(v []byte) {
+	if v == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(v)))
+	e.b = append(e.b, v...)
+}
+
+func (e *uaEncoder) string(v string) {
+	e.int32(int32(len(v)))
+	e.b = append(e.b, v...)
+}
+
+func (e *uaEncoder) strings(v []string) {
+	e.int32(int32(len(v)))
+	for _, s := range v {
+		e.string(s)
+	}
+}
+
+func (e *uaEncoder) time(t time.Time) { e.uint64(uint64(uaTicks(t))) }
+
+func (e *uaEncoder) nodeID(id uaNodeID) {
+	switch {
+	case id.IsString:
+		e.byte(0x03)
+		e.uint16(id.NS)
+		e.string(id.Name)
+	case id.Kind == 'g':
+		e.byte(0x04)
+		e.uint16(id.NS)
+		e.b = append(e.b, id.Opaque...)
+	case id.Kind == 'b':
+		e.byte(0x05)
+		e.uint16(id.NS)
+		e.bytes([]byte(id.Opaque))
+	case id.NS == 0 && id.ID <= 0xFF:
+		e.byte(0x00)
+		e.byte(byte(id.ID))
+	case id.NS <= 0xFF && id.ID <= 0xFFFF:
+		e.byte(0x01)
+		e.byte(byte(id.NS))
+		e.uint16(uint16(id.ID))
+	default:
+		e.byte(0x02)
+		e.uint16(id.NS)
+		e.uint32(id.ID)
+	}
+}
+
+// expandedNodeID appends id as an ExpandedNodeId of the local server,
+// which is encoded like a NodeId.
+func (e *uaEncoder) expandedNodeID(id uaNodeID) { e.nodeID(id) }
+
+func (e *uaEncoder) qualifiedName(q uaQualifiedName) {
+	e.uint16(q.NS)
+	e.string(q.Name)
+}
+
+func (e *uaEncoder) localizedText(text string) {
+	if text == "" {
+		e.byte(0)
+		return
+	}
+	e.byte(0x02)
+	e.string(text)
+}
+
+// extensionObject appends body as an ExtensionObject of the binary
+// encoding typeID; a nil body is encoded as an empty ExtensionObject.
+func (e *uaEncoder) extensionObject(typeID uint32, body []byte) {
+	if body == nil {
+		e.nodeID(uaNodeID{})
+		e.byte(0)
+		return
+	}
+	e.nodeID(uaNodeID{ID: typeID})
+	e.byte(0x01)
+	e.bytes(body)
+}
+
+// emptyDiagnostics appends an empty DiagnosticInfo array.
+func (e *uaEncoder) emptyDiagnostics() { e.int32(0) }
+
+// Variant type ids (OPC 10000-6, 5.1.2).
+const (
+	uaTypeBoolean         = 1
+	uaTypeSByte           = 2
+	uaTypeByte            = 3
+	uaTypeInt16           = 4
+	uaTypeUInt16          = 5
+	uaTypeInt32           = 6
+	uaTypeUInt32          = 7
+	uaTypeInt64           = 8
+	uaTypeUInt64          = 9
+	uaTypeFloat           = 10
+	uaTypeDouble          = 11
+	uaTypeString          = 12
+	uaTypeDateTime        = 13
+	uaTypeNodeID          = 17
+	uaTypeQualifiedName   = 20
+	uaTypeLocalizedText   = 21
+	uaTypeExtensionObject = 22
+)
+
+// uaExtension is a value encoded as an ExtensionObject in a Variant.
+type uaExtension struct {
+	typeID uint32
+	body   []byte
+}
+
+// variant appends v as a Variant. Supported are the Go types the tag
+// decoder produces, []string and []uint32 arrays, uaNodeID, uaExtension and
+// nil for an empty Variant. Durations are sent as Double milliseconds.
+func (e *uaEncoder) variant(v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		e.byte(0)
+	case bool:
+		e.byte(uaTypeBoolean)
+		e.bool(v)
+	case int8:
+		e.byte(uaTypeSByte)
+		e.byte(byte(v))
+	case uint8:
+		e.byte(uaTypeByte)
+		e.byte(v)
+	case int16:
+		e.byte(uaTypeInt16)
+		e.uint16(uint16(v))
+	case uint16:
+		e.byte(uaTypeUInt16)
+		e.uint16(v)
+	case int32:
+		e.byte(uaTypeInt32)
+		e.int32(v)
+	case uint32:
+		e.byte(uaTypeUInt32)
+		e.uint32(v)
+	case int64:
+		e.byte(uaTypeInt64)
+		e.uint64(uint64(v))
+	case uint64:
+		e.byte(uaTypeUInt64)
+		e.uint64(v)
+	case float32:
+		e.byte(uaTypeFloat)
+		e.uint32(math.Float32bits(v))
+	case float64:
+		e.byte(uaTypeDouble)
+		e.double(v)
+	case time.Duration:
+		e.byte(uaTypeDouble)
+		e.double(float64(v) / float64(time.Millisecond))
+	case string:
+		e.byte(uaTypeString)
+		e.string(v)
+	case time.Time:
+		e.byte(uaTypeDateTime)
+		e.time(v)
+	case uaNodeID:
+		e.byte(uaTypeNodeID)
+		e.nodeID(v)
+	case uaLocalizedText:
+		e.byte(uaTypeLocalizedText)
+		e.localizedText(string(v))
+	case uaQualifiedName:
+		e.byte(uaTypeQualifiedName)
+		e.qualifiedName(v)
+	case uaExtension:
+		e.byte(uaTypeExtensionObject)
+		e.extensionObject(v.typeID, v.body)
+	case []string:
+		e.byte(uaTypeString | 0x80)
+		e.strings(v)
+	case []uint32:
+		e.byte(uaTypeUInt32 | 0x80)
+		e.int32(int32(len(v)))
+		for _, x := range v {
+			e.uint32(x)
+		}
+	default:
+		e.byte(0)
+	}
+}
+
+// uaLocalizedText is a LocalizedText without locale in a Variant.
+type uaLocalizedText string
+
+// uaDataValue is a DataValue.
+type uaDataValue struct {
+	Value           interface{}
+	HasValue        bool
+	Status          uaStatus
+	SourceTimestamp time.Time
+	ServerTimestamp time.Time
+}
+
+func (e *uaEncoder) dataValue(dv uaDataValue) {
+	var mask byte
+	if dv.HasValue {
+		mask |= 0x01
+	}
+	if dv.Status != uaGood {
+		mask |= 0x02
+	}
+	if !dv.SourceTimestamp.IsZero() {
+		mask |= 0x04
+	}
+	if !dv.ServerTimestamp.IsZero() {
+		mask |= 0x08
+	}
+	e.byte(mask)
+	if dv.HasValue {
+		e.variant(dv.Value)
+	}
+	if dv.Status != uaGood {
+		e.status(dv.Status)
+	}
+	if !dv.SourceTimestamp.IsZero() {
+		e.time(dv.SourceTimestamp)
+	}
+	if !dv.ServerTimestamp.IsZero() {
+		e.time(dv.ServerTimestamp)
+	}
+}
+
+// uaNodeID is a NodeId. Numeric ids use ID, string ids Name; GUID and
+// opaque ids, which the server never issues, keep their bytes in Opaque.
+type uaNodeID struct {
+	NS       uint16
+	ID       uint32
+	Name     string
+	IsString bool
+	Opaque   string
+	Kind     byte // 'g' for GUID, 'b' for ByteString ids
+}
+
+func (id uaNodeID) isNull() bool {
+	return id == uaNodeID{}
+}
+
+// uaQualifiedName is a QualifiedName.
+type uaQualifiedName struct {
+	NS   uint16
+	Name string
+}
+
+// uaUnixTicks is the Unix epoch as an OPC UA DateTime, which counts 100 ns
+// intervals since 1601.
+const uaUnixTicks = 116444736000000000
+
+// uaTicks converts t to an OPC UA DateTime, 0 for the zero time.
+func uaTicks(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uaUnixTicks + t.UnixNano()/100
+}
+
+// uaTime converts an OPC UA DateTime to a time, the zero time for 0.
+func uaTime(ticks int64) time.Time {
+	if ticks <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, (ticks-uaUnixTicks)*100).UTC()
+}
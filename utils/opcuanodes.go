@@ -0,0 +1,916 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Node classes.
+const (
+	uaClassObject       = 1
+	uaClassVariable     = 2
+	uaClassObjectType   = 8
+	uaClassVariableType = 16
+	uaClassDataType     = 64
+)
+
+// Reference types.
+const (
+	uaRefReferences      = 31
+	uaRefNonHierarchical = 32
+	uaRefHierarchical    = 33
+	uaRefHasChild        = 34
+	uaRefOrganizes       = 35
+	uaRefHasEventSource  = 36
+	uaRefHasTypeDef      = 40
+	uaRefAggregates      = 44
+	uaRefHasSubtype      = 45
+	uaRefHasProperty     = 46
+	uaRefHasComponent    = 47
+	uaRefHasNotifier     = 48
+)
+
+// uaRefParents holds the supertype of every reference type the server
+// knows, for browsing with IncludeSubtypes.
+var uaRefParents = map[uint32]uint32{
+	uaRefNonHierarchical: uaRefReferences,
+	uaRefHierarchical:    uaRefReferences,
+	uaRefHasChild:        uaRefHierarchical,
+	uaRefOrganizes:       uaRefHierarchical,
+	uaRefHasEventSource:  uaRefHierarchical,
+	uaRefHasTypeDef:      uaRefNonHierarchical,
+	uaRefAggregates:      uaRefHasChild,
+	uaRefHasSubtype:      uaRefHasChild,
+	uaRefHasProperty:     uaRefAggregates,
+	uaRefHasComponent:    uaRefAggregates,
+	uaRefHasNotifier:     uaRefHasEventSource,
+}
+
+// uaRefMatches reports whether references of type ref are selected by a
+// browse for want.
+func uaRefMatches(ref, want uint32, subtypes bool) bool {
+	for ref != 0 {
+		if ref == want {
+			return true
+		}
+		if !subtypes {
+			return false
+		}
+		ref = uaRefParents[ref]
+	}
+	return false
+}
+
+// Well-known nodes of namespace 0.
+const (
+	uaNodeRoot                = 84
+	uaNodeObjects             = 85
+	uaNodeTypes               = 86
+	uaNodeViews               = 87
+	uaNodeServer              = 2253
+	uaNodeServerArray         = 2254
+	uaNodeNamespaceArray      = 2255
+	uaNodeServerStatus        = 2256
+	uaNodeStartTime           = 2257
+	uaNodeCurrentTime         = 2258
+	uaNodeState               = 2259
+	uaNodeBuildInfo           = 2260
+	uaNodeProductURI          = 2261
+	uaNodeManufacturerName    = 2262
+	uaNodeProductName         = 2263
+	uaNodeSoftwareVersion     = 2264
+	uaNodeBuildNumber         = 2265
+	uaNodeBuildDate           = 2266
+	uaNodeServiceLevel        = 2267
+	uaNodeSecondsTillShutdown = 2992
+	uaNodeShutdownReason      = 2993
+)
+
+// Type definitions and data types used by the nodes.
+const (
+	uaTypeBaseObject       = 58
+	uaTypeFolder           = 61
+	uaTypeBaseDataVariable = 63
+	uaTypeProperty         = 68
+	uaTypeServer           = 2004
+	uaTypeServerStatus     = 2138
+	uaTypeBuildInfo        = 3051
+
+	uaDataDuration     = 290
+	uaDataUtcTime      = 294
+	uaDataBuildInfo    = 338
+	uaDataServerState  = 852
+	uaDataServerStatus = 862
+
+	uaEncodingBuildInfo    = 340
+	uaEncodingServerStatus = 864
+)
+
+// uaDataTypeNames names the data types that appear in the DataType
+// attribute of the variables.
+var uaDataTypeNames = map[uint32]string{
+	uaTypeBoolean: "Boolean", uaTypeSByte: "SByte", uaTypeByte: "Byte",
+	uaTypeInt16: "Int16", uaTypeUInt16: "UInt16", uaTypeInt32: "Int32", uaTypeUInt32: "UInt32",
+	uaTypeInt64: "Int64", uaTypeUInt64: "UInt64", uaTypeFloat: "Float", uaTypeDouble: "Double",
+	uaTypeString: "String", uaTypeDateTime: "DateTime", uaTypeLocalizedText: "LocalizedText",
+	uaDataDuration: "Duration", uaDataUtcTime: "UtcTime", uaDataBuildInfo: "BuildInfo",
+	uaDataServerState: "ServerState", uaDataServerStatus: "ServerStatusDataType",
+}
+
+// uaDataType returns the OPC UA data type of values of an S7 type.
+func uaDataType(t DataType) uint32 {
+	switch t {
+	case TypeBool:
+		return uaTypeBoolean
+	case TypeByte, TypeUSInt:
+		return uaTypeByte
+	case TypeSInt:
+		return uaTypeSByte
+	case TypeWord, TypeUInt:
+		return uaTypeUInt16
+	case TypeInt:
+		return uaTypeInt16
+	case TypeDWord, TypeUDInt:
+		return uaTypeUInt32
+	case TypeDInt:
+		return uaTypeInt32
+	case TypeLWord, TypeULInt:
+		return uaTypeUInt64
+	case TypeLInt:
+		return uaTypeInt64
+	case TypeReal:
+		return uaTypeFloat
+	case TypeLReal:
+		return uaTypeDouble
+	case TypeTime, TypeTOD, TypeS5Time:
+		return uaDataDuration
+	case TypeDate, TypeDT, TypeDTL:
+		return uaTypeDateTime
+	}
+	return uaTypeString
+}
+
+// uaNode is a node of the address space.
+type uaNode struct {
+	id          uaNodeID
+	class       uint32
+	browseName  uaQualifiedName
+	displayName string
+	description string
+	typeDef     uint32 // Type definition of objects and variables
+	refs        []uaReference
+	inverse     []uaReference
+
+	// Variables
+	dataType uint32
+	tag      string // Tag whose cached value the variable has, empty for server nodes
+	writable *Tag   // The tag when it is Writable
+}
+
+// uaReference is a reference from or, in inverse, to a node.
+type uaReference struct {
+	typeID uint32
+	target *uaNode
+}
+
+// OPCUAAddressSpace holds the nodes an OPCUAServer publishes: the standard
+// Server object and a folder of the PLC with a folder per measurement,
+// grouping the tags as in InfluxDB. Tags are variables in these with the
+// NodeId ns=1;s=<tag name>; the parts of struct tag names like
+// Motors[1].Speed become nested folders.
+type OPCUAAddressSpace struct {
+	plcName string
+	nodes   map[uaNodeID]*uaNode
+}
+
+// NewOPCUAAddressSpace builds the nodes for tags of the PLC plcName.
+func NewOPCUAAddressSpace(plcName string, tags []Tag) (*OPCUAAddressSpace, error) {
+	a := &OPCUAAddressSpace{plcName: plcName, nodes: map[uaNodeID]*uaNode{}}
+	a.addStandardNodes()
+
+	plc := a.add(&uaNode{
+		id:         uaNodeID{NS: 1, Name: plcName, IsString: true},
+		class:      uaClassObject,
+		browseName: uaQualifiedName{NS: 1, Name: plcName},
+		typeDef:    uaTypeFolder,
+	}, a.nodes[uaNodeID{ID: uaNodeObjects}], uaRefOrganizes)
+
+	for _, tag := range tags {
+		id := uaNodeID{NS: 1, Name: tag.Name, IsString: true}
+		if a.nodes[id] != nil {
+			return nil, fmt.Errorf("OPC UA: tag %s has the same NodeId as a folder", tag.Name)
+		}
+
+		// Find or make the folders on the way to the variable
+		parent := plc
+		path := plcName + "/" + tag.Measurement
+		parts := append([]string{tag.Measurement}, strings.Split(tag.Name, ".")...)
+		for i, name := range parts[:len(parts)-1] {
+			if i > 0 {
+				path += "/" + name
+			}
+			folder := a.nodes[uaNodeID{NS: 1, Name: path, IsString: true}]
+			if folder == nil {
+				folder = a.add(&uaNode{
+					id:         uaNodeID{NS: 1, Name: path, IsString: true},
+					class:      uaClassObject,
+					browseName: uaQualifiedName{NS: 1, Name: name},
+					typeDef:    uaTypeFolder,
+				}, parent, uaRefOrganizes)
+			}
+			parent = folder
+		}
+		if parent.class != uaClassObject {
+			return nil, fmt.Errorf("OPC UA: folder %s of tag %s has the same NodeId as a tag", path, tag.Name)
+		}
+
+		description := tag.Addr.String()
+		switch {
+		case tag.Expression != "":
+			description = "= " + tag.Expression
+		case tag.Accumulate != nil:
+			description = tag.Accumulate.Type + " of " + tag.Accumulate.Source
+		}
+		n := a.add(&uaNode{
+			id:          id,
+			class:       uaClassVariable,
+			browseName:  uaQualifiedName{NS: 1, Name: parts[len(parts)-1]},
+			description: description,
+			typeDef:     uaTypeBaseDataVariable,
+			dataType:    uaDataType(tag.Addr.Type),
+			tag:         tag.Name,
+		}, parent, uaRefOrganizes)
+		if tag.Writable {
+			n.writable = &tag
+		}
+	}
+	return a, nil
+}
+
+// add adds n with a reference of type ref from parent, and a reference to
+// its type definition.
+func (a *OPCUAAddressSpace) add(n *uaNode, parent *uaNode, ref uint32) *uaNode {
+	if n.displayName == "" {
+		n.displayName = n.browseName.Name
+	}
+	a.nodes[n.id] = n
+	if parent != nil {
+		a.link(parent, ref, n)
+	}
+	if n.typeDef != 0 {
+		if typ := a.nodes[uaNodeID{ID: n.typeDef}]; typ != nil {
+			a.link(n, uaRefHasTypeDef, typ)
+		}
+	}
+	return n
+}
+
+// link adds a reference of type ref from source to target.
+func (a *OPCUAAddressSpace) link(source *uaNode, ref uint32, target *uaNode) {
+	source.refs = append(source.refs, uaReference{ref, target})
+	target.inverse = append(target.inverse, uaReference{ref, source})
+}
+
+// addStandardNodes adds the root folders, the Server object with its
+// status and the types the other nodes refer to.
+func (a *OPCUAAddressSpace) addStandardNodes() {
+	for _, t := range []struct {
+		id    uint32
+		class uint32
+		name  string
+	}{
+		{uaTypeBaseObject, uaClassObjectType, "BaseObjectType"},
+		{uaTypeFolder, uaClassObjectType, "FolderType"},
+		{uaTypeServer, uaClassObjectType, "ServerType"},
+		{uaTypeBaseDataVariable, uaClassVariableType, "BaseDataVariableType"},
+		{uaTypeProperty, uaClassVariableType, "PropertyType"},
+		{uaTypeServerStatus, uaClassVariableType, "ServerStatusType"},
+		{uaTypeBuildInfo, uaClassVariableType, "BuildInfoType"},
+	} {
+		a.add(&uaNode{id: uaNodeID{ID: t.id}, class: t.class, browseName: uaQualifiedName{Name: t.name}}, nil, 0)
+	}
+	for id, name := range uaDataTypeNames {
+		a.add(&uaNode{id: uaNodeID{ID: id}, class: uaClassDataType, browseName: uaQualifiedName{Name: name}}, nil, 0)
+	}
+
+	folder := func(id uint32, name string, parent *uaNode) *uaNode {
+		return a.add(&uaNode{
+			id: uaNodeID{ID: id}, class: uaClassObject, browseName: uaQualifiedName{Name: name}, typeDef: uaTypeFolder,
+		}, parent, uaRefOrganizes)
+	}
+	root := folder(uaNodeRoot, "Root", nil)
+	objects := folder(uaNodeObjects, "Objects", root)
+	folder(uaNodeTypes, "Types", root)
+	folder(uaNodeViews, "Views", root)
+
+	server := a.add(&uaNode{
+		id: uaNodeID{ID: uaNodeServer}, class: uaClassObject, browseName: uaQualifiedName{Name: "Server"}, typeDef: uaTypeServer,
+	}, objects, uaRefOrganizes)
+	variable := func(id uint32, name string, dataType uint32, typeDef uint32, parent *uaNode, ref uint32) *uaNode {
+		return a.add(&uaNode{
+			id: uaNodeID{ID: id}, class: uaClassVariable, browseName: uaQualifiedName{Name: name},
+			dataType: dataType, typeDef: typeDef,
+		}, parent, ref)
+	}
+	variable(uaNodeServerArray, "ServerArray", uaTypeString, uaTypeProperty, server, uaRefHasProperty)
+	variable(uaNodeNamespaceArray, "NamespaceArray", uaTypeString, uaTypeProperty, server, uaRefHasProperty)
+	variable(uaNodeServiceLevel, "ServiceLevel", uaTypeByte, uaTypeProperty, server, uaRefHasProperty)
+	status := variable(uaNodeServerStatus, "ServerStatus", uaDataServerStatus, uaTypeServerStatus, server, uaRefHasComponent)
+	variable(uaNodeStartTime, "StartTime", uaDataUtcTime, uaTypeBaseDataVariable, status, uaRefHasComponent)
+	variable(uaNodeCurrentTime, "CurrentTime", uaDataUtcTime, uaTypeBaseDataVariable, status, uaRefHasComponent)
+	variable(uaNodeState, "State", uaDataServerState, uaTypeBaseDataVariable, status, uaRefHasComponent)
+	build := variable(uaNodeBuildInfo, "BuildInfo", uaDataBuildInfo, uaTypeBuildInfo, status, uaRefHasComponent)
+	variable(uaNodeSecondsTillShutdown, "SecondsTillShutdown", uaTypeUInt32, uaTypeBaseDataVariable, status, uaRefHasComponent)
+	variable(uaNodeShutdownReason, "ShutdownReason", uaTypeLocalizedText, uaTypeBaseDataVariable, status, uaRefHasComponent)
+	for _, v := range []struct {
+		id       uint32
+		name     string
+		dataType uint32
+	}{
+		{uaNodeProductURI, "ProductUri", uaTypeString},
+		{uaNodeManufacturerName, "ManufacturerName", uaTypeString},
+		{uaNodeProductName, "ProductName", uaTypeString},
+		{uaNodeSoftwareVersion, "SoftwareVersion", uaTypeString},
+		{uaNodeBuildNumber, "BuildNumber", uaTypeString},
+		{uaNodeBuildDate, "BuildDate", uaDataUtcTime},
+	} {
+		variable(v.id, v.name, v.dataType, uaTypeBaseDataVariable, build, uaRefHasComponent)
+	}
+}
+
+// Product information in BuildInfo.
+const (
+	uaProductURI   = "urn:s7_plc_read"
+	uaProductName  = "s7_plc_read"
+	uaManufacturer = "s7_plc_read"
+)
+
+// Attribute ids.
+const (
+	uaAttrNodeID                  = 1
+	uaAttrNodeClass               = 2
+	uaAttrBrowseName              = 3
+	uaAttrDisplayName             = 4
+	uaAttrDescription             = 5
+	uaAttrWriteMask               = 6
+	uaAttrUserWriteMask           = 7
+	uaAttrIsAbstract              = 8
+	uaAttrEventNotifier           = 12
+	uaAttrValue                   = 13
+	uaAttrDataType                = 14
+	uaAttrValueRank               = 15
+	uaAttrArrayDimensions         = 16
+	uaAttrAccessLevel             = 17
+	uaAttrUserAccessLevel         = 18
+	uaAttrMinimumSamplingInterval = 19
+	uaAttrHistorizing             = 20
+)
+
+// attribute returns the value of an attribute of n. Values of variables
+// carry timestamps, other attributes none.
+func (s *OPCUAServer) attribute(n *uaNode, attr uint32) uaDataValue {
+	good := func(v interface{}) uaDataValue { return uaDataValue{Value: v, HasValue: true} }
+	switch attr {
+	case uaAttrNodeID:
+		return good(n.id)
+	case uaAttrNodeClass:
+		return good(int32(n.class))
+	case uaAttrBrowseName:
+		return good(n.browseName)
+	case uaAttrDisplayName:
+		return good(uaLocalizedText(n.displayName))
+	case uaAttrDescription:
+		return good(uaLocalizedText(n.description))
+	case uaAttrWriteMask, uaAttrUserWriteMask:
+		return good(uint32(0))
+	}
+	switch n.class {
+	case uaClassObject:
+		if attr == uaAttrEventNotifier {
+			return good(uint8(0))
+		}
+	case uaClassObjectType, uaClassVariableType, uaClassDataType:
+		if attr == uaAttrIsAbstract {
+			return good(false)
+		}
+	case uaClassVariable:
+		switch attr {
+		case uaAttrValue:
+			return s.value(n)
+		case uaAttrDataType:
+			return good(uaNodeID{ID: n.dataType})
+		case uaAttrValueRank:
+			if n.id == (uaNodeID{ID: uaNodeNamespaceArray}) || n.id == (uaNodeID{ID: uaNodeServerArray}) {
+				return good(int32(1))
+			}
+			return good(int32(-1))
+		case uaAttrArrayDimensions:
+			return uaDataValue{Status: uaBadAttributeIDInvalid}
+		case uaAttrAccessLevel, uaAttrUserAccessLevel:
+			if n.writable != nil {
+				return good(uint8(3)) // CurrentRead and CurrentWrite
+			}
+			return good(uint8(1)) // CurrentRead
+		case uaAttrMinimumSamplingInterval:
+			if n.tag == "" {
+				return good(float64(0))
+			}
+			return good(float64(s.sampling) / float64(time.Millisecond))
+		case uaAttrHistorizing:
+			return good(false)
+		}
+	}
+	return uaDataValue{Status: uaBadAttributeIDInvalid}
+}
+
+// value returns the value of the variable n: from the value cache for
+// tags, computed for the Server object.
+func (s *OPCUAServer) value(n *uaNode) uaDataValue {
+	now := time.Now()
+	if n.tag != "" {
+		cached, ok := s.cache.Get(n.tag)
+		switch {
+		case !ok:
+			return uaDataValue{Status: uaBadWaitingForInitialData, ServerTimestamp: now}
+		case cached.Quality != QualityGood:
+			return uaDataValue{Status: uaBadNoCommunication, SourceTimestamp: cached.Timestamp, ServerTimestamp: now}
+		}
+		return uaDataValue{Value: cached.Value, HasValue: true, SourceTimestamp: cached.Timestamp, ServerTimestamp: now}
+	}
+
+	var v interface{}
+	switch n.id.ID {
+	case uaNodeServerArray:
+		v = []string{s.appURI}
+	case uaNodeNamespaceArray:
+		v = []string{"http://opcfoundation.org/UA/", s.appURI}
+	case uaNodeServiceLevel:
+		v = uint8(255)
+	case uaNodeServerStatus:
+		v = uaExtension{typeID: uaEncodingServerStatus, body: s.serverStatus(now)}
+	case uaNodeStartTime:
+		v = s.started
+	case uaNodeCurrentTime:
+		v = now
+	case uaNodeState:
+		v = int32(0) // Running
+	case uaNodeBuildInfo:
+		e := &uaEncoder{}
+		s.encodeBuildInfo(e)
+		v = uaExtension{typeID: uaEncodingBuildInfo, body: e.b}
+	case uaNodeProductURI:
+		v = uaProductURI
+	case uaNodeManufacturerName:
+		v = uaManufacturer
+	case uaNodeProductName:
+		v = uaProductName
+	case uaNodeSoftwareVersion, uaNodeBuildNumber:
+		v = ""
+	case uaNodeBuildDate:
+		v = s.started
+	case uaNodeSecondsTillShutdown:
+		v = uint32(0)
+	case uaNodeShutdownReason:
+		v = uaLocalizedText("")
+	}
+	return uaDataValue{Value: v, HasValue: true, SourceTimestamp: now, ServerTimestamp: now}
+}
+
+// serverStatus returns the encoded ServerStatusDataType.
+func (s *OPCUAServer) serverStatus(now time.Time) []byte {
+	e := &uaEncoder{}
+	e.time(s.started)
+	e.time(now)
+	e.int32(0) // Running
+	s.encodeBuildInfo(e)
+	e.uint32(0)
+	e.localizedText("")
+	return e.b
+}
+
+func (s *OPCUAServer) encodeBuildInfo(e *uaEncoder) {
+	e.string(uaProductURI)
+	e.string(uaManufacturer)
+	e.string(uaProductName)
+	e.string("")
+	e.string("")
+	e.time(s.started)
+}
+
+// Values of TimestampsToReturn.
+const (
+	uaTimestampsSource  = 0
+	uaTimestampsServer  = 1
+	uaTimestampsBoth    = 2
+	uaTimestampsNeither = 3
+)
+
+// withTimestamps drops the timestamps of dv the client did not ask for.
+func withTimestamps(dv uaDataValue, ts uint32) uaDataValue {
+	if ts == uaTimestampsServer || ts == uaTimestampsNeither {
+		dv.SourceTimestamp = time.Time{}
+	}
+	if ts == uaTimestampsSource || ts == uaTimestampsNeither {
+		dv.ServerTimestamp = time.Time{}
+	}
+	return dv
+}
+
+// uaReadValue is a decoded ReadValueId.
+type uaReadValue struct {
+	node      uaNodeID
+	attribute uint32
+	indexes   string
+	encoding  uaQualifiedName
+}
+
+func decodeReadValue(d *uaDecoder) uaReadValue {
+	return uaReadValue{node: d.nodeID(), attribute: d.uint32(), indexes: d.string(), encoding: d.qualifiedName()}
+}
+
+// readValue reads one attribute, without filtering the timestamps.
+func (s *OPCUAServer) readValue(space *OPCUAAddressSpace, rv uaReadValue) uaDataValue {
+	n := space.nodes[rv.node]
+	switch {
+	case n == nil:
+		return uaDataValue{Status: uaBadNodeIDUnknown}
+	case rv.indexes != "":
+		return uaDataValue{Status: uaBadIndexRangeInvalid}
+	case rv.encoding.Name != "" && (rv.attribute != uaAttrValue || rv.encoding.Name != "Default Binary"):
+		return uaDataValue{Status: uaBadDataEncodingInvalid}
+	}
+	return s.attribute(n, rv.attribute)
+}
+
+func (s *OPCUAServer) read(r *uaRequest, d *uaDecoder) {
+	maxAge := d.double()
+	ts := d.uint32()
+	nodes := make([]uaReadValue, d.arrayLen())
+	for i := range nodes {
+		nodes[i] = decodeReadValue(d)
+	}
+	switch {
+	case d.err != nil:
+		r.fault(uaBadDecodingError)
+		return
+	case maxAge < 0:
+		r.fault(uaBadMaxAgeInvalid)
+		return
+	case ts > uaTimestampsNeither:
+		r.fault(uaBadTimestampsToReturnInvalid)
+		return
+	case len(nodes) == 0:
+		r.fault(uaBadNothingToDo)
+		return
+	case len(nodes) > uaMaxNodesPerRequest:
+		r.fault(uaBadTooManyOperations)
+		return
+	}
+	space := s.space.Load()
+	r.respond(uaReadResponse, func(e *uaEncoder) {
+		e.int32(int32(len(nodes)))
+		for _, rv := range nodes {
+			dv := s.readValue(space, rv)
+			if rv.attribute == uaAttrValue {
+				dv = withTimestamps(dv, ts)
+			}
+			e.dataValue(dv)
+		}
+		e.emptyDiagnostics()
+	})
+}
+
+// writeValues writes the values of Writable tags through to the PLC.
+// Timestamps sent along are ignored, the PLC has none.
+func (s *OPCUAServer) writeValues(r *uaRequest, d *uaDecoder) {
+	type writeValue struct {
+		node      uaNodeID
+		attribute uint32
+		indexes   string
+		value     uaDataValue
+	}
+	values := make([]writeValue, d.arrayLen())
+	for i := range values {
+		values[i] = writeValue{node: d.nodeID(), attribute: d.uint32(), indexes: d.string(), value: d.dataValue()}
+	}
+	switch {
+	case d.err != nil:
+		r.fault(uaBadDecodingError)
+		return
+	case len(values) == 0:
+		r.fault(uaBadNothingToDo)
+		return
+	case len(values) > uaMaxNodesPerRequest:
+		r.fault(uaBadTooManyOperations)
+		return
+	}
+	s.mu.Lock()
+	user, role := r.session.user, r.session.role
+	s.mu.Unlock()
+
+	space := s.space.Load()
+	results := make([]uaStatus, len(values))
+	for i, wv := range values {
+		n := space.nodes[wv.node]
+		switch {
+		case n == nil:
+			results[i] = uaBadNodeIDUnknown
+		case wv.attribute != uaAttrValue:
+			results[i] = uaBadNotWritable
+		case wv.indexes != "":
+			results[i] = uaBadIndexRangeInvalid
+		case n.writable == nil:
+			results[i] = uaBadNotWritable
+		case !RoleAllows(role, RoleOperator):
+			results[i] = uaBadUserAccessDenied
+		case !wv.value.HasValue || wv.value.Status != uaGood:
+			results[i] = uaBadWriteNotSupported
+		default:
+			results[i] = s.writeTag(*n.writable, n.dataType, wv.value.Value, user)
+		}
+	}
+	r.respond(uaWriteResponse, func(e *uaEncoder) {
+		e.int32(int32(len(results)))
+		for _, status := range results {
+			e.status(status)
+		}
+		e.emptyDiagnostics()
+	})
+}
+
+// writeTag writes v, which must have the data type of the variable of the
+// tag, and returns the status of the write.
+func (s *OPCUAServer) writeTag(tag Tag, dataType uint32, v interface{}, user string) uaStatus {
+	// Durations are Doubles
+	if got := uaVariantType(v); got != dataType && (dataType != uaDataDuration || got != uaTypeDouble) {
+		return uaBadTypeMismatch
+	}
+	var text string
+	switch v := v.(type) {
+	case float32:
+		text = strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		text = strconv.FormatFloat(v, 'g', -1, 64)
+		if dataType == uaDataDuration {
+			text = time.Duration(v * float64(time.Millisecond)).String()
+		}
+	case time.Time:
+		text = v.Format(time.RFC3339Nano)
+	default:
+		text = fmt.Sprint(v)
+	}
+	data, err := EncodeValue(tag.Addr, text)
+	if err != nil {
+		return uaBadOutOfRange
+	}
+	if err := s.write(tag, data); err != nil {
+		Warnf("OPC UA: writing %s: %v", tag.Name, err)
+		return uaBadCommunicationError
+	}
+	Infof("OPC UA: %s wrote %s to %s (%s)", user, text, tag.Name, tag.Addr)
+	return uaGood
+}
+
+// uaVariantType returns the built-in type of a value decoded from a
+// Variant.
+func uaVariantType(v interface{}) uint32 {
+	switch v.(type) {
+	case bool:
+		return uaTypeBoolean
+	case int8:
+		return uaTypeSByte
+	case uint8:
+		return uaTypeByte
+	case int16:
+		return uaTypeInt16
+	case uint16:
+		return uaTypeUInt16
+	case int32:
+		return uaTypeInt32
+	case uint32:
+		return uaTypeUInt32
+	case int64:
+		return uaTypeInt64
+	case uint64:
+		return uaTypeUInt64
+	case float32:
+		return uaTypeFloat
+	case float64:
+		return uaTypeDouble
+	case string:
+		return uaTypeString
+	case time.Time:
+		return uaTypeDateTime
+	}
+	return 0
+}
+
+// Browse limits.
+const (
+	uaMaxNodesPerRequest   = 10000
+	uaMaxReferences        = 1000 // References per BrowseResult when the client sets no limit
+	uaMaxContinuationPoint = 10   // Continuation points per session
+)
+
+// uaReferenceResult is a ReferenceDescription of a browse result.
+type uaReferenceResult struct {
+	ref     uaReference
+	forward bool
+	mask    uint32
+}
+
+func (rr uaReferenceResult) encode(e *uaEncoder) {
+	t := rr.ref.target
+	if rr.mask&0x01 != 0 {
+		e.nodeID(uaNodeID{ID: rr.ref.typeID})
+	} else {
+		e.nodeID(uaNodeID{})
+	}
+	e.bool(rr.forward)
+	e.expandedNodeID(t.id)
+	if rr.mask&0x08 != 0 {
+		e.qualifiedName(t.browseName)
+	} else {
+		e.qualifiedName(uaQualifiedName{})
+	}
+	if rr.mask&0x10 != 0 {
+		e.localizedText(t.displayName)
+	} else {
+		e.localizedText("")
+	}
+	if rr.mask&0x04 != 0 {
+		e.uint32(t.class)
+	} else {
+		e.uint32(0)
+	}
+	if rr.mask&0x20 != 0 && t.typeDef != 0 {
+		e.expandedNodeID(uaNodeID{ID: t.typeDef})
+	} else {
+		e.expandedNodeID(uaNodeID{})
+	}
+}
+
+// uaBrowseRest holds the references of a continuation point and the limit
+// of the Browse request it continues.
+type uaBrowseRest struct {
+	refs  []uaReferenceResult
+	limit int
+}
+
+// uaBrowseResult is a BrowseResult before encoding.
+type uaBrowseResult struct {
+	status       uaStatus
+	continuation string
+	refs         []uaReferenceResult
+}
+
+func (b uaBrowseResult) encode(e *uaEncoder) {
+	e.status(b.status)
+	if b.continuation == "" {
+		e.bytes(nil)
+	} else {
+		e.bytes([]byte(b.continuation))
+	}
+	e.int32(int32(len(b.refs)))
+	for _, rr := range b.refs {
+		rr.encode(e)
+	}
+}
+
+// page returns the first limit references as the result and stores the
+// rest under a new continuation point of the session. Called with the
+// server mutex held.
+func (session *uaSession) page(refs []uaReferenceResult, limit int) uaBrowseResult {
+	if limit == 0 || limit > uaMaxReferences {
+		limit = uaMaxReferences
+	}
+	if len(refs) <= limit {
+		return uaBrowseResult{refs: refs}
+	}
+	if len(session.browsing) >= uaMaxContinuationPoint {
+		return uaBrowseResult{status: uaBadNoContinuationPoints}
+	}
+	cp := string(randomBytes(16))
+	session.browsing[cp] = uaBrowseRest{refs[limit:], limit}
+	return uaBrowseResult{continuation: cp, refs: refs[:limit]}
+}
+
+func (s *OPCUAServer) browse(r *uaRequest, d *uaDecoder) {
+	view := d.nodeID()
+	d.time()
+	d.uint32() // View version
+	limit := int(d.uint32())
+	type description struct {
+		node      uaNodeID
+		direction uint32
+		refType   uaNodeID
+		subtypes  bool
+		classMask uint32
+		mask      uint32
+	}
+	nodes := make([]description, d.arrayLen())
+	for i := range nodes {
+		nodes[i] = description{d.nodeID(), d.uint32(), d.nodeID(), d.bool(), d.uint32(), d.uint32()}
+	}
+	switch {
+	case d.err != nil:
+		r.fault(uaBadDecodingError)
+		return
+	case !view.isNull():
+		r.fault(uaBadViewIDUnknown)
+		return
+	case len(nodes) == 0:
+		r.fault(uaBadNothingToDo)
+		return
+	case len(nodes) > uaMaxNodesPerRequest:
+		r.fault(uaBadTooManyOperations)
+		return
+	}
+
+	space := s.space.Load()
+	results := make([]uaBrowseResult, len(nodes))
+	s.mu.Lock()
+	for i, bd := range nodes {
+		n := space.nodes[bd.node]
+		_, knownRef := uaRefParents[bd.refType.ID]
+		switch {
+		case n == nil:
+			results[i].status = uaBadNodeIDUnknown
+			continue
+		case bd.direction > 2:
+			results[i].status = uaBadBrowseDirectionInvalid
+			continue
+		case !bd.refType.isNull() && (bd.refType.NS != 0 || !knownRef && bd.refType.ID != uaRefReferences):
+			results[i].status = uaBadReferenceTypeIDInvalid
+			continue
+		}
+		var refs []uaReferenceResult
+		collect := func(list []uaReference, forward bool) {
+			for _, ref := range list {
+				if !bd.refType.isNull() && !uaRefMatches(ref.typeID, bd.refType.ID, bd.subtypes) {
+					continue
+				}
+				if bd.classMask != 0 && bd.classMask&ref.target.class == 0 {
+					continue
+				}
+				refs = append(refs, uaReferenceResult{ref, forward, bd.mask})
+			}
+		}
+		if bd.direction != 1 {
+			collect(n.refs, true)
+		}
+		if bd.direction != 0 {
+			collect(n.inverse, false)
+		}
+		results[i] = r.session.page(refs, limit)
+	}
+	s.mu.Unlock()
+
+	r.respond(uaBrowseResponse, func(e *uaEncoder) {
+		e.int32(int32(len(results)))
+		for _, res := range results {
+			res.encode(e)
+		}
+		e.emptyDiagnostics()
+	})
+}
+
+func (s *OPCUAServer) browseNext(r *uaRequest, d *uaDecoder) {
+	release := d.bool()
+	points := make([]string, d.arrayLen())
+	for i := range points {
+		points[i] = string(d.bytes())
+	}
+	switch {
+	case d.err != nil:
+		r.fault(uaBadDecodingError)
+		return
+	case len(points) == 0:
+		r.fault(uaBadNothingToDo)
+		return
+	}
+
+	results := make([]uaBrowseResult, len(points))
+	s.mu.Lock()
+	for i, cp := range points {
+		rest, ok := r.session.browsing[cp]
+		delete(r.session.browsing, cp)
+		switch {
+		case !ok:
+			results[i].status = uaBadContinuationPointInvalid
+		case !release:
+			results[i] = r.session.page(rest.refs, rest.limit)
+		}
+	}
+	s.mu.Unlock()
+
+	r.respond(uaBrowseNextResponse, func(e *uaEncoder) {
+		e.int32(int32(len(results)))
+		for _, res := range results {
+			res.encode(e)
+		}
+		e.emptyDiagnostics()
+	})
+}
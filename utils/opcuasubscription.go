@@ -0,0 +1,728 @@
+package utils
+
+import (
+	"math"
+	"reflect"
+	"time"
+)
+
+// Subscription limits of the server.
+const (
+	uaTickInterval          = 50 * time.Millisecond
+	uaMinPublishingInterval = 100 * time.Millisecond
+	uaMaxSubscriptions      = 20    // Per session
+	uaMaxMonitoredItems     = 10000 // Per subscription
+	uaMaxPublishRequests    = 10    // Queued per session
+	uaMaxRetransmit         = 10    // Notification messages kept for Republish
+)
+
+// Binary encoding ids of notifications and filters.
+const (
+	uaDataChangeFilter         = 724
+	uaDataChangeNotification   = 811
+	uaStatusChangeNotification = 820
+)
+
+// Monitoring modes.
+const (
+	uaModeDisabled  = 0
+	uaModeSampling  = 1
+	uaModeReporting = 2
+)
+
+// Data change triggers and deadband types of a DataChangeFilter.
+const (
+	uaTriggerStatus               = 0
+	uaTriggerStatusValue          = 1
+	uaTriggerStatusValueTimestamp = 2
+	uaDeadbandNone                = 0
+	uaDeadbandAbsolute            = 1
+)
+
+// uaSubscription is a subscription of a session. It samples its
+// monitored items every publishing interval and sends the changes with the
+// next publish request of the session. Its fields are guarded by the
+// mutex of the server.
+type uaSubscription struct {
+	session          *uaSession
+	id               uint32
+	interval         time.Duration
+	lifetime         uint32 // Intervals without publish requests before it expires
+	keepAlive        uint32 // Intervals without notifications before a keep-alive
+	maxNotifications uint32 // Per message, 0 for no limit
+	enabled          bool
+	next             time.Time // Start of the next publishing cycle
+	items            map[uint32]*uaMonitoredItem
+
+	seq        uint32 // Sequence number of the next notification message
+	idle       uint32 // Intervals since the last message
+	unanswered uint32 // Intervals since the last publish request
+	late       bool   // A message is due but no publish request was queued
+	retransmit []uaSentMessage
+}
+
+// uaSentMessage is a NotificationMessage kept until the client
+// acknowledges it.
+type uaSentMessage struct {
+	seq  uint32
+	body []byte
+}
+
+// uaMonitoredItem is a monitored attribute of a node.
+type uaMonitoredItem struct {
+	id         uint32
+	handle     uint32 // Client handle
+	read       uaReadValue
+	mode       uint32
+	timestamps uint32
+	trigger    uint32
+	deadband   float64      // Absolute deadband, 0 for none
+	last       *uaDataValue // Last value reported, nil to report the next sample
+	pending    *uaDataValue // Change not yet reported
+}
+
+// uaPublish is a queued publish request with the results of its
+// acknowledgements.
+type uaPublish struct {
+	request *uaRequest
+	acks    []uaStatus
+}
+
+// revise sets the publishing parameters from the requested ones.
+func (sub *uaSubscription) revise(interval float64, lifetime, keepAlive, maxNotifications uint32) {
+	sub.interval = time.Duration(interval * float64(time.Millisecond))
+	if math.IsNaN(interval) || sub.interval < uaMinPublishingInterval {
+		sub.interval = uaMinPublishingInterval
+	}
+	sub.interval = min(sub.interval, time.Hour)
+	sub.keepAlive = min(max(keepAlive, 1), 10000)
+	sub.lifetime = min(max(lifetime, 3*sub.keepAlive), 100000)
+	sub.maxNotifications = maxNotifications
+}
+
+func (sub *uaSubscription) encodeRevised(e *uaEncoder) {
+	e.double(float64(sub.interval) / float64(time.Millisecond))
+	e.uint32(sub.lifetime)
+	e.uint32(sub.keepAlive)
+}
+
+// cycle samples the monitored items once the publishing interval has
+// passed and returns the message to send, if one is due and the session
+// has a publish request.
+func (sub *uaSubscription) cycle(now time.Time) []uaOutgoing {
+	if now.Before(sub.next) {
+		return nil
+	}
+	sub.next = now.Add(sub.interval)
+	session := sub.session
+
+	sub.unanswered++
+	if sub.unanswered > sub.lifetime {
+		Infof("OPC UA: subscription %d of session %q expired without publish requests", sub.id, session.name)
+		delete(session.subs, sub.id)
+		if p := session.nextPublish(); p != nil {
+			return []uaOutgoing{sub.statusChange(p, uaBadTimeout, now)}
+		}
+		return nil
+	}
+
+	server := session.server
+	space := server.space.Load()
+	for _, item := range sub.items {
+		if item.mode != uaModeDisabled {
+			item.sample(server, space)
+		}
+	}
+	if !sub.late && !sub.due() {
+		return nil
+	}
+	if p := session.nextPublish(); p != nil {
+		return []uaOutgoing{sub.message(p, now)}
+	}
+	sub.late = true
+	return nil
+}
+
+// due reports whether a message should be sent: notifications are waiting
+// or a keep-alive is due. It counts the interval towards the keep-alive.
+func (sub *uaSubscription) due() bool {
+	if sub.enabled {
+		for _, item := range sub.items {
+			if item.pending != nil && item.mode == uaModeReporting {
+				return true
+			}
+		}
+	}
+	sub.idle++
+	return sub.idle >= sub.keepAlive
+}
+
+// message answers the publish request p with the waiting notifications of
+// the subscription, or with a keep-alive when there are none.
+func (sub *uaSubscription) message(p *uaPublish, now time.Time) uaOutgoing {
+	sub.late = false
+	sub.idle = 0
+
+	var notes []*uaMonitoredItem
+	more := false
+	if sub.enabled {
+		for _, item := range sub.items {
+			if item.pending == nil || item.mode != uaModeReporting {
+				continue
+			}
+			if sub.maxNotifications > 0 && len(notes) == int(sub.maxNotifications) {
+				more = true
+				sub.late = true // Send the rest with the next publish request
+				break
+			}
+			notes = append(notes, item)
+		}
+	}
+
+	msg := &uaEncoder{}
+	if len(notes) == 0 {
+		// A keep-alive has the next sequence number without using it
+		msg.uint32(sub.seq)
+		msg.time(now)
+		msg.int32(0)
+	} else {
+		data := &uaEncoder{}
+		data.int32(int32(len(notes)))
+		for _, item := range notes {
+			data.uint32(item.handle)
+			data.dataValue(withTimestamps(*item.pending, item.timestamps))
+			item.last, item.pending = item.pending, nil
+		}
+		data.emptyDiagnostics()
+
+		msg.uint32(sub.seq)
+		msg.time(now)
+		msg.int32(1)
+		msg.extensionObject(uaDataChangeNotification, data.b)
+		sub.retransmit = append(sub.retransmit, uaSentMessage{sub.seq, msg.b})
+		if len(sub.retransmit) > uaMaxRetransmit {
+			sub.retransmit = sub.retransmit[1:]
+		}
+		sub.seq++
+		if sub.seq == 0 {
+			sub.seq = 1
+		}
+	}
+	return sub.publishResponse(p, more, msg.b)
+}
+
+// statusChange answers p with a StatusChangeNotification, sent when the
+// subscription ends.
+func (sub *uaSubscription) statusChange(p *uaPublish, status uaStatus, now time.Time) uaOutgoing {
+	data := &uaEncoder{}
+	data.status(status)
+	data.byte(0) // No diagnostics
+	msg := &uaEncoder{}
+	msg.uint32(sub.seq)
+	msg.time(now)
+	msg.int32(1)
+	msg.extensionObject(uaStatusChangeNotification, data.b)
+	return sub.publishResponse(p, false, msg.b)
+}
+
+// publishResponse returns the fields of a PublishResponse to p carrying
+// the encoded NotificationMessage msg.
+func (sub *uaSubscription) publishResponse(p *uaPublish, more bool, msg []byte) uaOutgoing {
+	e := &uaEncoder{}
+	e.uint32(sub.id)
+	e.int32(int32(len(sub.retransmit)))
+	for _, m := range sub.retransmit {
+		e.uint32(m.seq)
+	}
+	e.bool(more)
+	e.b = append(e.b, msg...)
+	e.int32(int32(len(p.acks)))
+	for _, status := range p.acks {
+		e.status(status)
+	}
+	e.emptyDiagnostics()
+	return uaOutgoing{request: p.request, body: e.b}
+}
+
+// sample reads the monitored attribute and keeps it for the next message
+// when it changed enough to trigger a notification.
+func (item *uaMonitoredItem) sample(s *OPCUAServer, space *OPCUAAddressSpace) {
+	dv := s.readValue(space, item.read)
+	last := item.pending
+	if last == nil {
+		last = item.last
+	}
+	if last != nil && !item.changed(*last, dv) {
+		return
+	}
+	item.pending = &dv
+}
+
+// changed reports whether dv differs from last according to the data
+// change filter of the item.
+func (item *uaMonitoredItem) changed(last, dv uaDataValue) bool {
+	if last.Status != dv.Status {
+		return true
+	}
+	if item.trigger == uaTriggerStatus {
+		return false
+	}
+	if item.trigger == uaTriggerStatusValueTimestamp && !last.SourceTimestamp.Equal(dv.SourceTimestamp) {
+		return true
+	}
+	if item.deadband > 0 {
+		a, okA := numericValue(last.Value)
+		b, okB := numericValue(dv.Value)
+		if okA && okB {
+			return math.Abs(a-b) > item.deadband
+		}
+	}
+	return !reflect.DeepEqual(last.Value, dv.Value)
+}
+
+// nextPublish removes and returns the oldest queued publish request, nil
+// when there is none.
+func (session *uaSession) nextPublish() *uaPublish {
+	if len(session.publishes) == 0 {
+		return nil
+	}
+	p := session.publishes[0]
+	session.publishes = session.publishes[1:]
+	return p
+}
+
+func (s *OPCUAServer) createSubscription(r *uaRequest, d *uaDecoder) {
+	interval := d.double()
+	lifetime := d.uint32()
+	keepAlive := d.uint32()
+	maxNotifications := d.uint32()
+	enabled := d.bool()
+	d.byte() // Priority
+	if d.err != nil {
+		r.fault(uaBadDecodingError)
+		return
+	}
+	s.mu.Lock()
+	session := r.session
+	if len(session.subs) >= uaMaxSubscriptions {
+		s.mu.Unlock()
+		r.fault(uaBadTooManySubscriptions)
+		return
+	}
+	sub := &uaSubscription{
+		session: session,
+		id:      s.nextID(),
+		enabled: enabled,
+		items:   map[uint32]*uaMonitoredItem{},
+		seq:     1,
+	}
+	sub.revise(interval, lifetime, keepAlive, maxNotifications)
+	sub.next = time.Now().Add(sub.interval)
+	sub.idle = sub.keepAlive - 1 // The first cycle answers a publish request
+	session.subs[sub.id] = sub
+	s.mu.Unlock()
+	Debugf("OPC UA: session %q subscribed every %s", session.name, sub.interval)
+
+	r.respond(uaCreateSubscriptionResponse, func(e *uaEncoder) {
+		e.uint32(sub.id)
+		sub.encodeRevised(e)
+	})
+}
+
+func (s *OPCUAServer) modifySubscription(r *uaRequest, d *uaDecoder) {
+	id := d.uint32()
+	interval := d.double()
+	lifetime := d.uint32()
+	keepAlive := d.uint32()
+	maxNotifications := d.uint32()
+	d.byte() // Priority
+	if d.err != nil {
+		r.fault(uaBadDecodingError)
+		return
+	}
+	s.mu.Lock()
+	sub := r.session.subs[id]
+	if sub == nil {
+		s.mu.Unlock()
+		r.fault(uaBadSubscriptionIDInvalid)
+		return
+	}
+	sub.revise(interval, lifetime, keepAlive, maxNotifications)
+	sub.next = time.Now().Add(sub.interval)
+	revised := &uaEncoder{}
+	sub.encodeRevised(revised)
+	s.mu.Unlock()
+
+	r.respond(uaModifySubscriptionResponse, func(e *uaEncoder) {
+		e.b = append(e.b, revised.b...)
+	})
+}
+
+// eachSubscription answers a request that applies fn to a list of
+// subscriptions with the status for each of them.
+func (s *OPCUAServer) eachSubscription(r *uaRequest, d *uaDecoder, typeID uint32, fn func(sub *uaSubscription) uaStatus) {
+	ids := d.uint32s()
+	switch {
+	case d.err != nil:
+		r.fault(uaBadDecodingError)
+		return
+	case len(ids) == 0:
+		r.fault(uaBadNothingToDo)
+		return
+	}
+	results := make([]uaStatus, len(ids))
+	s.mu.Lock()
+	for i, id := range ids {
+		results[i] = uaBadSubscriptionIDInvalid
+		if sub := r.session.subs[id]; sub != nil {
+			results[i] = fn(sub)
+		}
+	}
+	s.mu.Unlock()
+	r.respond(typeID, func(e *uaEncoder) {
+		e.int32(int32(len(results)))
+		for _, status := range results {
+			e.status(status)
+		}
+		e.emptyDiagnostics()
+	})
+}
+
+func (s *OPCUAServer) setPublishingMode(r *uaRequest, d *uaDecoder) {
+	enabled := d.bool()
+	s.eachSubscription(r, d, uaSetPublishingModeResponse, func(sub *uaSubscription) uaStatus {
+		sub.enabled = enabled
+		return uaGood
+	})
+}
+
+func (s *OPCUAServer) deleteSubscriptions(r *uaRequest, d *uaDecoder) {
+	s.eachSubscription(r, d, uaDeleteSubscriptionsResponse, func(sub *uaSubscription) uaStatus {
+		delete(r.session.subs, sub.id)
+		return uaGood
+	})
+
+	// Publish requests cannot be answered without subscriptions
+	var out []uaOutgoing
+	s.mu.Lock()
+	if len(r.session.subs) == 0 {
+		for p := r.session.nextPublish(); p != nil; p = r.session.nextPublish() {
+			out = append(out, uaOutgoing{request: p.request, status: uaBadNoSubscription})
+		}
+	}
+	s.mu.Unlock()
+	for _, o := range out {
+		o.send()
+	}
+}
+
+// decodeMonitoringParameters reads MonitoringParameters into item and
+// checks the filter.
+func decodeMonitoringParameters(d *uaDecoder, item *uaMonitoredItem) uaStatus {
+	item.handle = d.uint32()
+	d.double() // Sampling interval, the publishing interval is used
+	filterType, filter := d.extensionObject()
+	d.uint32() // Queue size, only the last change is kept
+	d.bool()   // Discard oldest
+	item.trigger, item.deadband = uaTriggerStatusValue, 0
+	switch {
+	case filterType.isNull():
+		return uaGood
+	case item.read.attribute != uaAttrValue:
+		return uaBadFilterNotAllowed
+	case filterType != uaNodeID{ID: uaDataChangeFilter}:
+		return uaBadMonitoredItemFilterUnsupp
+	}
+	f := &uaDecoder{b: filter}
+	trigger := f.uint32()
+	deadbandType := f.uint32()
+	deadband := f.double()
+	switch {
+	case f.err != nil || trigger > uaTriggerStatusValueTimestamp:
+		return uaBadMonitoredItemFilterUnsupp
+	case deadbandType == uaDeadbandAbsolute && deadband >= 0:
+		item.deadband = deadband
+	case deadbandType != uaDeadbandNone:
+		// Percent deadbands need an EURange the tags do not have
+		return uaBadMonitoredItemFilterUnsupp
+	}
+	item.trigger = trigger
+	return uaGood
+}
+
+func (s *OPCUAServer) createMonitoredItems(r *uaRequest, d *uaDecoder) {
+	subID := d.uint32()
+	ts := d.uint32()
+	items := make([]*uaMonitoredItem, d.arrayLen())
+	statuses := make([]uaStatus, len(items))
+	for i := range items {
+		item := &uaMonitoredItem{read: decodeReadValue(d), timestamps: ts}
+		item.mode = d.uint32()
+		statuses[i] = decodeMonitoringParameters(d, item)
+		items[i] = item
+	}
+	switch {
+	case d.err != nil:
+		r.fault(uaBadDecodingError)
+		return
+	case ts > uaTimestampsNeither:
+		r.fault(uaBadTimestampsToReturnInvalid)
+		return
+	case len(items) == 0:
+		r.fault(uaBadNothingToDo)
+		return
+	}
+
+	space := s.space.Load()
+	s.mu.Lock()
+	sub := r.session.subs[subID]
+	if sub == nil {
+		s.mu.Unlock()
+		r.fault(uaBadSubscriptionIDInvalid)
+		return
+	}
+	for i, item := range items {
+		if statuses[i] != uaGood {
+			continue
+		}
+		dv := s.readValue(space, item.read)
+		switch {
+		case dv.Status == uaBadNodeIDUnknown || dv.Status == uaBadAttributeIDInvalid ||
+			dv.Status == uaBadIndexRangeInvalid || dv.Status == uaBadDataEncodingInvalid:
+			statuses[i] = dv.Status
+		case item.mode > uaModeReporting:
+			statuses[i] = uaBadMonitoringModeInvalid
+		case len(sub.items) >= uaMaxMonitoredItems:
+			statuses[i] = uaBadTooManyMonitoredItems
+		default:
+			item.id = s.nextID()
+			sub.items[item.id] = item
+		}
+	}
+	interval := float64(sub.interval) / float64(time.Millisecond)
+	s.mu.Unlock()
+
+	r.respond(uaCreateMonitoredItemsResp, func(e *uaEncoder) {
+		e.int32(int32(len(items)))
+		for i, item := range items {
+			e.status(statuses[i])
+			e.uint32(item.id)
+			e.double(interval)
+			e.uint32(1)
+			e.extensionObject(0, nil)
+		}
+		e.emptyDiagnostics()
+	})
+}
+
+func (s *OPCUAServer) modifyMonitoredItems(r *uaRequest, d *uaDecoder) {
+	subID := d.uint32()
+	ts := d.uint32()
+	type modify struct {
+		id     uint32
+		params []byte
+	}
+	mods := make([]modify, d.arrayLen())
+	for i := range mods {
+		mods[i].id = d.uint32()
+		// Decoded once the attribute of the item is known
+		start := d.b
+		decodeMonitoringParameters(d, &uaMonitoredItem{})
+		mods[i].params = start[:len(start)-len(d.b)]
+	}
+	switch {
+	case d.err != nil:
+		r.fault(uaBadDecodingError)
+		return
+	case ts > uaTimestampsNeither:
+		r.fault(uaBadTimestampsToReturnInvalid)
+		return
+	case len(mods) == 0:
+		r.fault(uaBadNothingToDo)
+		return
+	}
+
+	statuses := make([]uaStatus, len(mods))
+	s.mu.Lock()
+	sub := r.session.subs[subID]
+	if sub == nil {
+		s.mu.Unlock()
+		r.fault(uaBadSubscriptionIDInvalid)
+		return
+	}
+	for i, m := range mods {
+		item := sub.items[m.id]
+		if item == nil {
+			statuses[i] = uaBadMonitoredItemIDInvalid
+			continue
+		}
+		changed := *item
+		if statuses[i] = decodeMonitoringParameters(&uaDecoder{b: m.params}, &changed); statuses[i] == uaGood {
+			changed.timestamps = ts
+			*item = changed
+		}
+	}
+	interval := float64(sub.interval) / float64(time.Millisecond)
+	s.mu.Unlock()
+
+	r.respond(uaModifyMonitoredItemsResp, func(e *uaEncoder) {
+		e.int32(int32(len(mods)))
+		for _, status := range statuses {
+			e.status(status)
+			e.double(interval)
+			e.uint32(1)
+			e.extensionObject(0, nil)
+		}
+		e.emptyDiagnostics()
+	})
+}
+
+// eachMonitoredItem answers a request that applies fn to a list of
+// monitored items of a subscription with the status for each of them.
+func (s *OPCUAServer) eachMonitoredItem(r *uaRequest, d *uaDecoder, subID uint32, typeID uint32, fn func(sub *uaSubscription, item *uaMonitoredItem) uaStatus) {
+	ids := d.uint32s()
+	switch {
+	case d.err != nil:
+		r.fault(uaBadDecodingError)
+		return
+	case len(ids) == 0:
+		r.fault(uaBadNothingToDo)
+		return
+	}
+	results := make([]uaStatus, len(ids))
+	s.mu.Lock()
+	sub := r.session.subs[subID]
+	if sub == nil {
+		s.mu.Unlock()
+		r.fault(uaBadSubscriptionIDInvalid)
+		return
+	}
+	for i, id := range ids {
+		results[i] = uaBadMonitoredItemIDInvalid
+		if item := sub.items[id]; item != nil {
+			results[i] = fn(sub, item)
+		}
+	}
+	s.mu.Unlock()
+	r.respond(typeID, func(e *uaEncoder) {
+		e.int32(int32(len(results)))
+		for _, status := range results {
+			e.status(status)
+		}
+		e.emptyDiagnostics()
+	})
+}
+
+func (s *OPCUAServer) setMonitoringMode(r *uaRequest, d *uaDecoder) {
+	subID := d.uint32()
+	mode := d.uint32()
+	if mode > uaModeReporting {
+		r.fault(uaBadMonitoringModeInvalid)
+		return
+	}
+	s.eachMonitoredItem(r, d, subID, uaSetMonitoringModeResponse, func(sub *uaSubscription, item *uaMonitoredItem) uaStatus {
+		if mode == uaModeDisabled {
+			item.last, item.pending = nil, nil
+		}
+		item.mode = mode
+		return uaGood
+	})
+}
+
+func (s *OPCUAServer) deleteMonitoredItems(r *uaRequest, d *uaDecoder) {
+	subID := d.uint32()
+	s.eachMonitoredItem(r, d, subID, uaDeleteMonitoredItemsResp, func(sub *uaSubscription, item *uaMonitoredItem) uaStatus {
+		delete(sub.items, item.id)
+		return uaGood
+	})
+}
+
+func (s *OPCUAServer) publish(r *uaRequest, d *uaDecoder) {
+	type ack struct{ sub, seq uint32 }
+	acks := make([]ack, d.arrayLen())
+	for i := range acks {
+		acks[i] = ack{d.uint32(), d.uint32()}
+	}
+	if d.err != nil {
+		r.fault(uaBadDecodingError)
+		return
+	}
+
+	p := &uaPublish{request: r, acks: make([]uaStatus, len(acks))}
+	var out []uaOutgoing
+	s.mu.Lock()
+	session := r.session
+	for i, a := range acks {
+		sub := session.subs[a.sub]
+		if sub == nil {
+			p.acks[i] = uaBadSubscriptionIDInvalid
+			continue
+		}
+		p.acks[i] = uaBadSequenceNumberUnknown
+		for j, m := range sub.retransmit {
+			if m.seq == a.seq {
+				sub.retransmit = append(sub.retransmit[:j], sub.retransmit[j+1:]...)
+				p.acks[i] = uaGood
+				break
+			}
+		}
+	}
+
+	switch {
+	case len(session.subs) == 0:
+		out = append(out, uaOutgoing{request: r, status: uaBadNoSubscription})
+	default:
+		for _, sub := range session.subs {
+			sub.unanswered = 0
+		}
+		var late *uaSubscription
+		for _, sub := range session.subs {
+			if sub.late && (late == nil || sub.id < late.id) {
+				late = sub
+			}
+		}
+		if late != nil {
+			out = append(out, late.message(p, time.Now()))
+			break
+		}
+		session.publishes = append(session.publishes, p)
+		if len(session.publishes) > uaMaxPublishRequests {
+			oldest := session.nextPublish()
+			out = append(out, uaOutgoing{request: oldest.request, status: uaBadTooManyPublishRequests})
+		}
+	}
+	s.mu.Unlock()
+	for _, o := range out {
+		o.send()
+	}
+}
+
+func (s *OPCUAServer) republish(r *uaRequest, d *uaDecoder) {
+	subID := d.uint32()
+	seq := d.uint32()
+	if d.err != nil {
+		r.fault(uaBadDecodingError)
+		return
+	}
+	s.mu.Lock()
+	sub := r.session.subs[subID]
+	var msg []byte
+	if sub != nil {
+		for _, m := range sub.retransmit {
+			if m.seq == seq {
+				msg = m.body
+			}
+		}
+	}
+	s.mu.Unlock()
+	switch {
+	case sub == nil:
+		r.fault(uaBadSubscriptionIDInvalid)
+	case msg == nil:
+		r.fault(uaBadMessageNotAvailable)
+	default:
+		r.respond(uaRepublishResponse, func(e *uaEncoder) {
+			e.b = append(e.b, msg...)
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/robinson/gos7"
+)
+
+// Block type codes accepted by gos7's GetAgBlockInfo.
+const (
+	BlockTypeOB  = 0x38
+	BlockTypeDB  = 0x41
+	BlockTypeSDB = 0x42
+	BlockTypeFC  = 0x43
+	BlockTypeSFC = 0x44
+	BlockTypeFB  = 0x45
+	BlockTypeSFB = 0x46
+)
+
+// CPU states returned by gos7's PLCGetStatus.
+const (
+	CPUStatusUnknown = 0
+	CPUStatusStop    = 4
+	CPUStatusRun     = 8
+)
+
+// ConnectionTypes maps the PlcConnectionType names to the S7 connection
+// resource codes expected by gos7.
+var ConnectionTypes = map[string]int{
+	"PG":    1,
+	"OP":    2,
+	"BASIC": 3,
+}
+
+// ConnectPLC opens an S7 session to the PLC described by cfg. The returned
+// handler owns the TCP connection and must be closed by the caller.
+func ConnectPLC(cfg Config) (*gos7.TCPClientHandler, gos7.Client, error) {
+	connType, ok := ConnectionTypes[strings.ToUpper(cfg.PlcConnectionType)]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown PLC connection type %q (use PG, OP or BASIC)", cfg.PlcConnectionType)
+	}
+	handler := gos7.NewTCPClientHandlerWithConnectType(net.JoinHostPort(cfg.PlcIP, cfg.PlcPort), cfg.PlcRack, cfg.PlcSlot, connType)
+	handler.IdleTimeout = time.Duration(cfg.ReconnectDelay) * time.Second
+	if err := handler.Connect(); err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to PLC %s: %w", cfg.PlcIP, err)
+	}
+	client := gos7.NewClient(handler)
+	if err := SetPLCPassword(client, cfg.PlcPassword); err != nil {
+		handler.Close()
+		return nil, nil, err
+	}
+	return handler, client, nil
+}
+
+// SetPLCPassword sends the session password to a CPU protected by one. It
+// is needed again for every new connection. An empty password does
+// nothing.
+func SetPLCPassword(client gos7.Client, password string) error {
+	if password == "" {
+		return nil
+	}
+	if err := protect(func() error { return client.SetSessionPassword(password) }); err != nil {
+		return fmt.Errorf("PLC rejected the session password: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SinkRouteConfig selects the tags a sink gets and renames them for it, so
+// one collector can feed several systems with different subsets. A tag is
+// sent when it matches one of Include, or Include is empty, and none of
+// Exclude.
+type SinkRouteConfig struct {
+	Include []TagFilter  `json:"Include"` // Tags sent to the sink, defaults to all tags
+	Exclude []TagFilter  `json:"Exclude"` // Tags taken out of those included
+	Rename  []RenameRule `json:"Rename"`  // The first rule matching a tag renames it
+}
+
+// TagFilter matches tags. Every field that is set must match. Tag, PLC,
+// Measurement and the values of Labels are patterns where * matches any
+// text and ? one character.
+type TagFilter struct {
+	Tag         string            `json:"Tag"`         // Pattern for the tag name, e.g. Energy*
+	Regex       string            `json:"Regex"`       // Regular expression for the tag name
+	PLC         string            `json:"PLC"`         // Pattern for PlcName
+	Measurement string            `json:"Measurement"` // Pattern for the measurement
+	Labels      map[string]string `json:"Labels"`      // Labels of the tag and patterns for their values
+}
+
+// RenameRule renames the tags whose name matches Regex. Name, Measurement
+// and Field may refer to groups of Regex as $1 or ${name}, and need ${1}
+// when a letter, digit or _ follows; those left empty are kept. Field
+// follows a new Name when it was the same as the old one.
+type RenameRule struct {
+	Regex       string `json:"Regex"`
+	Name        string `json:"Name"`
+	Measurement string `json:"Measurement"`
+	Field       string `json:"Field"`
+}
+
+// validate checks the fields of r, reporting problems under path, and
+// returns the tags the sink gets, or all tags when the rules are invalid.
+// tags are the tags of the config, plcName fills in PLC patterns.
+func (r *SinkRouteConfig) validate(path, plcName string, tags []Tag, errs *ConfigErrors) []Tag {
+	before := len(*errs)
+	for _, list := range []struct {
+		name    string
+		filters []TagFilter
+	}{{"Include", r.Include}, {"Exclude", r.Exclude}} {
+		for i, f := range list.filters {
+			f.validate(fmt.Sprintf("%s.%s[%d]", path, list.name, i), errs)
+		}
+	}
+	for i, rule := range r.Rename {
+		p := fmt.Sprintf("%s.Rename[%d]", path, i)
+		if rule.Regex == "" {
+			errs.add(p+".Regex", "is required")
+		} else if _, err := regexp.Compile(rule.Regex); err != nil {
+			errs.add(p+".Regex", "%v", err)
+		}
+		if rule.Name == "" && rule.Measurement == "" && rule.Field == "" {
+			errs.add(p, "needs Name, Measurement or Field")
+		}
+	}
+	if len(*errs) > before {
+		return tags // The rules cannot be applied
+	}
+
+	route := NewTagRoute(*r, plcName, tags)
+	if len(route.Tags()) == 0 && len(tags) > 0 {
+		errs.add(path, "selects none of the tags")
+	}
+	seen := map[string]string{}
+	for i, tag := range route.Tags() {
+		original := tags[route.indexes[i]].Name
+		if first, ok := seen[tag.Name]; ok {
+			errs.add(path+".Rename", "renames %s and %s to %s", first, original, tag.Name)
+		}
+		seen[tag.Name] = original
+	}
+	return route.Tags()
+}
+
+// validate checks the fields of f, reporting problems under path.
+func (f *TagFilter) validate(path string, errs *ConfigErrors) {
+	if f.Tag == "" && f.Regex == "" && f.PLC == "" && f.Measurement == "" && len(f.Labels) == 0 {
+		errs.add(path, "needs Tag, Regex, PLC, Measurement or Labels")
+	}
+	if _, err := regexp.Compile(f.Regex); err != nil {
+		errs.add(path+".Regex", "%v", err)
+	}
+}
+
+// matches reports whether tag of the PLC plcName matches f.
+func (f *TagFilter) matches(tag Tag, plcName string) bool {
+	if f.Tag != "" && !matchPattern(f.Tag, tag.Name) ||
+		f.PLC != "" && !matchPattern(f.PLC, plcName) ||
+		f.Measurement != "" && !matchPattern(f.Measurement, tag.Measurement) {
+		return false
+	}
+	if f.Regex != "" {
+		re, err := regexp.Compile(f.Regex)
+		if err != nil || !re.MatchString(tag.Name) {
+			return false
+		}
+	}
+	for key, pattern := range f.Labels {
+		value, ok := tag.Labels[key]
+		if !ok || !matchPattern(pattern, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPattern reports whether s matches pattern as a whole, where * in
+// pattern matches any text and ? one character. Tag names are full of
+// brackets, so unlike path.Match nothing else is special.
+func matchPattern(pattern, s string) bool {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(expr)
+	return regexp.MustCompile("^(?s:" + expr + ")$").MatchString(s)
+}
+
+// TagRoute is a SinkRouteConfig applied to the tags of a config: the tags
+// a sink gets, renamed for it.
+type TagRoute struct {
+	indexes []int // Of the selected tags in the tags the route was made for
+	tags    []Tag
+}
+
+// NewTagRoute selects and renames tags of the PLC plcName as cfg says. cfg
+// must be valid.
+func NewTagRoute(cfg SinkRouteConfig, plcName string, tags []Tag) *TagRoute {
+	rules := make([]*regexp.Regexp, len(cfg.Rename))
+	for i, rule := range cfg.Rename {
+		rules[i] = regexp.MustCompile(rule.Regex)
+	}
+	r := &TagRoute{}
+	for i, tag := range tags {
+		if !cfg.selects(tag, plcName) {
+			continue
+		}
+		for j, re := range rules {
+			if m := re.FindStringSubmatchIndex(tag.Name); m != nil {
+				tag = cfg.Rename[j].apply(tag, re, m)
+				break
+			}
+		}
+		r.indexes = append(r.indexes, i)
+		r.tags = append(r.tags, tag)
+	}
+	return r
+}
+
+// selects reports whether cfg sends tag to its sink.
+func (cfg *SinkRouteConfig) selects(tag Tag, plcName string) bool {
+	included := len(cfg.Include) == 0
+	for _, f := range cfg.Include {
+		included = included || f.matches(tag, plcName)
+	}
+	if !included {
+		return false
+	}
+	for _, f := range cfg.Exclude {
+		if f.matches(tag, plcName) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply renames tag, whose name re matched at m.
+func (rule *RenameRule) apply(tag Tag, re *regexp.Regexp, m []int) Tag {
+	original := tag.Name
+	expand := func(template string) string {
+		return string(re.ExpandString(nil, template, original, m))
+	}
+	if rule.Name != "" {
+		name := expand(rule.Name)
+		if tag.Field == tag.Name {
+			tag.Field = name
+		}
+		tag.Name = name
+	}
+	if rule.Measurement != "" {
+		tag.Measurement = expand(rule.Measurement)
+	}
+	if rule.Field != "" {
+		tag.Field = expand(rule.Field)
+	}
+	return tag
+}
+
+// Tags returns the tags the sink gets, renamed.
+func (r *TagRoute) Tags() []Tag {
+	return r.tags
+}
+
+// Apply returns the part of batch the sink gets, renamed. batch must hold
+// the values of the tags the route was made for.
+func (r *TagRoute) Apply(batch Batch) Batch {
+	routed := Batch{Time: batch.Time, Tags: r.tags, Values: make([]TagValue, len(r.indexes)), Context: batch.Context, Events: batch.Events}
+	for i, index := range r.indexes {
+		v := batch.Values[index]
+		v.Name = r.tags[i].Name
+		routed.Values[i] = v
+	}
+	return routed
+}
@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"Energy*", "Energy_Total", true},
+		{"Energy*", "Energy", true},
+		{"Energy*", "MainEnergy", false},
+		{"*Temp?", "Oven.Temp1", true},
+		{"*Temp?", "Oven.Temp12", false},
+		{"Motor[1].Speed", "Motor[1].Speed", true},
+		{"Motor[1].Speed", "Motor1.Speed", false},
+		{"Motor[*].Speed", "Motor[12].Speed", true},
+		{"a.b", "axb", false},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestTagRoute(t *testing.T) {
+	tags := []Tag{
+		{TagConfig: TagConfig{Name: "Energy_Total", Measurement: "energy", Field: "Energy_Total", Labels: map[string]string{"area": "utilities"}}},
+		{TagConfig: TagConfig{Name: "Energy_Line1", Measurement: "energy", Field: "kwh", Labels: map[string]string{"area": "line1"}}},
+		{TagConfig: TagConfig{Name: "Motor[1].Speed", Measurement: "plc", Field: "Motor[1].Speed", Labels: map[string]string{"area": "line1"}}},
+		{TagConfig: TagConfig{Name: "Motor[2].Speed", Measurement: "plc", Field: "Motor[2].Speed"}},
+		{TagConfig: TagConfig{Name: "Debug_Counter", Measurement: "plc", Field: "Debug_Counter"}},
+	}
+	tests := []struct {
+		name  string
+		route SinkRouteConfig
+		want  []string // Name/Measurement/Field of the tags sent
+	}{
+		{"all", SinkRouteConfig{}, []string{
+			"Energy_Total/energy/Energy_Total", "Energy_Line1/energy/kwh", "Motor[1].Speed/plc/Motor[1].Speed",
+			"Motor[2].Speed/plc/Motor[2].Speed", "Debug_Counter/plc/Debug_Counter",
+		}},
+		{"include pattern", SinkRouteConfig{Include: []TagFilter{{Tag: "Energy*"}}}, []string{
+			"Energy_Total/energy/Energy_Total", "Energy_Line1/energy/kwh",
+		}},
+		{"include regex or label", SinkRouteConfig{Include: []TagFilter{{Regex: `^Motor\[2\]`}, {Labels: map[string]string{"area": "line*"}}}}, []string{
+			"Energy_Line1/energy/kwh", "Motor[1].Speed/plc/Motor[1].Speed", "Motor[2].Speed/plc/Motor[2].Speed",
+		}},
+		{"every field of a filter", SinkRouteConfig{Include: []TagFilter{{Measurement: "energy", Labels: map[string]string{"area": "line1"}}}}, []string{
+			"Energy_Line1/energy/kwh",
+		}},
+		{"exclude", SinkRouteConfig{Exclude: []TagFilter{{Tag: "Debug_*"}, {Measurement: "energy"}}}, []string{
+			"Motor[1].Speed/plc/Motor[1].Speed", "Motor[2].Speed/plc/Motor[2].Speed",
+		}},
+		{"PLC", SinkRouteConfig{Include: []TagFilter{{PLC: "press*", Tag: "Motor*"}}}, nil},
+		{"rename", SinkRouteConfig{
+			Include: []TagFilter{{Tag: "Motor*"}, {Tag: "Energy_*"}},
+			Rename: []RenameRule{
+				{Regex: `^Motor\[(\d+)\]\.(\w+)$`, Name: "m${1}_$2", Measurement: "motor$1"},
+				{Regex: `^Energy_(?P<part>.*)`, Field: "${part}_kwh"},
+				{Regex: `^Motor`, Name: "never"}, // The first rule that matches wins
+			},
+		}, []string{
+			"Energy_Total/energy/Total_kwh", "Energy_Line1/energy/Line1_kwh", "m1_Speed/motor1/m1_Speed", "m2_Speed/motor2/m2_Speed",
+		}},
+	}
+	for _, tt := range tests {
+		var errs ConfigErrors
+		tt.route.validate("Route", "line1", tags, &errs)
+		if len(errs) > 0 && len(tt.want) > 0 {
+			t.Errorf("%s: %v", tt.name, errs)
+		}
+		r := NewTagRoute(tt.route, "line1", tags)
+		var got []string
+		for _, tag := range r.Tags() {
+			got = append(got, tag.Name+"/"+tag.Measurement+"/"+tag.Field)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTagRouteApply(t *testing.T) {
+	tags := []Tag{
+		{TagConfig: TagConfig{Name: "A", Field: "A"}},
+		{TagConfig: TagConfig{Name: "B", Field: "B"}},
+		{TagConfig: TagConfig{Name: "C", Field: "C"}},
+	}
+	r := NewTagRoute(SinkRouteConfig{
+		Exclude: []TagFilter{{Tag: "B"}},
+		Rename:  []RenameRule{{Regex: "^C$", Name: "See"}},
+	}, "plc", tags)
+	at := time.Unix(100, 0)
+	batch := Batch{Time: at, Tags: tags, Context: map[string]string{"shift": "early"}, Values: []TagValue{
+		{Name: "A", Value: 1, Quality: QualityGood},
+		{Name: "B", Value: 2, Quality: QualityGood},
+		{Name: "C", Value: 3, Quality: QualityBad},
+	}}
+	routed := r.Apply(batch)
+	if !routed.Time.Equal(at) || routed.Context["shift"] != "early" || len(routed.Tags) != 2 {
+		t.Errorf("routed batch %+v", routed)
+	}
+	if len(routed.Values) != 2 || routed.Values[0].Name != "A" || routed.Values[1].Name != "See" ||
+		routed.Values[1].Value != 3 || routed.Values[1].Quality != QualityBad {
+		t.Errorf("routed values %+v", routed.Values)
+	}
+	if batch.Values[2].Name != "C" {
+		t.Error("Apply renamed the values of the batch")
+	}
+}
+
+func TestSinkRouteValidate(t *testing.T) {
+	tags := []Tag{
+		{TagConfig: TagConfig{Name: "Line1_Speed"}},
+		{TagConfig: TagConfig{Name: "Line2_Speed"}},
+	}
+	tests := []struct {
+		name  string
+		route SinkRouteConfig
+		want  []string // Paths of the problems
+	}{
+		{"valid", SinkRouteConfig{Include: []TagFilter{{Tag: "Line*"}}, Rename: []RenameRule{{Regex: `^(Line\d)_`, Measurement: "$1"}}}, nil},
+		{"empty filter", SinkRouteConfig{Include: []TagFilter{{}}, Exclude: []TagFilter{{Regex: "("}}}, []string{"Route.Include[0]", "Route.Exclude[0].Regex"}},
+		{"bad rule", SinkRouteConfig{Rename: []RenameRule{{Name: "x"}, {Regex: "["}}}, []string{"Route.Rename[0].Regex", "Route.Rename[1].Regex", "Route.Rename[1]"}},
+		{"selects nothing", SinkRouteConfig{Include: []TagFilter{{Tag: "Line3*"}}}, []string{"Route"}},
+		{"same name", SinkRouteConfig{Rename: []RenameRule{{Regex: `_Speed$`, Name: "Speed"}}}, []string{"Route.Rename"}},
+	}
+	for _, tt := range tests {
+		var errs ConfigErrors
+		tt.route.validate("Route", "plc", tags, &errs)
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Path)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: problems at %v, want %v:\n%v", tt.name, got, tt.want, errs)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultSecretsDir is where Docker and Kubernetes mount secrets.
+const DefaultSecretsDir = "/run/secrets"
+
+// SecretsDir returns the directory secret: references are read from,
+// DefaultSecretsDir unless the SECRETS_DIR environment variable is set.
+func SecretsDir() string {
+	if dir := os.Getenv("SECRETS_DIR"); dir != "" {
+		return dir
+	}
+	return DefaultSecretsDir
+}
+
+// secretField is a config field that holds a secret.
+type secretField struct {
+	name  string
+	value *string
+}
+
+// secretFields returns the config fields that hold secrets. Their values
+// may be references that ResolveSecrets replaces with the secret.
+func (c *Config) secretFields() []secretField {
+	fields := []secretField{
+		{"InfluxDBToken", &c.InfluxDBToken},
+		{"PlcPassword", &c.PlcPassword},
+	}
+	for i := range c.StreamSinks {
+		s := &c.StreamSinks[i]
+		fields = append(fields,
+			secretField{fmt.Sprintf("StreamSinks[%d].Password", i), &s.Password},
+			secretField{fmt.Sprintf("StreamSinks[%d].Token", i), &s.Token})
+	}
+	return fields
+}
+
+// ResolveSecrets replaces references in the secret fields with the secrets
+// they name:
+//
+//	env:NAME       the environment variable NAME
+//	file:PATH      the content of a file, without trailing newlines
+//	secret:NAME    the file NAME in SecretsDir, e.g. a Docker secret
+//	keystore:NAME  the secret NAME in the keystore at Keystore
+//
+// Other values are used as they are. The keystore is only opened when it is
+// referenced. Resolved secrets are redacted from the log.
+func (c *Config) ResolveSecrets() ConfigErrors {
+	var errs ConfigErrors
+	var keystore *Keystore
+	var keystoreErr error
+	for _, f := range c.secretFields() {
+		kind, name, ok := strings.Cut(*f.value, ":")
+		if !ok {
+			RegisterSecret(*f.value)
+			continue
+		}
+		var value string
+		var err error
+		switch kind {
+		case "env":
+			var set bool
+			if value, set = os.LookupEnv(name); !set {
+				err = fmt.Errorf("environment variable %s is not set", name)
+			}
+		case "file":
+			value, err = readSecretFile(name)
+		case "secret":
+			value, err = readSecretFile(filepath.Join(SecretsDir(), name))
+		case "keystore":
+			if keystore == nil && keystoreErr == nil {
+				keystore, keystoreErr = c.openKeystore()
+			}
+			if err = keystoreErr; err == nil {
+				value, err = keystore.Get(name)
+			}
+		default:
+			// Not a reference, e.g. a token that happens to contain a colon.
+			RegisterSecret(*f.value)
+			continue
+		}
+		if err != nil {
+			errs.add(f.name, "%v", err)
+			continue
+		}
+		*f.value = value
+		RegisterSecret(value)
+	}
+	return errs
+}
+
+func (c *Config) openKeystore() (*Keystore, error) {
+	if c.Keystore == "" {
+		return nil, fmt.Errorf("keystore: references need Keystore to be set")
+	}
+	key, err := MasterKey()
+	if err != nil {
+		return nil, err
+	}
+	return OpenKeystore(c.Keystore, key, false)
+}
+
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read secret: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Redacted returns a copy of the config that is safe to show: secrets are
+// replaced by a placeholder, references to them are kept.
+func (c Config) Redacted() Config {
+	// The slices are shared with the caller's config, copy them first.
+	c.StreamSinks = append([]StreamSinkConfig(nil), c.StreamSinks...)
+	for _, f := range c.secretFields() {
+		if *f.value != "" && !isSecretRef(*f.value) {
+			*f.value = redactedSecret
+		}
+	}
+	// Hashes are not secrets, but there is no reason to hand them out.
+	c.WebUsers = append([]WebUser(nil), c.WebUsers...)
+	for i := range c.WebUsers {
+		c.WebUsers[i].Password = redactedSecret
+	}
+	c.WebAPIKeys = append([]WebAPIKey(nil), c.WebAPIKeys...)
+	for i := range c.WebAPIKeys {
+		c.WebAPIKeys[i].Key = redactedSecret
+	}
+	return c
+}
+
+func isSecretRef(value string) bool {
+	kind, _, ok := strings.Cut(value, ":")
+	switch kind {
+	case "env", "file", "secret", "keystore":
+		return ok
+	}
+	return false
+}
+
+// redactedSecret replaces secrets in output.
+const redactedSecret = "********"
+
+var secrets struct {
+	sync.RWMutex
+	values map[string]bool
+}
+
+// RegisterSecret makes the log replace value with a placeholder. Values
+// shorter than four characters are not registered, replacing them would
+// garble unrelated messages.
+func RegisterSecret(value string) {
+	if len(value) < 4 {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	if secrets.values == nil {
+		secrets.values = map[string]bool{}
+	}
+	secrets.values[value] = true
+}
+
+// Redact replaces every registered secret in s with a placeholder.
+func Redact(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for value := range secrets.values {
+		s = strings.ReplaceAll(s, value, redactedSecret)
+	}
+	return s
+}
@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKeystoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	if _, err := OpenKeystore(path, "master", false); err == nil {
+		t.Error("opened a missing keystore without create")
+	}
+	k, err := OpenKeystore(path, "master", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range map[string]string{"influxdb_token": "tok-123456", "plc_password": "päss:word"} {
+		if err := k.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := k.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "tok-123456") {
+		t.Error("the keystore file holds a secret in plain text")
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("keystore file mode %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+
+	k, err = OpenKeystore(path, "master", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := k.Names(); !reflect.DeepEqual(names, []string{"influxdb_token", "plc_password"}) {
+		t.Errorf("names %v", names)
+	}
+	if v, err := k.Get("plc_password"); err != nil || v != "päss:word" {
+		t.Errorf("plc_password = %q, %v", v, err)
+	}
+	if _, err := k.Get("missing"); err == nil {
+		t.Error("got a missing secret")
+	}
+	if !k.Delete("plc_password") || k.Delete("plc_password") {
+		t.Error("Delete does not report whether the secret existed")
+	}
+}
+
+func TestKeystoreBadKey(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keystore.json")
+	k, err := OpenKeystore(path, "master", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Set("a", "secret-a")
+	k.Set("b", "secret-b")
+	if err := k.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenKeystore(path, "wrong", false); err == nil || !strings.Contains(err.Error(), "wrong master key") {
+		t.Errorf("opened with a wrong key: %v", err)
+	}
+	// A value sealed for one name does not open under another.
+	k, err = OpenKeystore(path, "master", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.file.Secrets["a"], k.file.Secrets["b"] = k.file.Secrets["b"], k.file.Secrets["a"]
+	if v, err := k.Get("a"); err == nil || !strings.Contains(err.Error(), "damaged") {
+		t.Errorf("swapped secret opened: %q, %v", v, err)
+	}
+
+	damaged := filepath.Join(dir, "damaged.json")
+	os.WriteFile(damaged, []byte(`{"version": 1, "salt": `), 0o600)
+	if _, err := OpenKeystore(damaged, "master", false); err == nil || !strings.Contains(err.Error(), "damaged") {
+		t.Errorf("opened a damaged keystore: %v", err)
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	dir := t.TempDir()
+	keystore := filepath.Join(dir, "keystore.json")
+	k, err := OpenKeystore(keystore, "master", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Set("token", "from-keystore")
+	if err := k.Save(); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "token.txt"), []byte("from-file\n"), 0o600)
+	os.MkdirAll(filepath.Join(dir, "secrets"), 0o700)
+	os.WriteFile(filepath.Join(dir, "secrets", "token"), []byte("from-secret\r\n"), 0o600)
+	t.Setenv("SECRETS_DIR", filepath.Join(dir, "secrets"))
+	t.Setenv("S7_TEST_TOKEN", "from-env")
+	t.Setenv(MasterKeyEnv, "master")
+
+	tests := []struct {
+		ref      string
+		keystore string
+		want     string // Resolved value, empty for a problem
+	}{
+		{"plain-token", "", "plain-token"},
+		{"abc:def", "", "abc:def"}, // Not a reference
+		{"env:S7_TEST_TOKEN", "", "from-env"},
+		{"file:" + filepath.Join(dir, "token.txt"), "", "from-file"},
+		{"secret:token", "", "from-secret"},
+		{"keystore:token", keystore, "from-keystore"},
+		{"env:S7_TEST_UNSET", "", ""},
+		{"file:" + filepath.Join(dir, "missing"), "", ""},
+		{"keystore:token", "", ""},
+		{"keystore:missing", keystore, ""},
+	}
+	for _, tt := range tests {
+		cfg := Config{InfluxDBToken: tt.ref, Keystore: tt.keystore}
+		errs := cfg.ResolveSecrets()
+		if tt.want == "" {
+			if len(errs) != 1 || errs[0].Path != "InfluxDBToken" || cfg.InfluxDBToken != tt.ref {
+				t.Errorf("%s: %q, %v, want a problem at InfluxDBToken", tt.ref, cfg.InfluxDBToken, errs)
+			}
+			continue
+		}
+		if len(errs) > 0 || cfg.InfluxDBToken != tt.want {
+			t.Errorf("%s: %q, %v, want %q", tt.ref, cfg.InfluxDBToken, errs, tt.want)
+		}
+		if got := Redact("token " + tt.want); got != "token "+redactedSecret {
+			t.Errorf("%s: the log shows %q", tt.ref, got)
+		}
+	}
+}
+
+func TestRedactedConfig(t *testing.T) {
+	cfg := Config{
+		InfluxDBToken: "tok-123456",
+		PlcPassword:   "env:PLC_PASSWORD",
+		StreamSinks:   []StreamSinkConfig{{Token: "nats-token"}},
+		WebUsers:      []WebUser{{Name: "admin", Password: "$2a$10$hash"}},
+	}
+	r := cfg.Redacted()
+	if r.InfluxDBToken != redactedSecret || r.StreamSinks[0].Token != redactedSecret || r.WebUsers[0].Password != redactedSecret {
+		t.Errorf("secrets shown: %+v", r)
+	}
+	if r.PlcPassword != "env:PLC_PASSWORD" {
+		t.Errorf("reference replaced: %q", r.PlcPassword)
+	}
+	if cfg.StreamSinks[0].Token != "nats-token" || cfg.WebUsers[0].Password != "$2a$10$hash" {
+		t.Error("Redacted changed the original config")
+	}
+}
@@ -0,0 +1,384 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/robinson/gos7"
+)
+
+// SimulatedPLC is an in-memory stand-in for a real PLC. It implements
+// gos7.Client so the collector, the one-shot commands and the web server can
+// be exercised without hardware.
+type SimulatedPLC struct {
+	mu      sync.Mutex
+	dbs     map[int][]byte
+	merkers []byte
+	inputs  []byte
+	outputs []byte
+	timers  []byte
+	counter []byte
+	running bool
+	started time.Time
+	scans   int
+	tags    []Tag         // Tags animated by step
+	clock   time.Duration // Offset of the simulated PLC clock from host time
+}
+
+// simulatedDBSize is the size of every DB the simulator creates on demand.
+const simulatedDBSize = 1024
+
+// NewSimulatedPLC creates a simulator in RUN mode with DB1 pre-created. Call
+// Animate to make it produce changing values.
+func NewSimulatedPLC() *SimulatedPLC {
+	s := &SimulatedPLC{
+		dbs:     map[int][]byte{1: make([]byte, simulatedDBSize)},
+		merkers: make([]byte, 1024),
+		inputs:  make([]byte, 1024),
+		outputs: make([]byte, 1024),
+		timers:  make([]byte, 512),
+		counter: make([]byte, 512),
+		running: true,
+		started: time.Now(),
+	}
+	return s
+}
+
+// Run animates the simulated process until stop is closed.
+func (s *SimulatedPLC) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.step()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Animate makes the simulator change the values of tags on every scan and
+// creates the DBs they use. Writable values such as strings are left alone.
+func (s *SimulatedPLC) Animate(tags []Tag) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tags = tags
+	for _, tag := range tags {
+		if tag.Addr.Area == AreaDB && !tag.Derived() {
+			s.db(tag.Addr.DB)
+		}
+	}
+}
+
+// step advances the simulated process by one scan: numbers follow a sine
+// wave, double words count scans and bits toggle every few seconds.
+func (s *SimulatedPLC) step() {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return
+	}
+	s.scans++
+	scans, tags := s.scans, s.tags
+	s.mu.Unlock()
+
+	t := time.Since(s.started).Seconds()
+	for i, tag := range tags {
+		if tag.Derived() {
+			continue
+		}
+		phase := t/10 + float64(i)
+		var text string
+		switch tag.Addr.Type {
+		case TypeBool:
+			text = strconv.FormatBool(int(t/5+float64(i))%2 == 0)
+		case TypeReal, TypeLReal:
+			text = strconv.FormatFloat(50+25*math.Sin(phase), 'f', 3, 64)
+		case TypeDInt, TypeUDInt, TypeDWord, TypeLInt, TypeULInt, TypeLWord:
+			text = strconv.Itoa(scans)
+		case TypeByte, TypeSInt, TypeUSInt, TypeInt, TypeUInt, TypeWord:
+			text = strconv.Itoa(int(20 + 5*math.Sin(phase)))
+		default:
+			continue
+		}
+		if data, err := EncodeValue(tag.Addr, text); err == nil {
+			WriteAddress(s, tag.Addr, data)
+		}
+	}
+}
+
+func (s *SimulatedPLC) db(number int) []byte {
+	db, ok := s.dbs[number]
+	if !ok {
+		db = make([]byte, simulatedDBSize)
+		s.dbs[number] = db
+	}
+	return db
+}
+
+func (s *SimulatedPLC) copyFrom(area []byte, start, size int, buffer []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if start < 0 || start+size > len(area) {
+		return fmt.Errorf("address out of range")
+	}
+	copy(buffer[:size], area[start:start+size])
+	return nil
+}
+
+func (s *SimulatedPLC) copyTo(area []byte, start, size int, buffer []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if start < 0 || start+size > len(area) {
+		return fmt.Errorf("address out of range")
+	}
+	copy(area[start:start+size], buffer[:size])
+	return nil
+}
+
+func (s *SimulatedPLC) dbArea(number int) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db(number)
+}
+
+func (s *SimulatedPLC) AGReadDB(dbNumber int, start int, size int, buffer []byte) error {
+	return s.copyFrom(s.dbArea(dbNumber), start, size, buffer)
+}
+
+func (s *SimulatedPLC) AGWriteDB(dbNumber int, start int, size int, buffer []byte) error {
+	return s.copyTo(s.dbArea(dbNumber), start, size, buffer)
+}
+
+func (s *SimulatedPLC) AGReadMB(start int, size int, buffer []byte) error {
+	return s.copyFrom(s.merkers, start, size, buffer)
+}
+
+func (s *SimulatedPLC) AGWriteMB(start int, size int, buffer []byte) error {
+	return s.copyTo(s.merkers, start, size, buffer)
+}
+
+func (s *SimulatedPLC) AGReadEB(start int, size int, buffer []byte) error {
+	return s.copyFrom(s.inputs, start, size, buffer)
+}
+
+func (s *SimulatedPLC) AGWriteEB(start int, size int, buffer []byte) error {
+	return s.copyTo(s.inputs, start, size, buffer)
+}
+
+func (s *SimulatedPLC) AGReadAB(start int, size int, buffer []byte) error {
+	return s.copyFrom(s.outputs, start, size, buffer)
+}
+
+func (s *SimulatedPLC) AGWriteAB(start int, size int, buffer []byte) error {
+	return s.copyTo(s.outputs, start, size, buffer)
+}
+
+func (s *SimulatedPLC) AGReadTM(start int, size int, buffer []byte) error {
+	return s.copyFrom(s.timers, start*2, size*2, buffer)
+}
+
+func (s *SimulatedPLC) AGWriteTM(start int, size int, buffer []byte) error {
+	return s.copyTo(s.timers, start*2, size*2, buffer)
+}
+
+func (s *SimulatedPLC) AGReadCT(start int, size int, buffer []byte) error {
+	return s.copyFrom(s.counter, start*2, size*2, buffer)
+}
+
+func (s *SimulatedPLC) AGWriteCT(start int, size int, buffer []byte) error {
+	return s.copyTo(s.counter, start*2, size*2, buffer)
+}
+
+func (s *SimulatedPLC) area(code int, db int) ([]byte, error) {
+	switch code {
+	case s7AreaDB:
+		return s.dbArea(db), nil
+	case s7AreaMerker:
+		return s.merkers, nil
+	case s7AreaInput:
+		return s.inputs, nil
+	case s7AreaOutput:
+		return s.outputs, nil
+	}
+	return nil, fmt.Errorf("unsupported area 0x%02x", code)
+}
+
+func (s *SimulatedPLC) AGReadMulti(dataItems []gos7.S7DataItem, itemsCount int) error {
+	for i := 0; i < itemsCount; i++ {
+		item := &dataItems[i]
+		area, err := s.area(item.Area, item.DBNumber)
+		if err != nil {
+			item.Error = err.Error()
+			continue
+		}
+		if item.WordLen == s7WordLenBit {
+			var b [1]byte
+			if err := s.copyFrom(area, item.Start/8, 1, b[:]); err != nil {
+				item.Error = err.Error()
+				continue
+			}
+			item.Data[0] = (b[0] >> uint(item.Start%8)) & 1
+			continue
+		}
+		if err := s.copyFrom(area, item.Start, item.Amount, item.Data); err != nil {
+			item.Error = err.Error()
+		}
+	}
+	return nil
+}
+
+func (s *SimulatedPLC) AGWriteMulti(dataItems []gos7.S7DataItem, itemsCount int) error {
+	for i := 0; i < itemsCount; i++ {
+		item := dataItems[i]
+		area, err := s.area(item.Area, item.DBNumber)
+		if err != nil {
+			return err
+		}
+		if item.WordLen != s7WordLenBit {
+			if err := s.copyTo(area, item.Start, item.Amount, item.Data); err != nil {
+				return err
+			}
+			continue
+		}
+		s.mu.Lock()
+		pos, mask := item.Start/8, byte(1)<<uint(item.Start%8)
+		if pos >= len(area) {
+			s.mu.Unlock()
+			return fmt.Errorf("address out of range")
+		}
+		if item.Data[0] != 0 {
+			area[pos] |= mask
+		} else {
+			area[pos] &^= mask
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *SimulatedPLC) DBFill(dbnumber int, fillchar int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db := s.db(dbnumber)
+	for i := range db {
+		db[i] = byte(fillchar)
+	}
+	return nil
+}
+
+func (s *SimulatedPLC) DBGet(dbnumber int, usrdata []byte, size int) error {
+	return s.copyFrom(s.dbArea(dbnumber), 0, size, usrdata)
+}
+
+func (s *SimulatedPLC) Read(variable string, buffer []byte) (interface{}, error) {
+	addr, err := ParseAddress(variable)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ReadAddress(s, addr)
+	if err != nil {
+		return nil, err
+	}
+	copy(buffer, data)
+	return DecodeValue(addr, data), nil
+}
+
+func (s *SimulatedPLC) GetAgBlockInfo(blocktype int, blocknum int) (gos7.S7BlockInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db, ok := s.dbs[blocknum]
+	if blocktype != BlockTypeDB || !ok {
+		return gos7.S7BlockInfo{}, fmt.Errorf("block not found")
+	}
+	date := s.started.Format("2006/01/02")
+	return gos7.S7BlockInfo{
+		BlkType:   blocktype,
+		BlkNumber: blocknum,
+		MC7Size:   len(db),
+		LoadSize:  len(db) + 100,
+		CodeDate:  date,
+		IntfDate:  date,
+		Author:    "SIM",
+	}, nil
+}
+
+func (s *SimulatedPLC) PLCHotStart() error { return s.setRunning(true) }
+
+func (s *SimulatedPLC) PLCColdStart() error { return s.setRunning(true) }
+
+func (s *SimulatedPLC) PLCStop() error { return s.setRunning(false) }
+
+func (s *SimulatedPLC) setRunning(running bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = running
+	return nil
+}
+
+func (s *SimulatedPLC) PLCGetStatus() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return CPUStatusRun, nil
+	}
+	return CPUStatusStop, nil
+}
+
+func (s *SimulatedPLC) PGListBlocks() (gos7.S7BlocksList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := gos7.S7BlocksList{OBList: []int{1}, FCList: []int{1}}
+	for number := range s.dbs {
+		list.DBList = append(list.DBList, number)
+	}
+	sort.Ints(list.DBList)
+	return list, nil
+}
+
+func (s *SimulatedPLC) SetSessionPassword(password string) error { return nil }
+
+func (s *SimulatedPLC) ClearSessionPassword() error { return nil }
+
+func (s *SimulatedPLC) GetProtection() (gos7.S7Protection, error) {
+	return gos7.S7Protection{}, nil
+}
+
+func (s *SimulatedPLC) GetOrderCode() (gos7.S7OrderCode, error) {
+	return gos7.S7OrderCode{Code: "6ES7 000-0SIM0-0AB0", V1: 1, V2: 0, V3: 0}, nil
+}
+
+func (s *SimulatedPLC) GetCPUInfo() (gos7.S7CpuInfo, error) {
+	return gos7.S7CpuInfo{
+		ModuleTypeName: "Simulated CPU",
+		SerialNumber:   "SIM-0000001",
+		ASName:         "s7_plc_read",
+		Copyright:      "Original Siemens Equipment",
+		ModuleName:     "SIM",
+	}, nil
+}
+
+func (s *SimulatedPLC) GetCPInfo() (gos7.S7CpInfo, error) {
+	return gos7.S7CpInfo{MaxPduLength: 480, MaxConnections: 8, MaxMpiRate: 187500, MaxBusRate: 12000000}, nil
+}
+
+// PGClockRead sets the PLC clock. The name is inherited from gos7, where the
+// read and write clock functions are swapped.
+func (s *SimulatedPLC) PGClockRead(datetime time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock = time.Until(datetime)
+	return nil
+}
+
+// PGClockWrite returns the PLC clock, see PGClockRead.
+func (s *SimulatedPLC) PGClockWrite() (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().Add(s.clock), nil
+}
@@ -0,0 +1,538 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Batch is the result of one poll as it is handed to sinks.
+type Batch struct {
+	Time   time.Time
+	Tags   []Tag      // Tags[i] is the tag of Values[i]
+	Values []TagValue // Bad values are included, with their Error
+
+	Context map[string]string // Active contexts like the shift and order, nil without
+	Events  []ContextEvent    // Contexts that started or ended with this poll
+
+	Snapshot *Snapshot // Set, without Tags and Values, to hand a snapshot to the sinks
+}
+
+// Sink is an output the poll results are written to, such as InfluxDB or a
+// file. The Dispatcher calls Start, Write, Flush and Close from one
+// goroutine per sink, so they need not be safe for concurrent use; Health
+// and Name may be called from any goroutine.
+type Sink interface {
+	// Name describes the sink in log messages, e.g. "file sink daily".
+	Name() string
+	// Start prepares the sink before its first Write, for example by
+	// connecting to a server. It is called again before the next batch
+	// when it fails.
+	Start(ctx context.Context) error
+	// Write writes the values of one poll.
+	Write(batch Batch) error
+	// Flush waits until everything written so far is delivered.
+	Flush(ctx context.Context) error
+	// Close releases the resources of the sink.
+	Close() error
+	// Health reports why the sink cannot deliver at the moment, for
+	// example a lost connection, and nil when it can.
+	Health() error
+}
+
+// SinkQueueConfig configures the queue of poll results in front of a sink.
+type SinkQueueConfig struct {
+	Size   int    `json:"Size"`   // Poll results the queue holds, defaults to 60
+	OnFull string `json:"OnFull"` // drop-oldest (default), drop-newest or block
+}
+
+// What happens to a poll result when the queue of a sink is full.
+const (
+	QueueDropOldest = "drop-oldest" // The oldest queued result is dropped
+	QueueDropNewest = "drop-newest" // The new result is dropped
+	QueueBlock      = "block"       // The poll waits until the sink catches up
+)
+
+// applyDefaults fills in the optional fields of q.
+func (q *SinkQueueConfig) applyDefaults() {
+	if q.Size == 0 {
+		q.Size = 60
+	}
+	if q.OnFull == "" {
+		q.OnFull = QueueDropOldest
+	}
+}
+
+// validate checks the fields of q, reporting problems under path.
+func (q *SinkQueueConfig) validate(path string, errs *ConfigErrors) {
+	if q.Size < 1 {
+		errs.add(path+".Size", "must be at least 1")
+	}
+	checkOneOf(errs, path+".OnFull", q.OnFull, QueueDropOldest, QueueDropNewest, QueueBlock)
+}
+
+// ConfiguredSink is a sink with the kind it was registered as, and the
+// queue settings, route and aggregation of its config.
+type ConfiguredSink struct {
+	Sink
+	Kind      string
+	Queue     SinkQueueConfig
+	Route     *TagRoute   // nil when the sink gets all tags as they are
+	Aggregate *Aggregator // nil when the sink gets every polled value
+}
+
+// Tags returns the tags the sink gets of tags, the tags of the config.
+func (s ConfiguredSink) Tags(tags []Tag) []Tag {
+	switch {
+	case s.Aggregate != nil:
+		return s.Aggregate.Tags()
+	case s.Route != nil:
+		return s.Route.Tags()
+	}
+	return tags
+}
+
+// SameAggregation reports whether s aggregates the same way as other.
+func (s ConfiguredSink) SameAggregation(other ConfiguredSink) bool {
+	return s.Aggregate.sameAs(other.Aggregate)
+}
+
+// routeTags applies the route of a sink config to tags. It returns the
+// route for ConfiguredSink and the tags the sink gets.
+func routeTags(cfg SinkRouteConfig, plcName string, tags []Tag) (*TagRoute, []Tag) {
+	if len(cfg.Include) == 0 && len(cfg.Exclude) == 0 && len(cfg.Rename) == 0 {
+		return nil, tags
+	}
+	route := NewTagRoute(cfg, plcName, tags)
+	return route, route.Tags()
+}
+
+// SinkFactory opens the sinks of one kind that cfg asks for, none when it
+// asks for none. Sinks in old that the config change does not affect are
+// returned again instead of opening new ones; the factory tells its own
+// sinks apart by their type.
+type SinkFactory func(cfg Config, tags []Tag, old []ConfiguredSink) ([]ConfiguredSink, error)
+
+var sinkKinds []struct {
+	kind string
+	open SinkFactory
+}
+
+// RegisterSink adds a kind of sink that OpenSinks opens. Sinks register
+// themselves from an init function.
+func RegisterSink(kind string, open SinkFactory) {
+	sinkKinds = append(sinkKinds, struct {
+		kind string
+		open SinkFactory
+	}{kind, open})
+}
+
+// OpenSinks opens the sinks of every registered kind that cfg asks for,
+// reusing those of old that are unaffected by the config change. On error
+// the sinks opened here are closed again.
+func OpenSinks(cfg Config, tags []Tag, old []ConfiguredSink) ([]ConfiguredSink, error) {
+	var sinks []ConfiguredSink
+	for _, k := range sinkKinds {
+		opened, err := k.open(cfg, tags, old)
+		if err != nil {
+			closeOpenedSinks(sinks, old)
+			return nil, err
+		}
+		for i := range opened {
+			opened[i].Kind = k.kind
+		}
+		sinks = append(sinks, opened...)
+	}
+	return sinks, nil
+}
+
+// closeOpenedSinks closes the sinks that are not in old, for factories and
+// OpenSinks to clean up after an error.
+func closeOpenedSinks(sinks, old []ConfiguredSink) {
+	for _, s := range sinks {
+		if !containsSink(old, s.Sink) {
+			s.Close()
+		}
+	}
+}
+
+func containsSink(sinks []ConfiguredSink, sink Sink) bool {
+	return slices.ContainsFunc(sinks, func(s ConfiguredSink) bool { return s.Sink == sink })
+}
+
+// SinkStatus is the state of a sink and its queue.
+type SinkStatus struct {
+	Name      string    `json:"name"`
+	Kind      string    `json:"kind"`
+	Healthy   bool      `json:"healthy"`         // Health is nil and the last write succeeded
+	Error     string    `json:"error,omitempty"` // From Health or the last write
+	Queued    int       `json:"queued"`
+	QueueSize int       `json:"queueSize"`
+	OnFull    string    `json:"onFull"`
+	Written   int64     `json:"written"` // Poll results written
+	Failed    int64     `json:"failed"`  // Failed writes, which are tried again
+	Dropped   int64     `json:"dropped"` // Poll results dropped from the full queue or unwritten at shutdown
+	LastWrite time.Time `json:"lastWrite"`
+}
+
+// Dispatcher hands every poll result to all sinks concurrently. Each sink
+// has a bounded queue worked off by a goroutine of its own, so a slow sink
+// stalls neither the poll loop nor the other sinks, unless its queue is set
+// to block. The dispatcher owns the sinks it is given: it starts, flushes
+// and closes them.
+type Dispatcher struct {
+	mu      sync.Mutex
+	queues  []*sinkQueue
+	retired []*sinkQueue // Queues of removed sinks that are still writing
+}
+
+// sinkQueue is the queue and worker of one sink.
+type sinkQueue struct {
+	sink ConfiguredSink
+	done chan struct{}
+
+	mu      sync.Mutex
+	changed *sync.Cond // Signalled when batches are added or taken, or closing is set
+	batches []Batch
+	popped  int64 // Batches removed from the front of batches so far
+	closing bool
+
+	written, failed, dropped int64
+	lastWrite                time.Time
+	lastErr                  error
+}
+
+// NewDispatcher returns a dispatcher without sinks.
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{}
+}
+
+// SetSinks makes sinks the sinks of d. Queues of sinks d has already are
+// kept and take the new queue settings; their aggregation windows carry on
+// unless the aggregation changed, which writes them as they are. Removed
+// sinks write what they have queued in the background and are closed then.
+func (d *Dispatcher) SetSinks(sinks []ConfiguredSink) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var queues []*sinkQueue
+	for _, s := range sinks {
+		i := slices.IndexFunc(d.queues, func(q *sinkQueue) bool { return q.sink.Sink == s.Sink })
+		if i < 0 {
+			queues = append(queues, startSinkQueue(s))
+			continue
+		}
+		q := d.queues[i]
+		q.mu.Lock()
+		if q.sink.SameAggregation(s) {
+			s.Aggregate = q.sink.Aggregate
+		} else {
+			q.flushWindows()
+		}
+		q.sink = s
+		q.changed.Broadcast()
+		q.mu.Unlock()
+		queues = append(queues, q)
+	}
+	d.retired = slices.DeleteFunc(d.retired, (*sinkQueue).finished)
+	for _, q := range d.queues {
+		if !slices.Contains(queues, q) {
+			q.stop()
+			d.retired = append(d.retired, q)
+		}
+	}
+	d.queues = queues
+}
+
+// Dispatch queues batch for every sink. It only waits for sinks whose queue
+// is full and set to block, until ctx is done.
+func (d *Dispatcher) Dispatch(ctx context.Context, batch Batch) {
+	d.mu.Lock()
+	queues := slices.Clone(d.queues)
+	d.mu.Unlock()
+	for _, q := range queues {
+		q.push(ctx, batch)
+	}
+}
+
+// Close writes what is queued, flushes and closes every sink, including
+// removed sinks that are still writing, until ctx is done. It returns an
+// error naming the sinks that did not finish.
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.mu.Lock()
+	queues := append(d.queues, d.retired...)
+	d.queues, d.retired = nil, nil
+	d.mu.Unlock()
+
+	for _, q := range queues {
+		q.stop()
+	}
+	var unfinished []string
+	for _, q := range queues {
+		select {
+		case <-q.done:
+		case <-ctx.Done():
+			unfinished = append(unfinished, q.configured().Name())
+		}
+	}
+	if len(unfinished) > 0 {
+		return fmt.Errorf("sinks did not finish: %v", unfinished)
+	}
+	return nil
+}
+
+// Status returns the state of every sink.
+func (d *Dispatcher) Status() []SinkStatus {
+	d.mu.Lock()
+	queues := slices.Clone(d.queues)
+	d.mu.Unlock()
+	status := make([]SinkStatus, len(queues))
+	for i, q := range queues {
+		status[i] = q.status()
+	}
+	return status
+}
+
+func startSinkQueue(s ConfiguredSink) *sinkQueue {
+	q := &sinkQueue{sink: s, done: make(chan struct{})}
+	q.changed = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+// push routes and aggregates batch for the sink and queues the result.
+func (q *sinkQueue) push(ctx context.Context, batch Batch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closing {
+		return
+	}
+	if batch.Snapshot != nil {
+		// Snapshots capture tags of their own, unrouted and unaggregated.
+		q.add(ctx, batch)
+		return
+	}
+	if q.sink.Route != nil {
+		batch = q.sink.Route.Apply(batch)
+	}
+	if q.sink.Aggregate == nil {
+		q.add(ctx, batch)
+		return
+	}
+	for _, b := range q.sink.Aggregate.Add(batch) {
+		q.add(ctx, b)
+	}
+	// Events are not aggregated but passed on as they happen.
+	if len(batch.Events) > 0 {
+		q.add(ctx, Batch{Time: batch.Time, Context: batch.Context, Events: batch.Events})
+	}
+}
+
+// add queues batch, making room as the OnFull policy says. q.mu is held.
+func (q *sinkQueue) add(ctx context.Context, batch Batch) {
+	if len(q.batches) >= q.sink.Queue.Size && q.sink.Queue.OnFull == QueueBlock {
+		// sync.Cond cannot wait for ctx, so a goroutine wakes the wait
+		// when it is done.
+		stop := context.AfterFunc(ctx, func() {
+			q.mu.Lock()
+			q.changed.Broadcast()
+			q.mu.Unlock()
+		})
+		for len(q.batches) >= q.sink.Queue.Size && q.sink.Queue.OnFull == QueueBlock && !q.closing && ctx.Err() == nil {
+			q.changed.Wait()
+		}
+		stop()
+	}
+	if len(q.batches) >= q.sink.Queue.Size && (q.sink.Queue.OnFull == QueueDropNewest || q.sink.Queue.OnFull == QueueBlock) {
+		q.dropped++
+		return
+	}
+	q.append(batch)
+}
+
+// append queues batch, dropping the oldest batches when the queue is full.
+// q.mu is held.
+func (q *sinkQueue) append(batch Batch) {
+	for len(q.batches) >= q.sink.Queue.Size {
+		q.batches = q.batches[1:]
+		q.popped++
+		q.dropped++
+	}
+	q.batches = append(q.batches, batch)
+	q.changed.Broadcast()
+}
+
+// flushWindows queues the aggregates of the windows in progress, without
+// waiting for room. q.mu is held.
+func (q *sinkQueue) flushWindows() {
+	if q.sink.Aggregate == nil {
+		return
+	}
+	for _, b := range q.sink.Aggregate.Flush() {
+		q.append(b)
+	}
+}
+
+// configured returns the sink with its settings, which SetSinks replaces.
+func (q *sinkQueue) configured() ConfiguredSink {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.sink
+}
+
+// Delays before a failed batch is written again, doubling from
+// sinkRetryDelay up to sinkMaxRetryDelay.
+var (
+	sinkRetryDelay    = time.Second
+	sinkMaxRetryDelay = 30 * time.Second
+)
+
+// run writes the queued batches until the queue is stopped and empty, then
+// flushes and closes the sink. A batch that fails stays at the head of the
+// queue and is written again after a delay, until it is written, OnFull
+// drops it or the queue is stopped.
+func (q *sinkQueue) run() {
+	defer close(q.done)
+	var sink ConfiguredSink
+	started := false
+	delay := sinkRetryDelay
+	for {
+		q.mu.Lock()
+		for len(q.batches) == 0 && !q.closing {
+			q.changed.Wait()
+		}
+		sink = q.sink
+		if len(q.batches) == 0 {
+			q.mu.Unlock()
+			break
+		}
+		batch, head := q.batches[0], q.popped
+		q.mu.Unlock()
+
+		var err error
+		if !started {
+			err = sink.Start(context.Background())
+			started = err == nil
+		}
+		if err == nil {
+			err = sink.Write(batch)
+		}
+
+		q.mu.Lock()
+		if err != nil {
+			if q.lastErr == nil || q.lastErr.Error() != err.Error() {
+				Errorf("Failed to write to %s: %v", sink.Name(), err)
+			}
+			q.failed++
+		} else {
+			if q.lastErr != nil {
+				Infof("Writing to %s again", sink.Name())
+			}
+			q.written++
+			q.lastWrite = time.Now()
+		}
+		q.lastErr = err
+		switch {
+		case err == nil:
+			q.pop(head)
+			delay = sinkRetryDelay
+		case q.closing:
+			// Shutdown does not wait for the sink to come back.
+			if q.pop(head) {
+				q.dropped++
+			}
+		default:
+			q.backOff(delay)
+			delay = min(2*delay, sinkMaxRetryDelay)
+		}
+		q.mu.Unlock()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if started {
+		if err := sink.Flush(ctx); err != nil {
+			Errorf("Failed to flush %s: %v", sink.Name(), err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		Errorf("Failed to close %s: %v", sink.Name(), err)
+	}
+}
+
+// pop removes the batch at the head of the queue once the worker is done
+// with it, unless OnFull dropped it meanwhile. head is q.popped from when
+// the worker took the batch. q.mu is held.
+func (q *sinkQueue) pop(head int64) bool {
+	if q.popped != head {
+		return false
+	}
+	q.batches = q.batches[1:]
+	q.popped++
+	q.changed.Broadcast()
+	return true
+}
+
+// backOff waits for d, or until the queue is stopped. q.mu is held.
+func (q *sinkQueue) backOff(d time.Duration) {
+	expired := false
+	timer := time.AfterFunc(d, func() {
+		q.mu.Lock()
+		expired = true
+		q.changed.Broadcast()
+		q.mu.Unlock()
+	})
+	for !expired && !q.closing {
+		q.changed.Wait()
+	}
+	timer.Stop()
+}
+
+// stop lets the worker write what is queued, including the windows in
+// progress, and close the sink; done is closed then.
+func (q *sinkQueue) stop() {
+	q.mu.Lock()
+	if !q.closing {
+		q.flushWindows()
+	}
+	q.closing = true
+	q.changed.Broadcast()
+	q.mu.Unlock()
+}
+
+// finished reports whether the worker has closed the sink.
+func (q *sinkQueue) finished() bool {
+	select {
+	case <-q.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *sinkQueue) status() SinkStatus {
+	sink := q.configured()
+	health := sink.Health()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := SinkStatus{
+		Name:      sink.Name(),
+		Kind:      sink.Kind,
+		Healthy:   health == nil && q.lastErr == nil,
+		Queued:    len(q.batches),
+		QueueSize: sink.Queue.Size,
+		OnFull:    sink.Queue.OnFull,
+		Written:   q.written,
+		Failed:    q.failed,
+		Dropped:   q.dropped,
+		LastWrite: q.lastWrite,
+	}
+	switch {
+	case health != nil:
+		s.Error = health.Error()
+	case q.lastErr != nil:
+		s.Error = q.lastErr.Error()
+	}
+	return s
+}
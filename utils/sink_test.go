@@ -0,0 +1,280 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSink records the batches it writes by the second of their Time.
+// While hold is set, Write waits until it is closed; the first fail writes
+// return an error.
+type testSink struct {
+	name    string
+	hold    chan struct{}
+	writing chan struct{} // Receives a value when Write starts
+
+	mu      sync.Mutex
+	fail    int
+	written []int64
+	flushed bool
+	closed  bool
+}
+
+func newTestSink(name string) *testSink {
+	return &testSink{name: name, writing: make(chan struct{}, 100)}
+}
+
+func (s *testSink) Name() string                    { return "test sink " + s.name }
+func (s *testSink) Start(ctx context.Context) error { return nil }
+func (s *testSink) Health() error                   { return nil }
+
+func (s *testSink) Write(batch Batch) error {
+	s.writing <- struct{}{}
+	if s.hold != nil {
+		<-s.hold
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail > 0 {
+		s.fail--
+		return errors.New("connection refused")
+	}
+	s.written = append(s.written, batch.Time.Unix())
+	return nil
+}
+
+func (s *testSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushed = true
+	return nil
+}
+
+func (s *testSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// state returns the seconds of the batches written so far and whether the
+// sink was flushed and closed.
+func (s *testSink) state() ([]int64, bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.written...), s.flushed, s.closed
+}
+
+// startTestDispatcher returns a dispatcher of sinks with queues of size
+// and onFull, closed when the test ends.
+func startTestDispatcher(t *testing.T, size int, onFull string, sinks ...*testSink) *Dispatcher {
+	t.Helper()
+	d := NewDispatcher()
+	var configured []ConfiguredSink
+	for _, s := range sinks {
+		configured = append(configured, ConfiguredSink{Sink: s, Kind: "test", Queue: SinkQueueConfig{Size: size, OnFull: onFull}})
+	}
+	d.SetSinks(configured)
+	t.Cleanup(func() {
+		for _, s := range sinks {
+			if s.hold != nil {
+				select {
+				case <-s.hold:
+				default:
+					close(s.hold)
+				}
+			}
+		}
+		d.Close(context.Background())
+	})
+	return d
+}
+
+func testBatch(second int64) Batch {
+	return Batch{Time: time.Unix(second, 0)}
+}
+
+// waitFor fails the test unless cond becomes true within two seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestDispatcherOnFull(t *testing.T) {
+	tests := []struct {
+		onFull  string
+		written []int64
+		blocks  bool
+	}{
+		// The batch being written is the oldest one, so it is dropped
+		// from the queue but still written.
+		{QueueDropOldest, []int64{1, 4, 5}, false},
+		{QueueDropNewest, []int64{1, 2}, false},
+		{QueueBlock, []int64{1, 2}, true},
+	}
+	for _, tt := range tests {
+		sink := newTestSink(tt.onFull)
+		sink.hold = make(chan struct{})
+		d := startTestDispatcher(t, 2, tt.onFull, sink)
+
+		d.Dispatch(context.Background(), testBatch(1))
+		<-sink.writing
+		// The queue holds 1, which is being written, and 2; 3 to 5 find
+		// it full.
+		for i := int64(2); i <= 5; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			start := time.Now()
+			d.Dispatch(ctx, testBatch(i))
+			cancel()
+			if blocked := time.Since(start) >= 50*time.Millisecond; i > 2 && blocked != tt.blocks {
+				t.Errorf("%s: Dispatch of %d blocked %v, want %v", tt.onFull, i, blocked, tt.blocks)
+			}
+		}
+		if status := d.Status()[0]; status.Dropped != 3 || status.Queued != 2 {
+			t.Errorf("%s: %d dropped and %d queued, want 3 and 2", tt.onFull, status.Dropped, status.Queued)
+		}
+		close(sink.hold)
+		waitFor(t, tt.onFull+" writes", func() bool { return d.Status()[0].Queued == 0 })
+		if written, _, _ := sink.state(); !reflect.DeepEqual(written, tt.written) {
+			t.Errorf("%s: wrote %v, want %v", tt.onFull, written, tt.written)
+		}
+	}
+}
+
+func TestDispatcherBlockWaitsForRoom(t *testing.T) {
+	sink := newTestSink("block")
+	sink.hold = make(chan struct{})
+	d := startTestDispatcher(t, 1, QueueBlock, sink)
+	d.Dispatch(context.Background(), testBatch(1))
+	<-sink.writing
+
+	dispatched := make(chan struct{})
+	go func() {
+		d.Dispatch(context.Background(), testBatch(2))
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+		t.Fatal("Dispatch returned while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(sink.hold)
+	<-dispatched
+	waitFor(t, "the writes", func() bool {
+		written, _, _ := sink.state()
+		return len(written) == 2
+	})
+	if status := d.Status()[0]; status.Dropped != 0 || status.Written != 2 {
+		t.Errorf("%d dropped and %d written, want 0 and 2", status.Dropped, status.Written)
+	}
+}
+
+func TestDispatcherSlowSinkDoesNotDelayOthers(t *testing.T) {
+	slow, fast := newTestSink("slow"), newTestSink("fast")
+	slow.hold = make(chan struct{})
+	d := startTestDispatcher(t, 60, QueueDropOldest, slow, fast)
+
+	start := time.Now()
+	for i := int64(1); i <= 3; i++ {
+		d.Dispatch(context.Background(), testBatch(i))
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Dispatch took %v with a stalled sink", elapsed)
+	}
+	waitFor(t, "the fast sink", func() bool {
+		written, _, _ := fast.state()
+		return len(written) == 3
+	})
+	if written, _, _ := slow.state(); len(written) != 0 {
+		t.Errorf("the stalled sink wrote %v", written)
+	}
+	if status := d.Status(); status[0].Queued != 3 || status[1].Queued != 0 {
+		t.Errorf("queued %d and %d, want 3 and 0", status[0].Queued, status[1].Queued)
+	}
+}
+
+func TestDispatcherRetriesFailedBatch(t *testing.T) {
+	defer func(d time.Duration) { sinkRetryDelay = d }(sinkRetryDelay)
+	sinkRetryDelay = time.Millisecond
+	sink := newTestSink("flaky")
+	sink.fail = 2
+	d := startTestDispatcher(t, 60, QueueDropOldest, sink)
+
+	d.Dispatch(context.Background(), testBatch(1))
+	d.Dispatch(context.Background(), testBatch(2))
+	waitFor(t, "the writes", func() bool {
+		written, _, _ := sink.state()
+		return len(written) == 2
+	})
+	if written, _, _ := sink.state(); !reflect.DeepEqual(written, []int64{1, 2}) {
+		t.Errorf("wrote %v, want [1 2]", written)
+	}
+	status := d.Status()[0]
+	if status.Failed != 2 || status.Written != 2 || status.Dropped != 0 || !status.Healthy {
+		t.Errorf("status %+v, want 2 failed and 2 written", status)
+	}
+}
+
+func TestDispatcherClose(t *testing.T) {
+	ok, failing := newTestSink("ok"), newTestSink("failing")
+	ok.hold = make(chan struct{})
+	failing.fail = 100
+	d := NewDispatcher()
+	d.SetSinks([]ConfiguredSink{
+		{Sink: ok, Queue: SinkQueueConfig{Size: 60, OnFull: QueueDropOldest}},
+		{Sink: failing, Queue: SinkQueueConfig{Size: 60, OnFull: QueueDropOldest}},
+	})
+	for i := int64(1); i <= 3; i++ {
+		d.Dispatch(context.Background(), testBatch(i))
+	}
+	<-ok.writing
+
+	// Close writes what is queued, but does not wait for the failing sink
+	// to come back.
+	closed := make(chan error)
+	go func() { closed <- d.Close(context.Background()) }()
+	close(ok.hold)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	written, flushed, isClosed := ok.state()
+	if !reflect.DeepEqual(written, []int64{1, 2, 3}) || !flushed || !isClosed {
+		t.Errorf("ok sink: wrote %v, flushed %v, closed %v", written, flushed, isClosed)
+	}
+	if _, _, isClosed := failing.state(); !isClosed {
+		t.Error("failing sink not closed")
+	}
+	// Nothing is queued after Close.
+	d.Dispatch(context.Background(), testBatch(4))
+	if status := d.Status(); len(status) != 0 {
+		t.Errorf("status after Close: %+v", status)
+	}
+}
+
+func TestDispatcherCloseTimeout(t *testing.T) {
+	stuck := newTestSink("stuck")
+	stuck.hold = make(chan struct{})
+	d := startTestDispatcher(t, 60, QueueDropOldest, stuck)
+	d.Dispatch(context.Background(), testBatch(1))
+	<-stuck.writing
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := d.Close(ctx); err == nil || !strings.Contains(err.Error(), "test sink stuck") {
+		t.Errorf("got %v, want an error naming the stuck sink", err)
+	}
+}
@@ -0,0 +1,423 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SnapshotConfig captures the state of a machine around an event, such as a
+// fault: the values of some tags over the polls before and after the
+// trigger, stored as one record.
+type SnapshotConfig struct {
+	Name        string      `json:"Name"`        // Used in file names and the API
+	Trigger     string      `json:"Trigger"`     // Condition whose rising edge takes a snapshot, e.g. Fault or Current > 80; none to only take them by API
+	Tags        []TagFilter `json:"Tags"`        // Tags captured, defaults to all
+	Pre         int         `json:"Pre"`         // Polls before the trigger included
+	Post        int         `json:"Post"`        // Polls after the trigger included
+	Dir         string      `json:"Dir"`         // Directory of the snapshot files, defaults to snapshots
+	Keep        int         `json:"Keep"`        // Snapshots kept in Dir, older ones are deleted; defaults to 100
+	Measurement string      `json:"Measurement"` // InfluxDB measurement of the snapshots, defaults to snapshot
+}
+
+// maxSnapshotPolls limits Pre and Post, so a snapshot stays one record of a
+// sensible size.
+const maxSnapshotPolls = 3600
+
+var snapshotName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// applyDefaults fills in the optional fields of c.
+func (c *SnapshotConfig) applyDefaults() {
+	if c.Dir == "" {
+		c.Dir = "snapshots"
+	}
+	if c.Keep == 0 {
+		c.Keep = 100
+	}
+	if c.Measurement == "" {
+		c.Measurement = "snapshot"
+	}
+}
+
+// validate checks the fields of c, reporting problems under path. tags are
+// all tags, plcName fills in PLC patterns.
+func (c *SnapshotConfig) validate(path, plcName string, tags []Tag, errs *ConfigErrors) {
+	if !snapshotName.MatchString(c.Name) {
+		errs.add(path+".Name", "must be letters, digits, _ and -, found %q", c.Name)
+	}
+	if c.Trigger != "" {
+		if _, err := compileTrigger(c.Trigger, tags); err != nil {
+			errs.add(path+".Trigger", "%v", err)
+		}
+	}
+	for i, f := range c.Tags {
+		f.validate(fmt.Sprintf("%s.Tags[%d]", path, i), errs)
+	}
+	if len(c.Tags) > 0 && len(c.captured(plcName, tags)) == 0 {
+		errs.add(path+".Tags", "match no tag")
+	}
+	for _, f := range []struct {
+		name  string
+		value int
+	}{{"Pre", c.Pre}, {"Post", c.Post}} {
+		if f.value < 0 || f.value > maxSnapshotPolls {
+			errs.add(path+"."+f.name, "must be 0..%d, found %d", maxSnapshotPolls, f.value)
+		}
+	}
+	if c.Keep < 0 {
+		errs.add(path+".Keep", "must not be negative")
+	}
+}
+
+// captured returns the indexes of the tags among tags that c captures.
+func (c *SnapshotConfig) captured(plcName string, tags []Tag) []int {
+	var indexes []int
+	for i, tag := range tags {
+		if len(c.Tags) == 0 || slices.ContainsFunc(c.Tags, func(f TagFilter) bool { return f.matches(tag, plcName) }) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// compileTrigger compiles the Trigger condition s against tags.
+func compileTrigger(s string, tags []Tag) (*exprNode, error) {
+	node, err := parseExpression(s)
+	if err != nil {
+		return nil, err
+	}
+	index := map[string]int{}
+	for i, tag := range tags {
+		index[tag.Name] = i
+	}
+	err = node.check(func(name string) (int, exprKind, error) {
+		j, ok := index[name]
+		if !ok {
+			return 0, 0, fmt.Errorf("unknown tag %s", name)
+		}
+		kind, ok := exprTagKind(tags[j].Addr.Type)
+		if !ok {
+			return 0, 0, fmt.Errorf("tag %s of type %s cannot be used in expressions", name, tags[j].Addr.Type)
+		}
+		return j, kind, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if node.kind != kindBool {
+		return nil, fmt.Errorf("must be a condition like Fault or Current > 80, not a %s", node.kind)
+	}
+	return node, nil
+}
+
+// Snapshot is the state of the captured tags around a trigger.
+type Snapshot struct {
+	ID      string            `json:"id"` // <name>_<trigger time>, also the file name
+	Name    string            `json:"name"`
+	PLC     string            `json:"plc"`
+	Trigger string            `json:"trigger"` // The condition, or "api"
+	Time    time.Time         `json:"time"`    // Of the poll that triggered it
+	Context map[string]string `json:"context,omitempty"`
+	Samples []SnapshotSample  `json:"samples"`
+
+	Tags        []Tag  `json:"-"` // Of the values of every sample
+	Measurement string `json:"-"` // For InfluxDB
+}
+
+// SnapshotSample is one poll of a snapshot.
+type SnapshotSample struct {
+	Offset int        `json:"offset"` // Polls after the trigger, negative before it
+	Time   time.Time  `json:"time"`
+	Values []TagValue `json:"values"`
+}
+
+// SnapshotInfo describes a stored snapshot.
+type SnapshotInfo struct {
+	ID   string    `json:"id"`
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+// snapshotTimeLayout is the trigger time in snapshot IDs.
+const snapshotTimeLayout = "20060102T150405.000Z"
+
+// splitSnapshotID returns the name and the trigger time of a snapshot ID.
+// Names may contain _ too, the time does not.
+func splitSnapshotID(id string) (name, stamp string) {
+	i := strings.LastIndex(id, "_")
+	if i < 0 {
+		return "", ""
+	}
+	return id[:i], id[i+1:]
+}
+
+// SnapshotRecorder takes the snapshots of a config from the polls. It is
+// safe for concurrent use.
+type SnapshotRecorder struct {
+	mu       sync.Mutex
+	plc      string
+	triggers []*snapshotTrigger
+}
+
+// snapshotTrigger is the state of one SnapshotConfig.
+type snapshotTrigger struct {
+	cfg      SnapshotConfig
+	cond     *exprNode // nil without Trigger
+	tags     []Tag     // Captured
+	indexes  []int     // Of the captured tags in the batches
+	ring     []SnapshotSample
+	last     bool // The condition at the previous poll
+	known    bool // last is known
+	request  bool // Asked for by API
+	active   *Snapshot
+	received int // Polls after the trigger in active
+}
+
+// NewSnapshotRecorder returns a recorder without snapshots.
+func NewSnapshotRecorder() *SnapshotRecorder {
+	return &SnapshotRecorder{}
+}
+
+// SetConfig makes cfg the snapshots taken from the polls of tags, which
+// belong to the PLC plcName. Snapshots in progress are ended and returned,
+// like Flush does, since their tags may have changed.
+func (r *SnapshotRecorder) SetConfig(cfg []SnapshotConfig, plcName string, tags []Tag) []*Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ended := r.flush()
+	r.plc = plcName
+	r.triggers = nil
+	for _, c := range cfg {
+		t := &snapshotTrigger{cfg: c, indexes: c.captured(plcName, tags)}
+		for _, i := range t.indexes {
+			t.tags = append(t.tags, tags[i])
+		}
+		if c.Trigger != "" {
+			var err error
+			if t.cond, err = compileTrigger(c.Trigger, tags); err != nil {
+				Errorf("Snapshot %s: Trigger: %v", c.Name, err)
+			}
+		}
+		r.triggers = append(r.triggers, t)
+	}
+	return ended
+}
+
+// Trigger takes the snapshot name with the next poll.
+func (r *SnapshotRecorder) Trigger(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.trigger(name)
+	switch {
+	case t == nil:
+		return fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	case t.active != nil:
+		return fmt.Errorf("snapshot %s is being taken already", name)
+	}
+	t.request = true
+	return nil
+}
+
+func (r *SnapshotRecorder) trigger(name string) *snapshotTrigger {
+	for _, t := range r.triggers {
+		if t.cfg.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// Update adds the poll batch to the snapshots and returns those that are
+// complete, after saving them to their files. A trigger while the snapshot
+// is being taken is ignored.
+func (r *SnapshotRecorder) Update(batch Batch) []*Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var complete []*Snapshot
+	for _, t := range r.triggers {
+		sample := SnapshotSample{Time: batch.Time, Values: make([]TagValue, len(t.indexes))}
+		for j, i := range t.indexes {
+			sample.Values[j] = batch.Values[i]
+		}
+
+		fired, source := t.request, "api"
+		t.request = false
+		if t.cond != nil {
+			v, err := t.cond.eval(func(i int) (interface{}, error) {
+				if batch.Values[i].Quality != QualityGood {
+					return nil, fmt.Errorf("%s is bad", batch.Tags[i].Name)
+				}
+				return exprValue(batch.Values[i].Value), nil
+			})
+			// While the condition cannot be evaluated its last value holds.
+			if on, ok := v.(bool); err == nil && ok {
+				if on && t.known && !t.last {
+					fired, source = true, t.cfg.Trigger
+				}
+				t.last, t.known = on, true
+			}
+		}
+
+		switch {
+		case t.active != nil:
+			sample.Offset = t.received + 1
+			t.active.Samples = append(t.active.Samples, sample)
+			t.received++
+			if fired {
+				Warnf("Snapshot %s: triggered while the last one is being taken, ignored", t.cfg.Name)
+			}
+		case fired:
+			t.active = &Snapshot{
+				ID:          t.cfg.Name + "_" + batch.Time.UTC().Format(snapshotTimeLayout),
+				Name:        t.cfg.Name,
+				PLC:         r.plc,
+				Trigger:     source,
+				Time:        batch.Time,
+				Context:     batch.Context,
+				Tags:        t.tags,
+				Measurement: t.cfg.Measurement,
+			}
+			for j, s := range t.ring {
+				s.Offset = j - len(t.ring)
+				t.active.Samples = append(t.active.Samples, s)
+			}
+			t.active.Samples = append(t.active.Samples, sample)
+			t.received = 0
+			Infof("Snapshot %s triggered by %s", t.cfg.Name, source)
+		}
+		if t.active != nil && t.received >= t.cfg.Post {
+			complete = append(complete, t.end())
+		}
+
+		if t.cfg.Pre > 0 {
+			t.ring = append(t.ring, sample)
+			if len(t.ring) > t.cfg.Pre {
+				t.ring = slices.Delete(t.ring, 0, len(t.ring)-t.cfg.Pre)
+			}
+		}
+	}
+	return complete
+}
+
+// Flush ends the snapshots in progress, saves them to their files and
+// returns them.
+func (r *SnapshotRecorder) Flush() []*Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.flush()
+}
+
+func (r *SnapshotRecorder) flush() []*Snapshot {
+	var ended []*Snapshot
+	for _, t := range r.triggers {
+		if t.active != nil {
+			Infof("Snapshot %s ended after %d of %d poll(s)", t.cfg.Name, t.received, t.cfg.Post)
+			ended = append(ended, t.end())
+		}
+	}
+	return ended
+}
+
+// end saves the snapshot in progress and returns it.
+func (t *snapshotTrigger) end() *Snapshot {
+	s := t.active
+	t.active = nil
+	if err := t.save(s); err != nil {
+		Errorf("Snapshot %s: %v", s.ID, err)
+	} else {
+		Infof("Snapshot %s saved with %d poll(s)", s.ID, len(s.Samples))
+	}
+	return s
+}
+
+// save writes s to a file in Dir and deletes the oldest files beyond Keep.
+func (t *snapshotTrigger) save(s *Snapshot) error {
+	if err := os.MkdirAll(t.cfg.Dir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(t.cfg.Dir, s.ID+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	stored := listSnapshots(t.cfg)
+	for _, old := range stored[min(t.cfg.Keep, len(stored)):] {
+		os.Remove(filepath.Join(t.cfg.Dir, old.ID+".json"))
+	}
+	return nil
+}
+
+// listSnapshots returns the snapshots of cfg stored in its Dir, newest
+// first.
+func listSnapshots(cfg SnapshotConfig) []SnapshotInfo {
+	entries, _ := os.ReadDir(cfg.Dir)
+	var infos []SnapshotInfo
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		name, stamp := splitSnapshotID(id)
+		if !ok || name != cfg.Name || e.IsDir() {
+			continue
+		}
+		t, err := time.Parse(snapshotTimeLayout, stamp)
+		if err != nil {
+			continue
+		}
+		info := SnapshotInfo{ID: id, Name: name, Time: t}
+		if fi, err := e.Info(); err == nil {
+			info.Size = fi.Size()
+		}
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b SnapshotInfo) int { return b.Time.Compare(a.Time) })
+	return infos
+}
+
+// List returns the stored snapshots of all configured snapshots, newest
+// first, only those of name unless it is empty.
+func (r *SnapshotRecorder) List(name string) []SnapshotInfo {
+	r.mu.Lock()
+	configs := make([]SnapshotConfig, 0, len(r.triggers))
+	for _, t := range r.triggers {
+		if name == "" || t.cfg.Name == name {
+			configs = append(configs, t.cfg)
+		}
+	}
+	r.mu.Unlock()
+	infos := []SnapshotInfo{}
+	for _, cfg := range configs {
+		infos = append(infos, listSnapshots(cfg)...)
+	}
+	slices.SortFunc(infos, func(a, b SnapshotInfo) int { return b.Time.Compare(a.Time) })
+	return infos
+}
+
+// ErrSnapshotNotFound is returned for unknown snapshots and snapshot IDs.
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// Read returns the file of the stored snapshot id.
+func (r *SnapshotRecorder) Read(id string) ([]byte, error) {
+	name, _ := splitSnapshotID(id)
+	r.mu.Lock()
+	t := r.trigger(name)
+	r.mu.Unlock()
+	if t == nil || !slices.ContainsFunc(listSnapshots(t.cfg), func(s SnapshotInfo) bool { return s.ID == id }) {
+		return nil, ErrSnapshotNotFound
+	}
+	return os.ReadFile(filepath.Join(t.cfg.Dir, id+".json"))
+}
@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRecorder(t *testing.T) {
+	dir := t.TempDir()
+	tags := []Tag{
+		{TagConfig: TagConfig{Name: "Fault"}, Addr: Address{Type: TypeBool}},
+		{TagConfig: TagConfig{Name: "Current"}, Addr: Address{Type: TypeReal}},
+		{TagConfig: TagConfig{Name: "Speed"}, Addr: Address{Type: TypeReal}},
+	}
+	cfg := []SnapshotConfig{
+		{Name: "fault", Trigger: "Fault", Tags: []TagFilter{{Tag: "Fault"}, {Tag: "Current"}}, Pre: 2, Post: 1, Dir: dir, Keep: 2},
+		{Name: "manual", Post: 2, Dir: dir},
+	}
+	for i := range cfg {
+		cfg[i].applyDefaults()
+	}
+	r := NewSnapshotRecorder()
+	r.SetConfig(cfg, "press1", tags)
+
+	start := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	poll := func(i int, fault interface{}) []*Snapshot {
+		batch := Batch{Time: start.Add(time.Duration(i) * time.Second), Tags: tags, Values: []TagValue{
+			{Name: "Fault", Value: fault, Quality: QualityGood},
+			{Name: "Current", Value: float32(i), Quality: QualityGood},
+			{Name: "Speed", Value: float32(100), Quality: QualityGood},
+		}}
+		if fault == nil {
+			batch.Values[0].Quality = QualityBad
+		}
+		return r.Update(batch)
+	}
+
+	// Fault is set at the first poll, which is not a rising edge; it rises
+	// at 3, 7 and 11. The bad value at 9 leaves it set, so 10 is no edge.
+	faults := []interface{}{true, false, false, true, true, true, false, true, true, nil, false, true, false}
+	var taken []*Snapshot
+	for i, fault := range faults {
+		taken = append(taken, poll(i, fault)...)
+	}
+	if len(taken) != 3 {
+		t.Fatalf("%d snapshots, want 3", len(taken))
+	}
+	s := taken[0]
+	if s.ID != "fault_20240305T100003.000Z" || s.Name != "fault" || s.PLC != "press1" || s.Trigger != "Fault" || !s.Time.Equal(start.Add(3*time.Second)) {
+		t.Errorf("snapshot %s %s %s %s %v", s.ID, s.Name, s.PLC, s.Trigger, s.Time)
+	}
+	var offsets []int
+	var currents []interface{}
+	for _, sample := range s.Samples {
+		offsets = append(offsets, sample.Offset)
+		if len(sample.Values) != 2 || sample.Values[0].Name != "Fault" {
+			t.Errorf("sample %d values %+v, want Fault and Current", sample.Offset, sample.Values)
+			continue
+		}
+		currents = append(currents, sample.Values[1].Value)
+	}
+	if !slices.Equal(offsets, []int{-2, -1, 0, 1}) || !slices.Equal(currents, []interface{}{float32(1), float32(2), float32(3), float32(4)}) {
+		t.Errorf("offsets %v and currents %v", offsets, currents)
+	}
+	for i, want := range []time.Duration{7, 11} {
+		if got := taken[i+1].Time; !got.Equal(start.Add(want * time.Second)) {
+			t.Errorf("snapshot %d at %v, want at %ds", i+1, got, want)
+		}
+	}
+
+	// Only the latest Keep are kept.
+	var ids []string
+	for _, info := range r.List("fault") {
+		ids = append(ids, info.ID)
+	}
+	if want := []string{taken[2].ID, taken[1].ID}; !slices.Equal(ids, want) {
+		t.Errorf("stored %v, want %v", ids, want)
+	}
+	data, err := r.Read(taken[2].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored Snapshot
+	if err := json.Unmarshal(data, &stored); err != nil || stored.ID != taken[2].ID || len(stored.Samples) != 4 {
+		t.Errorf("stored snapshot %+v, %v", stored, err)
+	}
+	for _, id := range []string{taken[0].ID, "manual_20240305T100003.000Z", "../fault_20240305T100011.000Z", "other_20240305T100011.000Z"} {
+		if _, err := r.Read(id); !errors.Is(err, ErrSnapshotNotFound) {
+			t.Errorf("Read(%q): %v, want ErrSnapshotNotFound", id, err)
+		}
+	}
+}
+
+func TestSnapshotTriggerByAPI(t *testing.T) {
+	tags := []Tag{{TagConfig: TagConfig{Name: "Speed"}, Addr: Address{Type: TypeReal}}}
+	cfg := SnapshotConfig{Name: "manual", Post: 3, Dir: t.TempDir()}
+	cfg.applyDefaults()
+	r := NewSnapshotRecorder()
+	r.SetConfig([]SnapshotConfig{cfg}, "press1", tags)
+	start := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	poll := func(i int) []*Snapshot {
+		return r.Update(Batch{Time: start.Add(time.Duration(i) * time.Second), Tags: tags, Context: map[string]string{"batch": "B1"},
+			Values: []TagValue{{Name: "Speed", Value: float32(i), Quality: QualityGood}}})
+	}
+
+	if err := r.Trigger("other"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("Trigger of an unknown snapshot: %v", err)
+	}
+	poll(0)
+	if err := r.Trigger("manual"); err != nil {
+		t.Fatal(err)
+	}
+	poll(1)
+	if err := r.Trigger("manual"); err == nil || !strings.Contains(err.Error(), "being taken") {
+		t.Errorf("Trigger while taking the snapshot: %v", err)
+	}
+	poll(2)
+
+	// Flush ends the snapshot before its Post polls.
+	ended := r.Flush()
+	if len(ended) != 1 {
+		t.Fatalf("Flush returned %d snapshots, want 1", len(ended))
+	}
+	s := ended[0]
+	if s.Trigger != "api" || s.Context["batch"] != "B1" || len(s.Samples) != 2 || s.Samples[1].Offset != 1 {
+		t.Errorf("snapshot %+v", s)
+	}
+	if len(r.Flush()) != 0 || len(r.List("")) != 1 {
+		t.Error("Flush ended the snapshot twice or did not save it")
+	}
+}
+
+func TestSnapshotValidate(t *testing.T) {
+	tags := []Tag{
+		{TagConfig: TagConfig{Name: "Fault"}, Addr: Address{Type: TypeBool}},
+		{TagConfig: TagConfig{Name: "Current"}, Addr: Address{Type: TypeReal}},
+	}
+	tests := []struct {
+		name string
+		cfg  SnapshotConfig
+		want []string // Paths of the problems
+	}{
+		{"valid", SnapshotConfig{Name: "over-current_1", Trigger: "Current > 80 or Fault", Pre: 10, Post: 10}, nil},
+		{"name", SnapshotConfig{Name: "fault 1"}, []string{"S.Name"}},
+		{"trigger not a condition", SnapshotConfig{Name: "a", Trigger: "Current * 2"}, []string{"S.Trigger"}},
+		{"trigger unknown tag", SnapshotConfig{Name: "a", Trigger: "Alarm"}, []string{"S.Trigger"}},
+		{"tags", SnapshotConfig{Name: "a", Tags: []TagFilter{{Tag: "Voltage*"}}}, []string{"S.Tags"}},
+		{"polls", SnapshotConfig{Name: "a", Pre: -1, Post: maxSnapshotPolls + 1, Keep: -1}, []string{"S.Pre", "S.Post", "S.Keep"}},
+	}
+	for _, tt := range tests {
+		var errs ConfigErrors
+		tt.cfg.validate("S", "press1", tags, &errs)
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Path)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: problems at %v, want %v:\n%v", tt.name, got, tt.want, errs)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package utils
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Encodings of stream sink messages.
+const (
+	EncodingJSON     = "json"
+	EncodingProtobuf = "protobuf"
+	EncodingAvro     = "avro"
+)
+
+// streamSample is one tag value as published by stream sinks. Value is a
+// bool, int64, uint64, float64, string or nil, see streamValue.
+type streamSample struct {
+	PLC         string      `json:"plc"`
+	Tag         string      `json:"tag"`
+	Measurement string      `json:"measurement"`
+	Field       string      `json:"field"`
+	Type        string      `json:"type"`
+	Timestamp   time.Time   `json:"timestamp"`
+	Quality     string      `json:"quality"`
+	Value       interface{} `json:"value"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// streamValue converts a decoded tag value to one of the value types of
+// the message schemas. Durations are sent in milliseconds, dates and times
+// as RFC 3339 strings.
+func streamValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, bool, string, int64, uint64, float64:
+		return v
+	case float32:
+		// Keep the digits the PLC shows instead of those of the float64
+		// that is closest to the float32.
+		f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+		return f
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int:
+		return int64(v)
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case time.Duration:
+		return v.Milliseconds()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	f, _ := numericValue(v)
+	return f
+}
+
+// streamEncoding turns samples into message payloads of one Encoding.
+type streamEncoding struct {
+	contentType  string
+	registryType string // schemaType of the Confluent schema registry
+	schema       string
+	encode       func(streamSample) []byte
+}
+
+var streamEncodings = map[string]streamEncoding{
+	EncodingJSON:     {"application/json", "JSON", streamJSONSchema, encodeStreamJSON},
+	EncodingProtobuf: {"application/x-protobuf", "PROTOBUF", streamProtoSchema, encodeStreamProtobuf},
+	EncodingAvro:     {"application/avro", "AVRO", streamAvroSchema, encodeStreamAvro},
+}
+
+// StreamSchema returns the schema of stream sink messages in an Encoding:
+// a JSON Schema, a .proto file or an Avro schema.
+func StreamSchema(encoding string) string {
+	return streamEncodings[encoding].schema
+}
+
+const streamJSONSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "TagSample",
+  "description": "One value of a PLC tag",
+  "type": "object",
+  "required": ["plc", "tag", "measurement", "field", "type", "timestamp", "quality", "value"],
+  "properties": {
+    "plc": { "type": "string" },
+    "tag": { "type": "string" },
+    "measurement": { "type": "string" },
+    "field": { "type": "string" },
+    "type": { "type": "string", "description": "S7 data type, e.g. REAL" },
+    "timestamp": { "type": "string", "format": "date-time" },
+    "quality": { "enum": ["good", "bad"] },
+    "value": {
+      "type": ["boolean", "number", "string", "null"],
+      "description": "null when the quality is bad; TIME values in milliseconds, dates as RFC 3339 strings"
+    },
+    "error": { "type": "string" }
+  }
+}
+`
+
+const streamProtoSchema = `syntax = "proto3";
+
+package s7;
+
+// One value of a PLC tag. TIME values are sent in milliseconds, dates as
+// RFC 3339 strings; value is not set when the quality is bad.
+message TagSample {
+  string plc = 1;
+  string tag = 2;
+  string measurement = 3;
+  string field = 4;
+  string type = 5;
+  int64 timestamp_ms = 6;
+  string quality = 7;
+  oneof value {
+    bool bool_value = 8;
+    int64 int_value = 9;
+    uint64 uint_value = 10;
+    double double_value = 11;
+    string string_value = 12;
+  }
+  string error = 13;
+}
+`
+
+const streamAvroSchema = `{
+  "type": "record",
+  "name": "TagSample",
+  "namespace": "s7",
+  "doc": "One value of a PLC tag",
+  "fields": [
+    {"name": "plc", "type": "string"},
+    {"name": "tag", "type": "string"},
+    {"name": "measurement", "type": "string"},
+    {"name": "field", "type": "string"},
+    {"name": "type", "type": "string"},
+    {"name": "timestamp", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "quality", "type": "string"},
+    {"name": "value", "type": ["null", "boolean", "long", "double", "string"]},
+    {"name": "error", "type": ["null", "string"], "default": null}
+  ]
+}
+`
+
+func encodeStreamJSON(s streamSample) []byte {
+	data, _ := json.Marshal(s)
+	return data
+}
+
+func encodeStreamProtobuf(s streamSample) []byte {
+	var b []byte
+	appendString := func(num protowire.Number, v string) {
+		if v != "" {
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendString(b, v)
+		}
+	}
+	appendString(1, s.PLC)
+	appendString(2, s.Tag)
+	appendString(3, s.Measurement)
+	appendString(4, s.Field)
+	appendString(5, s.Type)
+	if ms := s.Timestamp.UnixMilli(); ms != 0 {
+		b = protowire.AppendTag(b, 6, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(ms))
+	}
+	appendString(7, s.Quality)
+	// Members of a oneof are written even when they hold the zero value.
+	switch v := s.Value.(type) {
+	case bool:
+		b = protowire.AppendTag(b, 8, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case int64:
+		b = protowire.AppendTag(b, 9, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	case uint64:
+		b = protowire.AppendTag(b, 10, protowire.VarintType)
+		b = protowire.AppendVarint(b, v)
+	case float64:
+		b = protowire.AppendTag(b, 11, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case string:
+		b = protowire.AppendTag(b, 12, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	}
+	appendString(13, s.Error)
+	return b
+}
+
+func encodeStreamAvro(s streamSample) []byte {
+	var b []byte
+	appendLong := func(v int64) {
+		b = protowire.AppendVarint(b, protowire.EncodeZigZag(v))
+	}
+	appendString := func(v string) {
+		appendLong(int64(len(v)))
+		b = append(b, v...)
+	}
+	appendString(s.PLC)
+	appendString(s.Tag)
+	appendString(s.Measurement)
+	appendString(s.Field)
+	appendString(s.Type)
+	appendLong(s.Timestamp.UnixMilli())
+	appendString(s.Quality)
+	// Unions start with the index of the branch.
+	switch v := s.Value.(type) {
+	case bool:
+		appendLong(1)
+		if v {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+	case int64:
+		appendLong(2)
+		appendLong(v)
+	case uint64:
+		if v <= math.MaxInt64 {
+			appendLong(2)
+			appendLong(int64(v))
+		} else {
+			appendLong(3)
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(float64(v)))
+		}
+	case float64:
+		appendLong(3)
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	case string:
+		appendLong(4)
+		appendString(v)
+	default:
+		appendLong(0)
+	}
+	if s.Error == "" {
+		appendLong(0)
+	} else {
+		appendLong(1)
+		appendString(s.Error)
+	}
+	return b
+}
+
+// registryFrame prefixes payload with the header of the Confluent schema
+// registry wire format: a zero byte and the schema ID, followed for
+// Protobuf by the index of the message type in the schema.
+func registryFrame(encoding string, id int, payload []byte) []byte {
+	b := make([]byte, 5, 6+len(payload))
+	binary.BigEndian.PutUint32(b[1:], uint32(id))
+	if encoding == EncodingProtobuf {
+		b = append(b, 0) // The first message type
+	}
+	return append(b, payload...)
+}
@@ -0,0 +1,264 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeStreamProtobuf decodes a TagSample message of streamProtoSchema.
+func decodeStreamProtobuf(b []byte) (streamSample, error) {
+	var s streamSample
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return s, protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v uint64
+		var text string
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			text, n = protowire.ConsumeString(b)
+		default:
+			return s, fmt.Errorf("field %d has wire type %d", num, typ)
+		}
+		if n < 0 {
+			return s, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch num {
+		case 1:
+			s.PLC = text
+		case 2:
+			s.Tag = text
+		case 3:
+			s.Measurement = text
+		case 4:
+			s.Field = text
+		case 5:
+			s.Type = text
+		case 6:
+			s.Timestamp = time.UnixMilli(int64(v))
+		case 7:
+			s.Quality = text
+		case 8:
+			s.Value = protowire.DecodeBool(v)
+		case 9:
+			s.Value = int64(v)
+		case 10:
+			s.Value = v
+		case 11:
+			s.Value = math.Float64frombits(v)
+		case 12:
+			s.Value = text
+		case 13:
+			s.Error = text
+		default:
+			return s, fmt.Errorf("unknown field %d", num)
+		}
+	}
+	return s, nil
+}
+
+// avroReader reads the primitive types of the Avro binary encoding.
+type avroReader struct {
+	b   []byte
+	err error
+}
+
+func (r *avroReader) long() int64 {
+	v, n := protowire.ConsumeVarint(r.b)
+	if n < 0 {
+		r.b, r.err = nil, protowire.ParseError(n)
+		return 0
+	}
+	r.b = r.b[n:]
+	return protowire.DecodeZigZag(v)
+}
+
+func (r *avroReader) bytes(n int64) []byte {
+	if n < 0 || n > int64(len(r.b)) {
+		r.b, r.err = nil, fmt.Errorf("%d bytes left, need %d", len(r.b), n)
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *avroReader) string() string {
+	return string(r.bytes(r.long()))
+}
+
+func (r *avroReader) double() float64 {
+	b := r.bytes(8)
+	if b == nil {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b))
+}
+
+// decodeStreamAvro decodes a TagSample record of streamAvroSchema.
+func decodeStreamAvro(b []byte) (streamSample, error) {
+	r := &avroReader{b: b}
+	s := streamSample{
+		PLC:         r.string(),
+		Tag:         r.string(),
+		Measurement: r.string(),
+		Field:       r.string(),
+		Type:        r.string(),
+		Timestamp:   time.UnixMilli(r.long()),
+		Quality:     r.string(),
+	}
+	switch branch := r.long(); branch {
+	case 0:
+	case 1:
+		v := r.bytes(1)
+		s.Value = len(v) == 1 && v[0] == 1
+	case 2:
+		s.Value = r.long()
+	case 3:
+		s.Value = r.double()
+	case 4:
+		s.Value = r.string()
+	default:
+		return s, fmt.Errorf("value: unknown branch %d", branch)
+	}
+	if r.long() == 1 {
+		s.Error = r.string()
+	}
+	if r.err == nil && len(r.b) > 0 {
+		r.err = fmt.Errorf("%d bytes left over", len(r.b))
+	}
+	return s, r.err
+}
+
+// decodeStreamJSON decodes a JSON sample, turning the number value into the
+// type of want.
+func decodeStreamJSON(b []byte, want interface{}) (streamSample, error) {
+	var s streamSample
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&s); err != nil {
+		return s, err
+	}
+	n, ok := s.Value.(json.Number)
+	if !ok {
+		return s, nil
+	}
+	var err error
+	switch want.(type) {
+	case int64:
+		s.Value, err = n.Int64()
+	case uint64:
+		s.Value, err = strconv.ParseUint(n.String(), 10, 64)
+	default:
+		s.Value, err = n.Float64()
+	}
+	return s, err
+}
+
+func TestStreamEncodingsRoundTrip(t *testing.T) {
+	ts := time.UnixMilli(1718000000123)
+	tests := []struct {
+		name string
+		in   interface{} // Decoded tag value, nil for a bad reading
+		want interface{} // Value of the message
+	}{
+		{"true", true, true},
+		{"false", false, false},
+		{"int", int16(-42), int64(-42)},
+		{"zero", int32(0), int64(0)},
+		{"uint", uint64(7), uint64(7)},
+		{"large uint", uint64(math.MaxInt64 + 1), uint64(math.MaxInt64 + 1)},
+		{"real", float32(21.7), 21.7},
+		{"lreal", -1e-300, -1e-300},
+		{"time", 1500 * time.Millisecond, int64(1500)},
+		{"string", "Stufe €", "Stufe €"},
+		{"bad", nil, nil},
+	}
+	for _, tt := range tests {
+		sample := streamSample{
+			PLC:         "Line1",
+			Tag:         "Motor.Speed",
+			Measurement: "line",
+			Field:       "speed",
+			Type:        "REAL",
+			Timestamp:   ts,
+			Quality:     QualityGood,
+			Value:       streamValue(tt.in),
+		}
+		if tt.in == nil {
+			sample.Quality, sample.Error = QualityBad, "address out of range"
+		}
+		want := sample
+		want.Value = tt.want
+
+		// Avro has no unsigned long, uint64 goes in a long when it fits
+		// and in a double otherwise.
+		wantAvro := want
+		if u, ok := tt.want.(uint64); ok {
+			if u <= math.MaxInt64 {
+				wantAvro.Value = int64(u)
+			} else {
+				wantAvro.Value = float64(u)
+			}
+		}
+
+		for _, c := range []struct {
+			encoding string
+			want     streamSample
+			decode   func([]byte) (streamSample, error)
+		}{
+			{EncodingJSON, want, func(b []byte) (streamSample, error) { return decodeStreamJSON(b, tt.want) }},
+			{EncodingProtobuf, want, decodeStreamProtobuf},
+			{EncodingAvro, wantAvro, decodeStreamAvro},
+		} {
+			got, err := c.decode(streamEncodings[c.encoding].encode(sample))
+			if err != nil {
+				t.Errorf("%s %s: %v", tt.name, c.encoding, err)
+				continue
+			}
+			if !got.Timestamp.Equal(c.want.Timestamp) {
+				t.Errorf("%s %s: timestamp %v, want %v", tt.name, c.encoding, got.Timestamp, c.want.Timestamp)
+			}
+			got.Timestamp = c.want.Timestamp
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%s %s:\n got %#v\nwant %#v", tt.name, c.encoding, got, c.want)
+			}
+		}
+	}
+}
+
+func TestRegistryFrame(t *testing.T) {
+	payload := []byte{0xAA, 0xBB}
+	if got, want := registryFrame(EncodingAvro, 258, payload), []byte{0, 0, 0, 1, 2, 0xAA, 0xBB}; !bytes.Equal(got, want) {
+		t.Errorf("avro: % X, want % X", got, want)
+	}
+	if got, want := registryFrame(EncodingProtobuf, 258, payload), []byte{0, 0, 0, 1, 2, 0, 0xAA, 0xBB}; !bytes.Equal(got, want) {
+		t.Errorf("protobuf: % X, want % X", got, want)
+	}
+}
+
+// The JSON Schema and the Avro schema are JSON documents.
+func TestStreamSchemasParse(t *testing.T) {
+	for _, encoding := range []string{EncodingJSON, EncodingAvro} {
+		var schema map[string]interface{}
+		if err := json.Unmarshal([]byte(StreamSchema(encoding)), &schema); err != nil {
+			t.Errorf("%s: %v", encoding, err)
+		}
+	}
+}
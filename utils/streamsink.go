@@ -0,0 +1,842 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// StreamSinkConfig configures a message bus that gets one message per tag
+// and poll, for data platforms that ingest from NATS or Kafka.
+type StreamSinkConfig struct {
+	Name           string   `json:"Name"`           // Used in log messages, defaults to Type and the first server
+	Type           string   `json:"Type"`           // nats, jetstream or kafka
+	Servers        []string `json:"Servers"`        // NATS URLs like nats://host:4222, or Kafka brokers like host:9092
+	Subject        string   `json:"Subject"`        // Subject or topic template, see StreamSink
+	Encoding       string   `json:"Encoding"`       // json (default), protobuf or avro
+	SchemaSubject  string   `json:"SchemaSubject"`  // Where the schema is published, see StreamSink
+	SchemaRegistry string   `json:"SchemaRegistry"` // Kafka only: URL of a Confluent schema registry the schema is registered with
+	Stream         string   `json:"Stream"`         // JetStream only: stream created for Subject when it does not exist
+	Delivery       string   `json:"Delivery"`       // at-least-once (default) or at-most-once; core NATS is always at-most-once
+	BatchSize      int      `json:"BatchSize"`      // Kafka only: most messages per produce request, defaults to 1000
+	Timeout        string   `json:"Timeout"`        // How long the messages of a poll may take to be acknowledged, defaults to 5s
+	Username       string   `json:"Username"`       // NATS user, or Kafka user with SASL
+	Password       string   `json:"Password"`       // Or a reference like InfluxDBToken
+	Token          string   `json:"Token"`          // NATS only: token instead of Username and Password, or a reference like InfluxDBToken
+	Credentials    string   `json:"Credentials"`    // NATS only: .creds file with a user JWT and NKey seed
+	SASL           string   `json:"SASL"`           // Kafka only: plain, scram-sha-256 or scram-sha-512
+	TLS            bool     `json:"TLS"`            // Kafka only: connect with TLS; NATS uses TLS for tls:// URLs
+
+	Queue     SinkQueueConfig     `json:"Queue"`
+	Route     SinkRouteConfig     `json:"Route"`
+	Aggregate SinkAggregateConfig `json:"Aggregate"`
+}
+
+// Types of stream sinks.
+const (
+	StreamNATS      = "nats"
+	StreamJetStream = "jetstream"
+	StreamKafka     = "kafka"
+)
+
+// Delivery guarantees of stream sinks.
+const (
+	AtLeastOnce = "at-least-once"
+	AtMostOnce  = "at-most-once"
+)
+
+// streamPlaceholders are replaced in Subject and SchemaSubject.
+var streamPlaceholders = []string{"{plc}", "{measurement}", "{field}", "{tag}"}
+
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// applyDefaults fills in the optional fields of s.
+func (s *StreamSinkConfig) applyDefaults() {
+	if s.Name == "" {
+		s.Name = s.Type
+		if len(s.Servers) > 0 {
+			s.Name += " " + s.Servers[0]
+		}
+	}
+	if s.Subject == "" {
+		s.Subject = "s7.{plc}.{measurement}.{tag}"
+		if s.Type == StreamKafka {
+			s.Subject = "s7.{plc}"
+		}
+	}
+	if s.SchemaSubject == "" && s.Type != StreamKafka {
+		s.SchemaSubject = "s7.schema.{plc}"
+	}
+	if s.Encoding == "" {
+		s.Encoding = EncodingJSON
+	}
+	if s.Delivery == "" {
+		s.Delivery = AtLeastOnce
+		if s.Type == StreamNATS {
+			s.Delivery = AtMostOnce
+		}
+	}
+	if s.BatchSize == 0 {
+		s.BatchSize = 1000
+	}
+	if s.Timeout == "" {
+		s.Timeout = "5s"
+	}
+	s.Queue.applyDefaults()
+	s.Aggregate.applyDefaults()
+}
+
+// validate checks the fields of s, reporting problems under path. plcName
+// fills in {plc}, tags are all tags.
+func (s *StreamSinkConfig) validate(path, plcName string, tags []Tag, errs *ConfigErrors) {
+	checkOneOf(errs, path+".Type", s.Type, StreamNATS, StreamJetStream, StreamKafka)
+	checkOneOf(errs, path+".Encoding", s.Encoding, EncodingJSON, EncodingProtobuf, EncodingAvro)
+	checkOneOf(errs, path+".Delivery", s.Delivery, AtLeastOnce, AtMostOnce)
+	kafka := s.Type == StreamKafka
+	if len(s.Servers) == 0 {
+		errs.add(path+".Servers", "is required")
+	}
+	for i, server := range s.Servers {
+		p := fmt.Sprintf("%s.Servers[%d]", path, i)
+		if kafka {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				errs.add(p, "must be host:port, found %q", server)
+			}
+		} else if u, err := url.Parse(server); err != nil || u.Host == "" && !strings.Contains(server, ":") {
+			errs.add(p, "must be a URL like nats://host:4222, found %q", server)
+		}
+	}
+	for _, f := range []struct{ name, value string }{{"Subject", s.Subject}, {"SchemaSubject", s.SchemaSubject}} {
+		for _, p := range placeholderPattern.FindAllString(f.value, -1) {
+			switch {
+			case !slices.Contains(streamPlaceholders, p):
+				errs.add(path+"."+f.name, "unknown placeholder %s, use %s", p, strings.Join(streamPlaceholders, ", "))
+			case f.name == "SchemaSubject" && p != "{plc}":
+				errs.add(path+".SchemaSubject", "may only use {plc}")
+			}
+		}
+		if !kafka && strings.ContainsAny(placeholderPattern.ReplaceAllString(f.value, "x"), " \t*>") {
+			errs.add(path+"."+f.name, "must not contain spaces or the wildcards * and >")
+		}
+	}
+	if s.Type == StreamNATS && s.Delivery == AtLeastOnce {
+		errs.add(path+".Delivery", "core NATS does not acknowledge messages, use jetstream for at-least-once")
+	}
+	if d, err := time.ParseDuration(s.Timeout); err != nil {
+		errs.add(path+".Timeout", "invalid duration %q", s.Timeout)
+	} else if d <= 0 {
+		errs.add(path+".Timeout", "must be positive")
+	}
+	if s.BatchSize < 0 {
+		errs.add(path+".BatchSize", "must not be negative")
+	}
+	if s.Stream != "" && s.Type != StreamJetStream {
+		errs.add(path+".Stream", "only applies to jetstream")
+	}
+	if s.Stream != "" && strings.ContainsAny(s.Stream, " \t.*>/\\") {
+		errs.add(path+".Stream", "must not contain spaces, dots, slashes or wildcards")
+	}
+	if s.Stream != "" && s.SchemaSubject != "" &&
+		natsSubjectMatches(streamWildcard(s.Subject, plcName), s.schemaSubject(plcName)) {
+		errs.add(path+".SchemaSubject", "must not be stored by Stream, which would answer requests for the schema")
+	}
+	s.Queue.validate(path+".Queue", errs)
+	routed := s.Route.validate(path+".Route", plcName, tags, errs)
+	s.Aggregate.validate(path+".Aggregate", plcName, routed, errs)
+	if kafka {
+		if s.Token != "" || s.Credentials != "" {
+			errs.add(path, "Token and Credentials only apply to NATS")
+		}
+		if s.SASL != "" {
+			checkOneOf(errs, path+".SASL", s.SASL, "plain", "scram-sha-256", "scram-sha-512")
+			if s.Username == "" {
+				errs.add(path+".Username", "required with SASL")
+			}
+		} else if s.Username != "" {
+			errs.add(path+".SASL", "required with Username")
+		}
+		if s.SchemaRegistry != "" {
+			if u, err := url.Parse(s.SchemaRegistry); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+				errs.add(path+".SchemaRegistry", "must be an http or https URL, found %q", s.SchemaRegistry)
+			}
+		}
+		return
+	}
+	if s.SASL != "" || s.TLS {
+		errs.add(path, "SASL and TLS only apply to Kafka, use tls:// URLs for NATS")
+	}
+	if s.SchemaRegistry != "" {
+		errs.add(path+".SchemaRegistry", "only applies to kafka")
+	}
+	if s.Token != "" && (s.Username != "" || s.Credentials != "") || s.Username != "" && s.Credentials != "" {
+		errs.add(path, "use only one of Username, Token and Credentials")
+	}
+	if s.Credentials != "" && !FileExists(s.Credentials) {
+		errs.add(path+".Credentials", "file %s does not exist", s.Credentials)
+	}
+}
+
+// expandStreamSubject fills in the placeholders of a Subject template for
+// tag. Characters a NATS subject or Kafka topic cannot hold are replaced by
+// _ later, see natsSubject and kafkaTopic.
+func expandStreamSubject(template, plc string, tag Tag) string {
+	return strings.NewReplacer(
+		"{plc}", plc,
+		"{measurement}", tag.Measurement,
+		"{field}", tag.Field,
+		"{tag}", tag.Name,
+	).Replace(template)
+}
+
+// natsSubject makes s a valid NATS subject. Dots are kept, so the dots of
+// struct tags such as Motor.Speed become subject tokens.
+func natsSubject(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '*' || r == '>' {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// kafkaTopic makes s a valid Kafka topic name.
+func kafkaTopic(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+	if len(s) > 249 {
+		s = s[:249]
+	}
+	return s
+}
+
+// schemaSubject returns the SchemaSubject of the sinks of the PLC plcName.
+func (s *StreamSinkConfig) schemaSubject(plcName string) string {
+	subject := expandStreamSubject(s.SchemaSubject, plcName, Tag{})
+	if s.Type == StreamKafka {
+		return kafkaTopic(subject)
+	}
+	return natsSubject(subject)
+}
+
+// natsSubjectMatches reports whether subject matches the subject filter,
+// which may use the wildcards * and >.
+func natsSubjectMatches(filter, subject string) bool {
+	f, s := strings.Split(filter, "."), strings.Split(subject, ".")
+	for i, token := range f {
+		if token == ">" {
+			return len(s) > i
+		}
+		if i >= len(s) || token != "*" && token != s[i] {
+			return false
+		}
+	}
+	return len(f) == len(s)
+}
+
+// streamWildcard returns the NATS subject filter that matches every subject
+// of a Subject template.
+func streamWildcard(template, plc string) string {
+	subject := natsSubject(strings.ReplaceAll(template, "{plc}", plc))
+	i := strings.Index(subject, "{")
+	if i < 0 {
+		return subject
+	}
+	// The tokens from the first placeholder on are unknown, and tag names
+	// may add tokens.
+	return subject[:strings.LastIndex(subject[:i], ".")+1] + ">"
+}
+
+// StreamSink publishes one message per tag and poll to NATS, JetStream or
+// Kafka. Subject is a template that may use {plc}, {measurement}, {field}
+// and {tag}; Kafka messages are keyed by <plc>/<tag>, so the values of a tag
+// stay in order on one partition.
+//
+// The schema of the messages is available at SchemaSubject: NATS answers
+// requests on it, Kafka publishes it to that topic once, keyed by
+// <plc>/<encoding>. With a SchemaRegistry, Kafka registers the schema under
+// <topic>-value and prefixes messages with its ID.
+//
+// At-least-once writes wait up to Timeout for the broker to acknowledge the
+// messages of a poll and retry until then. JetStream messages carry a
+// message ID so the stream drops duplicates of retried messages.
+//
+// The active contexts, such as the shift, are sent as message headers named
+// Context-<name>, lower case for Kafka. Snapshots are published as JSON, see
+// writeSnapshot.
+type StreamSink struct {
+	cfg      StreamSinkConfig
+	plc      string
+	timeout  time.Duration
+	encoding streamEncoding
+	targets  map[string]streamTarget
+
+	mu           sync.Mutex // Guards nc for Health and targets for SetTags
+	nc           *nats.Conn
+	js           jetstream.JetStream
+	streamReady  bool
+	kafka        *kafka.Writer
+	schemaSent   bool
+	schemaFailed bool
+	registry     *http.Client
+	registryIDs  map[string]int
+}
+
+// streamTarget is where the messages of a tag go.
+type streamTarget struct {
+	tag     Tag
+	subject string // NATS subject or Kafka topic
+	key     []byte
+}
+
+func init() {
+	RegisterSink("stream", openStreamSinks)
+}
+
+// openStreamSinks prepares the StreamSinks of cfg, keeping those of old
+// whose settings are the same.
+func openStreamSinks(cfg Config, tags []Tag, old []ConfiguredSink) ([]ConfiguredSink, error) {
+	var sinks []ConfiguredSink
+	for _, sc := range cfg.StreamSinks {
+		route, routed := routeTags(sc.Route, cfg.PlcName, tags)
+		aggregate, routed := aggregateTags(sc.Aggregate, cfg.PlcName, routed)
+		var sink *StreamSink
+		for _, o := range old {
+			if s, ok := o.Sink.(*StreamSink); ok && s.Reusable(sc, cfg.PlcName) && !containsSink(sinks, s) {
+				sink = s
+			}
+		}
+		if sink == nil {
+			var err error
+			if sink, err = OpenStreamSink(sc, cfg.PlcName, routed); err != nil {
+				closeOpenedSinks(sinks, old)
+				return nil, err
+			}
+		} else {
+			sink.SetTags(routed)
+		}
+		sinks = append(sinks, ConfiguredSink{Sink: sink, Queue: sc.Queue, Route: route, Aggregate: aggregate})
+	}
+	return sinks, nil
+}
+
+// OpenStreamSink prepares a stream sink for tags of the PLC plcName. It
+// connects in Start; a broker that cannot be reached yet is connected to in
+// the background.
+func OpenStreamSink(cfg StreamSinkConfig, plcName string, tags []Tag) (*StreamSink, error) {
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("stream sink %s: %w", cfg.Name, err)
+	}
+	s := &StreamSink{cfg: cfg, plc: plcName, timeout: timeout, encoding: streamEncodings[cfg.Encoding]}
+	s.SetTags(tags)
+	return s, nil
+}
+
+// Start connects to the brokers.
+func (s *StreamSink) Start(ctx context.Context) error {
+	if s.cfg.Type == StreamKafka {
+		return s.openKafka()
+	}
+	return s.openNATS()
+}
+
+func (s *StreamSink) openNATS() error {
+	opts := []nats.Option{
+		nats.Name("s7 collector " + s.plc),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true),
+		nats.ConnectHandler(func(nc *nats.Conn) {
+			Infof("Stream sink %s: connected to %s", s.cfg.Name, nc.ConnectedUrlRedacted())
+		}),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			if err != nil {
+				Warnf("Stream sink %s: disconnected: %v", s.cfg.Name, err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			Infof("Stream sink %s: reconnected to %s", s.cfg.Name, nc.ConnectedUrlRedacted())
+		}),
+		nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
+			Errorf("Stream sink %s: %v", s.cfg.Name, err)
+		}),
+	}
+	switch {
+	case s.cfg.Username != "":
+		opts = append(opts, nats.UserInfo(s.cfg.Username, s.cfg.Password))
+	case s.cfg.Token != "":
+		opts = append(opts, nats.Token(s.cfg.Token))
+	case s.cfg.Credentials != "":
+		opts = append(opts, nats.UserCredentials(s.cfg.Credentials))
+	}
+	nc, err := nats.Connect(strings.Join(s.cfg.Servers, ","), opts...)
+	if err != nil {
+		return err
+	}
+	if s.cfg.SchemaSubject != "" {
+		_, err = nc.Subscribe(s.cfg.schemaSubject(s.plc), func(m *nats.Msg) {
+			// Publishes without a reply subject, such as those of a stream
+			// that captures the subject, are not requests.
+			if m.Reply == "" {
+				return
+			}
+			reply := nats.NewMsg(m.Reply)
+			reply.Header.Set("Content-Type", schemaContentType(s.cfg.Encoding))
+			reply.Data = []byte(s.encoding.schema)
+			m.RespondMsg(reply)
+		})
+		if err != nil {
+			nc.Close()
+			return err
+		}
+	}
+	if s.cfg.Type == StreamJetStream {
+		if s.js, err = jetstream.New(nc); err != nil {
+			nc.Close()
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.nc = nc
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *StreamSink) openKafka() error {
+	transport := &kafka.Transport{ClientID: "s7-" + s.plc}
+	if s.cfg.TLS {
+		transport.TLS = &tls.Config{}
+	}
+	var err error
+	switch s.cfg.SASL {
+	case "plain":
+		transport.SASL = plain.Mechanism{Username: s.cfg.Username, Password: s.cfg.Password}
+	case "scram-sha-256":
+		transport.SASL, err = scram.Mechanism(scram.SHA256, s.cfg.Username, s.cfg.Password)
+	case "scram-sha-512":
+		transport.SASL, err = scram.Mechanism(scram.SHA512, s.cfg.Username, s.cfg.Password)
+	}
+	if err != nil {
+		return err
+	}
+	w := &kafka.Writer{
+		Addr:                   kafka.TCP(s.cfg.Servers...),
+		Balancer:               &kafka.Murmur2Balancer{}, // Partitions keys like the Java client
+		BatchSize:              s.cfg.BatchSize,
+		BatchTimeout:           10 * time.Millisecond,
+		WriteTimeout:           s.timeout,
+		RequiredAcks:           kafka.RequireAll,
+		AllowAutoTopicCreation: true,
+		Transport:              transport,
+	}
+	if s.cfg.Delivery == AtMostOnce {
+		// Do not wait for the broker at all; failed batches are only
+		// logged.
+		w.RequiredAcks = kafka.RequireNone
+		w.MaxAttempts = 1
+		w.Async = true
+		w.Completion = func(messages []kafka.Message, err error) {
+			if err != nil {
+				Errorf("Stream sink %s: dropped %d message(s): %v", s.cfg.Name, len(messages), err)
+			}
+		}
+	}
+	if s.cfg.SchemaRegistry != "" {
+		s.registry = &http.Client{Timeout: s.timeout}
+		s.registryIDs = map[string]int{}
+	}
+	s.kafka = w
+	return nil
+}
+
+// schemaContentType returns the media type of the schema of an Encoding.
+func schemaContentType(encoding string) string {
+	switch encoding {
+	case EncodingProtobuf:
+		return "text/x-protobuf"
+	case EncodingAvro:
+		return "application/vnd.apache.avro+json"
+	}
+	return "application/schema+json"
+}
+
+// SetTags sets the tags whose values are published, after a reload. It may
+// be called while Write is in progress.
+func (s *StreamSink) SetTags(tags []Tag) {
+	targets := make(map[string]streamTarget, len(tags))
+	for _, tag := range tags {
+		targets[tag.Name] = s.target(tag)
+	}
+	s.mu.Lock()
+	s.targets = targets
+	s.mu.Unlock()
+}
+
+// target returns where the messages of tag go.
+func (s *StreamSink) target(tag Tag) streamTarget {
+	subject := expandStreamSubject(s.cfg.Subject, s.plc, tag)
+	if s.cfg.Type == StreamKafka {
+		subject = kafkaTopic(subject)
+	} else {
+		subject = natsSubject(subject)
+	}
+	return streamTarget{tag: tag, subject: subject, key: []byte(s.plc + "/" + tag.Name)}
+}
+
+// Reusable reports whether the sink publishes like a sink opened with cfg
+// for plcName would, so a reload can keep it. The queue settings, route and
+// aggregation do not matter, SetTags takes the tags they result in.
+func (s *StreamSink) Reusable(cfg StreamSinkConfig, plcName string) bool {
+	cfg.Queue, cfg.Route, cfg.Aggregate = s.cfg.Queue, s.cfg.Route, s.cfg.Aggregate
+	return reflect.DeepEqual(s.cfg, cfg) && s.plc == plcName
+}
+
+// Name returns the name of the sink for log messages.
+func (s *StreamSink) Name() string {
+	return "stream sink " + s.cfg.Name
+}
+
+// Health reports whether the sink is connected to NATS. Kafka connections
+// are made per request, so their problems only show in Write.
+func (s *StreamSink) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nc != nil && !s.nc.IsConnected() {
+		return fmt.Errorf("not connected to %s", strings.Join(s.cfg.Servers, ", "))
+	}
+	return nil
+}
+
+// sample returns the message of one reading.
+func (s *StreamSink) sample(target streamTarget, r TagValue) streamSample {
+	sample := streamSample{
+		PLC:         s.plc,
+		Tag:         r.Name,
+		Measurement: target.tag.Measurement,
+		Field:       target.tag.Field,
+		Type:        string(target.tag.Addr.Type),
+		Timestamp:   r.Timestamp,
+		Quality:     r.Quality,
+		Error:       r.Error,
+	}
+	if r.Quality == QualityGood {
+		sample.Value = streamValue(r.Value)
+	}
+	return sample
+}
+
+// Write publishes the values of one poll.
+func (s *StreamSink) Write(batch Batch) error {
+	if batch.Snapshot != nil {
+		return s.writeSnapshot(batch.Snapshot)
+	}
+	s.mu.Lock()
+	targets := s.targets
+	s.mu.Unlock()
+	if s.kafka != nil {
+		return s.writeKafka(targets, batch.Values, batch.Context)
+	}
+	return s.writeNATS(targets, batch.Values, batch.Context)
+}
+
+// contextHeader returns the message header of the context name.
+func contextHeader(name string) string {
+	return "Context-" + name
+}
+
+func (s *StreamSink) writeNATS(targets map[string]streamTarget, readings []TagValue, contexts map[string]string) error {
+	// Messages are buffered while the connection is reconnecting, but not
+	// before the server has told whether it supports headers.
+	if !s.nc.HeadersSupported() {
+		if !s.nc.IsConnected() {
+			return fmt.Errorf("not connected to %s yet", strings.Join(s.cfg.Servers, ", "))
+		}
+		return fmt.Errorf("the server does not support headers, NATS 2.2 or later is required")
+	}
+	msgs := make([]*nats.Msg, 0, len(readings))
+	for _, r := range readings {
+		target, ok := targets[r.Name]
+		if !ok {
+			continue
+		}
+		msg := nats.NewMsg(target.subject)
+		msg.Header.Set("Content-Type", s.encoding.contentType)
+		for name, value := range contexts {
+			msg.Header.Set(contextHeader(name), value)
+		}
+		if s.js != nil {
+			// The ID lets the stream drop a message that is published twice.
+			msg.Header.Set(jetstream.MsgIDHeader, fmt.Sprintf("%s/%d", target.key, r.Timestamp.UnixNano()))
+		}
+		msg.Data = s.encoding.encode(s.sample(target, r))
+		msgs = append(msgs, msg)
+	}
+
+	if s.js == nil {
+		for _, msg := range msgs {
+			if err := s.nc.PublishMsg(msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	if err := s.ensureStream(ctx); err != nil {
+		return err
+	}
+	if s.cfg.Delivery == AtMostOnce {
+		for _, msg := range msgs {
+			if _, err := s.js.PublishMsgAsync(msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Publish everything, then wait for the acknowledgements and publish
+	// what failed again until the timeout.
+	pending := msgs
+	var lastErr error
+	for {
+		futures := make([]jetstream.PubAckFuture, 0, len(pending))
+		var failed []*nats.Msg
+		for _, msg := range pending {
+			future, err := s.js.PublishMsgAsync(msg)
+			if err != nil {
+				failed, lastErr = append(failed, msg), err
+				continue
+			}
+			futures = append(futures, future)
+		}
+		for _, future := range futures {
+			select {
+			case <-future.Ok():
+			case err := <-future.Err():
+				failed, lastErr = append(failed, future.Msg()), err
+			case <-ctx.Done():
+				failed, lastErr = append(failed, future.Msg()), ctx.Err()
+			}
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d of %d message(s) not acknowledged: %w", len(failed), len(msgs), lastErr)
+		case <-time.After(100 * time.Millisecond):
+		}
+		pending = failed
+	}
+}
+
+// writeSnapshot publishes snapshot as one JSON message, whatever the
+// Encoding, where a tag named snapshot.<name> would go.
+func (s *StreamSink) writeSnapshot(snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	target := s.target(Tag{TagConfig: TagConfig{
+		Name: "snapshot." + snapshot.Name, Measurement: snapshot.Measurement, Field: snapshot.Name,
+	}})
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	if s.kafka != nil {
+		return s.kafka.WriteMessages(ctx, kafka.Message{
+			Topic:   target.subject,
+			Key:     target.key,
+			Value:   data,
+			Headers: []kafka.Header{{Key: "content-type", Value: []byte("application/json")}},
+			Time:    snapshot.Time,
+		})
+	}
+	msg := nats.NewMsg(target.subject)
+	msg.Header.Set("Content-Type", "application/json")
+	msg.Data = data
+	if s.js == nil {
+		return s.nc.PublishMsg(msg)
+	}
+	msg.Header.Set(jetstream.MsgIDHeader, snapshot.ID)
+	if err := s.ensureStream(ctx); err != nil {
+		return err
+	}
+	if _, err := s.js.PublishMsg(ctx, msg); err != nil && s.cfg.Delivery != AtMostOnce {
+		return err
+	}
+	return nil
+}
+
+// ensureStream creates the Stream of the config once, unless it exists.
+func (s *StreamSink) ensureStream(ctx context.Context) error {
+	if s.cfg.Stream == "" || s.streamReady {
+		return nil
+	}
+	_, err := s.js.Stream(ctx, s.cfg.Stream)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		subject := streamWildcard(s.cfg.Subject, s.plc)
+		_, err = s.js.CreateStream(ctx, jetstream.StreamConfig{Name: s.cfg.Stream, Subjects: []string{subject}})
+		if err == nil {
+			Infof("Stream sink %s: created stream %s for %s", s.cfg.Name, s.cfg.Stream, subject)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("stream %s: %w", s.cfg.Stream, err)
+	}
+	s.streamReady = true
+	return nil
+}
+
+func (s *StreamSink) writeKafka(targets map[string]streamTarget, readings []TagValue, contexts map[string]string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	headers := []kafka.Header{{Key: "content-type", Value: []byte(s.encoding.contentType)}}
+	names := make([]string, 0, len(contexts))
+	for name := range contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		headers = append(headers, kafka.Header{Key: strings.ToLower(contextHeader(name)), Value: []byte(contexts[name])})
+	}
+	if !s.schemaSent && s.cfg.SchemaSubject != "" {
+		topic := s.cfg.schemaSubject(s.plc)
+		err := s.kafka.WriteMessages(ctx, kafka.Message{
+			Topic:   topic,
+			Key:     []byte(s.plc + "/" + s.cfg.Encoding),
+			Value:   []byte(s.encoding.schema),
+			Headers: []kafka.Header{{Key: "content-type", Value: []byte(schemaContentType(s.cfg.Encoding))}},
+		})
+		switch {
+		case err == nil:
+			s.schemaSent = true
+		case !s.schemaFailed:
+			// Tried again with every poll, but only reported once.
+			Warnf("Stream sink %s: cannot publish the schema to %s: %v", s.cfg.Name, topic, err)
+			s.schemaFailed = true
+		}
+	}
+
+	msgs := make([]kafka.Message, 0, len(readings))
+	for _, r := range readings {
+		target, ok := targets[r.Name]
+		if !ok {
+			continue
+		}
+		value := s.encoding.encode(s.sample(target, r))
+		if s.registry != nil {
+			id, err := s.schemaID(ctx, target.subject)
+			if err != nil {
+				return err
+			}
+			value = registryFrame(s.cfg.Encoding, id, value)
+		}
+		msgs = append(msgs, kafka.Message{
+			Topic:   target.subject,
+			Key:     target.key,
+			Value:   value,
+			Headers: headers,
+			Time:    r.Timestamp,
+		})
+	}
+	return s.kafka.WriteMessages(ctx, msgs...)
+}
+
+// schemaID registers the schema for topic with the schema registry, which
+// returns the ID of the existing version when it is registered already.
+func (s *StreamSink) schemaID(ctx context.Context, topic string) (int, error) {
+	if id, ok := s.registryIDs[topic]; ok {
+		return id, nil
+	}
+	body, _ := json.Marshal(map[string]string{"schema": s.encoding.schema, "schemaType": s.encoding.registryType})
+	u := strings.TrimSuffix(s.cfg.SchemaRegistry, "/") + "/subjects/" + url.PathEscape(topic+"-value") + "/versions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	resp, err := s.registry.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("schema registry: %w", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		ID      int    `json:"id"`
+		Message string `json:"message"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("schema registry: %s: %s", resp.Status, result.Message)
+	}
+	Infof("Stream sink %s: schema of %s has ID %d", s.cfg.Name, topic, result.ID)
+	s.registryIDs[topic] = result.ID
+	return result.ID, nil
+}
+
+// Flush waits until the messages published so far are acknowledged by
+// JetStream or sent to NATS. Kafka writes are acknowledged by Write already,
+// at-most-once writes are flushed by Close.
+func (s *StreamSink) Flush(ctx context.Context) error {
+	if s.nc == nil {
+		return nil
+	}
+	if s.js != nil {
+		select {
+		case <-s.js.PublishAsyncComplete():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	err := s.nc.FlushWithContext(ctx)
+	if errors.Is(err, nats.ErrConnectionReconnecting) {
+		return nil // The messages are buffered and sent once reconnected
+	}
+	return err
+}
+
+// Close waits up to Timeout for messages in flight and disconnects.
+func (s *StreamSink) Close() error {
+	if s.kafka != nil {
+		return s.kafka.Close()
+	}
+	if s.nc == nil {
+		return nil
+	}
+	if s.js != nil {
+		select {
+		case <-s.js.PublishAsyncComplete():
+		case <-time.After(s.timeout):
+		}
+	}
+	err := s.nc.FlushTimeout(s.timeout)
+	s.nc.Close()
+	if err != nil && !errors.Is(err, nats.ErrConnectionReconnecting) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,408 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// testNATS is a NATS server that speaks enough of the client protocol for
+// publishing, subscriptions and requests. It has no JetStream.
+type testNATS struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	subs map[*testNATSConn]map[string]string // Subject of every sid
+}
+
+type testNATSConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (c *testNATSConn) send(format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.conn, format, args...)
+}
+
+// startTestNATS runs a testNATS on a free port of the loopback interface
+// and returns its URL.
+func startTestNATS(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testNATS{ln: ln, subs: map[*testNATSConn]map[string]string{}}
+	var wg sync.WaitGroup
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serve(conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		s.mu.Lock()
+		for c := range s.subs {
+			c.conn.Close()
+		}
+		s.mu.Unlock()
+		wg.Wait()
+	})
+	return "nats://" + ln.Addr().String()
+}
+
+func (s *testNATS) serve(conn net.Conn) {
+	c := &testNATSConn{conn: conn}
+	s.mu.Lock()
+	s.subs[c] = map[string]string{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subs, c)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	port := s.ln.Addr().(*net.TCPAddr).Port
+	c.send("INFO {\"server_id\":\"test\",\"version\":\"2.10.0\",\"proto\":1,\"headers\":true,\"max_payload\":1048576,\"host\":\"127.0.0.1\",\"port\":%d}\r\n", port)
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			c.send("PONG\r\n")
+		case "SUB":
+			s.mu.Lock()
+			s.subs[c][args[len(args)-1]] = args[1]
+			s.mu.Unlock()
+		case "UNSUB":
+			s.mu.Lock()
+			delete(s.subs[c], args[1])
+			s.mu.Unlock()
+		case "PUB", "HPUB":
+			// PUB <subject> [reply] <size>, HPUB <subject> [reply] <header size> <size>
+			sizes := 1
+			if args[0] == "HPUB" {
+				sizes = 2
+			}
+			reply := ""
+			if len(args) == 2+sizes+1 {
+				reply = args[2]
+			}
+			size, _ := strconv.Atoi(args[len(args)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			header := ""
+			if sizes == 2 {
+				header = args[len(args)-2] + " "
+			}
+			s.deliver(args[0][:len(args[0])-3]+"MSG", args[1], reply, header, payload[:size])
+		}
+	}
+}
+
+// deliver sends a published message to every matching subscription.
+func (s *testNATS) deliver(op, subject, reply, header string, payload []byte) {
+	if reply != "" {
+		reply += " "
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c, subs := range s.subs {
+		for sid, filter := range subs {
+			if natsSubjectMatches(filter, subject) {
+				c.send("%s %s %s %s%s%d\r\n%s\r\n", op, subject, sid, reply, header, len(payload), payload)
+			}
+		}
+	}
+}
+
+// testJetStream stands in for JetStream. Every message published is
+// recorded and acknowledged, except for the first failures and, with
+// noAcks, every one.
+type testJetStream struct {
+	jetstream.JetStream
+
+	mu        sync.Mutex
+	streams   map[string]jetstream.StreamConfig
+	published []*nats.Msg
+	failures  int
+	noAcks    bool
+}
+
+type testPubAckFuture struct {
+	msg *nats.Msg
+	ok  chan *jetstream.PubAck
+	err chan error
+}
+
+func (f *testPubAckFuture) Ok() <-chan *jetstream.PubAck { return f.ok }
+func (f *testPubAckFuture) Err() <-chan error            { return f.err }
+func (f *testPubAckFuture) Msg() *nats.Msg               { return f.msg }
+
+func (js *testJetStream) Stream(ctx context.Context, name string) (jetstream.Stream, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if _, ok := js.streams[name]; !ok {
+		return nil, jetstream.ErrStreamNotFound
+	}
+	return nil, nil
+}
+
+func (js *testJetStream) CreateStream(ctx context.Context, cfg jetstream.StreamConfig) (jetstream.Stream, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.streams[cfg.Name] = cfg
+	return nil, nil
+}
+
+func (js *testJetStream) PublishMsgAsync(msg *nats.Msg, opts ...jetstream.PublishOpt) (jetstream.PubAckFuture, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.published = append(js.published, msg)
+	f := &testPubAckFuture{msg: msg, ok: make(chan *jetstream.PubAck, 1), err: make(chan error, 1)}
+	switch {
+	case js.noAcks:
+	case js.failures > 0:
+		js.failures--
+		f.err <- errors.New("nats: timeout")
+	default:
+		f.ok <- &jetstream.PubAck{Stream: "S7", Sequence: uint64(len(js.published))}
+	}
+	return f, nil
+}
+
+func (js *testJetStream) PublishAsyncComplete() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// msgs returns the messages published so far.
+func (js *testJetStream) msgs() []*nats.Msg {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return append([]*nats.Msg(nil), js.published...)
+}
+
+// startTestStreamSink starts a stream sink for the tags Speed and
+// Motor.Hours of the PLC Line1. JetStream sinks publish to js.
+func startTestStreamSink(t *testing.T, cfg StreamSinkConfig, js jetstream.JetStream) *StreamSink {
+	t.Helper()
+	cfg.applyDefaults()
+	tags, err := ParseTags(Config{Tags: []TagConfig{
+		{Name: "Speed", Address: "DB1.DBD0:REAL", Measurement: "line"},
+		{Name: "Motor.Hours", Address: "DB1.DBD4:UDINT", Measurement: "line"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var errs ConfigErrors
+	cfg.validate("StreamSinks[0]", "Line1", tags, &errs)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	s, err := OpenStreamSink(cfg, "Line1", tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if js != nil {
+		s.js = js
+	}
+	// Wait for the INFO of the server, which tells whether it supports
+	// headers.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.nc.FlushWithContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testStreamBatch returns the values of a poll at ts, with one tag the sink
+// does not publish.
+func testStreamBatch(ts time.Time) Batch {
+	return Batch{
+		Time: ts,
+		Values: []TagValue{
+			{Name: "Speed", Value: float32(21.5), Quality: QualityGood, Timestamp: ts},
+			{Name: "Motor.Hours", Quality: QualityBad, Error: "address out of range", Timestamp: ts},
+			{Name: "Other", Value: int16(1), Quality: QualityGood, Timestamp: ts},
+		},
+		Context: map[string]string{"Shift": "Early"},
+	}
+}
+
+func TestStreamSinkNATS(t *testing.T) {
+	url := startTestNATS(t)
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	sub, err := nc.SubscribeSync("s7.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc.Flush()
+
+	s := startTestStreamSink(t, StreamSinkConfig{Type: StreamNATS, Servers: []string{url}}, nil)
+	if err := s.Health(); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.UnixMilli(1718000000123)
+	if err := s.Write(testStreamBatch(ts)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		subject string
+		sample  streamSample
+	}{
+		{"s7.Line1.line.Speed", streamSample{
+			PLC: "Line1", Tag: "Speed", Measurement: "line", Field: "Speed", Type: "REAL",
+			Timestamp: ts, Quality: QualityGood, Value: 21.5,
+		}},
+		{"s7.Line1.line.Motor.Hours", streamSample{
+			PLC: "Line1", Tag: "Motor.Hours", Measurement: "line", Field: "Motor.Hours", Type: "UDINT",
+			Timestamp: ts, Quality: QualityBad, Error: "address out of range",
+		}},
+	}
+	for _, w := range want {
+		msg, err := sub.NextMsg(2 * time.Second)
+		if err != nil {
+			t.Fatalf("%s: %v", w.subject, err)
+		}
+		if msg.Subject != w.subject {
+			t.Errorf("subject %s, want %s", msg.Subject, w.subject)
+		}
+		if got := msg.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s: Content-Type %q", msg.Subject, got)
+		}
+		if got := msg.Header.Get("Context-Shift"); got != "Early" {
+			t.Errorf("%s: Context-Shift %q", msg.Subject, got)
+		}
+		if id := msg.Header.Get(jetstream.MsgIDHeader); id != "" {
+			t.Errorf("%s: message ID %q on core NATS", msg.Subject, id)
+		}
+		got, err := decodeStreamJSON(msg.Data, w.sample.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Timestamp.Equal(ts) || got.Tag != w.sample.Tag || got.Field != w.sample.Field ||
+			got.Type != w.sample.Type || got.Quality != w.sample.Quality || got.Value != w.sample.Value ||
+			got.Error != w.sample.Error {
+			t.Errorf("%s:\n got %#v\nwant %#v", msg.Subject, got, w.sample)
+		}
+	}
+	if msg, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Errorf("unexpected message on %s", msg.Subject)
+	}
+
+	// The sink answers requests for the schema.
+	reply, err := nc.Request("s7.schema.Line1", nil, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Data) != StreamSchema(EncodingJSON) || reply.Header.Get("Content-Type") != "application/schema+json" {
+		t.Errorf("schema reply %q (%s)", reply.Data, reply.Header.Get("Content-Type"))
+	}
+}
+
+func TestStreamSinkJetStream(t *testing.T) {
+	js := &testJetStream{streams: map[string]jetstream.StreamConfig{}, failures: 1}
+	s := startTestStreamSink(t, StreamSinkConfig{
+		Type: StreamJetStream, Servers: []string{startTestNATS(t)}, Stream: "S7", Encoding: EncodingProtobuf,
+	}, js)
+
+	// The first acknowledgement fails, so Speed is published again with the
+	// same message ID before Write returns.
+	ts := time.UnixMilli(1718000000123)
+	if err := s.Write(testStreamBatch(ts)); err != nil {
+		t.Fatal(err)
+	}
+	if subjects := js.streams["S7"].Subjects; len(subjects) != 1 || subjects[0] != "s7.Line1.>" {
+		t.Errorf("stream subjects %v, want [s7.Line1.>]", subjects)
+	}
+	want := []struct{ subject, id string }{
+		{"s7.Line1.line.Speed", "Line1/Speed/1718000000123000000"},
+		{"s7.Line1.line.Motor.Hours", "Line1/Motor.Hours/1718000000123000000"},
+		{"s7.Line1.line.Speed", "Line1/Speed/1718000000123000000"},
+	}
+	msgs := js.msgs()
+	if len(msgs) != len(want) {
+		t.Fatalf("%d messages published, want %d", len(msgs), len(want))
+	}
+	for i, w := range want {
+		if id := msgs[i].Header.Get(jetstream.MsgIDHeader); msgs[i].Subject != w.subject || id != w.id {
+			t.Errorf("message %d on %s with ID %q, want %s with %q", i, msgs[i].Subject, id, w.subject, w.id)
+		}
+	}
+	got, err := decodeStreamProtobuf(msgs[0].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Tag != "Speed" || got.Value != 21.5 || !got.Timestamp.Equal(ts) {
+		t.Errorf("first message: %#v", got)
+	}
+
+	// The next poll has IDs of its own.
+	if err := s.Write(testStreamBatch(ts.Add(time.Second))); err != nil {
+		t.Fatal(err)
+	}
+	msgs = js.msgs()
+	if id := msgs[len(msgs)-2].Header.Get(jetstream.MsgIDHeader); id != "Line1/Speed/1718000001123000000" {
+		t.Errorf("message ID %q of the next poll", id)
+	}
+}
+
+func TestStreamSinkJetStreamNotAcknowledged(t *testing.T) {
+	js := &testJetStream{streams: map[string]jetstream.StreamConfig{}, noAcks: true}
+	s := startTestStreamSink(t, StreamSinkConfig{Type: StreamJetStream, Servers: []string{startTestNATS(t)}, Timeout: "300ms"}, js)
+	start := time.Now()
+	err := s.Write(testStreamBatch(time.Now()))
+	if err == nil || !strings.Contains(err.Error(), "2 of 2 message(s) not acknowledged") {
+		t.Errorf("got %v, want 2 unacknowledged messages", err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("gave up after %v, before the timeout", d)
+	}
+}
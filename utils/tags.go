@@ -0,0 +1,503 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robinson/gos7"
+)
+
+// TagConfig is one value read from the PLC, as written in the config file,
+// or computed from other tags by an Expression.
+type TagConfig struct {
+	Name        string `json:"Name"`
+	Address     string `json:"Address"`               // S7 address with optional type, e.g. DB1.DBD4:REAL
+	Expression  string `json:"Expression,omitempty"`  // Instead of Address, computes the tag from others, e.g. Voltage * Current * 1.732
+	Type        string `json:"Type,omitempty"`        // Struct or array type, e.g. Array[1..20] of Motor, see ExpandTag
+	Measurement string `json:"Measurement,omitempty"` // InfluxDB measurement, defaults to "plc"
+	Field       string `json:"Field,omitempty"`       // InfluxDB field, defaults to Name
+	Writable    bool   `json:"Writable,omitempty"`    // May be written by name with the write command
+	Retention   string `json:"Retention,omitempty"`   // How long the Historian keeps the values, e.g. 7d
+
+	Accumulate *AccumulatorConfig `json:"Accumulate,omitempty"` // Instead of Address, adds up another tag, e.g. its run hours
+
+	Labels map[string]string `json:"Labels,omitempty"` // Metadata sinks can be routed by, e.g. {"area": "energy"}
+}
+
+// MemberConfig is one member of a struct type in the config file.
+type MemberConfig struct {
+	Name string `json:"Name"`
+	Type string `json:"Type"` // Elementary, struct or array type, e.g. REAL or Array[0..3] of BOOL
+}
+
+// DefaultTags is the DB1 layout the collector read before tags were
+// configurable. It is used when the config has no Tags.
+var DefaultTags = []TagConfig{
+	{Name: "Tag1", Address: "DB1.DBB0", Measurement: "temperature", Field: "temperature1"},
+	{Name: "Tag2", Address: "DB1.DBB1", Measurement: "temperature", Field: "temperature2"},
+	{Name: "Tag3", Address: "DB1.DBB2", Measurement: "temperature", Field: "temperature3"},
+	{Name: "Tag4", Address: "DB1.DBD3:DINT"},
+}
+
+// Tag is a configured tag with its address parsed. Derived tags, those with
+// an Expression or Accumulate, have no address but the Type of their values
+// in Addr.
+type Tag struct {
+	TagConfig
+	Addr Address
+	// Bad holds the reason a tag is not polled, for example an address past
+	// the end of its DB. Empty for good tags.
+	Bad string
+
+	expr *exprNode // Compiled Expression of derived tags
+}
+
+// Derived reports whether the tag is computed from other tags instead of
+// read from the PLC.
+func (t Tag) Derived() bool {
+	return t.TagConfig.derived()
+}
+
+func (tc TagConfig) derived() bool {
+	return tc.Expression != "" || tc.Accumulate != nil
+}
+
+// Quality of a tag value.
+const (
+	QualityGood = "good"
+	QualityBad  = "bad"
+)
+
+// TagValue is the last value read for a tag.
+type TagValue struct {
+	Name      string      `json:"name"`
+	Value     interface{} `json:"value"`
+	Quality   string      `json:"quality"`
+	Error     string      `json:"error,omitempty"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// ParseTags parses the tags of cfg, falling back to DefaultTags, expands
+// struct and array tags and fills in the defaults for Measurement and Field.
+func ParseTags(cfg Config) ([]Tag, error) {
+	configs := cfg.Tags
+	if len(configs) == 0 {
+		configs = DefaultTags
+	}
+	types, err := ParseTypes(cfg.Types)
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]Tag, 0, len(configs))
+	for i, tc := range configs {
+		if tc.Name == "" {
+			return nil, fmt.Errorf("Tags[%d]: Name is required", i)
+		}
+		if tc.derived() {
+			if err := checkDerivedConfig(tc); err != nil {
+				return nil, fmt.Errorf("Tags[%d] %s: %w", i, tc.Name, err)
+			}
+		}
+		expanded := []TagConfig{tc}
+		if tc.Type != "" {
+			if expanded, err = ExpandTag(tc, types); err != nil {
+				return nil, fmt.Errorf("Tags[%d] %s: %w", i, tc.Name, err)
+			}
+		}
+		for _, tc := range expanded {
+			var addr Address
+			if !tc.derived() {
+				if addr, err = ParseAddress(tc.Address); err != nil {
+					return nil, fmt.Errorf("Tags[%d] %s: %w", i, tc.Name, err)
+				}
+			}
+			if tc.Measurement == "" {
+				tc.Measurement = "plc"
+			}
+			if tc.Field == "" {
+				tc.Field = tc.Name
+			}
+			tags = append(tags, Tag{TagConfig: tc, Addr: addr})
+		}
+	}
+	for i, err := range compileDerived(tags) {
+		if err != nil {
+			return nil, fmt.Errorf("%s: Expression: %w", tags[i].Name, err)
+		}
+	}
+	return tags, nil
+}
+
+// checkDerivedConfig reports settings a derived tag cannot have.
+func checkDerivedConfig(tc TagConfig) error {
+	what := "an Expression"
+	if tc.Accumulate != nil {
+		what = "Accumulate"
+	}
+	switch {
+	case tc.Expression != "" && tc.Accumulate != nil:
+		return fmt.Errorf("has both an Expression and Accumulate")
+	case tc.Address != "":
+		return fmt.Errorf("has both an Address and %s", what)
+	case tc.Type != "":
+		return fmt.Errorf("Type cannot be used with %s", what)
+	case tc.Writable:
+		return fmt.Errorf("is computed from %s and cannot be Writable", what)
+	}
+	return nil
+}
+
+// compileDerived compiles the Expressions of the derived tags among tags
+// and sets the type of their values. It returns the problems per tag, nil
+// for tags without problems. Tags referring to each other in a circle are
+// reported. Accumulators are updated after the expressions are evaluated,
+// so expressions cannot use them.
+func compileDerived(tags []Tag) []error {
+	errs := make([]error, len(tags))
+	index := map[string]int{}
+	for i, tag := range tags {
+		index[tag.Name] = i
+	}
+	nodes := make([]*exprNode, len(tags))
+	for i, tag := range tags {
+		switch {
+		case tag.Expression != "":
+			nodes[i], errs[i] = parseExpression(tag.Expression)
+		case tag.Accumulate != nil:
+			tags[i].Addr = Address{Type: tag.Accumulate.dataType()}
+		}
+	}
+
+	// Tags are checked depth first, so the type of a derived tag is known
+	// when another one uses it.
+	const (
+		unchecked = iota
+		checking
+		checked
+	)
+	state := make([]int, len(tags))
+	var stack []int
+	var check func(i int)
+	check = func(i int) {
+		state[i] = checking
+		stack = append(stack, i)
+		err := nodes[i].check(func(name string) (int, exprKind, error) {
+			j, ok := index[name]
+			if !ok {
+				return 0, 0, fmt.Errorf("unknown tag %s", name)
+			}
+			if tags[j].Accumulate != nil {
+				return 0, 0, fmt.Errorf("tag %s is an accumulator, which expressions cannot use", name)
+			}
+			if !tags[j].Derived() {
+				kind, ok := exprTagKind(tags[j].Addr.Type)
+				if !ok {
+					return 0, 0, fmt.Errorf("tag %s of type %s cannot be used in expressions", name, tags[j].Addr.Type)
+				}
+				return j, kind, nil
+			}
+			switch state[j] {
+			case unchecked:
+				if nodes[j] != nil {
+					check(j)
+				}
+			case checking:
+				circle := stack[slices.Index(stack, j):]
+				names := make([]string, 0, len(circle)+1)
+				for _, k := range circle {
+					names = append(names, tags[k].Name)
+				}
+				err := fmt.Errorf("tags depend on each other: %s -> %s", strings.Join(names, " -> "), name)
+				for _, k := range circle {
+					if errs[k] == nil {
+						errs[k] = err
+					}
+				}
+				return 0, 0, err
+			}
+			if errs[j] != nil {
+				return 0, 0, fmt.Errorf("uses %s, whose Expression is invalid", name)
+			}
+			return j, nodes[j].kind, nil
+		})
+		stack = stack[:len(stack)-1]
+		state[i] = checked
+		if errs[i] == nil {
+			errs[i] = err
+		}
+	}
+	for i := range tags {
+		if nodes[i] != nil && state[i] == unchecked {
+			check(i)
+		}
+	}
+
+	for i := range tags {
+		if nodes[i] != nil && errs[i] == nil {
+			tags[i].expr = nodes[i]
+			tags[i].Addr = Address{Type: nodes[i].kind.dataType()}
+			if nodes[i].kind == kindString {
+				tags[i].Addr.Length = 254
+			}
+		}
+	}
+	return errs
+}
+
+// evaluateDerived computes the values of the derived tags from values, the
+// values of tags. A derived tag is bad when a tag it uses is bad.
+func evaluateDerived(tags []Tag, values []TagValue) {
+	done := make([]bool, len(tags))
+	var evaluate func(i int)
+	get := func(i int) (interface{}, error) {
+		if tags[i].Derived() && !done[i] {
+			evaluate(i)
+		}
+		if values[i].Quality != QualityGood {
+			return nil, fmt.Errorf("%s is bad", tags[i].Name)
+		}
+		return exprValue(values[i].Value), nil
+	}
+	evaluate = func(i int) {
+		done[i] = true
+		if tags[i].expr == nil {
+			return
+		}
+		v, err := tags[i].expr.eval(get)
+		if f, ok := v.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			err = fmt.Errorf("the result is not a finite number")
+		}
+		if err != nil {
+			values[i].Error = err.Error()
+			return
+		}
+		values[i].Value, values[i].Quality = v, QualityGood
+	}
+	for i := range tags {
+		if tags[i].Derived() && !done[i] {
+			evaluate(i)
+		}
+	}
+}
+
+// ParseTypes parses the struct types of the config file.
+func ParseTypes(configs map[string][]MemberConfig) (TypeNames, error) {
+	types := TypeNames{}
+	for name, members := range configs {
+		decl := TypeDecl{Fields: []FieldDecl{}}
+		for i, m := range members {
+			if m.Name == "" {
+				return nil, fmt.Errorf("Types.%s[%d]: Name is required", name, i)
+			}
+			t, err := ParseTypeDecl(m.Type)
+			if err != nil {
+				return nil, fmt.Errorf("Types.%s.%s: %w", name, m.Name, err)
+			}
+			decl.Fields = append(decl.Fields, FieldDecl{Name: m.Name, Type: t})
+		}
+		types[name] = decl
+	}
+	return types, nil
+}
+
+// ExpandTag lays out a tag with a struct or array Type starting at its
+// Address and returns one tag per elementary member, named like
+// Motors[3].Current. Field, when set, is prefixed to the member path in the
+// same way as Name.
+func ExpandTag(tc TagConfig, types TypeNames) ([]TagConfig, error) {
+	decl, err := ParseTypeDecl(tc.Type)
+	if err != nil {
+		return nil, err
+	}
+	start, err := ParseAddress(tc.Address)
+	if err != nil {
+		return nil, err
+	}
+	members, _, err := LayoutTags(tc.Name, decl, start, types)
+	if err != nil {
+		return nil, err
+	}
+	for i := range members {
+		if tc.Field != "" {
+			members[i].Field = tc.Field + strings.TrimPrefix(members[i].Name, tc.Name)
+		}
+		members[i].Measurement = tc.Measurement
+		members[i].Retention = tc.Retention
+		members[i].Labels = tc.Labels
+	}
+	return members, nil
+}
+
+// readSpan is one contiguous range of a memory area covering several tags.
+type readSpan struct {
+	addr Address // Area, DB and Start of the span
+	size int
+	tags []int // Indexes into the tag slice
+}
+
+// planReads groups the good tags into one read per area and DB so a poll
+// costs a request per DB instead of one per tag.
+func planReads(tags []Tag) []readSpan {
+	type key struct {
+		area Area
+		db   int
+	}
+	spans := map[key]*readSpan{}
+	var keys []key
+	for i, tag := range tags {
+		if tag.Bad != "" || tag.Derived() {
+			continue
+		}
+		k := key{tag.Addr.Area, tag.Addr.DB}
+		end := tag.Addr.Start + tag.Addr.Size()
+		span, ok := spans[k]
+		if !ok {
+			span = &readSpan{addr: Address{Area: k.area, DB: k.db, Start: tag.Addr.Start}, size: tag.Addr.Size()}
+			spans[k] = span
+			keys = append(keys, k)
+		}
+		if tag.Addr.Start < span.addr.Start {
+			span.size += span.addr.Start - tag.Addr.Start
+			span.addr.Start = tag.Addr.Start
+		}
+		if end > span.addr.Start+span.size {
+			span.size = end - span.addr.Start
+		}
+		span.tags = append(span.tags, i)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].area != keys[j].area {
+			return keys[i].area < keys[j].area
+		}
+		return keys[i].db < keys[j].db
+	})
+	plan := make([]readSpan, len(keys))
+	for i, k := range keys {
+		plan[i] = *spans[k]
+	}
+	return plan
+}
+
+// ReadTags reads all tags and returns one value per tag, in tag order, with
+// the values of derived tags computed from the others. Tags marked bad are
+// returned with bad quality. The error is only set when no read succeeded,
+// which usually means the connection is lost.
+func ReadTags(client gos7.Client, tags []Tag) ([]TagValue, error) {
+	now := time.Now()
+	values := make([]TagValue, len(tags))
+	for i, tag := range tags {
+		values[i] = TagValue{Name: tag.Name, Quality: QualityBad, Error: tag.Bad, Timestamp: now}
+	}
+
+	var lastErr error
+	succeeded := 0
+	plan := planReads(tags)
+	for _, span := range plan {
+		span.addr.Type = TypeByte
+		buf := make([]byte, span.size)
+		err := readArea(client, span.addr, buf)
+		for _, i := range span.tags {
+			if err != nil {
+				values[i].Error = err.Error()
+				continue
+			}
+			addr := tags[i].Addr
+			offset := addr.Start - span.addr.Start
+			values[i].Value = DecodeValue(addr, buf[offset:offset+addr.Size()])
+			values[i].Quality = QualityGood
+		}
+		if err != nil {
+			lastErr = err
+		} else {
+			succeeded++
+		}
+	}
+	evaluateDerived(tags, values)
+	if len(plan) > 0 && succeeded == 0 {
+		return values, lastErr
+	}
+	return values, nil
+}
+
+func readArea(client gos7.Client, addr Address, buf []byte) error {
+	switch addr.Area {
+	case AreaDB:
+		return client.AGReadDB(addr.DB, addr.Start, len(buf), buf)
+	case AreaMerker:
+		return client.AGReadMB(addr.Start, len(buf), buf)
+	case AreaInput:
+		return client.AGReadEB(addr.Start, len(buf), buf)
+	case AreaOutput:
+		return client.AGReadAB(addr.Start, len(buf), buf)
+	}
+	return fmt.Errorf("unsupported area %v", addr.Area)
+}
+
+// ValueCache holds the latest value of every tag for the web server and
+// other readers that do not poll the PLC themselves.
+type ValueCache struct {
+	mu     sync.RWMutex
+	values map[string]TagValue
+	order  []string
+}
+
+// NewValueCache creates an empty cache.
+func NewValueCache() *ValueCache {
+	return &ValueCache{values: map[string]TagValue{}}
+}
+
+// Update stores values, replacing older values of the same tags.
+func (c *ValueCache) Update(values []TagValue) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, v := range values {
+		if _, ok := c.values[v.Name]; !ok {
+			c.order = append(c.order, v.Name)
+		}
+		c.values[v.Name] = v
+	}
+}
+
+// Get returns the last value of a tag.
+func (c *ValueCache) Get(name string) (TagValue, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.values[name]
+	return v, ok
+}
+
+// Snapshot returns all values in the order the tags were first seen.
+func (c *ValueCache) Snapshot() []TagValue {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	values := make([]TagValue, 0, len(c.order))
+	for _, name := range c.order {
+		values = append(values, c.values[name])
+	}
+	return values
+}
+
+// Retain drops the values of all tags not in names, such as tags removed
+// from the config by a reload.
+func (c *ValueCache) Retain(names []string) {
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	order := c.order[:0]
+	for _, name := range c.order {
+		if keep[name] {
+			order = append(order, name)
+		} else {
+			delete(c.values, name)
+		}
+	}
+	c.order = order
+}
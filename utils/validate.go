@@ -0,0 +1,523 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfigError is a problem at a JSON path of the config file, such as
+// Tags[3].Address.
+type ConfigError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e ConfigError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// ConfigErrors is every problem found in a config file.
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ConfigParseErrors are problems that prevented decoding the config file at
+// all, such as a syntax error, an unset environment variable or a missing
+// include. The values of the config cannot be validated then.
+type ConfigParseErrors struct {
+	ConfigErrors
+}
+
+func (e *ConfigErrors) add(path, format string, args ...interface{}) {
+	*e = append(*e, ConfigError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// checkDoc reports unknown keys and values of the wrong JSON type in a
+// decoded config file. encoding/json silently ignores unknown keys and
+// matches keys without regard to case, which hides typos such as "PlcIp".
+func checkDoc(doc map[string]interface{}) ConfigErrors {
+	var errs ConfigErrors
+	checkValue("", doc, reflect.TypeOf(Config{}), &errs)
+	return errs
+}
+
+func lineColumn(data []byte, offset int64) (int, int) {
+	line, col := 1, 1
+	for _, b := range data[:min(int(offset), len(data))] {
+		if b == '\n' {
+			line, col = line+1, 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
+
+func checkValue(path string, v interface{}, t reflect.Type, errs *ConfigErrors) {
+	if v == nil {
+		return
+	}
+	// Optional sections such as Modbus are pointers to their config.
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	expected := ""
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			expected = "an object"
+			break
+		}
+		for _, key := range sortedKeys(obj) {
+			if path == "" && key == "$schema" {
+				continue
+			}
+			field, ok := fieldByKey(t, key)
+			if !ok {
+				msg := "unknown field"
+				if suggestion := suggestKey(t, key); suggestion != "" {
+					msg += fmt.Sprintf(", did you mean %q?", suggestion)
+				}
+				errs.add(joinPath(path, key), "%s", msg)
+				continue
+			}
+			checkValue(joinPath(path, key), obj[key], field.Type, errs)
+		}
+	case reflect.Map:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			expected = "an object"
+			break
+		}
+		for _, key := range sortedKeys(obj) {
+			checkValue(joinPath(path, key), obj[key], t.Elem(), errs)
+		}
+	case reflect.Slice:
+		list, ok := v.([]interface{})
+		if !ok {
+			expected = "an array"
+			break
+		}
+		for i, value := range list {
+			checkValue(fmt.Sprintf("%s[%d]", path, i), value, t.Elem(), errs)
+		}
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			expected = "a string"
+		}
+	case reflect.Int:
+		if n, ok := v.(float64); !ok || n != float64(int(n)) {
+			expected = "a whole number"
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			expected = "true or false"
+		}
+	}
+	if expected != "" {
+		got, _ := json.Marshal(v)
+		errs.add(path, "must be %s, found %s", expected, got)
+	}
+}
+
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func fieldByKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if configKey(t.Field(i)) == key {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// suggestKey returns the field name closest to a misspelled key.
+func suggestKey(t reflect.Type, key string) string {
+	best, bestDistance := "", 3
+	for i := 0; i < t.NumField(); i++ {
+		name := configKey(t.Field(i))
+		if strings.EqualFold(name, key) {
+			return name
+		}
+		if d := editDistance(strings.ToLower(name), strings.ToLower(key)); d < bestDistance {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+var hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*$`)
+
+// Validate checks the values of a config after defaults and command line
+// overrides are applied and returns every problem found.
+func (c *Config) Validate() ConfigErrors {
+	var errs ConfigErrors
+
+	if c.PlcIP == "" {
+		errs.add("PlcIP", "required, the IP address or host name of the PLC")
+	} else if net.ParseIP(c.PlcIP) == nil && !hostnamePattern.MatchString(c.PlcIP) {
+		errs.add("PlcIP", "%q is not an IP address or host name", c.PlcIP)
+	}
+	checkPort(&errs, "PlcPort", c.PlcPort)
+	checkPort(&errs, "WebPort", c.WebPort)
+	if c.PlcRack < 0 || c.PlcRack > 7 {
+		errs.add("PlcRack", "must be 0..7, found %d", c.PlcRack)
+	}
+	if c.PlcSlot < 0 || c.PlcSlot > 31 {
+		errs.add("PlcSlot", "must be 0..31, found %d", c.PlcSlot)
+	}
+	if _, ok := ConnectionTypes[strings.ToUpper(c.PlcConnectionType)]; !ok {
+		errs.add("PlcConnectionType", "must be PG, OP or BASIC, found %q", c.PlcConnectionType)
+	}
+	c.validateAuth(&errs)
+	for i, name := range c.ReadinessCritical {
+		known := false
+		for _, check := range ReadinessChecks {
+			known = known || check == name
+		}
+		if !known {
+			errs.add(fmt.Sprintf("ReadinessCritical[%d]", i), "must be one of %s, found %q", strings.Join(ReadinessChecks, ", "), name)
+		}
+	}
+	if len(c.PlcPassword) > 8 && !isSecretRef(c.PlcPassword) {
+		errs.add("PlcPassword", "S7 session passwords have at most 8 characters")
+	}
+	if strings.ContainsAny(c.PlcName, "/?# ") {
+		errs.add("PlcName", "%q is used in URLs and must not contain spaces, /, ? or #", c.PlcName)
+	}
+	if _, err := ParseLogLevel(c.LogLevel); err != nil {
+		errs.add("LogLevel", "must be debug, info, warn or error, found %q", c.LogLevel)
+	}
+	checkOneOf(&errs, "TagBoundsCheck", c.TagBoundsCheck, "mark", "fail", "off")
+	checkOneOf(&errs, "JSONLayout", c.JSONLayout, LayoutFlat, LayoutNested)
+
+	if c.WriteToInfluxDB {
+		// InfluxDBHealth defaults to a path below InfluxDBURL, so it is only
+		// worth checking when the URL itself is fine.
+		if checkURL(&errs, "InfluxDBURL", c.InfluxDBURL, true) {
+			checkURL(&errs, "InfluxDBHealth", c.InfluxDBHealth, false)
+		}
+		for _, f := range []struct{ path, value string }{
+			{"InfluxDBToken", c.InfluxDBToken},
+			{"InfluxDBOrg", c.InfluxDBOrg},
+			{"InfluxDBBucket", c.InfluxDBBucket},
+		} {
+			if f.value == "" {
+				errs.add(f.path, "required when WriteToInfluxDB is true")
+			}
+		}
+	}
+
+	types := c.validateTypes(&errs)
+	tags := c.validateTags(&errs, types)
+	// Sink routes are checked against all tags, in a stable order.
+	tagList := make([]Tag, 0, len(tags))
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tagList = append(tagList, tags[name])
+	}
+	if c.WriteToInfluxDB {
+		c.InfluxDBQueue.validate("InfluxDBQueue", &errs)
+		routed := c.InfluxDBRoute.validate("InfluxDBRoute", c.PlcName, tagList, &errs)
+		c.InfluxDBAggregate.validate("InfluxDBAggregate", c.PlcName, routed, &errs)
+	}
+	if c.Historian != nil {
+		c.Historian.validate("Historian", c.PlcName, tagList, &errs)
+	}
+	for i := range c.FileSinks {
+		c.FileSinks[i].validate(fmt.Sprintf("FileSinks[%d]", i), c.PlcName, tagList, &errs)
+	}
+	for i := range c.StreamSinks {
+		s := &c.StreamSinks[i]
+		path := fmt.Sprintf("StreamSinks[%d]", i)
+		s.validate(path, c.PlcName, tagList, &errs)
+		// NATS sinks answer requests on their SchemaSubject, two of them
+		// must not do so with different schemas.
+		for j, other := range c.StreamSinks[:i] {
+			if s.Type != StreamKafka && other.Type != StreamKafka && s.SchemaSubject != "" &&
+				s.SchemaSubject == other.SchemaSubject && s.Encoding != other.Encoding &&
+				slices.Equal(s.Servers, other.Servers) {
+				errs.add(path+".SchemaSubject", "used by StreamSinks[%d] for the %s schema already", j, other.Encoding)
+				break
+			}
+		}
+	}
+	if c.Modbus != nil {
+		c.Modbus.validate("Modbus", tags, &errs)
+	}
+	if c.OPCUA != nil {
+		c.OPCUA.validate("OPCUA", &errs)
+	}
+	if c.Context != nil {
+		c.Context.validate("Context", tags, &errs)
+	}
+	for i := range c.Snapshots {
+		s := &c.Snapshots[i]
+		path := fmt.Sprintf("Snapshots[%d]", i)
+		s.validate(path, c.PlcName, tagList, &errs)
+		if j := slices.IndexFunc(c.Snapshots[:i], func(o SnapshotConfig) bool { return o.Name == s.Name }); j >= 0 {
+			errs.add(path+".Name", "duplicate snapshot name %q, also used by Snapshots[%d]", s.Name, j)
+		}
+	}
+	return errs
+}
+
+func checkPort(errs *ConfigErrors, path, port string) {
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		errs.add(path, "must be a port number 1..65535, found %q", port)
+	}
+}
+
+// checkURL reports whether value is a valid http or https URL.
+func checkURL(errs *ConfigErrors, path, value string, required bool) bool {
+	if value == "" {
+		if required {
+			errs.add(path, "required when WriteToInfluxDB is true")
+		}
+		return !required
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs.add(path, "%q is not an http:// or https:// URL", value)
+		return false
+	}
+	return true
+}
+
+func checkOneOf(errs *ConfigErrors, path, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	errs.add(path, "must be one of %s, found %q", strings.Join(allowed, ", "), value)
+}
+
+func (c *Config) validateTypes(errs *ConfigErrors) TypeNames {
+	types := TypeNames{}
+	names := make([]string, 0, len(c.Types))
+	for name := range c.Types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		decl := TypeDecl{Fields: []FieldDecl{}}
+		seen := map[string]bool{}
+		for i, m := range c.Types[name] {
+			path := fmt.Sprintf("Types.%s[%d]", name, i)
+			if m.Name == "" {
+				errs.add(path+".Name", "required")
+				continue
+			}
+			if seen[m.Name] {
+				errs.add(path+".Name", "duplicate member %q", m.Name)
+			}
+			seen[m.Name] = true
+			t, err := ParseTypeDecl(m.Type)
+			if err != nil {
+				errs.add(path+".Type", "%v", err)
+				continue
+			}
+			decl.Fields = append(decl.Fields, FieldDecl{Name: m.Name, Type: t})
+		}
+		types[name] = decl
+	}
+	return types
+}
+
+// validatedTag is an expanded tag with the path of the config entry it
+// came from.
+type validatedTag struct {
+	path string
+	tag  Tag
+}
+
+// validateTags checks the tags and returns them by name, DefaultTags when
+// the config has none.
+func (c *Config) validateTags(errs *ConfigErrors, types TypeNames) map[string]Tag {
+	if len(c.Tags) == 0 {
+		known := map[string]Tag{}
+		for _, tc := range DefaultTags {
+			addr, _ := ParseAddress(tc.Address)
+			known[tc.Name] = Tag{TagConfig: tc, Addr: addr}
+		}
+		return known
+	}
+	var all []validatedTag
+	for i, tc := range c.Tags {
+		path := fmt.Sprintf("Tags[%d]", i)
+		if tc.Name == "" {
+			errs.add(path+".Name", "required")
+			continue
+		}
+		if tc.Retention != "" {
+			if d, err := ParseLongDuration(tc.Retention); err != nil {
+				errs.add(path+".Retention", "%v", err)
+			} else if d <= 0 {
+				errs.add(path+".Retention", "must be positive")
+			}
+		}
+		if tc.derived() {
+			if err := checkDerivedConfig(tc); err != nil {
+				errs.add(path, "%v", err)
+				continue
+			}
+		}
+		expanded := []TagConfig{tc}
+		if tc.Type != "" {
+			var err error
+			if expanded, err = ExpandTag(tc, types); err != nil {
+				errs.add(path+".Type", "%v", err)
+				continue
+			}
+		}
+		for _, e := range expanded {
+			var addr Address
+			if !e.derived() {
+				var err error
+				if addr, err = ParseAddress(e.Address); err != nil {
+					errs.add(path+".Address", "%v", err)
+					continue
+				}
+			}
+			if e.Measurement == "" {
+				e.Measurement = "plc"
+			}
+			if e.Field == "" {
+				e.Field = e.Name
+			}
+			all = append(all, validatedTag{path, Tag{TagConfig: e, Addr: addr}})
+		}
+	}
+
+	// Expressions are compiled against the tags that are fine so far.
+	compiled := make([]Tag, len(all))
+	for i, v := range all {
+		compiled[i] = v.tag
+	}
+	for i, err := range compileDerived(compiled) {
+		if err != nil {
+			errs.add(all[i].path+".Expression", "%v", err)
+		}
+		all[i].tag = compiled[i]
+	}
+
+	names := map[string]string{}
+	fields := map[string]string{}
+	known := map[string]Tag{}
+	for _, v := range all {
+		known[v.tag.Name] = v.tag
+		if first, ok := names[v.tag.Name]; ok {
+			errs.add(v.path+".Name", "duplicate tag name %q, also used by %s", v.tag.Name, first)
+		} else {
+			names[v.tag.Name] = v.path
+		}
+		key := v.tag.Measurement + "\x00" + v.tag.Field
+		if first, ok := fields[key]; ok && first != v.path {
+			errs.add(v.path+".Field", "field %q of measurement %q is also written by %s", v.tag.Field, v.tag.Measurement, first)
+		} else if !ok {
+			fields[key] = v.path
+		}
+	}
+
+	for _, v := range all {
+		if acc := v.tag.Accumulate; acc != nil {
+			var source *Tag
+			if t, ok := known[acc.Source]; ok {
+				source = &t
+			}
+			acc.validate(v.path+".Accumulate", source, errs)
+		}
+	}
+
+	// Writable tags that share memory would overwrite each other.
+	var writable []validatedTag
+	for _, v := range all {
+		if v.tag.Writable {
+			writable = append(writable, v)
+		}
+	}
+	bits := func(a Address) (int, int) {
+		if a.Type == TypeBool {
+			start := a.Start*8 + a.Bit
+			return start, start + 1
+		}
+		return a.Start * 8, (a.Start + a.Size()) * 8
+	}
+	sort.SliceStable(writable, func(i, j int) bool {
+		a, b := writable[i].tag.Addr, writable[j].tag.Addr
+		if a.Area != b.Area || a.DB != b.DB {
+			return a.Area < b.Area || a.Area == b.Area && a.DB < b.DB
+		}
+		as, _ := bits(a)
+		bs, _ := bits(b)
+		return as < bs
+	})
+	widest := 0 // The earlier tag in the same area and DB that reaches furthest
+	for i := 1; i < len(writable); i++ {
+		prev, cur := writable[widest].tag, writable[i].tag
+		if prev.Addr.Area != cur.Addr.Area || prev.Addr.DB != cur.Addr.DB {
+			widest = i
+			continue
+		}
+		_, prevEnd := bits(prev.Addr)
+		curStart, curEnd := bits(cur.Addr)
+		if curStart < prevEnd {
+			errs.add(writable[i].path+".Address", "writable tag %s (%s) overlaps writable tag %s (%s)",
+				cur.Name, cur.Addr, prev.Name, prev.Addr)
+		}
+		if curEnd > prevEnd {
+			widest = i
+		}
+	}
+	return known
+}
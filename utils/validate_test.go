@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string // Paths of the problems, none for a valid config
+	}{
+		{"defaults", func(c *Config) {}, nil},
+		{"host name", func(c *Config) { c.PlcIP = "plc-1.example.com" }, nil},
+		{"no PLC", func(c *Config) { c.PlcIP = "" }, []string{"PlcIP"}},
+		{"bad PLC", func(c *Config) { c.PlcIP = "plc 1" }, []string{"PlcIP"}},
+		{"ports", func(c *Config) { c.PlcPort, c.WebPort = "0", "http" }, []string{"PlcPort", "WebPort"}},
+		{"rack and slot", func(c *Config) { c.PlcRack, c.PlcSlot = 8, -1 }, []string{"PlcRack", "PlcSlot"}},
+		{"connection type", func(c *Config) { c.PlcConnectionType = "XX" }, []string{"PlcConnectionType"}},
+		{"readiness", func(c *Config) { c.ReadinessCritical = []string{"plc", "disk"} }, []string{"ReadinessCritical[1]"}},
+		{"log level", func(c *Config) { c.LogLevel = "loud" }, []string{"LogLevel"}},
+		{"influxdb", func(c *Config) {
+			c.WriteToInfluxDB = true
+			c.InfluxDBURL, c.InfluxDBToken, c.InfluxDBOrg, c.InfluxDBBucket = "ftp://db", "", "", "b"
+		}, []string{"InfluxDBURL", "InfluxDBToken", "InfluxDBOrg"}},
+		{"tags", func(c *Config) {
+			// Expressions and duplicates are checked after every tag is
+			// parsed, so their problems come last.
+			c.Tags = []TagConfig{
+				{Name: "A", Address: "DB1.DBD0:REAL"},
+				{Name: "", Address: "DB1.DBD4:REAL"},
+				{Name: "B", Address: "DB1.DBQ4"},
+				{Name: "A", Address: "DB1.DBD8:REAL", Field: "A2"},
+				{Name: "C", Address: "DB1.DBD12:REAL", Field: "A"},
+				{Name: "D", Expression: "A * "},
+				{Name: "E", Expression: "A", Address: "DB1.DBD16:REAL"},
+				{Name: "F", Address: "DB1.DBD20:REAL", Retention: "forever"},
+			}
+		}, []string{"Tags[1].Name", "Tags[2].Address", "Tags[6]", "Tags[7].Retention", "Tags[5].Expression", "Tags[3].Name", "Tags[4].Field"}},
+		{"types", func(c *Config) {
+			c.Types = map[string][]MemberConfig{"Motor": {{Name: "Speed", Type: "REAL"}, {Name: "Speed", Type: "INT"}, {Name: "X", Type: "INT junk"}}}
+		}, []string{"Types.Motor[1].Name", "Types.Motor[2].Type"}},
+	}
+	for _, tt := range tests {
+		cfg := DefaultConfig()
+		cfg.PlcIP = "192.168.0.1"
+		tt.change(&cfg)
+		errs := cfg.Validate()
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Path)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: problems at %v, want %v:\n%v", tt.name, got, tt.want, errs)
+		}
+	}
+}
+
+func TestReadConfigChecksKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	doc := `{"PlcIp": "10.0.0.1", "PlcRack": "0", "PlcSlot": 1.5, "Tags": [{"Name": "A", "Adress": "DB1.DBB0"}], "Modbus": []}`
+	if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ReadConfig(path)
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("ReadConfig: %v, want ConfigErrors", err)
+	}
+	want := []string{
+		`Modbus: must be an object, found []`,
+		`PlcIp: unknown field, did you mean "PlcIP"?`,
+		`PlcRack: must be a whole number, found "0"`,
+		`PlcSlot: must be a whole number, found 1.5`,
+		`Tags[0].Adress: unknown field, did you mean "Address"?`,
+	}
+	if errs.Error() != strings.Join(want, "\n") {
+		t.Errorf("got\n%v\nwant\n%s", errs, strings.Join(want, "\n"))
+	}
+}